@@ -1,59 +1,448 @@
 package main
 
 import (
+	"bufio"
 	"errors"
+	"flag"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 
+	"github.com/kijimaD/goboy/pkg/apu"
 	"github.com/kijimaD/goboy/pkg/bus"
 	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/cdl"
 	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/dap"
+	"github.com/kijimaD/goboy/pkg/debugger"
+	"github.com/kijimaD/goboy/pkg/disasm"
 	"github.com/kijimaD/goboy/pkg/gb"
+	"github.com/kijimaD/goboy/pkg/gbs"
 	"github.com/kijimaD/goboy/pkg/gpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/symbolizer"
 	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/lockstep"
+	"github.com/kijimaD/goboy/pkg/lockup"
 	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/model"
+	"github.com/kijimaD/goboy/pkg/pacer"
 	"github.com/kijimaD/goboy/pkg/pad"
 	"github.com/kijimaD/goboy/pkg/ram"
+	"github.com/kijimaD/goboy/pkg/recorder"
+	"github.com/kijimaD/goboy/pkg/srcmap"
+	"github.com/kijimaD/goboy/pkg/symbols"
 	"github.com/kijimaD/goboy/pkg/timer"
 	"github.com/kijimaD/goboy/pkg/utils"
 	"github.com/kijimaD/goboy/pkg/window"
+	"github.com/kijimaD/goboy/pkg/window/headless"
 )
 
 // go run main.go roms/helloworld/hello.gb
+// go run main.go -headless -frames 600 -wav out.wav roms/helloworld/hello.gb
+// go run main.go -headless -frames 3600 -midi out.mid roms/helloworld/hello.gb
+// go run main.go -headless -frames 3600 -vgm out.vgm roms/helloworld/hello.gb
+// go run main.go -headless -frames 3600 -song 2 -wav out.wav music.gbs
+// go run main.go -boot dmg_boot.bin roms/helloworld/hello.gb
+// go run main.go -model mgb roms/helloworld/hello.gb
+// go run main.go -headless -frames 60 -trace trace.log -trace-start pc:0x0100 roms/cpu_instrs/06-ld\ r,r.gb
+// go run main.go -lockstep reference.log roms/cpu_instrs/06-ld\ r,r.gb
+// go run main.go disasm -o hello.asm roms/helloworld/hello.gb
+// go run main.go -headless -frames 600 -profile cpu.pprof roms/helloworld/hello.gb
+// go run main.go -debug roms/helloworld/hello.gb
+// go run main.go -dap :4711 game.gb
+// go run main.go -sym game.sym -headless -trace trace.log -trace-start pc:Main game.gb
+
+var (
+	wavPath  = flag.String("wav", "", "record audio to the WAV file")
+	midiPath = flag.String("midi", "", "export the music to the MIDI file")
+	vgmPath  = flag.String("vgm", "", "log the sound register writes to the VGM file")
+	noWindow = flag.Bool("headless", false, "run without window")
+	frames   = flag.Int("frames", 600, "number of frames to run in headless mode")
+	vsync    = flag.Bool("vsync", false, "follow the display refresh instead of the timer")
+	song     = flag.Int("song", 0, "sub-song number of the GBS file (1 origin). 0 is the first song in the header")
+	bootPath = flag.String("boot", "", "run the boot ROM file (DMG/MGB/CGB) before the cartridge")
+	hwModel  = flag.String("model", "dmg", "hardware model: dmg, dmg0, mgb, sgb or cgb (DMG mode)")
+	// トレースはgameboy-doctorのログと比較できる
+	tracePath       = flag.String("trace", "", "write the instruction trace in gameboy-doctor format to the file")
+	traceStart      = flag.String("trace-start", "", "start the trace at pc:<addr> or frame:<n>")
+	traceStop       = flag.String("trace-stop", "", "stop the trace at pc:<addr> or frame:<n>")
+	lockstepPath    = flag.String("lockstep", "", "run headless in lockstep with the reference trace in gameboy-doctor format and report the first divergence")
+	profilePath     = flag.String("profile", "", "profile the ROM code and write it in pprof format to the file. The top addresses, opcodes and functions are printed at exit")
+	profileTop      = flag.Int("profile-top", 20, "number of the rows in the profile report")
+	debug           = flag.Bool("debug", false, "stop at the start and debug the ROM in the terminal. help shows the commands")
+	dapAddr         = flag.String("dap", "", "debug the ROM from an editor by the Debug Adapter Protocol on stdio or on the TCP address, e.g. :4711")
+	symPath         = flag.String("sym", "", "load the RGBDS symbol file to show the addresses as labels. The .sym file next to the ROM is loaded by default")
+	cdlPath         = flag.String("cdl", "", "log how the ROM bytes are used (code, operand, data, DMA) to the CDL file. An existing file is merged")
+	journalSize     = flag.Int("journal", 0, "record the last n bus writes with the writer, for who in -debug and -journal-dump")
+	journalRange    = flag.String("journal-range", "", "record only the writes to the range, e.g. C000-DFFF, C0A0, oam or a label")
+	journalDump     = flag.String("journal-dump", "", "write the recorded bus writes to the file at exit")
+	lockstepHistory = flag.Int("lockstep-history", 10, "number of the previous instructions shown at the divergence")
+)
 
 func main() {
+	flag.Parse()
+	// DAPの標準出力にはメッセージ以外を書かない
+	dapOut := os.Stdout
+	if *dapAddr == "stdio" {
+		os.Stdout = os.Stderr
+	}
 	level := "Debug"
 	if os.Getenv("LEVEL") != "" {
 		level = os.Getenv("LEVEL")
 	}
 	l := logger.NewLogger(logger.LogLevel(level))
-	if len(os.Args) != 2 {
+	if flag.Arg(0) == "disasm" {
+		runDisasm(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() != 1 {
 		log.Fatalf("ERROR: %v", errors.New("Please specify the ROM"))
 	}
-	file := os.Args[1]
+	m, err := model.Parse(*hwModel)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	file := flag.Arg(0)
 	log.Println(file)
 	buf, err := utils.LoadROM(file)
 	if err != nil {
 		log.Fatalf("ERROR: %v", errors.New("Failed to load ROM"))
 	}
-	cart, err := cartridge.NewCartridge(buf)
+	cart, err := loadCartridge(buf)
 	if err != nil {
-		log.Fatalf("ERROR: %v", errors.New("Failed to create cartridge"))
+		log.Fatalf("ERROR: %v", err)
 	}
+	syms := loadSymbols(file)
 	vRAM := ram.NewRAM(0x2000)
 	wRAM := ram.NewRAM(0x2000)
 	hRAM := ram.NewRAM(0x80)
 	oamRAM := ram.NewRAM(0xA0)
 	gpu := gpu.NewGPU()
 	t := timer.NewTimer()
+	a := apu.NewAPU()
 	pad := pad.NewPad()
 	irq := interrupt.NewInterrupt()
-	b := bus.NewBus(l, cart, gpu, vRAM, wRAM, hRAM, oamRAM, t, irq, pad)
+	b := bus.NewBus(l, cart, gpu, vRAM, wRAM, hRAM, oamRAM, t, a, irq, pad)
 	gpu.Init(b, irq)
+	if *lockstepPath != "" {
+		c := cpu.NewCPU(l, b, irq)
+		emu := gb.NewGB(c, gpu, t, a, irq, headless.New())
+		emu.SetModel(m)
+		loadBootROM(emu, b)
+		// 参照ログはLY=0x90固定で取られている
+		gpu.FixLY(0x90)
+		os.Exit(runLockstep(emu, c, syms))
+	}
+	if *debug {
+		runDebugger(l, b, gpu, t, a, irq, m, syms, len(buf))
+		return
+	}
+	if *dapAddr != "" {
+		runDAP(l, b, gpu, t, a, irq, m, syms, buf, file, dapOut)
+		return
+	}
+	if *noWindow {
+		c := cpu.NewCPU(l, b, irq)
+		emu := gb.NewGB(c, gpu, t, a, irq, headless.New())
+		emu.SetModel(m)
+		loadBootROM(emu, b)
+		emu.OnLockup(reportLockup(syms))
+		rec := startRecorders(emu, c, b, syms, len(buf))
+		emu.RunFrames(*frames)
+		closeRecorders(rec)
+		if emu.Lockup() != nil {
+			// CIで遅いだけのROMとクラッシュしたROMを区別できるように
+			os.Exit(lockupExitCode)
+		}
+		return
+	}
 	win := window.NewWindow(pad)
-	emu := gb.NewGB(cpu.NewCPU(l, b, irq), gpu, t, irq, win)
+	c := cpu.NewCPU(l, b, irq)
+	emu := gb.NewGB(c, gpu, t, a, irq, win)
+	emu.SetModel(m)
+	loadBootROM(emu, b)
+	emu.OnLockup(reportLockup(syms))
+	mode := pacer.Timer
+	if *vsync {
+		mode = pacer.VSync
+	}
+	win.SetVSync(*vsync)
+	p := pacer.NewPacer(mode)
+	p.OnStats(win.ShowStats)
+	emu.SetPacer(p)
+	rec := startRecorders(emu, c, b, syms, len(buf))
+	runWindow(emu, win)
+	closeRecorders(rec)
+}
+
+// runWindow runs the machine on the window until the window is closed or Ctrl-C is pressed.
+func runWindow(emu *gb.GB, win interface {
+	Run(f func())
+	Init()
+}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		for range sig {
+			emu.Quit()
+		}
+	}()
 	win.Run(func() {
 		win.Init()
 		emu.Start()
 	})
 }
+
+// startRecorders starts the recorders given by the flags.
+// The recorders have to be closed by closeRecorders after the run.
+func startRecorders(emu *gb.GB, c *cpu.CPU, b *bus.Bus, syms *symbols.Table, romSize int) *recorder.Recorders {
+	r, err := recorder.Start(emu, c, b, recorder.Config{
+		WAV:          *wavPath,
+		MIDI:         *midiPath,
+		VGM:          *vgmPath,
+		Trace:        *tracePath,
+		TraceStart:   *traceStart,
+		TraceStop:    *traceStop,
+		Profile:      *profilePath,
+		ProfileTop:   *profileTop,
+		JournalSize:  *journalSize,
+		JournalRange: *journalRange,
+		JournalDump:  *journalDump,
+		CDL:          *cdlPath,
+		ROMSize:      romSize,
+		Symbols:      syms,
+		Report:       os.Stdout,
+	})
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	return r
+}
+
+// closeRecorders writes the recorded files.
+func closeRecorders(r *recorder.Recorders) {
+	if err := r.Close(); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// lockupExitCode is the exit status of a headless run that got stuck
+const lockupExitCode = 2
+
+func reportLockup(syms *symbols.Table) func(lockup.Event) {
+	return func(e lockup.Event) {
+		log.Printf("LOCKUP: %s", e.Format(symbolizerOf(syms)))
+	}
+}
+
+// lockstepExitCode is the exit status when the run diverges from the reference
+const lockstepExitCode = 3
+
+// runLockstep compares the run with the reference given by -lockstep and returns the exit status.
+func runLockstep(emu *gb.GB, c *cpu.CPU, syms *symbols.Table) int {
+	f, err := os.Open(*lockstepPath)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer f.Close()
+	d, err := lockstep.Run(bufio.NewReader(f), emu, c, *lockstepHistory)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return 1
+	}
+	if d != nil {
+		log.Printf("DIVERGED: %s", d.Format(symbolizerOf(syms)))
+		return lockstepExitCode
+	}
+	log.Println("the whole reference matched")
+	return 0
+}
+
+// newDebugger makes the machine driven by the debugger.
+func newDebugger(l *logger.Log, b *bus.Bus, g *gpu.GPU, t *timer.Timer, a *apu.APU, irq *interrupt.Interrupt, m model.Model, syms *symbols.Table) (*debugger.Debugger, *gb.GB, *cpu.CPU) {
+	c := cpu.NewCPU(l, b, irq)
+	emu := gb.NewGB(c, g, t, a, irq, headless.New())
+	emu.SetModel(m)
+	loadBootROM(emu, b)
+	d := debugger.New(emu, c, b)
+	d.SetSymbols(syms)
+	emu.OnLockup(d.Lockup)
+	return d, emu, c
+}
+
+// runDebugger runs the ROM headless under the debugger, which reads the commands from stdin.
+func runDebugger(l *logger.Log, b *bus.Bus, g *gpu.GPU, t *timer.Timer, a *apu.APU, irq *interrupt.Interrupt, m model.Model, syms *symbols.Table, romSize int) {
+	d, emu, c := newDebugger(l, b, g, t, a, irq, m, syms)
+	rec := startRecorders(emu, c, b, syms, romSize)
+	defer closeRecorders(rec)
+	d.SetJournal(rec.Journal())
+
+	// Ctrl-Cで実行中のコマンドを止める
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		for range sig {
+			d.Interrupt()
+		}
+	}()
+	if err := d.Run(os.Stdin, os.Stdout); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// runDisasm writes the RGBDS source of the whole ROM.
+func runDisasm(args []string) {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	out := fs.String("o", "", "write the source to the file instead of stdout")
+	cdlFile := fs.String("cdl", "", "also disassemble the opcodes executed in the CDL file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("ERROR: %v", errors.New("Please specify the ROM"))
+	}
+	rom, err := utils.LoadROM(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	d := disasm.New(rom)
+	if *cdlFile != "" {
+		traceCoverage(d, *cdlFile, len(rom))
+	}
+	// シンボルがあれば自動でつけたラベルを置き換える
+	for _, s := range loadSymbols(fs.Arg(0)).Symbols() {
+		if off := disasm.Offset(s.Bank, int(s.Addr)); off >= 0 && off < len(rom) {
+			d.SetLabel(off, s.Name)
+		}
+	}
+	if err := d.WriteASM(w); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+}
+
+// traceCoverage disassembles the opcodes executed in the CDL file, which the static walk may miss.
+func traceCoverage(d *disasm.Disassembler, path string, romSize int) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer f.Close()
+	cov, err := cdl.Load(f, romSize)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	for off := 0; off < cov.Len(); off++ {
+		if cov.Executed(off) {
+			d.Trace(off)
+		}
+	}
+}
+
+// loadSymbols loads the symbol file given by -sym or the one next to the ROM.
+// It returns nil if there is none.
+func loadSymbols(romPath string) *symbols.Table {
+	var (
+		t   *symbols.Table
+		err error
+	)
+	if *symPath != "" {
+		t, err = symbols.Load(*symPath)
+	} else {
+		t, err = symbols.LoadForROM(romPath)
+	}
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if t != nil {
+		log.Printf("loaded %d symbols", len(t.Symbols()))
+	}
+	return t
+}
+
+// symbolizerOf returns nil without the symbols, so that the addresses are printed as they are.
+func symbolizerOf(syms *symbols.Table) symbolizer.Symbolizer {
+	if syms == nil {
+		return nil
+	}
+	return syms
+}
+
+// loadBootROM maps the boot ROM given by -boot and resets the machine to run it. Call it after GB.SetModel.
+func loadBootROM(emu *gb.GB, b *bus.Bus) {
+	if *bootPath == "" {
+		return
+	}
+	rom, err := utils.LoadROM(*bootPath)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := emu.SetBootROM(b, rom); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+}
+
+// loadCartridge makes the cartridge from a ROM or a GBS file.
+func loadCartridge(buf []byte) (*cartridge.Cartridge, error) {
+	if !gbs.IsGBS(buf) {
+		cart, err := cartridge.NewCartridge(buf)
+		if err != nil {
+			return nil, errors.New("Failed to create cartridge")
+		}
+		return cart, nil
+	}
+	g, err := gbs.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	n := *song
+	if n == 0 {
+		n = g.FirstSong
+	}
+	log.Printf("%s - %s (%d/%d)", g.Title, g.Author, n, g.Songs)
+	return g.Cartridge(n)
+}
+
+// runDAP runs the ROM headless under the debugger served by the Debug Adapter Protocol.
+// The session is on stdio, or on the first connection to the TCP address.
+func runDAP(l *logger.Log, b *bus.Bus, g *gpu.GPU, t *timer.Timer, a *apu.APU, irq *interrupt.Interrupt, m model.Model, syms *symbols.Table, rom []byte, romPath string, stdout io.Writer) {
+	d, _, _ := newDebugger(l, b, g, t, a, irq, m, syms)
+	src := srcmap.New(rom, syms)
+	// ROMの隣のソースを読む。ほかの場所はlaunchのsourceRootで指定する
+	if err := src.AddDir(filepath.Dir(romPath)); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	s := dap.NewServer(d, src)
+	s.SetSymbols(syms)
+	if *dapAddr == "stdio" {
+		if err := s.Serve(os.Stdin, stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+	ln, err := net.Listen("tcp", *dapAddr)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	log.Printf("waiting for the debugger on %s", ln.Addr())
+	conn, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer conn.Close()
+	if err := s.Serve(conn, conn); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+}
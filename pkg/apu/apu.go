@@ -0,0 +1,402 @@
+package apu
+
+import (
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// ClockSpeed is the DMG master clock in Hz.
+const ClockSpeed = 4194304
+
+// SampleRate is the rate of the stereo samples produced by the APU.
+const SampleRate = 44100
+
+// frameSequencerPeriod is the number of clocks between two 512Hz frame sequencer steps.
+const frameSequencerPeriod = ClockSpeed / 512
+
+// maxBufferedSamples bounds the sample buffer when nobody pulls samples.
+// About half a second of audio. Older samples are dropped first.
+const maxBufferedSamples = SampleRate / 2
+
+// Sound register addresses (offset from 0xFF00)
+const (
+	// NR10 - Channel 1 Sweep register (R/W)
+	// Bit 6-4 - Sweep pace
+	// Bit 3   - Sweep direction (0: addition, 1: subtraction)
+	// Bit 2-0 - Sweep individual step
+	NR10 types.Word = 0x10
+	// NR11 - Channel 1 length timer & duty cycle
+	// Bit 7-6 - Wave duty (R/W)
+	// Bit 5-0 - Initial length timer (W)
+	NR11 = 0x11
+	// NR12 - Channel 1 volume & envelope
+	// Bit 7-4 - Initial volume
+	// Bit 3   - Envelope direction (0: decrease, 1: increase)
+	// Bit 2-0 - Sweep pace
+	NR12 = 0x12
+	// NR13 - Channel 1 period low (W)
+	NR13 = 0x13
+	// NR14 - Channel 1 period high & control
+	// Bit 7   - Trigger (W)
+	// Bit 6   - Length enable (R/W)
+	// Bit 2-0 - Period high (W)
+	NR14 = 0x14
+	NR21 = 0x16
+	NR22 = 0x17
+	NR23 = 0x18
+	NR24 = 0x19
+	// NR30 - Channel 3 DAC enable (Bit 7)
+	NR30 = 0x1A
+	NR31 = 0x1B
+	// NR32 - Channel 3 output level
+	// Bit 6-5 - 00: mute, 01: 100%, 10: 50%, 11: 25%
+	NR32 = 0x1C
+	NR33 = 0x1D
+	NR34 = 0x1E
+	NR41 = 0x20
+	NR42 = 0x21
+	// NR43 - Channel 4 frequency & randomness
+	// Bit 7-4 - Clock shift
+	// Bit 3   - LFSR width (0: 15 bits, 1: 7 bits)
+	// Bit 2-0 - Clock divider
+	NR43 = 0x22
+	NR44 = 0x23
+	// NR50 - Master volume & VIN panning
+	// Bit 6-4 - Left volume
+	// Bit 2-0 - Right volume
+	NR50 = 0x24
+	// NR51 - Sound panning
+	// Bit 7-4 - Channel 4-1 to left
+	// Bit 3-0 - Channel 4-1 to right
+	NR51 = 0x25
+	// NR52 - Sound on/off
+	// Bit 7   - All sound on/off (R/W)
+	// Bit 3-0 - Channel 4-1 on flags (R)
+	NR52 = 0x26
+	// WaveRAMBegin is start of the 32 4bit samples played by channel 3.
+	WaveRAMBegin = 0x30
+	WaveRAMEnd   = 0x3F
+)
+
+// readMasks are OR-ed to the register values on read.
+// Write only bits and unused registers read back as 1.
+var readMasks = [0x17]byte{
+	0x80, 0x3F, 0x00, 0xFF, 0xBF, // NR10-NR14
+	0xFF, 0x3F, 0x00, 0xFF, 0xBF, // NR20-NR24
+	0x7F, 0xFF, 0x9F, 0xFF, 0xBF, // NR30-NR34
+	0xFF, 0xFF, 0x00, 0x00, 0xBF, // NR40-NR44
+	0x00, 0x00, 0x70, //             NR50-NR52
+}
+
+// Sample is a stereo sample. Each side is in the range [-1, 1].
+type Sample struct {
+	Left  float32
+	Right float32
+}
+
+// APU is Audio Processing Unit
+// 4つのチャンネルを持つ。矩形波(スイープ付き)、矩形波、波形メモリ、ノイズ
+type APU struct {
+	regs    [0x17]byte
+	waveRAM [0x10]byte
+	enabled bool
+
+	ch1 square
+	ch2 square
+	ch3 wave
+	ch4 noise
+
+	frameSequencerClock uint
+	frameSequencerStep  byte
+
+	sampleClock uint
+	capLeft     float32
+	capRight    float32
+	buffer      []Sample
+	bufferHead  int
+	bufferLen   int
+}
+
+// NewAPU constructs apu peripheral in the state the boot ROM leaves it.
+func NewAPU() *APU {
+	a := &APU{buffer: make([]Sample, maxBufferedSamples)}
+	a.ch1.hasSweep = true
+	a.enabled = true
+	for _, r := range []struct {
+		addr types.Word
+		data byte
+	}{
+		{NR10, 0x80}, {NR11, 0xBF}, {NR12, 0xF3}, {NR13, 0xFF}, {NR14, 0x3F},
+		{NR21, 0x3F}, {NR22, 0x00}, {NR23, 0xFF}, {NR24, 0x3F},
+		{NR30, 0x7F}, {NR31, 0xFF}, {NR32, 0x9F}, {NR33, 0xFF}, {NR34, 0x3F},
+		{NR41, 0xFF}, {NR42, 0x00}, {NR43, 0x00}, {NR44, 0x3F},
+		{NR50, 0x77}, {NR51, 0xF3},
+	} {
+		// Trigger bits are left clear, so no channel is restarted here.
+		a.Write(r.addr, r.data)
+	}
+	// The boot sound has already faded out on channel 1, but the channel is still on.
+	a.ch1.enabled = true
+	a.ch1.env.volume = 0
+	return a
+}
+
+// PowerOn puts APU into the state at power on, before the boot ROM runs.
+// All registers are cleared and the sound is off.
+func (a *APU) PowerOn() {
+	a.setPower(false)
+}
+
+// Step runs APU for the given clocks.
+// Channels are advanced up to each sample point, so long steps keep the waveform.
+func (a *APU) Step(cycles uint) {
+	for cycles > 0 {
+		n := (ClockSpeed - a.sampleClock + SampleRate - 1) / SampleRate
+		if n > cycles {
+			n = cycles
+		}
+		a.stepChannels(n)
+		cycles -= n
+		a.sampleClock += n * SampleRate
+		if a.sampleClock >= ClockSpeed {
+			a.sampleClock -= ClockSpeed
+			a.pushSample(a.mix())
+		}
+	}
+}
+
+func (a *APU) stepChannels(cycles uint) {
+	if !a.enabled {
+		return
+	}
+	a.ch1.step(cycles)
+	a.ch2.step(cycles)
+	a.ch3.step(cycles)
+	a.ch4.step(cycles)
+
+	a.frameSequencerClock += cycles
+	for a.frameSequencerClock >= frameSequencerPeriod {
+		a.frameSequencerClock -= frameSequencerPeriod
+		a.stepFrameSequencer()
+	}
+}
+
+// フレームシーケンサは512Hzで長さ・スイープ・エンベロープを更新する
+// Step   Length Ctr  Vol Env     Sweep
+// ---------------------------------------
+// 0      Clock       -           -
+// 1      -           -           -
+// 2      Clock       -           Clock
+// 3      -           -           -
+// 4      Clock       -           -
+// 5      -           -           -
+// 6      Clock       -           Clock
+// 7      -           Clock       -
+func (a *APU) stepFrameSequencer() {
+	switch a.frameSequencerStep {
+	case 0, 4:
+		a.clockLength()
+	case 2, 6:
+		a.clockLength()
+		a.ch1.clockSweep()
+	case 7:
+		a.ch1.env.clock()
+		a.ch2.env.clock()
+		a.ch4.env.clock()
+	}
+	a.frameSequencerStep = (a.frameSequencerStep + 1) & 0x07
+}
+
+func (a *APU) clockLength() {
+	a.ch1.length.clock(&a.ch1.enabled)
+	a.ch2.length.clock(&a.ch2.enabled)
+	a.ch3.length.clock(&a.ch3.enabled)
+	a.ch4.length.clock(&a.ch4.enabled)
+}
+
+// mix produces one stereo sample from the 4 channels according to NR50 and NR51.
+func (a *APU) mix() Sample {
+	if !a.enabled {
+		return a.highPass(0, 0)
+	}
+	outputs := [4]float32{
+		dac(a.ch1.output(), a.ch1.dacEnabled),
+		dac(a.ch2.output(), a.ch2.dacEnabled),
+		dac(a.ch3.output(&a.waveRAM), a.ch3.dacEnabled),
+		dac(a.ch4.output(), a.ch4.dacEnabled),
+	}
+	nr51 := a.regs[NR51-NR10]
+	var left, right float32
+	for i, o := range outputs {
+		if nr51&(0x10<<uint(i)) != 0 {
+			left += o
+		}
+		if nr51&(0x01<<uint(i)) != 0 {
+			right += o
+		}
+	}
+	nr50 := a.regs[NR50-NR10]
+	left *= float32((nr50>>4)&0x07+1) / 8 / 4
+	right *= float32(nr50&0x07+1) / 8 / 4
+	return a.highPass(left, right)
+}
+
+// dac converts a 4bit digital value to an analog value in the range [-1, 1].
+// A disabled DAC outputs 0.
+func dac(digital byte, enabled bool) float32 {
+	if !enabled {
+		return 0
+	}
+	return float32(digital)/7.5 - 1
+}
+
+// highPass removes the DC offset like the capacitor on the real hardware.
+func (a *APU) highPass(left, right float32) Sample {
+	// 0.999958^(ClockSpeed/SampleRate)
+	const charge = 0.996
+	outLeft := left - a.capLeft
+	a.capLeft = left - outLeft*charge
+	outRight := right - a.capRight
+	a.capRight = right - outRight*charge
+	return Sample{Left: outLeft, Right: outRight}
+}
+
+func (a *APU) pushSample(s Sample) {
+	if a.bufferLen == maxBufferedSamples {
+		// drop the oldest sample
+		a.bufferHead = (a.bufferHead + 1) % maxBufferedSamples
+		a.bufferLen--
+	}
+	a.buffer[(a.bufferHead+a.bufferLen)%maxBufferedSamples] = s
+	a.bufferLen++
+}
+
+// ReadSamples moves buffered samples into dst and returns the number of samples read.
+func (a *APU) ReadSamples(dst []Sample) int {
+	n := 0
+	for n < len(dst) && a.bufferLen > 0 {
+		dst[n] = a.buffer[a.bufferHead]
+		a.bufferHead = (a.bufferHead + 1) % maxBufferedSamples
+		a.bufferLen--
+		n++
+	}
+	return n
+}
+
+// Buffered returns the number of samples ready to be read.
+func (a *APU) Buffered() int {
+	return a.bufferLen
+}
+
+func (a *APU) Read(addr types.Word) byte {
+	switch {
+	case addr >= WaveRAMBegin && addr <= WaveRAMEnd:
+		return a.waveRAM[addr-WaveRAMBegin]
+	case addr == NR52:
+		v := byte(0x70)
+		if a.enabled {
+			v |= 0x80
+		}
+		for i, on := range []bool{a.ch1.enabled, a.ch2.enabled, a.ch3.enabled, a.ch4.enabled} {
+			if on {
+				v |= 1 << uint(i)
+			}
+		}
+		return v
+	case addr >= NR10 && addr < NR52:
+		return a.regs[addr-NR10] | readMasks[addr-NR10]
+	}
+	return 0xFF
+}
+
+func (a *APU) Write(addr types.Word, data byte) {
+	switch {
+	case addr >= WaveRAMBegin && addr <= WaveRAMEnd:
+		a.waveRAM[addr-WaveRAMBegin] = data
+		return
+	case addr == NR52:
+		a.setPower(data&0x80 != 0)
+		return
+	case addr < NR10 || addr > NR52:
+		return
+	}
+	// 電源オフの間はレジスタへの書き込みは無視される
+	if !a.enabled {
+		return
+	}
+	a.regs[addr-NR10] = data
+	switch addr {
+	case NR10:
+		a.ch1.writeSweep(data)
+	case NR11:
+		a.ch1.writeDutyLength(data)
+	case NR12:
+		a.ch1.writeEnvelope(data)
+	case NR13:
+		a.ch1.freq = a.ch1.freq&0x700 | uint16(data)
+	case NR14:
+		a.ch1.writeControl(data)
+	case NR21:
+		a.ch2.writeDutyLength(data)
+	case NR22:
+		a.ch2.writeEnvelope(data)
+	case NR23:
+		a.ch2.freq = a.ch2.freq&0x700 | uint16(data)
+	case NR24:
+		a.ch2.writeControl(data)
+	case NR30:
+		a.ch3.writeDAC(data)
+	case NR31:
+		a.ch3.length.load(256 - int(data))
+	case NR32:
+		a.ch3.volumeCode = (data >> 5) & 0x03
+	case NR33:
+		a.ch3.freq = a.ch3.freq&0x700 | uint16(data)
+	case NR34:
+		a.ch3.writeControl(data)
+	case NR41:
+		a.ch4.length.load(64 - int(data&0x3F))
+	case NR42:
+		a.ch4.writeEnvelope(data)
+	case NR43:
+		a.ch4.writePolynomial(data)
+	case NR44:
+		a.ch4.writeControl(data)
+	}
+}
+
+func (a *APU) setPower(on bool) {
+	if on == a.enabled {
+		return
+	}
+	a.enabled = on
+	if on {
+		a.frameSequencerStep = 0
+		a.frameSequencerClock = 0
+		return
+	}
+	// 電源を切ると NR10-NR51 はクリアされる。波形メモリはそのまま
+	a.regs = [0x17]byte{}
+	a.ch1 = square{hasSweep: true}
+	a.ch2 = square{}
+	a.ch3 = wave{}
+	a.ch4 = noise{}
+}
+
+// State is the state of APU saved by Snapshot. The buffered samples are not saved.
+type State struct {
+	apu APU
+}
+
+// Snapshot saves the state of APU.
+func (a *APU) Snapshot() State {
+	s := State{apu: *a}
+	s.apu.buffer, s.apu.bufferHead, s.apu.bufferLen = nil, 0, 0
+	return s
+}
+
+// Restore puts APU back into the saved state. The buffered samples are dropped.
+func (a *APU) Restore(s State) {
+	buffer := a.buffer
+	*a = s.apu
+	a.buffer = buffer
+}
@@ -0,0 +1,127 @@
+package apu
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterReadMask(t *testing.T) {
+	assert := assert.New(t)
+	a := NewAPU()
+	assert.Equal(byte(0x80), a.Read(NR10))
+	assert.Equal(byte(0xBF), a.Read(NR11))
+	assert.Equal(byte(0xFF), a.Read(NR13), "NR13 is write only")
+	assert.Equal(byte(0xF1), a.Read(NR52))
+	assert.Equal(byte(0xFF), a.Read(0x27), "unused register")
+}
+
+func TestPowerOff(t *testing.T) {
+	assert := assert.New(t)
+	a := NewAPU()
+	a.Write(WaveRAMBegin, 0xA5)
+	a.Write(NR52, 0x00)
+	assert.Equal(byte(0x70), a.Read(NR52))
+	assert.Equal(byte(0x00), a.Read(NR50))
+	assert.Equal(byte(0xA5), a.Read(WaveRAMBegin), "wave RAM is kept")
+
+	a.Write(NR50, 0x77)
+	assert.Equal(byte(0x00), a.Read(NR50), "write is ignored while power is off")
+}
+
+func TestTriggerAndLength(t *testing.T) {
+	assert := assert.New(t)
+	a := NewAPU()
+	a.Write(NR22, 0xF0)
+	a.Write(NR21, 0x3F) // length 1
+	a.Write(NR24, 0xC0) // trigger with length enabled
+	assert.Equal(byte(0x02), a.Read(NR52)&0x02, "channel 2 is on")
+
+	// 長さカウンタは 256Hz で更新される
+	a.Step(frameSequencerPeriod * 2)
+	assert.Equal(byte(0x00), a.Read(NR52)&0x02, "channel 2 is off after length expired")
+}
+
+func TestDACOff(t *testing.T) {
+	assert := assert.New(t)
+	a := NewAPU()
+	a.Write(NR30, 0x80)
+	a.Write(NR34, 0x80)
+	assert.Equal(byte(0x04), a.Read(NR52)&0x04)
+	a.Write(NR30, 0x00)
+	assert.Equal(byte(0x00), a.Read(NR52)&0x04)
+}
+
+func TestSweepOverflow(t *testing.T) {
+	assert := assert.New(t)
+	a := NewAPU()
+	a.Write(NR10, 0x11) // pace 1, addition, step 1
+	a.Write(NR12, 0xF0)
+	a.Write(NR13, 0xFF)
+	a.Write(NR14, 0x87) // freq 0x7FF, trigger
+	assert.Equal(byte(0x00), a.Read(NR52)&0x01, "overflow check on trigger disables channel 1")
+}
+
+func TestReadSamples(t *testing.T) {
+	assert := assert.New(t)
+	a := NewAPU()
+	a.Step(ClockSpeed / 4)
+	assert.Equal(SampleRate/4, a.Buffered())
+
+	buf := make([]Sample, 100)
+	assert.Equal(100, a.ReadSamples(buf))
+	assert.Equal(SampleRate/4-100, a.Buffered())
+
+	a.Step(ClockSpeed)
+	assert.Equal(maxBufferedSamples, a.Buffered(), "buffer is bounded")
+}
+
+func TestSquareOutput(t *testing.T) {
+	assert := assert.New(t)
+	a := NewAPU()
+	a.Write(NR51, 0x22)
+	a.Write(NR22, 0xF0)
+	a.Write(NR21, 0x80) // 50% duty
+	a.Write(NR23, 0x00)
+	a.Write(NR24, 0x87) // freq 0x700 => 1024Hz
+	a.Step(ClockSpeed / 10)
+
+	buf := make([]Sample, a.Buffered())
+	n := a.ReadSamples(buf)
+	high, low := 0, 0
+	for _, s := range buf[:n] {
+		assert.Equal(s.Left, s.Right)
+		if s.Left > 0 {
+			high++
+		} else if s.Left < 0 {
+			low++
+		}
+	}
+	assert.InDelta(high, low, float64(n)/10, "50% duty")
+}
+
+func TestWAVWriter(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "out.wav")
+	f, err := os.Create(path)
+	assert.NoError(err)
+
+	w, err := NewWAVWriter(f, SampleRate)
+	assert.NoError(err)
+	assert.NoError(w.WriteSamples([]Sample{{1, -1}, {0, 0}}))
+	assert.NoError(w.Close())
+	assert.NoError(f.Close())
+
+	b, err := os.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal(wavHeaderSize+8, len(b))
+	assert.Equal("RIFF", string(b[0:4]))
+	assert.Equal(uint32(len(b)-8), binary.LittleEndian.Uint32(b[4:8]))
+	assert.Equal(uint32(SampleRate), binary.LittleEndian.Uint32(b[24:28]))
+	assert.Equal(uint32(8), binary.LittleEndian.Uint32(b[40:44]))
+	assert.Equal(int16(32767), int16(binary.LittleEndian.Uint16(b[44:46])))
+	assert.Equal(int16(-32767), int16(binary.LittleEndian.Uint16(b[46:48])))
+}
@@ -0,0 +1,328 @@
+package apu
+
+// dutyTable is the waveform of the square channels for each duty setting.
+// 12.5%, 25%, 50%, 75%
+var dutyTable = [4][8]byte{
+	{0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 1, 1, 1},
+	{0, 1, 1, 1, 1, 1, 1, 0},
+}
+
+// noiseDivisors is the base period of the noise channel for each divider code.
+var noiseDivisors = [8]uint{8, 16, 32, 48, 64, 80, 96, 112}
+
+// lengthCounter turns a channel off when it reaches zero.
+type lengthCounter struct {
+	counter int
+	max     int
+	enabled bool
+}
+
+func (l *lengthCounter) load(v int) {
+	l.counter = v
+}
+
+func (l *lengthCounter) clock(channelEnabled *bool) {
+	if !l.enabled || l.counter == 0 {
+		return
+	}
+	l.counter--
+	if l.counter == 0 {
+		*channelEnabled = false
+	}
+}
+
+func (l *lengthCounter) trigger() {
+	if l.counter == 0 {
+		l.counter = l.max
+	}
+}
+
+// envelope changes the volume periodically.
+type envelope struct {
+	initialVolume byte
+	increase      bool
+	period        byte
+	timer         byte
+	volume        byte
+}
+
+func (e *envelope) write(data byte) {
+	e.initialVolume = data >> 4
+	e.increase = data&0x08 != 0
+	e.period = data & 0x07
+}
+
+func (e *envelope) trigger() {
+	e.volume = e.initialVolume
+	e.timer = e.period
+}
+
+func (e *envelope) clock() {
+	if e.period == 0 {
+		return
+	}
+	if e.timer > 0 {
+		e.timer--
+	}
+	if e.timer != 0 {
+		return
+	}
+	e.timer = e.period
+	if e.increase && e.volume < 0x0F {
+		e.volume++
+	} else if !e.increase && e.volume > 0 {
+		e.volume--
+	}
+}
+
+// square is channel 1 and 2. Only channel 1 has the frequency sweep.
+type square struct {
+	enabled    bool
+	dacEnabled bool
+	duty       byte
+	dutyPos    byte
+	freq       uint16
+	timer      int
+	length     lengthCounter
+	env        envelope
+
+	hasSweep     bool
+	sweepPeriod  byte
+	sweepNegate  bool
+	sweepShift   byte
+	sweepTimer   byte
+	sweepEnabled bool
+	shadowFreq   uint16
+}
+
+func (s *square) period() int {
+	return int(2048-s.freq) * 4
+}
+
+func (s *square) step(cycles uint) {
+	s.timer -= int(cycles)
+	for s.timer <= 0 {
+		s.timer += s.period()
+		s.dutyPos = (s.dutyPos + 1) & 0x07
+	}
+}
+
+func (s *square) output() byte {
+	if !s.enabled {
+		return 0
+	}
+	return dutyTable[s.duty][s.dutyPos] * s.env.volume
+}
+
+func (s *square) writeSweep(data byte) {
+	s.sweepPeriod = (data >> 4) & 0x07
+	s.sweepNegate = data&0x08 != 0
+	s.sweepShift = data & 0x07
+}
+
+func (s *square) writeDutyLength(data byte) {
+	s.duty = data >> 6
+	s.length.max = 64
+	s.length.load(64 - int(data&0x3F))
+}
+
+func (s *square) writeEnvelope(data byte) {
+	s.env.write(data)
+	s.dacEnabled = data&0xF8 != 0
+	if !s.dacEnabled {
+		s.enabled = false
+	}
+}
+
+func (s *square) writeControl(data byte) {
+	s.freq = s.freq&0x00FF | uint16(data&0x07)<<8
+	s.length.max = 64
+	s.length.enabled = data&0x40 != 0
+	if data&0x80 != 0 {
+		s.trigger()
+	}
+}
+
+func (s *square) trigger() {
+	s.enabled = s.dacEnabled
+	s.timer = s.period()
+	s.length.trigger()
+	s.env.trigger()
+	if !s.hasSweep {
+		return
+	}
+	s.shadowFreq = s.freq
+	s.sweepTimer = s.sweepPeriod
+	if s.sweepTimer == 0 {
+		s.sweepTimer = 8
+	}
+	s.sweepEnabled = s.sweepPeriod != 0 || s.sweepShift != 0
+	if s.sweepShift != 0 {
+		s.calcSweep()
+	}
+}
+
+// calcSweep computes the next frequency and disables the channel on overflow.
+func (s *square) calcSweep() uint16 {
+	delta := s.shadowFreq >> s.sweepShift
+	next := s.shadowFreq + delta
+	if s.sweepNegate {
+		next = s.shadowFreq - delta
+	}
+	if next > 2047 {
+		s.enabled = false
+	}
+	return next
+}
+
+func (s *square) clockSweep() {
+	if !s.hasSweep {
+		return
+	}
+	if s.sweepTimer > 0 {
+		s.sweepTimer--
+	}
+	if s.sweepTimer != 0 {
+		return
+	}
+	s.sweepTimer = s.sweepPeriod
+	if s.sweepTimer == 0 {
+		s.sweepTimer = 8
+	}
+	if !s.sweepEnabled || s.sweepPeriod == 0 {
+		return
+	}
+	next := s.calcSweep()
+	if next <= 2047 && s.sweepShift != 0 {
+		s.freq = next
+		s.shadowFreq = next
+		s.calcSweep()
+	}
+}
+
+// wave is channel 3. It plays 32 4bit samples stored in wave RAM.
+type wave struct {
+	enabled    bool
+	dacEnabled bool
+	freq       uint16
+	timer      int
+	position   byte
+	volumeCode byte
+	length     lengthCounter
+}
+
+func (w *wave) period() int {
+	return int(2048-w.freq) * 2
+}
+
+func (w *wave) step(cycles uint) {
+	w.timer -= int(cycles)
+	for w.timer <= 0 {
+		w.timer += w.period()
+		w.position = (w.position + 1) & 0x1F
+	}
+}
+
+func (w *wave) output(ram *[0x10]byte) byte {
+	if !w.enabled {
+		return 0
+	}
+	// 1バイトに2サンプル。上位ニブルが先
+	sample := ram[w.position/2]
+	if w.position%2 == 0 {
+		sample >>= 4
+	}
+	sample &= 0x0F
+	switch w.volumeCode {
+	case 0:
+		return 0
+	case 1:
+		return sample
+	case 2:
+		return sample >> 1
+	}
+	return sample >> 2
+}
+
+func (w *wave) writeDAC(data byte) {
+	w.dacEnabled = data&0x80 != 0
+	if !w.dacEnabled {
+		w.enabled = false
+	}
+}
+
+func (w *wave) writeControl(data byte) {
+	w.freq = w.freq&0x00FF | uint16(data&0x07)<<8
+	w.length.max = 256
+	w.length.enabled = data&0x40 != 0
+	if data&0x80 != 0 {
+		w.enabled = w.dacEnabled
+		w.timer = w.period()
+		w.position = 0
+		w.length.trigger()
+	}
+}
+
+// noise is channel 4. It outputs the bit 0 of a linear feedback shift register.
+type noise struct {
+	enabled    bool
+	dacEnabled bool
+	lfsr       uint16
+	shift      byte
+	width7     bool
+	divisor    byte
+	timer      int
+	length     lengthCounter
+	env        envelope
+}
+
+func (n *noise) period() int {
+	return int(noiseDivisors[n.divisor] << n.shift)
+}
+
+func (n *noise) step(cycles uint) {
+	n.timer -= int(cycles)
+	for n.timer <= 0 {
+		n.timer += n.period()
+		xor := (n.lfsr & 0x01) ^ ((n.lfsr >> 1) & 0x01)
+		n.lfsr = (n.lfsr >> 1) | (xor << 14)
+		if n.width7 {
+			n.lfsr = n.lfsr&^(1<<6) | (xor << 6)
+		}
+	}
+}
+
+func (n *noise) output() byte {
+	if !n.enabled || n.lfsr&0x01 != 0 {
+		return 0
+	}
+	return n.env.volume
+}
+
+func (n *noise) writeEnvelope(data byte) {
+	n.env.write(data)
+	n.dacEnabled = data&0xF8 != 0
+	if !n.dacEnabled {
+		n.enabled = false
+	}
+}
+
+func (n *noise) writePolynomial(data byte) {
+	n.shift = data >> 4
+	n.width7 = data&0x08 != 0
+	n.divisor = data & 0x07
+}
+
+func (n *noise) writeControl(data byte) {
+	n.length.max = 64
+	n.length.enabled = data&0x40 != 0
+	if data&0x80 != 0 {
+		n.enabled = n.dacEnabled
+		n.timer = n.period()
+		n.lfsr = 0x7FFF
+		n.length.trigger()
+		n.env.trigger()
+	}
+}
@@ -0,0 +1,92 @@
+package apu
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Sink receives the samples pulled from the APU.
+type Sink interface {
+	WriteSamples(samples []Sample) error
+}
+
+// WAVWriter writes samples as a 16bit stereo PCM WAV file.
+// It needs no audio device, so it can record a ROM's audio on CI.
+type WAVWriter struct {
+	w          io.WriteSeeker
+	sampleRate uint32
+	dataSize   uint32
+}
+
+const wavHeaderSize = 44
+
+// NewWAVWriter writes the WAV header and returns the writer.
+// The sizes in the header are fixed up by Close.
+func NewWAVWriter(w io.WriteSeeker, sampleRate int) (*WAVWriter, error) {
+	wav := &WAVWriter{
+		w:          w,
+		sampleRate: uint32(sampleRate),
+	}
+	if err := wav.writeHeader(); err != nil {
+		return nil, err
+	}
+	return wav, nil
+}
+
+func (wav *WAVWriter) writeHeader() error {
+	const (
+		channels      = 2
+		bitsPerSample = 16
+		blockAlign    = channels * bitsPerSample / 8
+	)
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:8], wavHeaderSize-8+wav.dataSize)
+	copy(h[8:12], "WAVE")
+	copy(h[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:20], 16)
+	binary.LittleEndian.PutUint16(h[20:22], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:24], channels)
+	binary.LittleEndian.PutUint32(h[24:28], wav.sampleRate)
+	binary.LittleEndian.PutUint32(h[28:32], wav.sampleRate*blockAlign)
+	binary.LittleEndian.PutUint16(h[32:34], blockAlign)
+	binary.LittleEndian.PutUint16(h[34:36], bitsPerSample)
+	copy(h[36:40], "data")
+	binary.LittleEndian.PutUint32(h[40:44], wav.dataSize)
+	_, err := wav.w.Write(h)
+	return err
+}
+
+// WriteSamples appends samples to the data chunk.
+func (wav *WAVWriter) WriteSamples(samples []Sample) error {
+	buf := make([]byte, len(samples)*4)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(buf[i*4:], uint16(toPCM(s.Left)))
+		binary.LittleEndian.PutUint16(buf[i*4+2:], uint16(toPCM(s.Right)))
+	}
+	n, err := wav.w.Write(buf)
+	wav.dataSize += uint32(n)
+	return err
+}
+
+// Close rewrites the header with the final sizes.
+func (wav *WAVWriter) Close() error {
+	if _, err := wav.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := wav.writeHeader(); err != nil {
+		return err
+	}
+	_, err := wav.w.Seek(0, io.SeekEnd)
+	return err
+}
+
+func toPCM(v float32) int16 {
+	if v > 1 {
+		v = 1
+	}
+	if v < -1 {
+		v = -1
+	}
+	return int16(v * 32767)
+}
@@ -0,0 +1,374 @@
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// Assemble translates the assembly into the machine code placed at org.
+// The mnemonics are the ones CPU decodes, which cpu.Disassemble also prints.
+//
+//	loop:                ; label
+//	    LD BC,$ADDE      ; $FF, 0xFF, 255 and labels are numbers. label+1 and label-1 work too
+//	    LDH ($FF80),A    ; ($80) is also accepted
+//	    JR NZ,loop       ; the target address. The offset is calculated
+//	    ADD SP,-2
+//	    DB $01,2,loop    ; raw bytes
+//	    DW $1234,loop    ; little endian words
+//
+// Mnemonics and registers are case insensitive. Labels are case sensitive.
+func Assemble(src string, org types.Word) ([]byte, error) {
+	a := &assembler{labels: map[string]types.Word{}, mnemonics: indexMnemonics()}
+	lines := strings.Split(src, "\n")
+	// 1パス目でラベルのアドレスを決め、2パス目で出力する
+	for pass := 1; pass <= 2; pass++ {
+		a.pass, a.pc, a.out = pass, org, []byte{}
+		for i, line := range lines {
+			if err := a.line(line); err != nil {
+				return nil, fmt.Errorf("line %d: %q: %w", i+1, strings.TrimSpace(line), err)
+			}
+		}
+	}
+	return a.out, nil
+}
+
+// MustAssemble is like Assemble but panics on error. It is for the fixed sources, e.g. the programs in tests.
+func MustAssemble(src string, org types.Word) []byte {
+	code, err := Assemble(src, org)
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
+
+type assembler struct {
+	pass   int
+	pc     types.Word
+	out    []byte
+	labels map[string]types.Word
+	// mnemonics is the index of the instructions by the mnemonic
+	mnemonics map[string][]op
+}
+
+// op is an instruction of CPU
+type op struct {
+	// code is the opcode with the CB prefix if any
+	code []byte
+	// description is the mnemonic with the operand placeholders, e.g. "LD A,(nn)"
+	description string
+	// operands is the size of the operands in bytes
+	operands int
+}
+
+// reserved are the names that are operands by themselves, so that they can't be labels.
+var reserved = map[string]bool{
+	"A": true, "B": true, "C": true, "D": true, "E": true, "H": true, "L": true,
+	"AF": true, "BC": true, "DE": true, "HL": true, "SP": true,
+	"NZ": true, "Z": true, "NC": true,
+}
+
+func (a *assembler) line(line string) error {
+	if i := strings.Index(line, ";"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if i := strings.Index(line, ":"); i >= 0 {
+		label := strings.TrimSpace(line[:i])
+		if err := a.define(label); err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line[i+1:])
+	}
+	if line == "" {
+		return nil
+	}
+	// ニーモニックとオペランドの間はタブでもよい
+	fields := strings.Fields(line)
+	mnemonic := strings.ToUpper(fields[0])
+	operands := []string{}
+	if args := strings.Join(fields[1:], ""); args != "" {
+		operands = strings.Split(args, ",")
+	}
+	switch mnemonic {
+	case "DB":
+		return a.data(operands, 1)
+	case "DW":
+		return a.data(operands, 2)
+	}
+	return a.inst(mnemonic, operands)
+}
+
+func (a *assembler) define(label string) error {
+	if !isSymbol(label) || reserved[strings.ToUpper(label)] {
+		return fmt.Errorf("invalid label %q", label)
+	}
+	if _, ok := a.labels[label]; ok && a.pass == 1 {
+		return fmt.Errorf("label %q is already defined", label)
+	}
+	a.labels[label] = a.pc
+	return nil
+}
+
+func (a *assembler) emit(b ...byte) {
+	a.out = append(a.out, b...)
+	a.pc += types.Word(len(b))
+}
+
+func (a *assembler) data(operands []string, size int) error {
+	if len(operands) == 0 {
+		return fmt.Errorf("no data")
+	}
+	for _, o := range operands {
+		v, err := a.value(o)
+		if err != nil {
+			return err
+		}
+		if size == 1 {
+			if err := a.checkRange(v, -128, 0xFF); err != nil {
+				return err
+			}
+			a.emit(byte(v))
+			continue
+		}
+		if err := a.checkRange(v, -0x8000, 0xFFFF); err != nil {
+			return err
+		}
+		a.emit(byte(v), byte(v>>8))
+	}
+	return nil
+}
+
+// inst finds the instruction whose operands match and emits it.
+func (a *assembler) inst(mnemonic string, operands []string) error {
+	candidates, ok := a.mnemonics[mnemonic]
+	if !ok {
+		return fmt.Errorf("unknown mnemonic %s", mnemonic)
+	}
+	for _, in := range candidates {
+		args := []string{}
+		if _, list, ok := strings.Cut(in.description, " "); ok {
+			args = strings.Split(list, ",")
+		}
+		exprs, ok := match(args, operands)
+		if !ok {
+			continue
+		}
+		return a.encode(mnemonic, in, args, exprs)
+	}
+	return fmt.Errorf("invalid operands for %s", mnemonic)
+}
+
+// match compares the operands with the placeholders of the instruction.
+// It returns the expressions given to the placeholders.
+func match(args, operands []string) ([]string, bool) {
+	if len(args) != len(operands) {
+		return nil, false
+	}
+	exprs := make([]string, len(args))
+	for i, arg := range args {
+		src := operands[i]
+		switch arg {
+		case "n", "nn", "e":
+		case "(n)", "(nn)":
+			if !strings.HasPrefix(src, "(") || !strings.HasSuffix(src, ")") {
+				return nil, false
+			}
+			src = src[1 : len(src)-1]
+		case "SP+e":
+			if len(src) < 3 || !strings.EqualFold(src[:2], "SP") {
+				return nil, false
+			}
+			src = src[2:]
+		default:
+			if !strings.EqualFold(arg, src) && !sameNumber(arg, src) {
+				return nil, false
+			}
+			continue
+		}
+		if !isExpr(src) {
+			return nil, false
+		}
+		exprs[i] = src
+	}
+	return exprs, true
+}
+
+// encode emits the instruction with the operand values.
+func (a *assembler) encode(mnemonic string, in op, args, exprs []string) error {
+	code := append([]byte{}, in.code...)
+	size := len(code) + in.operands
+	for i, arg := range args {
+		if exprs[i] == "" {
+			continue
+		}
+		v, err := a.value(exprs[i])
+		if err != nil {
+			return err
+		}
+		switch arg {
+		case "nn", "(nn)":
+			err = a.checkRange(v, -0x8000, 0xFFFF)
+			code = append(code, byte(v), byte(v>>8))
+		case "(n)":
+			// LDHは0xFF00からのオフセット
+			if v >= 0xFF00 {
+				v -= 0xFF00
+			}
+			err = a.checkRange(v, 0, 0xFF)
+			code = append(code, byte(v))
+		case "n":
+			err = a.checkRange(v, -128, 0xFF)
+			code = append(code, byte(v))
+		default:
+			if mnemonic == "JR" {
+				// JRのオフセットは命令の次のアドレスから数える
+				v -= int(a.pc) + size
+			}
+			err = a.checkRange(v, -128, 127)
+			code = append(code, byte(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// STOPはプレースホルダがないが、2バイト目を持つ
+	for len(code) < size {
+		code = append(code, 0x00)
+	}
+	a.emit(code...)
+	return nil
+}
+
+// checkRange is skipped in the first pass, because the labels may not be defined yet.
+func (a *assembler) checkRange(v, min, max int) error {
+	if a.pass == 1 || (min <= v && v <= max) {
+		return nil
+	}
+	return fmt.Errorf("%d is out of range [%d, %d]", v, min, max)
+}
+
+// isExpr reports whether s can be a number expression. Register names are not.
+func isExpr(s string) bool {
+	if s == "" || strings.ContainsAny(s, "()") {
+		return false
+	}
+	for _, t := range strings.FieldsFunc(s, func(r rune) bool { return r == '+' || r == '-' }) {
+		if reserved[strings.ToUpper(t)] {
+			return false
+		}
+	}
+	return true
+}
+
+// value evaluates the terms joined by + and -.
+func (a *assembler) value(s string) (int, error) {
+	total, sign, term := 0, 1, ""
+	flush := func() error {
+		if term == "" {
+			return fmt.Errorf("invalid expression %q", s)
+		}
+		v, err := a.term(term)
+		total += sign * v
+		term = ""
+		return err
+	}
+	for i, r := range s {
+		if (r == '+' || r == '-') && i > 0 {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+			sign = 1
+			if r == '-' {
+				sign = -1
+			}
+			continue
+		}
+		if r == '+' && i == 0 {
+			continue
+		}
+		if r == '-' && i == 0 {
+			sign = -1
+			continue
+		}
+		term += string(r)
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func (a *assembler) term(s string) (int, error) {
+	if isSymbol(s) {
+		addr, ok := a.labels[s]
+		if !ok && a.pass == 2 {
+			return 0, fmt.Errorf("undefined label %q", s)
+		}
+		return int(addr), nil
+	}
+	return parseNumber(s)
+}
+
+// parseNumber parses $FF, 0xFF or 255.
+func parseNumber(s string) (int, error) {
+	var (
+		v   uint64
+		err error
+	)
+	switch {
+	case strings.HasPrefix(s, "$"):
+		v, err = strconv.ParseUint(s[1:], 16, 16)
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		v, err = strconv.ParseUint(s[2:], 16, 16)
+	default:
+		v, err = strconv.ParseUint(s, 10, 16)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return int(v), nil
+}
+
+// sameNumber reports whether the fixed number in the mnemonic, e.g. RST $38 and BIT 7, is written in the other way.
+func sameNumber(arg, src string) bool {
+	x, err := parseNumber(arg)
+	if err != nil {
+		return false
+	}
+	y, err := parseNumber(src)
+	return err == nil && x == y
+}
+
+func isSymbol(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r == '.' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// indexMnemonics makes the index of the instructions by the mnemonic. The instructions are the ones CPU decodes.
+func indexMnemonics() map[string][]op {
+	mnemonics := map[string][]op{}
+	for _, prefix := range [][]byte{{}, {0xCB}} {
+		for i := 0; i < 0x100; i++ {
+			code := append(append([]byte{}, prefix...), byte(i))
+			in := cpu.Decode(code)
+			// 0xCBはプレフィックスで、CB命令は2周目で数える
+			if in.Description == "" || len(prefix) == 0 && i == 0xCB {
+				continue
+			}
+			m, _, _ := strings.Cut(in.Description, " ")
+			mnemonics[m] = append(mnemonics[m], op{code: code, description: in.Description, operands: in.Length - len(code)})
+		}
+	}
+	return mnemonics
+}
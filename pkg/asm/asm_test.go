@@ -0,0 +1,115 @@
+package asm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		src  string
+		code []byte
+	}{
+		{"NOP", []byte{0x00}},
+		{"LD BC,$ADDE", []byte{0x01, 0xDE, 0xAD}},
+		{"ld bc, 0xADDE", []byte{0x01, 0xDE, 0xAD}},
+		{"LD\tA,B", []byte{0x78}},
+		{"LD \t A, \t B", []byte{0x78}},
+		{"\tRET\t; done", []byte{0xC9}},
+		{"LD A,(BC)", []byte{0x0A}},
+		{"LD A,($C0DE)", []byte{0xFA, 0xDE, 0xC0}},
+		{"LD A,(C)", []byte{0xF2}},
+		{"LD (HL+),A", []byte{0x22}},
+		{"LD (HL),255", []byte{0x36, 0xFF}},
+		{"LDH ($FF44),A", []byte{0xE0, 0x44}},
+		{"LDH A,($44)", []byte{0xF0, 0x44}},
+		{"ADD SP,-3", []byte{0xE8, 0xFD}},
+		{"LD HL,SP+$05", []byte{0xF8, 0x05}},
+		{"JR $0100", []byte{0x18, 0xFE}},
+		{"JP C,$0150", []byte{0xDA, 0x50, 0x01}},
+		{"RET C", []byte{0xD8}},
+		{"RST 0x38", []byte{0xFF}},
+		{"BIT 7,H", []byte{0xCB, 0x7C}},
+		{"STOP", []byte{0x10, 0x00}},
+		{"DB $01,2,-1", []byte{0x01, 0x02, 0xFF}},
+		{"DW $1234", []byte{0x34, 0x12}},
+	}
+	for _, tt := range tests {
+		code, err := Assemble(tt.src, 0x0100)
+		assert.NoError(t, err, tt.src)
+		assert.Equal(t, tt.code, code, tt.src)
+	}
+}
+
+func TestAssembleLabels(t *testing.T) {
+	src := `
+start:
+	LD B,3        ; counter
+loop: DEC B
+	JR NZ,loop
+	JP end
+table:
+	DW start,table+2
+end:  HALT
+`
+	code, err := Assemble(src, 0x0150)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x06, 0x03, // LD B,3
+		0x05,       // DEC B
+		0x20, 0xFD, // JR NZ,loop
+		0xC3, 0x5C, 0x01, // JP end
+		0x50, 0x01, 0x5A, 0x01, // DW start,table+2
+		0x76, // HALT
+	}, code)
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for _, src := range []string{
+		"FOO A",
+		"LD A,(DE+)",
+		"LD B,$100",
+		"JP nowhere",
+		"a: NOP",
+		"x: NOP\nx: NOP",
+	} {
+		_, err := Assemble(src, 0)
+		assert.Error(t, err, src)
+	}
+	far := "JR far\n"
+	for i := 0; i < 128; i++ {
+		far += "NOP\n"
+	}
+	_, err := Assemble(far+"far: NOP", 0)
+	assert.Error(t, err)
+}
+
+// TestAssembleDisassemble checks that every instruction assembles back from the disassembly.
+func TestAssembleDisassemble(t *testing.T) {
+	n := 0
+	for _, ins := range indexMnemonics() {
+		for _, in := range ins {
+			n++
+			code := append([]byte{}, in.code...)
+			operands := []byte{0x12, 0x34}
+			if in.description == "STOP" {
+				operands = []byte{0x00}
+			}
+			code = append(code, operands[:in.operands]...)
+
+			b := &mocks.MockBus{}
+			b.SetMemory(0x0100, code)
+			text, _ := cpu.Disassemble(b, 0x0100)
+			got, err := Assemble(text, 0x0100)
+			name := fmt.Sprintf("%s (% X)", text, code)
+			assert.NoError(t, err, name)
+			assert.Equal(t, code, got, name)
+		}
+	}
+	// 未定義の11命令以外のすべて
+	assert.Equal(t, 0x100-11-1+0x100, n)
+}
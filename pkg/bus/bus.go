@@ -1,12 +1,17 @@
 package bus
 
 import (
+	"fmt"
+
 	"github.com/kijimaD/goboy/pkg/interfaces/pad"
 	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/model"
 
+	"github.com/kijimaD/goboy/pkg/apu"
 	"github.com/kijimaD/goboy/pkg/cartridge"
 	"github.com/kijimaD/goboy/pkg/gpu"
 	"github.com/kijimaD/goboy/pkg/interfaces/logger"
+	"github.com/kijimaD/goboy/pkg/interfaces/soundlog"
 	"github.com/kijimaD/goboy/pkg/ram"
 	"github.com/kijimaD/goboy/pkg/serial"
 	"github.com/kijimaD/goboy/pkg/timer"
@@ -15,10 +20,20 @@ import (
 )
 
 const (
-	// DMGStatusReg is DMA status register
+	// DMGStatusReg unmaps the boot ROM when a non-zero value is written.
+	// It can not be mapped again until reset.
 	DMGStatusReg types.Word = 0xFF50
 )
 
+// Boot ROM sizes
+const (
+	// DMGBootROMSize is the size of DMG, MGB and SGB boot ROM. It is mapped at 0000-00FF.
+	DMGBootROMSize = 0x100
+	// CGBBootROMSize is the size of CGB boot ROM. It is mapped at 0000-00FF and 0200-08FF.
+	// The cartridge header at 0100-01FF is visible between them.
+	CGBBootROMSize = 0x900
+)
+
 const (
 	BANK_BEGIN             = 0x0000
 	BANK_END               = 0x7FFF
@@ -37,9 +52,14 @@ const (
 	IO_REG_END             = 0xFF7F
 	JOYPAD                 = 0xFF00
 	SERIAL_BEGIN           = 0xFF01
+	SERIAL_CONTROL         = 0xFF02
 	TIMER_BEGIN            = 0xFF04
 	TIMER_END              = 0xFF07
+	SOUND_BEGIN            = 0xFF10
+	SOUND_END              = 0xFF3F
 	GPU_BEGIN              = 0xFF40
+	GPU_END                = 0xFF4B
+	KEY1                   = 0xFF4D
 	HRAM_BEGIN             = 0xFF80
 	HRAM_END               = 0xFFFE
 	IE_REG_ENABLE          = 0xFFFF
@@ -47,8 +67,11 @@ const (
 
 // Bus is gb bus
 type Bus struct {
-	logger    logger.Logger
+	logger logger.Logger
+	model  model.Model
+	// bootmode is set while the boot ROM is mapped
 	bootmode  bool
+	bootROM   []byte
 	cartridge *cartridge.Cartridge
 	gpu       *gpu.GPU
 	vRAM      *ram.RAM
@@ -56,8 +79,21 @@ type Bus struct {
 	hRAM      *ram.RAM
 	oamRAM    *ram.RAM
 	timer     *timer.Timer
+	apu       *apu.APU
 	irq       *interrupt.Interrupt
 	pad       pad.Pad
+	// sb and sc are the serial data and control. Nothing is connected to the link port.
+	sb byte
+	sc byte
+	// soundRecorder receives the sound register writes. nil if not recording.
+	soundRecorder soundlog.Recorder
+	// hookList are the registered hooks. reads, writes and execs are nil without hooks.
+	hookList []*Hook
+	reads    *hooks
+	writes   *hooks
+	execs    *hooks
+	// replay is set while the machine replays the steps after a rewind
+	replay bool
 }
 
 /* --------------------------+
@@ -96,11 +132,12 @@ func NewBus(
 	hRAM *ram.RAM,
 	oamRAM *ram.RAM,
 	timer *timer.Timer,
+	apu *apu.APU,
 	irq *interrupt.Interrupt,
 	pad pad.Pad) *Bus {
 	return &Bus{
 		logger:    logger,
-		bootmode:  true,
+		bootmode:  false,
 		cartridge: cartridge,
 		gpu:       gpu,
 		vRAM:      vram,
@@ -108,21 +145,59 @@ func NewBus(
 		hRAM:      hRAM,
 		oamRAM:    oamRAM,
 		timer:     timer,
+		apu:       apu,
 		irq:       irq,
 		pad:       pad,
 	}
 }
 
+// SetSoundRecorder sets the recorder of the sound register writes.
+func (b *Bus) SetSoundRecorder(r soundlog.Recorder) {
+	b.soundRecorder = r
+}
+
+// SetModel selects the hardware model. The boot ROM is mapped as the model does.
+func (b *Bus) SetModel(m model.Model) {
+	b.model = m
+}
+
+// SetBootROM maps the boot ROM of the model. CPU should start from 0x0000 to run it.
+func (b *Bus) SetBootROM(rom []byte) error {
+	size := DMGBootROMSize
+	if b.model.IsCGB() {
+		size = CGBBootROMSize
+	}
+	if len(rom) != size {
+		return fmt.Errorf("invalid boot ROM size %d bytes. %d bytes are expected for %s", len(rom), size, b.model)
+	}
+	b.bootROM = rom
+	b.bootmode = true
+	return nil
+}
+
+// inBootROM reports whether the boot ROM is mapped at addr.
+func (b *Bus) inBootROM(addr types.Word) bool {
+	if !b.bootmode {
+		return false
+	}
+	if addr < CARTRIDGE_HEADER_BEGIN {
+		return true
+	}
+	// CGBのブートROMはカートリッジヘッダを避けて配置される
+	return b.model.IsCGB() && addr >= 0x0200 && addr < CGBBootROMSize
+}
+
 // READBYTE is byte data reader from bus
 // メモリマップ
 func (b *Bus) ReadByte(addr types.Word) byte {
+	if b.reads != nil {
+		// フックがあるときだけ遅い経路を通る
+		return b.readHooked(addr)
+	}
 	switch {
 	case addr >= BANK_BEGIN && addr <= BANK_END:
-		if b.bootmode && addr < CARTRIDGE_HEADER_BEGIN {
-			return BIOS[addr]
-		}
-		if addr == CARTRIDGE_HEADER_BEGIN {
-			b.bootmode = false
+		if b.inBootROM(addr) {
+			return b.bootROM[addr]
 		}
 		return b.cartridge.ReadByte(addr)
 	// Video RAM
@@ -142,14 +217,28 @@ func (b *Bus) ReadByte(addr types.Word) byte {
 	// Pad
 	case addr == JOYPAD:
 		return b.pad.Read()
+	// Serial
+	case addr == SERIAL_BEGIN:
+		return b.sb
+	case addr == SERIAL_CONTROL:
+		// bit1-6は使われておらず1が読める
+		return b.sc | 0x7E
 	// Timer
 	case addr >= TIMER_BEGIN && addr <= TIMER_END:
 		return b.timer.Read(addr - IO_REG_BEGIN)
 	// IF
 	case addr == 0xFF0F:
 		return b.irq.Read(addr - IO_REG_BEGIN)
+	// Sound
+	case addr >= SOUND_BEGIN && addr <= SOUND_END:
+		return b.apu.Read(addr - IO_REG_BEGIN)
+	// KEY1 (CGB only). DMGには存在しないので0xFFが読める
+	case addr == KEY1:
+		return 0xFF
+	case addr == DMGStatusReg:
+		return 0xFF
 	// GPU
-	case addr >= GPU_BEGIN && addr <= IO_REG_END:
+	case addr >= GPU_BEGIN && addr <= GPU_END:
 		return b.gpu.Read(addr - GPU_BEGIN)
 	// Zero page RAM
 	case addr >= HRAM_BEGIN && addr <= HRAM_END:
@@ -157,12 +246,28 @@ func (b *Bus) ReadByte(addr types.Word) byte {
 	// IE
 	case addr == IE_REG_ENABLE:
 		return b.irq.Read(addr - IO_REG_BEGIN)
+	// 割り当てのないI/Oはオープンバスで0xFFが読める
+	case addr >= IO_REG_BEGIN && addr <= IO_REG_END:
+		return 0xFF
 	default:
 		return 0
 	}
 	return 0
 }
 
+// ROMBank returns the ROM bank mapped at addr. It returns -1 if addr is not in ROM, or the boot ROM is mapped there.
+func (b *Bus) ROMBank(addr types.Word) int {
+	switch {
+	case b.inBootROM(addr):
+		return -1
+	case addr < 0x4000:
+		return 0
+	case addr <= BANK_END:
+		return b.cartridge.ROMBank()
+	}
+	return -1
+}
+
 // ReadWord is word data reader from bus
 func (b *Bus) ReadWord(addr types.Word) types.Word {
 	l := b.ReadByte(addr)
@@ -172,6 +277,10 @@ func (b *Bus) ReadWord(addr types.Word) types.Word {
 
 // WriteByte is byte data writer to bus
 func (b *Bus) WriteByte(addr types.Word, data byte) {
+	if b.writes != nil {
+		b.writeHooked(addr, data)
+		return
+	}
 	switch {
 	case addr >= BANK_BEGIN && addr <= BANK_END:
 		b.cartridge.WriteByte(addr, data)
@@ -194,15 +303,37 @@ func (b *Bus) WriteByte(addr types.Word, data byte) {
 		b.pad.Write(data)
 	// Serial
 	case addr == SERIAL_BEGIN:
-		serial.Send(data)
+		b.sb = data
+		if !b.replay {
+			serial.Send(data)
+		}
+	case addr == SERIAL_CONTROL:
+		// 相手がいないので、内部クロックの転送はすぐに終わる
+		if data&0x01 != 0 {
+			data &^= 0x80
+		}
+		b.sc = data
 	// Timer
 	case addr >= TIMER_BEGIN && addr <= TIMER_END:
 		b.timer.Write(addr-IO_REG_BEGIN, data)
 	// IF
 	case addr == 0xFF0F:
 		b.irq.Write(addr-IO_REG_BEGIN, data)
+	// Sound
+	case addr >= SOUND_BEGIN && addr <= SOUND_END:
+		if b.soundRecorder != nil && !b.replay {
+			b.soundRecorder.Record(addr, data)
+		}
+		b.apu.Write(addr-IO_REG_BEGIN, data)
+	// KEY1 (CGB only)
+	case addr == KEY1:
+	// ブートROMの終了
+	case addr == DMGStatusReg:
+		if data != 0 {
+			b.bootmode = false
+		}
 	// GPU
-	case addr >= GPU_BEGIN && addr <= IO_REG_END:
+	case addr >= GPU_BEGIN && addr <= GPU_END:
 		b.gpu.Write(addr-GPU_BEGIN, data)
 	//Zero page RAM
 	case addr >= HRAM_BEGIN && addr <= HRAM_END:
@@ -221,6 +352,3 @@ func (b *Bus) WriteWord(addr types.Word, data types.Word) {
 	b.WriteByte(addr, lower)
 	b.WriteByte(addr+1, upper)
 }
-
-// BIOS is
-var BIOS = []byte{ /* Removed*/ }
@@ -3,10 +3,14 @@ package bus
 import (
 	"testing"
 
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/asm"
 	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/cpu"
 	"github.com/kijimaD/goboy/pkg/gpu"
 	"github.com/kijimaD/goboy/pkg/interrupt"
 	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/model"
 	"github.com/kijimaD/goboy/pkg/pad"
 	"github.com/kijimaD/goboy/pkg/ram"
 	"github.com/kijimaD/goboy/pkg/timer"
@@ -25,8 +29,9 @@ func setup() (*Bus, *ram.RAM, *ram.RAM) {
 	pad := pad.NewPad()
 	l := logger.NewLogger(logger.LogLevel("Debug"))
 	t := timer.NewTimer()
+	a := apu.NewAPU()
 	irq := interrupt.NewInterrupt()
-	return NewBus(l, cart, gpu, vRAM, wRAM, hRAM, oamRAM, t, irq, pad), wRAM, hRAM
+	return NewBus(l, cart, gpu, vRAM, wRAM, hRAM, oamRAM, t, a, irq, pad), wRAM, hRAM
 }
 
 func TestCartridgeRead(t *testing.T) {
@@ -79,3 +84,77 @@ func TestZRAMReadWrite(t *testing.T) {
 	assert.Equal(byte(0xA5), hRAM.Read(0x0000))
 	assert.Equal(types.Word(0xDEAD), b.ReadWord(0xFF90))
 }
+
+func TestBootROM(t *testing.T) {
+	assert := assert.New(t)
+	b, _, _ := setup()
+	buf := make([]byte, 0x8000)
+	buf[0x0000] = 0x01
+	buf[0x0100] = 0x02
+	buf[0x0200] = 0x03
+	b.cartridge, _ = cartridge.NewCartridge(buf)
+	assert.Equal(byte(0x01), b.ReadByte(0x0000))
+
+	assert.Error(b.SetBootROM(make([]byte, 0x200)))
+	// CGBのブートROMはCGBでしか使えない
+	assert.Error(b.SetBootROM(make([]byte, CGBBootROMSize)))
+
+	b.SetModel(model.CGB)
+	assert.Error(b.SetBootROM(make([]byte, DMGBootROMSize)))
+	boot := make([]byte, CGBBootROMSize)
+	boot[0x0000] = 0x11
+	boot[0x0100] = 0x12
+	boot[0x0200] = 0x13
+	assert.NoError(b.SetBootROM(boot))
+	assert.Equal(byte(0x11), b.ReadByte(0x0000))
+	// カートリッジヘッダは見える
+	assert.Equal(byte(0x02), b.ReadByte(0x0100))
+	assert.Equal(byte(0x13), b.ReadByte(0x0200))
+
+	// 0を書いても外れない
+	b.WriteByte(DMGStatusReg, 0x00)
+	assert.Equal(byte(0x11), b.ReadByte(0x0000))
+	b.WriteByte(DMGStatusReg, 0x11)
+	assert.Equal(byte(0x01), b.ReadByte(0x0000))
+	assert.Equal(byte(0x03), b.ReadByte(0x0200))
+}
+
+func TestCPUAccess(t *testing.T) {
+	assert := assert.New(t)
+	b, wRAM, hRAM := setup()
+	buf := make([]byte, 0x8000)
+	copy(buf[0x0100:], asm.MustAssemble(`
+	LD A,$A5
+	LD ($E010),A
+	LD A,($C010)
+	INC A
+	LDH ($FF90),A
+	LD HL,$FF90
+	LD B,(HL)
+`, 0x0100))
+	b.cartridge, _ = cartridge.NewCartridge(buf)
+	c := cpu.NewCPU(logger.NewLogger(logger.LogLevel("Info")), b, interrupt.NewInterrupt())
+	for i := 0; i < 7; i++ {
+		c.Step()
+	}
+	// エコーRAMへの書き込みはWRAMに入る
+	assert.Equal(byte(0xA5), wRAM.Read(0x0010))
+	assert.Equal(byte(0xA6), hRAM.Read(0x0010))
+	assert.Equal(byte(0xA6), c.Regs.B)
+}
+
+func TestIORead(t *testing.T) {
+	assert := assert.New(t)
+	b, _, _ := setup()
+	b.WriteByte(0xFF01, 'A')
+	assert.Equal(byte('A'), b.ReadByte(0xFF01))
+	// 内部クロックの転送はすぐに終わる
+	b.WriteByte(0xFF02, 0x81)
+	assert.Equal(byte(0x7F), b.ReadByte(0xFF02))
+	b.WriteByte(0xFF02, 0x80)
+	assert.Equal(byte(0xFE), b.ReadByte(0xFF02))
+	// 割り当てのないI/O
+	for _, addr := range []types.Word{0xFF03, 0xFF08, 0xFF4C, 0xFF4F, 0xFF7F} {
+		assert.Equal(byte(0xFF), b.ReadByte(addr), "$%04X", addr)
+	}
+}
@@ -0,0 +1,175 @@
+package bus
+
+import "github.com/kijimaD/goboy/pkg/types"
+
+// Access is a kind of bus access. They can be combined, e.g. Read|Write.
+type Access int
+
+const (
+	// Read is a read of a byte
+	Read Access = 1 << iota
+	// Write is a write of a byte
+	Write
+	// Execute is a fetch of an opcode by CPU
+	Execute
+)
+
+// AnyBank matches the accesses in all banks
+const AnyBank = -1
+
+// anyValue matches all values
+const anyValue = -1
+
+// Event is a bus access passed to the hooks.
+type Event struct {
+	Access Access
+	Addr   types.Word
+	// Value is the byte read or written. It is the opcode for Execute.
+	Value byte
+	// Old is the byte read before the write. It is set for Write.
+	Old byte
+	// Bank is the ROM bank mapped at Addr. It is -1 outside ROM.
+	Bank int
+}
+
+// Hook is a callback on the accesses to an address range.
+// Debuggers, cheats and tracers observe the bus by hooks instead of wrapping it.
+type Hook struct {
+	access     Access
+	start, end types.Word
+	bank       int
+	value      int
+	fn         func(Event)
+}
+
+// NewHook constructs a hook called on the accesses to start-end (inclusive).
+func NewHook(access Access, start, end types.Word, fn func(Event)) *Hook {
+	return &Hook{access: access, start: start, end: end, bank: AnyBank, value: anyValue, fn: fn}
+}
+
+// SetBank limits the hook to the accesses in the ROM bank. ROM0 is bank 0.
+func (h *Hook) SetBank(bank int) {
+	h.bank = bank
+}
+
+// SetValue limits the hook to the accesses of the value.
+func (h *Hook) SetValue(v byte) {
+	h.value = int(v)
+}
+
+func (h *Hook) matches(e Event) bool {
+	return e.Addr >= h.start && e.Addr <= h.end &&
+		(h.bank == AnyBank || h.bank == e.Bank) &&
+		(h.value == anyValue || h.value == int(e.Value))
+}
+
+// hooks are the hooks of an access kind
+type hooks struct {
+	list []*Hook
+	// pages marks the 256-byte pages covered by the hooks, so that the other accesses skip the list
+	pages [0x100]bool
+}
+
+// covers reports whether a hook may match the address. It is inlined in the hot path.
+func (hs *hooks) covers(addr types.Word) bool {
+	return hs != nil && hs.pages[addr>>8]
+}
+
+func (hs *hooks) call(b *Bus, access Access, addr types.Word, v byte) {
+	hs.notify(Event{Access: access, Addr: addr, Value: v, Bank: b.ROMBank(addr)})
+}
+
+func (hs *hooks) notify(e Event) {
+	for _, h := range hs.list {
+		if h.matches(e) {
+			h.fn(e)
+		}
+	}
+}
+
+// AddHook registers the hook. The hooks are called in the order of registration.
+func (b *Bus) AddHook(h *Hook) {
+	b.hookList = append(b.hookList, h)
+	b.updateHooks()
+}
+
+// RemoveHook unregisters the hook. It can be called in the hook.
+func (b *Bus) RemoveHook(h *Hook) {
+	list := []*Hook{}
+	for _, x := range b.hookList {
+		if x != h {
+			list = append(list, x)
+		}
+	}
+	b.hookList = list
+	b.updateHooks()
+}
+
+// updateHooks rebuilds the hooks of each access kind.
+// The lists are made anew, so that the running calls are not affected.
+func (b *Bus) updateHooks() {
+	b.reads, b.writes, b.execs = nil, nil, nil
+	if b.replay {
+		// 再実行中のアクセスはフックが一度見ている
+		return
+	}
+	for _, h := range b.hookList {
+		for _, p := range []struct {
+			access Access
+			hs     **hooks
+		}{{Read, &b.reads}, {Write, &b.writes}, {Execute, &b.execs}} {
+			if h.access&p.access == 0 {
+				continue
+			}
+			if *p.hs == nil {
+				*p.hs = &hooks{}
+			}
+			(*p.hs).list = append((*p.hs).list, h)
+			for page := int(h.start >> 8); page <= int(h.end>>8); page++ {
+				(*p.hs).pages[page] = true
+			}
+		}
+	}
+}
+
+// Execute calls the execute hooks. CPU calls it before it fetches the opcode at the address.
+func (b *Bus) Execute(addr types.Word) {
+	if b.execs.covers(addr) {
+		b.execs.call(b, Execute, addr, b.Peek(addr))
+	}
+}
+
+// readHooked reads the byte and calls the read hooks.
+func (b *Bus) readHooked(addr types.Word) byte {
+	v := b.Peek(addr)
+	if reads := b.reads; reads.covers(addr) {
+		reads.call(b, Read, addr, v)
+	}
+	return v
+}
+
+// writeHooked writes the byte and calls the write hooks after the write.
+func (b *Bus) writeHooked(addr types.Word, data byte) {
+	writes := b.writes
+	if !writes.covers(addr) {
+		b.writes = nil
+		b.WriteByte(addr, data)
+		b.writes = writes
+		return
+	}
+	old := b.Peek(addr)
+	b.writes = nil
+	b.WriteByte(addr, data)
+	b.writes = writes
+	writes.notify(Event{Access: Write, Addr: addr, Value: data, Old: old, Bank: b.ROMBank(addr)})
+}
+
+// Peek reads the byte without the read hooks.
+// The debugger, the tracer and PPU read the memory with it, so that the hooks see only the accesses by CPU.
+func (b *Bus) Peek(addr types.Word) byte {
+	reads := b.reads
+	b.reads = nil
+	v := b.ReadByte(addr)
+	b.reads = reads
+	return v
+}
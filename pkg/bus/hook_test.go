@@ -0,0 +1,108 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHookReadWrite(t *testing.T) {
+	b, _, _ := setup()
+	events := []Event{}
+	record := func(e Event) { events = append(events, e) }
+	b.AddHook(NewHook(Write, 0xC000, 0xC0FF, record))
+	b.AddHook(NewHook(Read|Write, 0xFF80, 0xFF80, record))
+
+	b.WriteByte(0xC010, 0x11)
+	b.WriteByte(0xC010, 0x12)
+	b.WriteByte(0xC100, 0x34)
+	b.WriteWord(0xC0FF, 0xBEEF)
+	assert.Equal(t, byte(0x12), b.ReadByte(0xC010))
+	b.WriteByte(0xFF80, 0x56)
+	assert.Equal(t, byte(0x56), b.ReadByte(0xFF80))
+	// 同じページでも範囲外は呼ばれない
+	b.ReadByte(0xFF81)
+	// Peekはフックを呼ばない
+	assert.Equal(t, byte(0x56), b.Peek(0xFF80))
+
+	assert.Equal(t, []Event{
+		{Access: Write, Addr: 0xC010, Value: 0x11, Bank: -1},
+		{Access: Write, Addr: 0xC010, Value: 0x12, Old: 0x11, Bank: -1},
+		{Access: Write, Addr: 0xC0FF, Value: 0xEF, Bank: -1},
+		{Access: Write, Addr: 0xFF80, Value: 0x56, Bank: -1},
+		{Access: Read, Addr: 0xFF80, Value: 0x56, Bank: -1},
+	}, events)
+}
+
+func TestHookValue(t *testing.T) {
+	b, _, _ := setup()
+	n := 0
+	h := NewHook(Write, 0xC000, 0xDFFF, func(Event) { n++ })
+	h.SetValue(0xFF)
+	b.AddHook(h)
+	b.WriteByte(0xC000, 0x00)
+	b.WriteByte(0xC001, 0xFF)
+	assert.Equal(t, 1, n)
+}
+
+func TestHookBank(t *testing.T) {
+	b, _, _ := setup()
+	buf := make([]byte, 0x10000)
+	// MBC1, 64KB
+	buf[0x0147] = 0x01
+	buf[0x0148] = 0x01
+	buf[0x8000] = 0x22
+	cart, err := cartridge.NewCartridge(buf)
+	assert.NoError(t, err)
+	b.cartridge = cart
+
+	events := []Event{}
+	h := NewHook(Read|Execute, 0x4000, 0x7FFF, func(e Event) { events = append(events, e) })
+	h.SetBank(2)
+	b.AddHook(h)
+	b.ReadByte(0x4000)
+	b.WriteByte(0x2000, 2)
+	b.ReadByte(0x4000)
+	b.Execute(0x4000)
+	b.Execute(0x0100)
+	assert.Equal(t, []Event{
+		{Access: Read, Addr: 0x4000, Value: 0x22, Bank: 2},
+		{Access: Execute, Addr: 0x4000, Value: 0x22, Bank: 2},
+	}, events)
+}
+
+func TestRemoveHook(t *testing.T) {
+	b, _, _ := setup()
+	n := 0
+	var h *Hook
+	// 自分を外すフック
+	h = NewHook(Write, 0xC000, 0xC000, func(Event) {
+		n++
+		b.RemoveHook(h)
+	})
+	b.AddHook(h)
+	b.WriteByte(0xC000, 1)
+	b.WriteByte(0xC000, 2)
+	assert.Equal(t, 1, n)
+	assert.Nil(t, b.reads)
+	assert.Nil(t, b.writes)
+	assert.Nil(t, b.execs)
+}
+
+func TestHookReadsInHook(t *testing.T) {
+	b, _, _ := setup()
+	b.WriteByte(0xC001, 0x99)
+	got := byte(0)
+	b.AddHook(NewHook(Write, 0xC000, 0xC000, func(e Event) {
+		// フックの中のアクセスもほかのフックに見える
+		got = b.ReadByte(e.Addr + 1)
+	}))
+	reads := 0
+	b.AddHook(NewHook(Read, 0xC001, 0xC001, func(Event) { reads++ }))
+	b.WriteByte(0xC000, 1)
+	assert.Equal(t, byte(0x99), got)
+	assert.Equal(t, 1, reads)
+	assert.Equal(t, byte(1), b.ReadByte(types.Word(0xC000)))
+}
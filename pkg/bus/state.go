@@ -0,0 +1,64 @@
+package bus
+
+import (
+	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/pad"
+)
+
+// State is the state of the memories behind the bus saved by Snapshot.
+// GPU, timer, APU and irq are saved by themselves.
+type State struct {
+	bootmode bool
+	sb       byte
+	sc       byte
+	vRAM     []byte
+	wRAM     []byte
+	hRAM     []byte
+	oamRAM   []byte
+	cart     cartridge.State
+	pad      pad.State
+}
+
+// Snapshot saves the RAMs, the cartridge, the joypad, the serial registers and whether the boot ROM is mapped.
+func (b *Bus) Snapshot() State {
+	return State{
+		bootmode: b.bootmode,
+		sb:       b.sb,
+		sc:       b.sc,
+		vRAM:     b.vRAM.Snapshot(),
+		wRAM:     b.wRAM.Snapshot(),
+		hRAM:     b.hRAM.Snapshot(),
+		oamRAM:   b.oamRAM.Snapshot(),
+		cart:     b.cartridge.Snapshot(),
+		pad:      b.pad.Snapshot(),
+	}
+}
+
+// Restore puts the memories back into the saved state. The hooks are kept.
+func (b *Bus) Restore(s State) {
+	b.bootmode = s.bootmode
+	b.sb, b.sc = s.sb, s.sc
+	b.vRAM.Restore(s.vRAM)
+	b.wRAM.Restore(s.wRAM)
+	b.hRAM.Restore(s.hRAM)
+	b.oamRAM.Restore(s.oamRAM)
+	b.cartridge.Restore(s.cart)
+	b.pad.Restore(s.pad)
+}
+
+// SetReplay mutes the hooks, the sound recorder and the serial output while the machine replays the steps after a rewind.
+// They have seen the accesses when the steps were run first.
+func (b *Bus) SetReplay(replay bool) {
+	b.replay = replay
+	b.updateHooks()
+}
+
+// Buttons returns the buttons pressed on the joypad.
+func (b *Bus) Buttons() pad.Button {
+	return b.pad.Buttons()
+}
+
+// SetButtons presses the buttons on the joypad and releases the others.
+func (b *Bus) SetButtons(buttons pad.Button) {
+	b.pad.SetButtons(buttons)
+}
@@ -119,3 +119,24 @@ func (c *Cartridge) ReadByte(addr types.Word) byte {
 func (c *Cartridge) WriteByte(addr types.Word, data byte) {
 	c.mbc.Write(addr, data)
 }
+
+// ROMBank returns the ROM bank mapped at 4000-7FFF
+func (c *Cartridge) ROMBank() int {
+	return c.mbc.ROMBank()
+}
+
+// State is the state of the MBC and the cartridge RAM saved by Snapshot.
+type State struct {
+	mbc MBC
+}
+
+// Snapshot saves the state of the MBC and the cartridge RAM.
+func (c *Cartridge) Snapshot() State {
+	return State{mbc: c.mbc.clone()}
+}
+
+// Restore puts the MBC and the cartridge RAM back into the saved state.
+func (c *Cartridge) Restore(s State) {
+	// 同じスナップショットから何度も戻せるように複製する
+	c.mbc = s.mbc.clone()
+}
@@ -9,6 +9,10 @@ import (
 type MBC interface {
 	Write(addr types.Word, value byte)
 	Read(addr types.Word) byte
+	// ROMBank returns the bank mapped at 4000-7FFF
+	ROMBank() int
 	switchROMBank(bank int)
 	switchRAMBank(bank int)
+	// clone returns a copy of the state. ROM is shared.
+	clone() MBC
 }
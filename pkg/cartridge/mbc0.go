@@ -25,6 +25,10 @@ func (m *MBC0) Read(addr types.Word) byte {
 	return m.rom.Read(addr)
 }
 
+func (m *MBC0) ROMBank() int {
+	return 1
+}
+
 func (m *MBC0) switchROMBank(bank int) {
 	// ROM bankは1つなので
 	// nop
@@ -34,3 +38,8 @@ func (m *MBC0) switchRAMBank(bank int) {
 	// ROM bankは1つなので
 	// nop
 }
+
+func (m *MBC0) clone() MBC {
+	c := *m
+	return &c
+}
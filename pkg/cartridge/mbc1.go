@@ -110,15 +110,23 @@ func (m *MBC1) Read(addr types.Word) byte {
 		if m.hasRAM && m.ramEnabled {
 			switch m.memoryMode {
 			case ROM4mRAM32kMode:
-				m.ram.Read(types.Word((int(addr) + m.selectedRAMBank*0x2000) - 0xA000))
+				return m.ram.Read(types.Word((int(addr) + m.selectedRAMBank*0x2000) - 0xA000))
 			case ROM16mRAM8kMode:
-				m.ram.Read(types.Word((int(addr)) - 0xA000))
+				return m.ram.Read(types.Word((int(addr)) - 0xA000))
 			}
 		}
 	}
 	return 0x00
 }
 
+// ROMBank returns the bank mapped at 4000-7FFF. Bank 0 is read as bank 1.
+func (m *MBC1) ROMBank() int {
+	if m.selectedROMBank == 0 {
+		return 1
+	}
+	return m.selectedROMBank
+}
+
 func (m *MBC1) switchROMBank(bank int) {
 	m.selectedROMBank = bank
 }
@@ -126,3 +134,13 @@ func (m *MBC1) switchROMBank(bank int) {
 func (m *MBC1) switchRAMBank(bank int) {
 	m.selectedRAMBank = bank
 }
+
+func (m *MBC1) clone() MBC {
+	c := *m
+	if m.ram != nil {
+		data := m.ram.Snapshot()
+		c.ram = ram.NewRAM(len(data))
+		c.ram.Restore(data)
+	}
+	return &c
+}
@@ -0,0 +1,152 @@
+package cdl
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/interfaces/cdl"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+const (
+	bankSize            = 0x4000
+	oamStart types.Word = 0xFE00
+	oamEnd   types.Word = 0xFE9F
+)
+
+// Machine tells the copies by OAM DMA. gb.GB implements it.
+type Machine interface {
+	OAMDMA() bool
+	OAMDMASource() types.Word
+}
+
+// Coverage is the code/data log of the ROM. It has a byte of the usage flags for each ROM byte, in the order of the ROM file.
+// The file is the flags as they are, so the logs of the sessions are merged by OR.
+type Coverage struct {
+	flags []cdl.Usage
+}
+
+// New constructs an empty log of the ROM of the size.
+func New(romSize int) *Coverage {
+	return &Coverage{flags: make([]cdl.Usage, romSize)}
+}
+
+// Load reads the log written by Write. The size has to be the ROM size.
+func Load(r io.Reader, romSize int) (*Coverage, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != romSize {
+		return nil, fmt.Errorf("CDL size %d bytes does not match the ROM size %d bytes", len(buf), romSize)
+	}
+	c := New(romSize)
+	for i, b := range buf {
+		c.flags[i] = cdl.Usage(b)
+	}
+	return c, nil
+}
+
+// LoadFile reads the log file. It returns an empty log if the file does not exist.
+func LoadFile(path string, romSize int) (*Coverage, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return New(romSize), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f, romSize)
+}
+
+// Write writes the flags of each ROM byte.
+func (c *Coverage) Write(w io.Writer) error {
+	buf := make([]byte, len(c.flags))
+	for i, u := range c.flags {
+		buf[i] = byte(u)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// Merge adds the usage recorded in the other log of the same ROM.
+func (c *Coverage) Merge(o *Coverage) error {
+	if len(o.flags) != len(c.flags) {
+		return fmt.Errorf("CDL size %d bytes does not match %d bytes", len(o.flags), len(c.flags))
+	}
+	for i, u := range o.flags {
+		c.flags[i] |= u
+	}
+	return nil
+}
+
+// Attach records the ROM bytes copied by OAM DMA. The reads by CPU are given by cpu.SetCDL.
+// DMA does not fire the read hooks, so the copies are caught as the writes to OAM.
+func (c *Coverage) Attach(b *bus.Bus, m Machine) {
+	b.AddHook(bus.NewHook(bus.Write, oamStart, oamEnd, func(e bus.Event) {
+		if m.OAMDMA() {
+			src := m.OAMDMASource() + e.Addr - oamStart
+			c.Log(src, b.ROMBank(src), cdl.DMA)
+		}
+	}))
+}
+
+// Log records the usage of the byte at addr in the bank. The reads outside the ROM are ignored.
+func (c *Coverage) Log(addr types.Word, bank int, u cdl.Usage) {
+	if off := offset(addr, bank); off >= 0 && off < len(c.flags) {
+		c.flags[off] |= u
+	}
+}
+
+// offset returns the ROM offset of the address in the bank, or -1 if it is not in the ROM.
+func offset(addr types.Word, bank int) int {
+	switch {
+	case bank < 0 || addr >= 2*bankSize:
+		return -1
+	case addr < bankSize:
+		return int(addr)
+	}
+	return bank*bankSize + int(addr) - bankSize
+}
+
+// Usage returns the usage of the byte at the ROM offset.
+func (c *Coverage) Usage(offset int) cdl.Usage {
+	return c.flags[offset]
+}
+
+// Executed reports whether the byte at the ROM offset was executed as an opcode.
+func (c *Coverage) Executed(offset int) bool {
+	return c.flags[offset]&cdl.Opcode != 0
+}
+
+// Len returns the ROM size.
+func (c *Coverage) Len() int {
+	return len(c.flags)
+}
+
+// Summary counts the bytes by the usage, e.g. "opcode 1024, operand 812, data 4096, DMA 160, unused 26636 of 32768 bytes".
+// A byte used in several ways is counted in each.
+func (c *Coverage) Summary() string {
+	var opcode, operand, data, dma, unused int
+	for _, u := range c.flags {
+		if u&cdl.Opcode != 0 {
+			opcode++
+		}
+		if u&cdl.Operand != 0 {
+			operand++
+		}
+		if u&cdl.Data != 0 {
+			data++
+		}
+		if u&cdl.DMA != 0 {
+			dma++
+		}
+		if u == 0 {
+			unused++
+		}
+	}
+	return fmt.Sprintf("opcode %d, operand %d, data %d, DMA %d, unused %d of %d bytes", opcode, operand, data, dma, unused, len(c.flags))
+}
@@ -0,0 +1,115 @@
+package cdl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/gb"
+	"github.com/kijimaD/goboy/pkg/gpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/cdl"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/pad"
+	"github.com/kijimaD/goboy/pkg/ram"
+	"github.com/kijimaD/goboy/pkg/timer"
+	"github.com/kijimaD/goboy/pkg/window/headless"
+	"github.com/stretchr/testify/assert"
+)
+
+const program = `
+	LD A,2         ; $0100
+	LD ($2000),A   ; $0102
+	LD A,($4010)   ; $0105
+	CALL $4000     ; $0108
+	LD A,$03       ; $010B
+	LDH ($FF46),A  ; $010D
+loop:
+	JR loop        ; $010F
+`
+
+// run runs the program on MBC1 with 4 banks. Bank 2 has a subroutine at 0x4000.
+func run(t *testing.T, steps int) *Coverage {
+	rom := make([]byte, 4*bankSize)
+	rom[0x0147] = 0x01
+	rom[0x0148] = 0x01
+	copy(rom[0x0100:], asm.MustAssemble(program, 0x0100))
+	copy(rom[2*bankSize:], asm.MustAssemble("INC A\nRET", 0x4000))
+	cart, err := cartridge.NewCartridge(rom)
+	assert.NoError(t, err)
+	l := logger.NewLogger(logger.LogLevel("Info"))
+	g := gpu.NewGPU()
+	tm := timer.NewTimer()
+	irq := interrupt.NewInterrupt()
+	b := bus.NewBus(l, cart, g, ram.NewRAM(0x2000), ram.NewRAM(0x2000), ram.NewRAM(0x80), ram.NewRAM(0xA0), tm, apu.NewAPU(), irq, pad.NewPad())
+	g.Init(b, irq)
+	c := cpu.NewCPU(l, b, irq)
+	emu := gb.NewGB(c, g, tm, apu.NewAPU(), irq, headless.New())
+	cov := New(len(rom))
+	c.SetCDL(cov)
+	cov.Attach(b, emu)
+	for i := 0; i < steps; i++ {
+		emu.Step()
+	}
+	return cov
+}
+
+func TestCoverage(t *testing.T) {
+	cov := run(t, 100)
+	for _, tt := range []struct {
+		offset int
+		usage  cdl.Usage
+	}{
+		{0x0100, cdl.Opcode},
+		{0x0101, cdl.Operand},
+		{0x0105, cdl.Opcode},
+		{0x0106, cdl.Operand},
+		{0x0107, cdl.Operand},
+		{0x010F, cdl.Opcode},
+		{0x0110, cdl.Operand},
+		{0x0111, 0},
+		// バンク2のコードとデータ
+		{2 * bankSize, cdl.Opcode},
+		{2*bankSize + 1, cdl.Opcode},
+		{2*bankSize + 0x10, cdl.Data},
+		{bankSize + 0x10, 0},
+		{0x0300, cdl.DMA},
+		{0x039F, cdl.DMA},
+		{0x03A0, 0},
+	} {
+		assert.Equal(t, tt.usage, cov.Usage(tt.offset), "offset 0x%04X", tt.offset)
+	}
+	assert.True(t, cov.Executed(0x0100))
+	assert.False(t, cov.Executed(0x0101))
+	assert.Equal(t, "opcode 9, operand 10, data 1, DMA 160, unused 65356 of 65536 bytes", cov.Summary())
+}
+
+func TestMerge(t *testing.T) {
+	cov := run(t, 100)
+	var buf bytes.Buffer
+	assert.NoError(t, cov.Write(&buf))
+	assert.Equal(t, cov.Len(), buf.Len())
+
+	loaded, err := Load(bytes.NewReader(buf.Bytes()), cov.Len())
+	assert.NoError(t, err)
+	assert.Equal(t, cov, loaded)
+
+	other := New(cov.Len())
+	other.Log(0x0100, 0, cdl.Data)
+	other.Log(0x4000, 3, cdl.Opcode)
+	// ROMの外とブートROMは無視する
+	other.Log(0xC000, -1, cdl.Data)
+	other.Log(0x0000, -1, cdl.Opcode)
+	assert.NoError(t, loaded.Merge(other))
+	assert.Equal(t, cdl.Opcode|cdl.Data, loaded.Usage(0x0100))
+	assert.Equal(t, cdl.Opcode, loaded.Usage(3*bankSize))
+	assert.Equal(t, cdl.Usage(0), loaded.Usage(0x0000))
+
+	assert.Error(t, loaded.Merge(New(0x8000)))
+	_, err = Load(bytes.NewReader(buf.Bytes()), 0x8000)
+	assert.Error(t, err)
+}
@@ -2,8 +2,15 @@ package cpu
 
 import (
 	"github.com/kijimaD/goboy/pkg/interfaces/bus"
+	"github.com/kijimaD/goboy/pkg/interfaces/cdl"
 	"github.com/kijimaD/goboy/pkg/interfaces/interrupt"
 	"github.com/kijimaD/goboy/pkg/interfaces/logger"
+	"github.com/kijimaD/goboy/pkg/interfaces/profiler"
+	"github.com/kijimaD/goboy/pkg/interfaces/speed"
+	"github.com/kijimaD/goboy/pkg/interfaces/ticker"
+	"github.com/kijimaD/goboy/pkg/interfaces/tracer"
+	"github.com/kijimaD/goboy/pkg/lockup"
+	"github.com/kijimaD/goboy/pkg/model"
 	"github.com/kijimaD/goboy/pkg/types"
 	"github.com/kijimaD/goboy/pkg/utils"
 )
@@ -39,86 +46,376 @@ const (
 
 // CPU is cpu state struct
 type CPU struct {
-	logger  logger.Logger
-	PC      types.Word
-	SP      types.Word
-	Regs    Registers
-	bus     bus.Accessor
-	irq     interrupt.Interrupt
-	stopped bool
-	halted  bool
+	logger   logger.Logger
+	PC       types.Word
+	SP       types.Word
+	Regs     Registers
+	bus      bus.Accessor
+	executor bus.Executor
+	irq      interrupt.Interrupt
+	ticker   ticker.Ticker
+	tracer   tracer.Tracer
+	profiler profiler.Profiler
+	speed    speed.Switcher
+	cdl      cdl.Logger
+	stopped  bool
+	halted   bool
+	// ime is interrupt master enable flag
+	ime bool
+	// eiDelay counts down the instructions until EI sets IME.
+	// IME is set after the instruction following EI.
+	eiDelay int
+	// haltBug is set when HALT is executed with IME=0 and a pending interrupt.
+	// The next opcode is read twice, because PC fails to increment.
+	haltBug bool
+	// lockup is set when an illegal opcode hangs CPU
+	lockup *lockup.Event
+	model  model.Model
+	// cycles is M-cycles spent in the current step
+	cycles Cycle
+	// polledIO is set when the current step reads an IO register
+	polledIO bool
+	// replay is set while the steps which have been run are run again.
+	// The tracer, the profiler and the code/data logger have seen them.
+	replay bool
 }
 
 type Cycle = uint
 
-// NewCPU is CPU constructor
+// joypadAddr is P1/JOYP register. STOP mode ends when its input lines go low.
+const joypadAddr types.Word = 0xFF00
+
+// ioBegin and ioEnd are the IO registers. They can change without CPU writing them, unlike HRAM and IE.
+const (
+	ioBegin types.Word = 0xFF00
+	ioEnd   types.Word = 0xFF7F
+)
+
+// postBootRegisters are the registers when the boot ROM jumps to 0x0100.
+// Software detects the hardware by A. For example, A=0x11 is CGB.
+// F of DMG and MGB depends on the header checksum. It is 0xB0 unless the checksum is 0.
+var postBootRegisters = map[model.Model]Registers{
+	model.DMG0: {A: 0x01, B: 0xFF, C: 0x13, D: 0x00, E: 0xC1, H: 0x84, L: 0x03, F: 0x00},
+	model.DMG:  {A: 0x01, B: 0x00, C: 0x13, D: 0x00, E: 0xD8, H: 0x01, L: 0x4D, F: 0xB0},
+	model.MGB:  {A: 0xFF, B: 0x00, C: 0x13, D: 0x00, E: 0xD8, H: 0x01, L: 0x4D, F: 0xB0},
+	model.SGB:  {A: 0x01, B: 0x00, C: 0x14, D: 0x00, E: 0x00, H: 0xC0, L: 0x60, F: 0x00},
+	model.CGB:  {A: 0x11, B: 0x00, C: 0x00, D: 0x00, E: 0x08, H: 0x00, L: 0x7C, F: 0x80},
+}
+
+// NewCPU is CPU constructor. It starts as DMG.
 func NewCPU(logger logger.Logger, bus bus.Accessor, irq interrupt.Interrupt) *CPU {
 	cpu := &CPU{
-		logger: logger,
-		PC:     0x100, // INFO: Skip
-		SP:     0xFFFE,
-		Regs: Registers{
-			A: 0x11,
-			B: 0x00,
-			C: 0x00,
-			D: 0xFF,
-			E: 0x56,
-			F: 0x80,
-			H: 0x00,
-			L: 0x0D,
-		},
-		bus:     bus,
-		irq:     irq,
-		stopped: false,
-		halted:  false,
+		logger:   logger,
+		bus:      bus,
+		executor: executorOf(bus),
+		irq:      irq,
+		stopped:  false,
+		halted:   false,
 	}
+	cpu.SetModel(model.DMG)
 	return cpu
 }
 
-func (cpu *CPU) fetch() byte {
+// executorOf returns the bus as an Executor. It is nil if the bus isn't.
+func executorOf(b bus.Accessor) bus.Executor {
+	e, _ := b.(bus.Executor)
+	return e
+}
+
+// SetModel puts CPU into the state the boot ROM of the model leaves it.
+func (cpu *CPU) SetModel(m model.Model) {
+	cpu.model = m
+	cpu.PC = 0x100 // ブートROMの終了後から始める。PowerOnで0x0000になる
+	cpu.SP = 0xFFFE
+	cpu.Regs = postBootRegisters[m]
+}
+
+// Model returns the hardware model.
+func (cpu *CPU) Model() model.Model {
+	return cpu.model
+}
+
+// PowerOn puts CPU into the state at power on, so that it runs the boot ROM from 0x0000.
+func (cpu *CPU) PowerOn() {
+	cpu.PC = 0x0000
+	cpu.SP = 0x0000
+	cpu.Regs = Registers{}
+	cpu.ime = false
+	cpu.eiDelay = 0
+	cpu.halted = false
+	cpu.stopped = false
+}
+
+// SetTicker sets the ticker that advances the rest of the system on each M-cycle.
+// Without a ticker, the CPU only counts the cycles.
+func (cpu *CPU) SetTicker(t ticker.Ticker) {
+	cpu.ticker = t
+}
+
+// SetTracer sets the tracer that receives the state before each instruction. nil disables it.
+func (cpu *CPU) SetTracer(t tracer.Tracer) {
+	cpu.tracer = t
+}
+
+// trace sends the state before the instruction at PC to the tracer.
+// It peeks the memory without ticking.
+func (cpu *CPU) trace() {
+	s := tracer.State{
+		A: cpu.Regs.A, F: cpu.Regs.F, B: cpu.Regs.B, C: cpu.Regs.C,
+		D: cpu.Regs.D, E: cpu.Regs.E, H: cpu.Regs.H, L: cpu.Regs.L,
+		SP: cpu.SP, PC: cpu.PC,
+	}
+	for i := range s.PCMem {
+		s.PCMem[i] = peek(cpu.bus, cpu.PC+types.Word(i))
+	}
+	cpu.tracer.Trace(s)
+}
+
+// NextStep tells what the next Step does: an instruction, an interrupt dispatch or nothing.
+func (cpu *CPU) NextStep() profiler.Kind {
+	switch {
+	case cpu.halted || cpu.stopped || cpu.lockup != nil:
+		return profiler.Idle
+	case cpu.ime && cpu.irq.HasIRQ():
+		return profiler.Interrupt
+	}
+	return profiler.Instruction
+}
+
+// SetProfiler sets the profiler that receives every step. nil disables it.
+func (cpu *CPU) SetProfiler(p profiler.Profiler) {
+	cpu.profiler = p
+}
+
+// SetSpeedSwitcher sets the CGB speed switch used by STOP. DMG has none.
+func (cpu *CPU) SetSpeedSwitcher(s speed.Switcher) {
+	cpu.speed = s
+}
+
+// State is the state of CPU saved by Snapshot.
+type State struct {
+	cpu CPU
+}
+
+// Snapshot saves the registers and the modes of CPU.
+func (cpu *CPU) Snapshot() State {
+	return State{cpu: *cpu}
+}
+
+// Restore puts CPU back into the saved state. The bus, the ticker, the tracer and the other collaborators are kept.
+func (cpu *CPU) Restore(s State) {
+	c := s.cpu
+	c.logger, c.bus, c.executor, c.irq = cpu.logger, cpu.bus, cpu.executor, cpu.irq
+	c.ticker, c.tracer, c.profiler, c.speed, c.cdl = cpu.ticker, cpu.tracer, cpu.profiler, cpu.speed, cpu.cdl
+	c.replay = cpu.replay
+	*cpu = c
+}
+
+// SetReplay mutes the tracer, the profiler and the code/data logger while the machine replays the steps after a rewind.
+func (cpu *CPU) SetReplay(replay bool) {
+	cpu.replay = replay
+}
+
+// SetCDL sets the code/data logger, which receives the reads of the ROM by CPU.
+func (cpu *CPU) SetCDL(l cdl.Logger) {
+	cpu.cdl = l
+}
+
+// logCDL passes the read to the code/data logger if it is in the ROM.
+func (cpu *CPU) logCDL(addr types.Word, u cdl.Usage) {
+	if addr < 0x8000 && !cpu.replay {
+		cpu.cdl.Log(addr, cpu.ROMBank(addr), u)
+	}
+}
+
+// Stopped reports whether CPU is in STOP mode.
+func (cpu *CPU) Stopped() bool {
+	return cpu.stopped
+}
+
+// Halted reports whether CPU is in HALT mode.
+func (cpu *CPU) Halted() bool {
+	return cpu.halted
+}
+
+// PolledIO reports whether the last step read an IO register.
+func (cpu *CPU) PolledIO() bool {
+	return cpu.polledIO
+}
+
+// IME reports whether interrupts are enabled, including the pending EI.
+func (cpu *CPU) IME() bool {
+	return cpu.ime || cpu.eiDelay > 0
+}
+
+// Lockup returns the illegal opcode that hung CPU. It returns nil while CPU is running.
+func (cpu *CPU) Lockup() *lockup.Event {
+	return cpu.lockup
+}
+
+// NewLockup makes the event that CPU got stuck at pc.
+func (cpu *CPU) NewLockup(kind lockup.Kind, pc types.Word) *lockup.Event {
+	return &lockup.Event{Kind: kind, PC: pc, Opcode: peek(cpu.bus, pc), Bank: cpu.ROMBank(pc)}
+}
+
+// ROMBank returns the ROM bank mapped at addr, or -1 if it is unknown.
+func (cpu *CPU) ROMBank(addr types.Word) int {
+	if b, ok := cpu.bus.(bus.Banker); ok {
+		return b.ROMBank(addr)
+	}
+	return -1
+}
+
+// tick advances the system by 1 M-cycle
+func (cpu *CPU) tick() {
+	cpu.cycles++
+	if cpu.ticker != nil {
+		cpu.ticker.Tick(1)
+	}
+}
+
+// peek reads a byte without the read hooks, if the bus has them. It is for the reads which are not the accesses by the instructions.
+func peek(b bus.Accessor, addr types.Word) byte {
+	if p, ok := b.(bus.Peeker); ok {
+		return p.Peek(addr)
+	}
+	return b.ReadByte(addr)
+}
+
+// read reads a byte from the bus. It takes 1 M-cycle.
+func (cpu *CPU) read(addr types.Word) byte {
+	if cpu.cdl != nil {
+		cpu.logCDL(addr, cdl.Data)
+	}
+	if addr >= ioBegin && addr <= ioEnd {
+		cpu.polledIO = true
+	}
+	cpu.tick()
+	return cpu.bus.ReadByte(addr)
+}
+
+// write writes a byte to the bus. It takes 1 M-cycle.
+func (cpu *CPU) write(addr types.Word, data byte) {
+	cpu.tick()
+	cpu.bus.WriteByte(addr, data)
+}
+
+// internal is a M-cycle without memory access.
+func (cpu *CPU) internal() {
+	cpu.tick()
+}
+
+// fetch reads the byte of the instruction at PC. u tells the code/data logger which part of the instruction it is.
+func (cpu *CPU) fetch(u cdl.Usage) byte {
+	if cpu.cdl != nil {
+		cpu.logCDL(cpu.PC, u)
+	}
+	cpu.tick()
 	d := cpu.bus.ReadByte(cpu.PC) // プログラムカウンタが指している場所のROMから命令を読み込む
-	cpu.PC++                      // 次の命令を読み込めるように値を更新
+	if cpu.haltBug {
+		// HALTバグ: PCが進まない
+		cpu.haltBug = false
+		return d
+	}
+	cpu.PC++ // 次の命令を読み込めるように値を更新
 	return d
 }
 
-// Step execute an instruction
+// Step execute an instruction and returns the spent M-cycles.
+// The peripherals are advanced through the ticker during the instruction.
 func (cpu *CPU) Step() Cycle {
+	if cpu.profiler == nil || cpu.replay {
+		return cpu.step()
+	}
+	s := profiler.Sample{Kind: cpu.NextStep(), PC: cpu.PC, Bank: cpu.ROMBank(cpu.PC)}
+	if s.Kind == profiler.Instruction {
+		// Stepの前にメモリを覗くだけなので、tickしない
+		s.Opcode = uint16(peek(cpu.bus, cpu.PC))
+		if s.Opcode == 0xCB {
+			s.Opcode = 0xCB00 | uint16(peek(cpu.bus, cpu.PC+1))
+		}
+	}
+	s.Cycles = cpu.step()
+	s.NextPC, s.NextBank, s.SP = cpu.PC, cpu.ROMBank(cpu.PC), cpu.SP
+	cpu.profiler.Profile(s)
+	return s.Cycles
+}
+
+func (cpu *CPU) step() Cycle {
+	cpu.cycles = 0
+	cpu.polledIO = false
+	if cpu.stopped {
+		// STOP中はクロックが止まる。P10-P13のいずれかがLowになると復帰する
+		if peek(cpu.bus, joypadAddr)&0x0F != 0x0F {
+			cpu.stopped = false
+		}
+		return 0
+	}
+	if cpu.lockup != nil {
+		// 未定義命令でハングしたCPUは割り込みも受け付けない。クロックだけが進む
+		cpu.internal()
+		return cpu.cycles
+	}
 	// 割り込み
 	if cpu.halted {
 		if cpu.irq.HasIRQ() {
 			cpu.halted = false
 		}
-		return 0x01
+		cpu.internal()
+		return cpu.cycles
 	}
-	if hasIRQ := cpu.resolveIRQ(); hasIRQ {
-		return 0x01
+	if cpu.ime && cpu.irq.HasIRQ() {
+		cpu.dispatchIRQ()
+		return cpu.cycles
 	}
 
+	if cpu.tracer != nil && !cpu.replay {
+		cpu.trace()
+	}
+	if cpu.executor != nil {
+		cpu.executor.Execute(cpu.PC)
+	}
 	// オペコードとオペランド取得・実行
-	opcode := cpu.fetch()
+	pc := cpu.PC
+	opcode := cpu.fetch(cdl.Opcode)
 	var inst *inst
 	// CBプレフィックスは、CB命令が続くことを示す特殊なオペコードであり、これに続く1バイトのオペコードが実際の操作を指定するために用いられる
 	if opcode == 0xCB {
-		next := cpu.fetch()
+		next := cpu.fetch(cdl.Opcode)
 		inst = cbPrefixedInstructions[next]
 	} else {
 		inst = instructions[opcode]
 	}
+	if inst == EMPTY {
+		cpu.lockup = cpu.NewLockup(lockup.IllegalOpcode, pc)
+		return cpu.cycles
+	}
 
 	operands := cpu.fetchOperands(inst.OperandsSize)
 	inst.Execute(cpu, operands)
-	return inst.Cycles
+	// メモリアクセスのない内部サイクルを埋める
+	// 条件分岐で分岐した場合は、Execute内で追加のサイクルを消費している
+	for cpu.cycles < inst.Cycles {
+		cpu.internal()
+	}
+	if cpu.eiDelay > 0 {
+		cpu.eiDelay--
+		if cpu.eiDelay == 0 {
+			cpu.ime = true
+		}
+	}
+	return cpu.cycles
 }
 
 func (cpu *CPU) fetchOperands(size uint) []byte {
 	operands := []byte{}
 	switch size {
 	case 1:
-		operands = append(operands, cpu.fetch())
+		operands = append(operands, cpu.fetch(cdl.Operand))
 		// オペランドをフェッチして追加
 	case 2:
-		operands = append(operands, cpu.fetch())
-		operands = append(operands, cpu.fetch())
+		operands = append(operands, cpu.fetch(cdl.Operand))
+		operands = append(operands, cpu.fetch(cdl.Operand))
 		// オペランドのサイズ分進む
 	}
 	return operands
@@ -126,14 +423,16 @@ func (cpu *CPU) fetchOperands(size uint) []byte {
 
 // 命令
 type inst struct {
-	Opcode       byte
+	Opcode byte
+	// Description is the mnemonic. The operands are written as placeholders.
+	// n is 8bit immediate, nn is 16bit immediate and e is signed 8bit offset.
 	Description  string
 	OperandsSize uint
 	Cycles       uint
 	Execute      func(cpu *CPU, operands []byte)
 }
 
-// EMPTY is empty instruction
+// EMPTY is the undefined opcode. Fetching it locks up CPU.
 var EMPTY = &inst{0xFF, "EMPTY", 0, 1, func(cpu *CPU, operands []byte) {
 }}
 
@@ -413,15 +712,15 @@ var instructions = []*inst{
 	&inst{0xD, "DEC C", 0, 1, func(cpu *CPU, operands []byte) { cpu.dec_n(&cpu.Regs.C) }},
 	&inst{0xE, "LD C,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.ldnn_n(&cpu.Regs.C, operands) }},
 	&inst{0xF, "RRCA", 0, 1, func(cpu *CPU, operands []byte) { cpu.rrca() }},
-	&inst{0x10, "STOP", 1, 0, func(cpu *CPU, operands []byte) { cpu.stop() }},
-	&inst{0x11, "LD DE,(nn)", 2, 3, func(cpu *CPU, operands []byte) { cpu.ldn_nn(&cpu.Regs.D, &cpu.Regs.E, operands) }},
+	&inst{0x10, "STOP", 1, 1, func(cpu *CPU, operands []byte) { cpu.stop() }},
+	&inst{0x11, "LD DE,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.ldn_nn(&cpu.Regs.D, &cpu.Regs.E, operands) }},
 	&inst{0x12, "LD (DE),A", 0, 2, func(cpu *CPU, operands []byte) { cpu.ldrr_r(cpu.Regs.D, cpu.Regs.E, cpu.Regs.A) }},
 	&inst{0x13, "INC DE", 0, 2, func(cpu *CPU, operands []byte) { cpu.inc_nn(&cpu.Regs.D, &cpu.Regs.E) }},
 	&inst{0x14, "INC D", 0, 1, func(cpu *CPU, operands []byte) { cpu.inc_n(&cpu.Regs.D) }},
 	&inst{0x15, "DEC D", 0, 1, func(cpu *CPU, operands []byte) { cpu.dec_n(&cpu.Regs.D) }},
 	&inst{0x16, "LD D,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.ldnn_n(&cpu.Regs.D, operands) }},
 	&inst{0x17, "RLA", 0, 1, func(cpu *CPU, operands []byte) { cpu.rla() }},
-	&inst{0x18, "JR n", 1, 3, func(cpu *CPU, operands []byte) { cpu.jr_n(operands) }},
+	&inst{0x18, "JR e", 1, 3, func(cpu *CPU, operands []byte) { cpu.jr_n(operands) }},
 	&inst{0x19, "ADD HL,DE", 0, 2, func(cpu *CPU, operands []byte) { cpu.addhl_rr(&cpu.Regs.D, &cpu.Regs.E) }},
 	&inst{0x1A, "LD A,(DE)", 0, 2, func(cpu *CPU, operands []byte) { cpu.ldr_rr(cpu.Regs.D, cpu.Regs.E, &cpu.Regs.A) }},
 	&inst{0x1B, "DEC DE", 0, 2, func(cpu *CPU, operands []byte) { cpu.dec_nn(&cpu.Regs.D, &cpu.Regs.E) }},
@@ -429,7 +728,7 @@ var instructions = []*inst{
 	&inst{0x1D, "DEC E", 0, 1, func(cpu *CPU, operands []byte) { cpu.dec_n(&cpu.Regs.E) }},
 	&inst{0x1E, "LD E,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.ldnn_n(&cpu.Regs.E, operands) }},
 	&inst{0x1F, "RRA", 0, 1, func(cpu *CPU, operands []byte) { cpu.rra() }},
-	&inst{0x20, "JR NZ,*", 1, 2, func(cpu *CPU, operands []byte) { cpu.jrcc_n(Z, false, operands) }},
+	&inst{0x20, "JR NZ,e", 1, 2, func(cpu *CPU, operands []byte) { cpu.jrcc_n(Z, false, operands) }},
 	&inst{0x21, "LD HL,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.ldn_nn(&cpu.Regs.H, &cpu.Regs.L, operands) }},
 	&inst{0x22, "LD (HL+),A", 0, 2, func(cpu *CPU, operands []byte) { cpu.ldihl_a() }},
 	&inst{0x23, "INC HL", 0, 2, func(cpu *CPU, operands []byte) { cpu.inc_nn(&cpu.Regs.H, &cpu.Regs.L) }},
@@ -437,15 +736,15 @@ var instructions = []*inst{
 	&inst{0x25, "DEC H", 0, 1, func(cpu *CPU, operands []byte) { cpu.dec_n(&cpu.Regs.H) }},
 	&inst{0x26, "LD H,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.ldnn_n(&cpu.Regs.H, operands) }},
 	&inst{0x27, "DAA", 0, 1, func(cpu *CPU, operands []byte) { cpu.daa() }},
-	&inst{0x28, "JR Z,*", 1, 2, func(cpu *CPU, operands []byte) { cpu.jrcc_n(Z, true, operands) }},
+	&inst{0x28, "JR Z,e", 1, 2, func(cpu *CPU, operands []byte) { cpu.jrcc_n(Z, true, operands) }},
 	&inst{0x29, "ADD HL,HL", 0, 2, func(cpu *CPU, operands []byte) { cpu.addhl_rr(&cpu.Regs.H, &cpu.Regs.L) }},
-	&inst{0x2A, "LDI A,(HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.ldia_hl() }},
+	&inst{0x2A, "LD A,(HL+)", 0, 2, func(cpu *CPU, operands []byte) { cpu.ldia_hl() }},
 	&inst{0x2B, "DEC HL", 0, 2, func(cpu *CPU, operands []byte) { cpu.dec_nn(&cpu.Regs.H, &cpu.Regs.L) }},
 	&inst{0x2C, "INC L", 0, 1, func(cpu *CPU, operands []byte) { cpu.inc_n(&cpu.Regs.L) }},
 	&inst{0x2D, "DEC L", 0, 1, func(cpu *CPU, operands []byte) { cpu.dec_n(&cpu.Regs.L) }},
 	&inst{0x2E, "LD L,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.ldnn_n(&cpu.Regs.L, operands) }},
 	&inst{0x2F, "CPL", 0, 1, func(cpu *CPU, operands []byte) { cpu.cpl() }},
-	&inst{0x30, "JR NC,*", 1, 2, func(cpu *CPU, operands []byte) { cpu.jrcc_n(C, false, operands) }},
+	&inst{0x30, "JR NC,e", 1, 2, func(cpu *CPU, operands []byte) { cpu.jrcc_n(C, false, operands) }},
 	&inst{0x31, "LD SP,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.ldsp_nn(operands) }},
 	&inst{0x32, "LD (HL-),A", 0, 2, func(cpu *CPU, operands []byte) { cpu.lddhl_a() }},
 	&inst{0x33, "INC SP", 0, 2, func(cpu *CPU, operands []byte) { cpu.inc_sp() }},
@@ -453,13 +752,13 @@ var instructions = []*inst{
 	&inst{0x35, "DEC (HL)", 0, 3, func(cpu *CPU, operands []byte) { cpu.dec_hl() }},
 	&inst{0x36, "LD (HL),n", 1, 3, func(cpu *CPU, operands []byte) { cpu.ldhl_n(operands) }},
 	&inst{0x37, "SCF", 0, 1, func(cpu *CPU, operands []byte) { cpu.scf() }},
-	&inst{0x38, "JR C,*", 1, 2, func(cpu *CPU, operands []byte) { cpu.jrcc_n(C, true, operands) }},
+	&inst{0x38, "JR C,e", 1, 2, func(cpu *CPU, operands []byte) { cpu.jrcc_n(C, true, operands) }},
 	&inst{0x39, "ADD HL,SP", 0, 2, func(cpu *CPU, operands []byte) { cpu.addhl_sp() }},
 	&inst{0x3A, "LD A,(HL-)", 0, 2, func(cpu *CPU, operands []byte) { cpu.ldda_hl() }},
 	&inst{0x3B, "DEC SP", 0, 2, func(cpu *CPU, operands []byte) { cpu.dec_sp() }},
 	&inst{0x3C, "INC A", 0, 1, func(cpu *CPU, operands []byte) { cpu.inc_n(&cpu.Regs.A) }},
 	&inst{0x3D, "DEC A", 0, 1, func(cpu *CPU, operands []byte) { cpu.dec_r(&cpu.Regs.A) }},
-	&inst{0x3E, "LD A,#", 1, 2, func(cpu *CPU, operands []byte) { cpu.lda_n(operands) }},
+	&inst{0x3E, "LD A,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.lda_n(operands) }},
 	&inst{0x3F, "CCF", 0, 1, func(cpu *CPU, operands []byte) { cpu.ccf() }},
 	&inst{0x40, "LD B,B", 0, 1, func(cpu *CPU, operands []byte) { cpu.ldrr(&cpu.Regs.B, &cpu.Regs.B) }},
 	&inst{0x41, "LD B,C", 0, 1, func(cpu *CPU, operands []byte) { cpu.ldrr(&cpu.Regs.B, &cpu.Regs.C) }},
@@ -531,7 +830,7 @@ var instructions = []*inst{
 	&inst{0x83, "ADD A,E", 0, 1, func(cpu *CPU, operands []byte) { cpu.adda_n(cpu.Regs.E) }},
 	&inst{0x84, "ADD A,H", 0, 1, func(cpu *CPU, operands []byte) { cpu.adda_n(cpu.Regs.H) }},
 	&inst{0x85, "ADD A,L", 0, 1, func(cpu *CPU, operands []byte) { cpu.adda_n(cpu.Regs.L) }},
-	&inst{0x86, "ADD A,(HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.adda_n(cpu.bus.ReadByte(cpu.getHL())) }},
+	&inst{0x86, "ADD A,(HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.adda_n(cpu.read(cpu.getHL())) }},
 	&inst{0x87, "ADD A,A", 0, 1, func(cpu *CPU, operands []byte) { cpu.adda_n(cpu.Regs.A) }},
 	&inst{0x88, "ADC A,B", 0, 1, func(cpu *CPU, operands []byte) { cpu.adca_n(cpu.Regs.B) }},
 	&inst{0x89, "ADC A,C", 0, 1, func(cpu *CPU, operands []byte) { cpu.adca_n(cpu.Regs.C) }},
@@ -539,7 +838,7 @@ var instructions = []*inst{
 	&inst{0x8B, "ADC A,E", 0, 1, func(cpu *CPU, operands []byte) { cpu.adca_n(cpu.Regs.E) }},
 	&inst{0x8C, "ADC A,H", 0, 1, func(cpu *CPU, operands []byte) { cpu.adca_n(cpu.Regs.H) }},
 	&inst{0x8D, "ADC A,L", 0, 1, func(cpu *CPU, operands []byte) { cpu.adca_n(cpu.Regs.L) }},
-	&inst{0x8E, "ADC A,(HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.adca_n(cpu.bus.ReadByte(cpu.getHL())) }},
+	&inst{0x8E, "ADC A,(HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.adca_n(cpu.read(cpu.getHL())) }},
 	&inst{0x8F, "ADC A,A", 0, 1, func(cpu *CPU, operands []byte) { cpu.adca_n(cpu.Regs.A) }},
 	&inst{0x90, "SUB B", 0, 1, func(cpu *CPU, operands []byte) { cpu.sub_n(cpu.Regs.B) }},
 	&inst{0x91, "SUB C", 0, 1, func(cpu *CPU, operands []byte) { cpu.sub_n(cpu.Regs.C) }},
@@ -547,7 +846,7 @@ var instructions = []*inst{
 	&inst{0x93, "SUB E", 0, 1, func(cpu *CPU, operands []byte) { cpu.sub_n(cpu.Regs.E) }},
 	&inst{0x94, "SUB H", 0, 1, func(cpu *CPU, operands []byte) { cpu.sub_n(cpu.Regs.H) }},
 	&inst{0x95, "SUB L", 0, 1, func(cpu *CPU, operands []byte) { cpu.sub_n(cpu.Regs.L) }},
-	&inst{0x96, "SUB (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.sub_n(cpu.bus.ReadByte(cpu.getHL())) }},
+	&inst{0x96, "SUB (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.sub_n(cpu.read(cpu.getHL())) }},
 	&inst{0x97, "SUB A", 0, 1, func(cpu *CPU, operands []byte) { cpu.sub_n(cpu.Regs.A) }},
 	&inst{0x98, "SBC A,B", 0, 1, func(cpu *CPU, operands []byte) { cpu.subca_n(cpu.Regs.B) }},
 	&inst{0x99, "SBC A,C", 0, 1, func(cpu *CPU, operands []byte) { cpu.subca_n(cpu.Regs.C) }},
@@ -555,7 +854,7 @@ var instructions = []*inst{
 	&inst{0x9B, "SBC A,E", 0, 1, func(cpu *CPU, operands []byte) { cpu.subca_n(cpu.Regs.E) }},
 	&inst{0x9C, "SBC A,H", 0, 1, func(cpu *CPU, operands []byte) { cpu.subca_n(cpu.Regs.H) }},
 	&inst{0x9D, "SBC A,L", 0, 1, func(cpu *CPU, operands []byte) { cpu.subca_n(cpu.Regs.L) }},
-	&inst{0x9E, "SBC A,(HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.subca_n(cpu.bus.ReadByte(cpu.getHL())) }},
+	&inst{0x9E, "SBC A,(HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.subca_n(cpu.read(cpu.getHL())) }},
 	&inst{0x9F, "SBC A,A", 0, 1, func(cpu *CPU, operands []byte) { cpu.subca_n(cpu.Regs.A) }},
 	&inst{0xA0, "AND B", 0, 1, func(cpu *CPU, operands []byte) { cpu.and_n(cpu.Regs.B) }},
 	&inst{0xA1, "AND C", 0, 1, func(cpu *CPU, operands []byte) { cpu.and_n(cpu.Regs.C) }},
@@ -563,7 +862,7 @@ var instructions = []*inst{
 	&inst{0xA3, "AND E", 0, 1, func(cpu *CPU, operands []byte) { cpu.and_n(cpu.Regs.E) }},
 	&inst{0xA4, "AND H", 0, 1, func(cpu *CPU, operands []byte) { cpu.and_n(cpu.Regs.H) }},
 	&inst{0xA5, "AND L", 0, 1, func(cpu *CPU, operands []byte) { cpu.and_n(cpu.Regs.L) }},
-	&inst{0xA6, "AND (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.and_n(cpu.bus.ReadByte(cpu.getHL())) }},
+	&inst{0xA6, "AND (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.and_n(cpu.read(cpu.getHL())) }},
 	&inst{0xA7, "AND A", 0, 1, func(cpu *CPU, operands []byte) { cpu.and_n(cpu.Regs.A) }},
 	&inst{0xA8, "XOR B", 0, 1, func(cpu *CPU, operands []byte) { cpu.xor_n(cpu.Regs.B) }},
 	&inst{0xA9, "XOR C", 0, 1, func(cpu *CPU, operands []byte) { cpu.xor_n(cpu.Regs.C) }},
@@ -571,7 +870,7 @@ var instructions = []*inst{
 	&inst{0xAB, "XOR E", 0, 1, func(cpu *CPU, operands []byte) { cpu.xor_n(cpu.Regs.E) }},
 	&inst{0xAC, "XOR H", 0, 1, func(cpu *CPU, operands []byte) { cpu.xor_n(cpu.Regs.H) }},
 	&inst{0xAD, "XOR L", 0, 1, func(cpu *CPU, operands []byte) { cpu.xor_n(cpu.Regs.L) }},
-	&inst{0xAE, "XOR (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.xor_n(cpu.bus.ReadByte(cpu.getHL())) }},
+	&inst{0xAE, "XOR (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.xor_n(cpu.read(cpu.getHL())) }},
 	&inst{0xAF, "XOR A", 0, 1, func(cpu *CPU, operands []byte) { cpu.xor_n(cpu.Regs.A) }},
 	&inst{0xB0, "OR B", 0, 1, func(cpu *CPU, operands []byte) { cpu.or_n(cpu.Regs.B) }},
 	&inst{0xB1, "OR C", 0, 1, func(cpu *CPU, operands []byte) { cpu.or_n(cpu.Regs.C) }},
@@ -579,7 +878,7 @@ var instructions = []*inst{
 	&inst{0xB3, "OR E", 0, 1, func(cpu *CPU, operands []byte) { cpu.or_n(cpu.Regs.E) }},
 	&inst{0xB4, "OR H", 0, 1, func(cpu *CPU, operands []byte) { cpu.or_n(cpu.Regs.H) }},
 	&inst{0xB5, "OR L", 0, 1, func(cpu *CPU, operands []byte) { cpu.or_n(cpu.Regs.L) }},
-	&inst{0xB6, "OR (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.or_n(cpu.bus.ReadByte(cpu.getHL())) }},
+	&inst{0xB6, "OR (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.or_n(cpu.read(cpu.getHL())) }},
 	&inst{0xB7, "OR A", 0, 1, func(cpu *CPU, operands []byte) { cpu.or_n(cpu.Regs.A) }},
 	&inst{0xB8, "CP B", 0, 1, func(cpu *CPU, operands []byte) { cpu.cp_n(cpu.Regs.B) }},
 	&inst{0xB9, "CP C", 0, 1, func(cpu *CPU, operands []byte) { cpu.cp_n(cpu.Regs.C) }},
@@ -587,7 +886,7 @@ var instructions = []*inst{
 	&inst{0xBB, "CP E", 0, 1, func(cpu *CPU, operands []byte) { cpu.cp_n(cpu.Regs.E) }},
 	&inst{0xBC, "CP H", 0, 1, func(cpu *CPU, operands []byte) { cpu.cp_n(cpu.Regs.H) }},
 	&inst{0xBD, "CP L", 0, 1, func(cpu *CPU, operands []byte) { cpu.cp_n(cpu.Regs.L) }},
-	&inst{0xBE, "CP (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.cp_n(cpu.bus.ReadByte(cpu.getHL())) }},
+	&inst{0xBE, "CP (HL)", 0, 2, func(cpu *CPU, operands []byte) { cpu.cp_n(cpu.read(cpu.getHL())) }},
 	&inst{0xBF, "CP A", 0, 1, func(cpu *CPU, operands []byte) { cpu.cp_n(cpu.Regs.A) }},
 	&inst{0xC0, "RET NZ", 0, 2, func(cpu *CPU, operands []byte) { cpu.retcc(Z, false) }},
 	&inst{0xC1, "POP BC", 0, 3, func(cpu *CPU, operands []byte) { cpu.pop_nn(&cpu.Regs.B, &cpu.Regs.C) }},
@@ -595,32 +894,32 @@ var instructions = []*inst{
 	&inst{0xC3, "JP nn", 2, 4, func(cpu *CPU, operands []byte) { cpu.jp_nn(operands) }},
 	&inst{0xC4, "CALL NZ,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.callcc_nn(Z, false, operands) }},
 	&inst{0xC5, "PUSH BC", 0, 4, func(cpu *CPU, operands []byte) { cpu.push_nn(cpu.Regs.B, cpu.Regs.C) }},
-	&inst{0xC6, "ADD A,#", 1, 2, func(cpu *CPU, operands []byte) { cpu.adda_n(operands[0]) }},
-	&inst{0xC7, "RST n", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x00) }},
+	&inst{0xC6, "ADD A,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.adda_n(operands[0]) }},
+	&inst{0xC7, "RST $00", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x00) }},
 	&inst{0xC8, "RET Z", 0, 2, func(cpu *CPU, operands []byte) { cpu.retcc(Z, true) }},
 	&inst{0xC9, "RET", 0, 4, func(cpu *CPU, operands []byte) { cpu.ret() }},
 	&inst{0xCA, "JP Z,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.jpcc_nn(Z, true, operands) }},
 	EMPTY,
 	&inst{0xCC, "CALL Z,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.callcc_nn(Z, true, operands) }},
-	&inst{0xCD, "CALL nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.call_nn(operands) }},
-	&inst{0xCE, "ADC A,#", 1, 2, func(cpu *CPU, operands []byte) { cpu.adca_n(operands[0]) }},
-	&inst{0xCF, "RST n", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x08) }},
+	&inst{0xCD, "CALL nn", 2, 6, func(cpu *CPU, operands []byte) { cpu.call_nn(operands) }},
+	&inst{0xCE, "ADC A,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.adca_n(operands[0]) }},
+	&inst{0xCF, "RST $08", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x08) }},
 	&inst{0xD0, "RET NC", 0, 2, func(cpu *CPU, operands []byte) { cpu.retcc(C, false) }},
 	&inst{0xD1, "POP DE", 0, 3, func(cpu *CPU, operands []byte) { cpu.pop_nn(&cpu.Regs.D, &cpu.Regs.E) }},
-	&inst{0xD2, "JP NC,mm", 2, 3, func(cpu *CPU, operands []byte) { cpu.jpcc_nn(C, false, operands) }},
+	&inst{0xD2, "JP NC,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.jpcc_nn(C, false, operands) }},
 	EMPTY,
 	&inst{0xD4, "CALL NC,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.callcc_nn(C, false, operands) }},
 	&inst{0xD5, "PUSH DE", 0, 4, func(cpu *CPU, operands []byte) { cpu.push_nn(cpu.Regs.D, cpu.Regs.E) }},
 	&inst{0xD6, "SUB n", 1, 2, func(cpu *CPU, operands []byte) { cpu.sub_n(operands[0]) }},
-	&inst{0xD7, "RST n", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x10) }},
+	&inst{0xD7, "RST $10", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x10) }},
 	&inst{0xD8, "RET C", 0, 2, func(cpu *CPU, operands []byte) { cpu.retcc(C, true) }},
 	&inst{0xD9, "RETI", 0, 4, func(cpu *CPU, operands []byte) { cpu.ret_i() }},
 	&inst{0xDA, "JP C,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.jpcc_nn(C, true, operands) }},
 	EMPTY,
 	&inst{0xDC, "CALL C,nn", 2, 3, func(cpu *CPU, operands []byte) { cpu.callcc_nn(C, true, operands) }},
 	EMPTY,
-	&inst{0xDE, "SBC A,#", 1, 2, func(cpu *CPU, operands []byte) { cpu.subca_n(operands[0]) }},
-	&inst{0xDF, "RST n", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x18) }},
+	&inst{0xDE, "SBC A,n", 1, 2, func(cpu *CPU, operands []byte) { cpu.subca_n(operands[0]) }},
+	&inst{0xDF, "RST $18", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x18) }},
 	&inst{0xE0, "LDH (n),A", 1, 3, func(cpu *CPU, operands []byte) { cpu.ldhn_a(operands) }},
 	&inst{0xE1, "POP HL", 0, 3, func(cpu *CPU, operands []byte) { cpu.pop_nn(&cpu.Regs.H, &cpu.Regs.L) }},
 	&inst{0xE2, "LD (C),A", 0, 2, func(cpu *CPU, operands []byte) { cpu.ldc_a() }},
@@ -628,31 +927,31 @@ var instructions = []*inst{
 	EMPTY,
 	&inst{0xE5, "PUSH HL", 0, 4, func(cpu *CPU, operands []byte) { cpu.push_nn(cpu.Regs.H, cpu.Regs.L) }},
 	&inst{0xE6, "AND n", 1, 2, func(cpu *CPU, operands []byte) { cpu.and_n(operands[0]) }},
-	&inst{0xE7, "RST n", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x20) }},
-	&inst{0xE8, "ADD SP,n", 1, 4, func(cpu *CPU, operands []byte) { cpu.addsp_n(operands) }},
+	&inst{0xE7, "RST $20", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x20) }},
+	&inst{0xE8, "ADD SP,e", 1, 4, func(cpu *CPU, operands []byte) { cpu.addsp_n(operands) }},
 	&inst{0xE9, "JP (HL)", 0, 1, func(cpu *CPU, operands []byte) { cpu.jp_hl() }},
 	&inst{0xEA, "LD (nn),A", 2, 4, func(cpu *CPU, operands []byte) { cpu.ldnn_r(operands) }},
 	EMPTY,
 	EMPTY,
 	EMPTY,
 	&inst{0xEE, "XOR n", 1, 2, func(cpu *CPU, operands []byte) { cpu.xor_n(operands[0]) }},
-	&inst{0xEF, "RST n", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x28) }},
+	&inst{0xEF, "RST $28", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x28) }},
 	&inst{0xF0, "LDH A,(n)", 1, 3, func(cpu *CPU, operands []byte) { cpu.ldha_n(operands) }},
 	&inst{0xF1, "POP AF", 0, 3, func(cpu *CPU, operands []byte) { cpu.pop_af() }},
 	&inst{0xF2, "LD A,(C)", 0, 2, func(cpu *CPU, operands []byte) { cpu.lda_c() }},
 	&inst{0xF3, "DI", 0, 1, func(cpu *CPU, operands []byte) { cpu.di() }},
 	EMPTY,
 	&inst{0xF5, "PUSH AF", 0, 4, func(cpu *CPU, operands []byte) { cpu.push_nn(cpu.Regs.A, cpu.Regs.F) }},
-	&inst{0xF6, "OR #", 1, 2, func(cpu *CPU, operands []byte) { cpu.or_n(operands[0]) }},
-	&inst{0xF7, "RST n", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x30) }},
-	&inst{0xF8, "LD HL,SP+n", 1, 3, func(cpu *CPU, operands []byte) { cpu.ldhlsp_n(operands[0]) }},
+	&inst{0xF6, "OR n", 1, 2, func(cpu *CPU, operands []byte) { cpu.or_n(operands[0]) }},
+	&inst{0xF7, "RST $30", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x30) }},
+	&inst{0xF8, "LD HL,SP+e", 1, 3, func(cpu *CPU, operands []byte) { cpu.ldhlsp_n(operands[0]) }},
 	&inst{0xF9, "LD SP,HL", 0, 2, func(cpu *CPU, operands []byte) { cpu.ldsp_hl() }},
 	&inst{0xFA, "LD A,(nn)", 2, 4, func(cpu *CPU, operands []byte) { cpu.lda_nn(operands) }},
 	&inst{0xFB, "EI", 0, 1, func(cpu *CPU, operands []byte) { cpu.ei() }},
 	EMPTY,
 	EMPTY,
 	&inst{0xFE, "CP n", 1, 2, func(cpu *CPU, operands []byte) { cpu.cp_n(operands[0]) }},
-	&inst{0xFF, "RST n", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x38) }},
+	&inst{0xFF, "RST $38", 0, 4, func(cpu *CPU, operands []byte) { cpu.rst(0x38) }},
 }
 
 func (cpu *CPU) nop() {
@@ -687,7 +986,7 @@ func (cpu *CPU) ldn_nn(r1, r2 *types.Register, operands []byte) {
 
 func (cpu *CPU) ldrr_r(upper, lower, r byte) {
 	addr := utils.Bytes2Word(upper, lower)
-	cpu.bus.WriteByte(addr, r)
+	cpu.write(addr, r)
 }
 
 // INC nn
@@ -748,7 +1047,9 @@ func (cpu *CPU) rlca() {
 
 func (cpu *CPU) ldnn_sp(operands []byte) {
 	addr := utils.Bytes2Word(operands[1], operands[0])
-	cpu.bus.WriteWord(addr, cpu.SP)
+	upper, lower := utils.Word2Bytes(cpu.SP)
+	cpu.write(addr, lower)
+	cpu.write(addr+1, upper)
 }
 
 func (cpu *CPU) addhl_rr(r1, r2 *byte) {
@@ -769,7 +1070,7 @@ func (cpu *CPU) addhl_rr(r1, r2 *byte) {
 //	dest = A,B,C,D,E,H,L
 func (cpu *CPU) ldr_rr(r1 byte, r2 byte, dest *byte) {
 	addr := utils.Bytes2Word(r1, r2)
-	*dest = cpu.bus.ReadByte(addr)
+	*dest = cpu.read(addr)
 }
 
 // LD A,n
@@ -783,7 +1084,7 @@ func (cpu *CPU) ldr_rr(r1 byte, r2 byte, dest *byte) {
 //	nn = two byte immediate value. (LS byte first.)
 func (cpu *CPU) lda_nn(operands []byte) {
 	addr := utils.Bytes2Word(operands[1], operands[0])
-	cpu.Regs.A = cpu.bus.ReadByte(addr)
+	cpu.Regs.A = cpu.read(addr)
 }
 
 // DEC nn
@@ -828,7 +1129,12 @@ func (cpu *CPU) rrca() {
 // and screen until any button is pressed. The GB
 // and GBP screen goes white with a single dark
 // horizontal line. The GBC screen goes black.
+// On CGB with the speed switch armed, it switches the speed instead.
 func (cpu *CPU) stop() {
+	if cpu.speed != nil && cpu.speed.Armed() {
+		cpu.speed.Switch()
+		return
+	}
 	cpu.stopped = true
 }
 
@@ -930,6 +1236,7 @@ func (cpu *CPU) rra() {
 func (cpu *CPU) jrcc_n(flag flags, isSet bool, operands []byte) {
 	n := int8(operands[0])
 	if cpu.isSet(flag) == isSet {
+		cpu.internal()
 		if n != 0x00 {
 			if n < 0 {
 				cpu.PC -= types.Word(-n)
@@ -947,7 +1254,7 @@ func (cpu *CPU) jrcc_n(flag flags, isSet bool, operands []byte) {
 //	Same as: LD (HL),A - INC HL
 func (cpu *CPU) ldihl_a() {
 	hl := types.Word(utils.Bytes2Word(cpu.Regs.H, cpu.Regs.L))
-	cpu.bus.WriteByte(hl, cpu.Regs.A)
+	cpu.write(hl, cpu.Regs.A)
 	hl++
 	cpu.toHLRegs(hl)
 }
@@ -999,7 +1306,7 @@ func (cpu *CPU) daa() {
 //	Same as: LD A,(HL) - INC HL
 func (cpu *CPU) ldia_hl() {
 	hl := cpu.getHL()
-	cpu.Regs.A = cpu.bus.ReadByte(hl)
+	cpu.Regs.A = cpu.read(hl)
 	hl++
 	cpu.toHLRegs(hl)
 }
@@ -1039,7 +1346,7 @@ func (cpu *CPU) ldsp_nn(operands []byte) {
 //	Put A into memory address HL. Decrement HL.
 func (cpu *CPU) lddhl_a() {
 	hl := cpu.getHL()
-	cpu.bus.WriteByte(hl, cpu.Regs.A)
+	cpu.write(hl, cpu.Regs.A)
 	hl--
 	cpu.toHLRegs(hl)
 }
@@ -1069,9 +1376,9 @@ func (cpu *CPU) inc_sp() {
 //	C - Not affected.
 func (cpu *CPU) inc_hl() {
 	hl := cpu.getHL()
-	v := cpu.bus.ReadByte(hl)
+	v := cpu.read(hl)
 	result := cpu.inc(v)
-	cpu.bus.WriteByte(hl, result)
+	cpu.write(hl, result)
 }
 
 // DEC (HL)
@@ -1087,9 +1394,9 @@ func (cpu *CPU) inc_hl() {
 //	C - Not affected.
 func (cpu *CPU) dec_hl() {
 	hl := cpu.getHL()
-	v := cpu.bus.ReadByte(hl)
+	v := cpu.read(hl)
 	result := cpu.dec(v)
-	cpu.bus.WriteByte(hl, result)
+	cpu.write(hl, result)
 }
 
 // LD (HL),n
@@ -1097,7 +1404,7 @@ func (cpu *CPU) dec_hl() {
 // Put value operands[0] into (HL)
 func (cpu *CPU) ldhl_n(operands []byte) {
 	hl := cpu.getHL()
-	cpu.bus.WriteByte(hl, operands[0])
+	cpu.write(hl, operands[0])
 }
 
 // SCF
@@ -1142,7 +1449,7 @@ func (cpu *CPU) addhl_sp() {
 //	Same as: LD A,(HL) - DEC HL
 func (cpu *CPU) ldda_hl() {
 	hl := cpu.getHL()
-	cpu.Regs.A = cpu.bus.ReadByte(hl)
+	cpu.Regs.A = cpu.read(hl)
 	hl--
 	cpu.toHLRegs(hl)
 }
@@ -1249,7 +1556,15 @@ func (cpu *CPU) ldrr(r1 *types.Register, r2 *types.Register) {
 //
 //	Power down CPU until an interrupt occurs. Use this
 //	when ever possible to reduce energy consumption.
+//
+//	With IME=0 and a pending interrupt, HALT does not halt
+//	and the next opcode is read twice. (HALT bug)
 func (cpu *CPU) halt() {
+	// 直前のEIでIMEが立つなら、HALTバグは起きず割り込みが処理される
+	if !cpu.IME() && cpu.irq.HasIRQ() {
+		cpu.haltBug = true
+		return
+	}
 	cpu.halted = true
 }
 
@@ -1467,8 +1782,10 @@ func (cpu *CPU) cp_n(v byte) {
 //	cc = NC, Return if C flag is reset.
 //	cc = C, Return if C flag is set.
 func (cpu *CPU) retcc(flag flags, isSet bool) {
+	cpu.internal()
 	if cpu.isSet(flag) == isSet {
 		cpu.pop2PC()
+		cpu.internal()
 	}
 }
 
@@ -1505,6 +1822,7 @@ func (cpu *CPU) pop_af() {
 //	nn = two byte immediate value. (LS byte first.)
 func (cpu *CPU) jpcc_nn(flag flags, isSet bool, operands []byte) {
 	if cpu.isSet(flag) == isSet {
+		cpu.internal()
 		cpu.PC = utils.Bytes2Word(operands[1], operands[0])
 	}
 }
@@ -1535,6 +1853,7 @@ func (cpu *CPU) jp_nn(operands []byte) {
 //	nn = two byte immediate value. (LS byte first.)
 func (cpu *CPU) callcc_nn(flag flags, isSet bool, operands []byte) {
 	if cpu.isSet(flag) == isSet {
+		cpu.internal()
 		cpu.push(byte(cpu.PC >> 8))
 		cpu.push(byte(cpu.PC & 0xFF))
 		cpu.PC = utils.Bytes2Word(operands[1], operands[0])
@@ -1551,6 +1870,7 @@ func (cpu *CPU) callcc_nn(flag flags, isSet bool, operands []byte) {
 //
 //	nn = AF,BC,DE,HL
 func (cpu *CPU) push_nn(h, l types.Register) {
+	cpu.internal()
 	cpu.push(h)
 	cpu.push(l)
 }
@@ -1565,6 +1885,7 @@ func (cpu *CPU) push_nn(h, l types.Register) {
 //
 //	n = $00,$08,$10,$18,$20,$28,$30,$38
 func (cpu *CPU) rst(n byte) {
+	cpu.internal()
 	cpu.push(byte(cpu.PC >> 8))
 	cpu.push(byte(cpu.PC & 0xFF))
 	cpu.PC = types.Word(n)
@@ -1590,6 +1911,7 @@ func (cpu *CPU) ret() {
 //
 //	nn = two byte immediate value. (LS byte first.)
 func (cpu *CPU) call_nn(operands []byte) {
+	cpu.internal()
 	cpu.push(byte(cpu.PC >> 8))
 	cpu.push(byte(cpu.PC & 0xFF))
 	cpu.PC = utils.Bytes2Word(operands[1], operands[0])
@@ -1604,7 +1926,7 @@ func (cpu *CPU) ret_i() {
 	l := cpu.pop()
 	h := cpu.pop()
 	cpu.PC = utils.Bytes2Word(h, l)
-	cpu.irq.Enable()
+	cpu.ime = true
 }
 
 // LDH (n),A
@@ -1616,7 +1938,7 @@ func (cpu *CPU) ret_i() {
 //
 //	n = one byte immediate value.
 func (cpu *CPU) ldhn_a(operands []byte) {
-	cpu.bus.WriteByte(0xFF00+types.Word(operands[0]), cpu.Regs.A)
+	cpu.write(0xFF00+types.Word(operands[0]), cpu.Regs.A)
 }
 
 // LD (C),A
@@ -1625,7 +1947,7 @@ func (cpu *CPU) ldhn_a(operands []byte) {
 //	Put A into address $FF00 + register C.
 func (cpu *CPU) ldc_a() {
 	addr := 0xFF00 + types.Word(cpu.Regs.C)
-	cpu.bus.WriteByte(addr, cpu.Regs.A)
+	cpu.write(addr, cpu.Regs.A)
 }
 
 // ADD SP,n
@@ -1687,7 +2009,7 @@ func (cpu *CPU) jp_hl() {
 //	nn = two byte immediate value. (LS byte first.)
 func (cpu *CPU) ldnn_r(operands []byte) {
 	addr := utils.Bytes2Word(operands[1], operands[0])
-	cpu.bus.WriteByte(addr, cpu.Regs.A)
+	cpu.write(addr, cpu.Regs.A)
 }
 
 // LDH A,(n)
@@ -1699,7 +2021,7 @@ func (cpu *CPU) ldnn_r(operands []byte) {
 //
 //	n = one byte immediate value.
 func (cpu *CPU) ldha_n(operands []byte) {
-	cpu.Regs.A = cpu.bus.ReadByte(types.Word(0xFF00) + types.Word(operands[0]))
+	cpu.Regs.A = cpu.read(types.Word(0xFF00) + types.Word(operands[0]))
 }
 
 // LD A,(C)
@@ -1708,7 +2030,7 @@ func (cpu *CPU) ldha_n(operands []byte) {
 //	Put value at address $FF00 + register C into A.
 //	Same as: LD A,($FF00+C)
 func (cpu *CPU) lda_c() {
-	cpu.Regs.A = cpu.bus.ReadByte(types.Word(0xFF00) + types.Word(cpu.Regs.C))
+	cpu.Regs.A = cpu.read(types.Word(0xFF00) + types.Word(cpu.Regs.C))
 }
 
 // DI
@@ -1722,7 +2044,8 @@ func (cpu *CPU) lda_c() {
 //
 //	None.
 func (cpu *CPU) di() {
-	cpu.irq.Disable()
+	cpu.ime = false
+	cpu.eiDelay = 0
 }
 
 // EI
@@ -1736,7 +2059,10 @@ func (cpu *CPU) di() {
 //
 //	None.
 func (cpu *CPU) ei() {
-	cpu.irq.Enable()
+	// EIの次の命令の実行後にIMEがセットされる
+	if !cpu.ime {
+		cpu.eiDelay = 2
+	}
 }
 
 // LD HL,SP+n / LDHL SP,n
@@ -1823,8 +2149,8 @@ func (cpu *CPU) rlc_n(r *types.Register) {
 // rlc_nとの違いはメモリ上の値を書き換える点
 func (cpu *CPU) rlc_hl() {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.rlc(v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.rlc(v))
 }
 
 // RRC n
@@ -1860,8 +2186,8 @@ func (cpu *CPU) rrc_n(r *types.Register) {
 
 func (cpu *CPU) rrc_hl() {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.rrc(v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.rrc(v))
 }
 
 //  RL n
@@ -1899,8 +2225,8 @@ func (cpu *CPU) rl_n(r *types.Register) {
 
 func (cpu *CPU) rl_hl() {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.rl(v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.rl(v))
 }
 
 // RR n
@@ -1943,8 +2269,8 @@ func (cpu *CPU) rr_n(r *types.Register) {
 
 func (cpu *CPU) rr_hl() {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.rr(v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.rr(v))
 }
 
 //	SLA n
@@ -1982,8 +2308,8 @@ func (cpu *CPU) sla_n(r *types.Register) {
 
 func (cpu *CPU) sla_hl() {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.sla(v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.sla(v))
 }
 
 // SRA n
@@ -2020,8 +2346,8 @@ func (cpu *CPU) sra_n(r *types.Register) {
 
 func (cpu *CPU) sra_hl() {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.sra(v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.sra(v))
 }
 
 // SWAP n
@@ -2056,8 +2382,8 @@ func (cpu *CPU) swap_n(r *types.Register) {
 
 func (cpu *CPU) swap_hl() {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.swap(v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.swap(v))
 }
 
 // SRL n
@@ -2094,8 +2420,8 @@ func (cpu *CPU) srl_n(r *types.Register) {
 
 func (cpu *CPU) srl_hl() {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.srl(v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.srl(v))
 }
 
 // BIT b,r
@@ -2125,7 +2451,7 @@ func (cpu *CPU) bit_b_r(b types.Bit, r *byte) {
 
 func (cpu *CPU) bit_b_hl(b types.Bit) {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
+	v := cpu.read(addr)
 	cpu.testBit(b, v)
 }
 
@@ -2145,8 +2471,8 @@ func (cpu *CPU) res_b_r(b types.Bit, r *types.Register) {
 
 func (cpu *CPU) res_b_hl(b types.Bit) {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.res_b(b, v))
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.res_b(b, v))
 }
 
 // SET b,r
@@ -2165,20 +2491,27 @@ func (cpu *CPU) set_b_r(b types.Bit, r *types.Register) {
 
 func (cpu *CPU) set_b_hl(b types.Bit) {
 	addr := cpu.getHL()
-	v := cpu.bus.ReadByte(addr)
-	cpu.bus.WriteByte(addr, cpu.set_b(b, v))
-}
-
-func (cpu *CPU) resolveIRQ() bool {
-	if !cpu.irq.Enabled() || !cpu.irq.HasIRQ() {
-		return false
-	}
-	cpu.pushPC()
+	v := cpu.read(addr)
+	cpu.write(addr, cpu.set_b(b, v))
+}
+
+// dispatchIRQ calls the interrupt service routine. It takes 5 M-cycles.
+// The interrupt is chosen after the upper byte of PC is pushed.
+// If the push overwrites IE and no interrupt remains, the dispatch is cancelled and jumps to 0x0000.
+func (cpu *CPU) dispatchIRQ() {
+	cpu.ime = false
+	cpu.haltBug = false
+	cpu.internal()
+	cpu.internal()
+	upper, lower := utils.Word2Bytes(cpu.PC)
+	cpu.push(upper)
+	// この時点の優先順位で割り込みを決める
 	addr := cpu.irq.ResolveISRAddr()
+	cpu.push(lower)
+	cpu.internal()
 	if addr == nil {
-		return false
+		cpu.PC = 0x0000
+		return
 	}
 	cpu.PC = *addr
-	cpu.irq.Disable()
-	return true
 }
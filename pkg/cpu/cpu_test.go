@@ -6,6 +6,7 @@ import (
 	"github.com/kijimaD/goboy/pkg/interrupt"
 	"github.com/kijimaD/goboy/pkg/logger"
 	"github.com/kijimaD/goboy/pkg/mocks"
+	"github.com/kijimaD/goboy/pkg/model"
 	"github.com/kijimaD/goboy/pkg/types"
 	"github.com/stretchr/testify/assert"
 )
@@ -18,64 +19,100 @@ func setupCPU(offset types.Word, data []byte) (*CPU, *mocks.MockBus) {
 	return NewCPU(l, &b, irq), &b
 }
 
-func TestNOP(t *testing.T) {
-	cpu, _ := setupCPU(0, []byte{0})
-	cpu.Step()
+type countTicker struct {
+	cycles uint
 }
 
-func TestLDn_nn(t *testing.T) {
-	assert := assert.New(t)
-	cpu, _ := setupCPU(0, []byte{0x01, 0xDE, 0xAD})
-	cpu.PC = 0x00
-	cpu.Step()
-	assert.Equal(byte(0xAD), cpu.Regs.B, "should B equals 0xad")
-	assert.Equal(byte(0xDE), cpu.Regs.C, "should C equals 0xde")
+func (c *countTicker) Tick(cycles uint) {
+	c.cycles += cycles
 }
 
-func TestLDrr_r(t *testing.T) {
-	assert := assert.New(t)
-	cpu, bus := setupCPU(0, []byte{0x02})
-	cpu.PC = 0x00
-	cpu.Regs.A = 0xA5
-	cpu.Regs.B = 0x10
-	cpu.Regs.C = 0x20
-	cpu.Step()
-	assert.Equal(byte(0xA5), bus.MockMemory[0x1020], "should memory equals 0xa5")
+// irqBus routes IF and IE to the interrupt controller
+type irqBus struct {
+	mocks.MockBus
+	irq *interrupt.Interrupt
 }
 
-func TestIncrr(t *testing.T) {
-	assert := assert.New(t)
-	cpu, _ := setupCPU(0, []byte{0x03})
-	cpu.PC = 0x00
-	cpu.Regs.B = 0x10
-	cpu.Regs.C = 0x20
-	cpu.Step()
-	assert.Equal(byte(0x10), cpu.Regs.B, "should not B incremented")
-	assert.Equal(byte(0x21), cpu.Regs.C, "should C incremented")
+func (b *irqBus) WriteByte(addr types.Word, data byte) {
+	switch addr {
+	case interrupt.InterruptFlagAddr, interrupt.InterruptEnableFlagAddr:
+		b.irq.Write(addr-interrupt.RegisterOffset, data)
+		return
+	}
+	b.MockBus.WriteByte(addr, data)
 }
 
-func TestIncB(t *testing.T) {
-	assert := assert.New(t)
-	cpu, _ := setupCPU(0, []byte{0x04})
-	cpu.PC = 0x00
-	cpu.Regs.B = 0x10
-	cpu.Step()
-	assert.Equal(byte(0x11), cpu.Regs.B, "should B incremented")
+func (b *irqBus) ReadByte(addr types.Word) byte {
+	switch addr {
+	case interrupt.InterruptFlagAddr, interrupt.InterruptEnableFlagAddr:
+		return b.irq.Read(addr - interrupt.RegisterOffset)
+	}
+	return b.MockBus.ReadByte(addr)
 }
 
-func TestDecB(t *testing.T) {
-	assert := assert.New(t)
-	cpu, _ := setupCPU(0, []byte{0x05})
+func setupIRQ(data []byte) (*CPU, *interrupt.Interrupt) {
+	irq := interrupt.NewInterrupt()
+	b := &irqBus{irq: irq}
+	b.SetMemory(0, data)
+	l := logger.NewLogger(logger.LogLevel("Debug"))
+	cpu := NewCPU(l, b, irq)
 	cpu.PC = 0x00
-	cpu.Regs.B = 0x10
-	cpu.Step()
-	assert.Equal(byte(0x0F), cpu.Regs.B, "should B decremented")
+	// ブートROMが残すVBlank要求を消しておく
+	irq.IF = 0x00
+	return cpu, irq
 }
 
-func TestLDnn_n(t *testing.T) {
-	assert := assert.New(t)
-	cpu, _ := setupCPU(0, []byte{0x06, 0xA5})
-	cpu.PC = 0x00
+func TestDispatchPriority(t *testing.T) {
+	cpu, irq := setupIRQ([]byte{0x00})
+	cpu.ime = true
+	irq.IE = 0x1F
+	irq.SetIRQ(interrupt.TimerOverflowFlag | interrupt.LCDSFlag)
 	cpu.Step()
-	assert.Equal(cpu.Regs.B, byte(0xA5), "should B equals 0xa5")
+	assert.Equal(t, types.Word(0x48), cpu.PC)
+	assert.Equal(t, interrupt.TimerOverflowFlag, irq.IF&0x1F)
+	assert.False(t, cpu.ime)
+}
+
+func TestDispatchCancelledByIEPush(t *testing.T) {
+	tests := []struct {
+		name string
+		pc   types.Word
+		want types.Word
+	}{
+		// 上位バイト0x02がIEに書き込まれ、VBlankが無効になる
+		{"cancelled", 0x0200, 0x0000},
+		{"not cancelled", 0x0100, 0x0040},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu, irq := setupIRQ([]byte{0x00})
+			cpu.ime = true
+			cpu.PC = tt.pc
+			cpu.SP = 0x0000
+			irq.IE = interrupt.VerticalBlankFlag
+			irq.SetIRQ(interrupt.VerticalBlankFlag)
+			assert.Equal(t, Cycle(5), cpu.Step())
+			assert.Equal(t, tt.want, cpu.PC)
+		})
+	}
+}
+
+func TestSetModel(t *testing.T) {
+	cpu, _ := setupCPU(0, []byte{})
+	assert.Equal(t, model.DMG, cpu.Model())
+	assert.Equal(t, byte(0x01), cpu.Regs.A)
+
+	// ソフトはAでハードウェアを判別する
+	tests := map[model.Model]byte{
+		model.DMG0: 0x01,
+		model.MGB:  0xFF,
+		model.SGB:  0x01,
+		model.CGB:  0x11,
+	}
+	for m, a := range tests {
+		cpu.SetModel(m)
+		assert.Equal(t, a, cpu.Regs.A, m.String())
+		assert.Equal(t, types.Word(0x0100), cpu.PC)
+		assert.Equal(t, types.Word(0xFFFE), cpu.SP)
+	}
 }
@@ -0,0 +1,104 @@
+package cpu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/interfaces/bus"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/kijimaD/goboy/pkg/utils"
+)
+
+// Instruction is a decoded instruction.
+type Instruction struct {
+	// Description is the mnemonic with the operand placeholders, e.g. "LD A,(nn)". It is empty for undefined opcodes.
+	Description string
+	// Length is the length in bytes including the opcode and CB prefix
+	Length   int
+	Operands []byte
+}
+
+// Decode decodes the instruction at the beginning of code.
+// The bytes beyond code are read as 0.
+func Decode(code []byte) Instruction {
+	at := func(i int) byte {
+		if i < len(code) {
+			return code[i]
+		}
+		return 0x00
+	}
+	length := 1
+	in := instructions[at(0)]
+	if at(0) == 0xCB {
+		in = cbPrefixedInstructions[at(1)]
+		length++
+	}
+	if in == EMPTY {
+		return Instruction{Length: 1}
+	}
+	operands := make([]byte, in.OperandsSize)
+	for i := range operands {
+		operands[i] = at(length + i)
+	}
+	return Instruction{Description: in.Description, Length: length + len(operands), Operands: operands}
+}
+
+// Disassemble decodes the instruction at addr and returns its text and length in bytes.
+// The operands are formatted with the real values, e.g. "LD A,($C0DE)" and "JR NZ,$0150".
+// The target of relative jumps is resolved to the absolute address.
+// Undefined opcodes are shown as "DB $xx".
+// It peeks the memory without ticking, so it can be used while the emulator is running.
+func Disassemble(b bus.Accessor, addr types.Word) (string, int) {
+	code := make([]byte, 4)
+	for i := range code {
+		code[i] = peek(b, addr+types.Word(i))
+	}
+	in := Decode(code)
+	if in.Description == "" {
+		return fmt.Sprintf("DB $%02X", code[0]), in.Length
+	}
+	return formatInst(in.Description, in.Operands, addr+types.Word(in.Length)), in.Length
+}
+
+// formatInst replaces the operand placeholder of the mnemonic with the value.
+// next is the address of the next instruction. Relative jumps are based on it.
+func formatInst(desc string, operands []byte, next types.Word) string {
+	mnemonic, args, ok := strings.Cut(desc, " ")
+	if !ok || len(operands) == 0 {
+		return desc
+	}
+	list := strings.Split(args, ",")
+	for i, arg := range list {
+		list[i] = formatOperand(mnemonic, arg, operands, next)
+	}
+	return mnemonic + " " + strings.Join(list, ",")
+}
+
+func formatOperand(mnemonic, arg string, operands []byte, next types.Word) string {
+	switch arg {
+	case "nn":
+		return fmt.Sprintf("$%04X", utils.Bytes2Word(operands[1], operands[0]))
+	case "(nn)":
+		return fmt.Sprintf("($%04X)", utils.Bytes2Word(operands[1], operands[0]))
+	case "n":
+		return fmt.Sprintf("$%02X", operands[0])
+	case "(n)":
+		// LDHは0xFF00からのオフセット
+		return fmt.Sprintf("($FF%02X)", operands[0])
+	case "e":
+		if mnemonic == "JR" {
+			return fmt.Sprintf("$%04X", next+types.Word(int8(operands[0])))
+		}
+		return signed(operands[0])
+	case "SP+e":
+		return "SP" + signed(operands[0])
+	}
+	return arg
+}
+
+func signed(b byte) string {
+	if v := int8(b); v < 0 {
+		return fmt.Sprintf("-$%02X", -int(v))
+	}
+	return fmt.Sprintf("+$%02X", b)
+}
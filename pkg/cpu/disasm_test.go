@@ -0,0 +1,52 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisassemble(t *testing.T) {
+	tests := []struct {
+		code   []byte
+		text   string
+		length int
+	}{
+		{[]byte{0x00}, "NOP", 1},
+		{[]byte{0xFA, 0xDE, 0xC0}, "LD A,($C0DE)", 3},
+		{[]byte{0x3E, 0x42}, "LD A,$42", 2},
+		{[]byte{0x01, 0x34, 0x12}, "LD BC,$1234", 3},
+		{[]byte{0x11, 0x34, 0x12}, "LD DE,$1234", 3},
+		{[]byte{0xEA, 0x00, 0xC0}, "LD ($C000),A", 3},
+		{[]byte{0xE0, 0x44}, "LDH ($FF44),A", 2},
+		// 0x0150 = 0x0100 + 2 + 0x4E
+		{[]byte{0x20, 0x4E}, "JR NZ,$0150", 2},
+		{[]byte{0x18, 0xFE}, "JR $0100", 2},
+		{[]byte{0xCD, 0x50, 0x01}, "CALL $0150", 3},
+		{[]byte{0xE8, 0xFD}, "ADD SP,-$03", 2},
+		{[]byte{0xF8, 0x05}, "LD HL,SP+$05", 2},
+		{[]byte{0xFF}, "RST $38", 1},
+		{[]byte{0xCB, 0x7C}, "BIT 7,H", 2},
+		{[]byte{0x10, 0x00}, "STOP", 2},
+		{[]byte{0xD3}, "DB $D3", 1},
+	}
+	for _, tt := range tests {
+		b := &mocks.MockBus{}
+		b.SetMemory(0x0100, tt.code)
+		text, length := Disassemble(b, 0x0100)
+		assert.Equal(t, tt.text, text)
+		assert.Equal(t, tt.length, length, tt.text)
+	}
+}
+
+func TestDescriptions(t *testing.T) {
+	// オペランドのある命令はプレースホルダを1つ持つ
+	for _, in := range instructions {
+		if in == EMPTY || in.OperandsSize == 0 || in.Description == "STOP" {
+			continue
+		}
+		text := formatInst(in.Description, []byte{0x12, 0x34}, 0)
+		assert.NotEqual(t, in.Description, text, "opcode 0x%02X", in.Opcode)
+	}
+}
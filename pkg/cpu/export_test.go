@@ -0,0 +1,21 @@
+package cpu
+
+// The helpers for the tests in package cpu_test, which assemble the programs with pkg/asm.
+
+var (
+	SetupCPU   = setupCPU
+	SetupIRQ   = setupIRQ
+	JoypadAddr = joypadAddr
+)
+
+type CountTicker = countTicker
+
+// Cycles returns the ticked M-cycles.
+func (c *countTicker) Cycles() uint {
+	return c.cycles
+}
+
+// SetIME sets IME without EI.
+func (cpu *CPU) SetIME(ime bool) {
+	cpu.ime = ime
+}
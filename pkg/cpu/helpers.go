@@ -191,14 +191,14 @@ func (cpu *CPU) or(a, b byte) byte {
 }
 
 func (cpu *CPU) pop() byte {
-	b := cpu.bus.ReadByte(cpu.SP)
+	b := cpu.read(cpu.SP)
 	cpu.SP++
 	return b
 }
 
 func (cpu *CPU) push(v byte) {
 	cpu.SP--
-	cpu.bus.WriteByte(cpu.SP, v)
+	cpu.write(cpu.SP, v)
 }
 
 func (cpu *CPU) pushPC() {
@@ -0,0 +1,282 @@
+package cpu_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/tracer"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/lockup"
+	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/mocks"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// The tests of the programs are outside package cpu, because pkg/asm imports it.
+
+func TestNOP(t *testing.T) {
+	c, _ := cpu.SetupCPU(0, asm.MustAssemble("NOP", 0))
+	c.Step()
+}
+
+func TestLDn_nn(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := cpu.SetupCPU(0, asm.MustAssemble("LD BC,$ADDE", 0))
+	c.PC = 0x00
+	c.Step()
+	assert.Equal(byte(0xAD), c.Regs.B, "should B equals 0xad")
+	assert.Equal(byte(0xDE), c.Regs.C, "should C equals 0xde")
+}
+
+func TestLDrr_r(t *testing.T) {
+	assert := assert.New(t)
+	c, bus := cpu.SetupCPU(0, asm.MustAssemble("LD (BC),A", 0))
+	c.PC = 0x00
+	c.Regs.A = 0xA5
+	c.Regs.B = 0x10
+	c.Regs.C = 0x20
+	c.Step()
+	assert.Equal(byte(0xA5), bus.MockMemory[0x1020], "should memory equals 0xa5")
+}
+
+func TestIncrr(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := cpu.SetupCPU(0, asm.MustAssemble("INC BC", 0))
+	c.PC = 0x00
+	c.Regs.B = 0x10
+	c.Regs.C = 0x20
+	c.Step()
+	assert.Equal(byte(0x10), c.Regs.B, "should not B incremented")
+	assert.Equal(byte(0x21), c.Regs.C, "should C incremented")
+}
+
+func TestIncB(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := cpu.SetupCPU(0, asm.MustAssemble("INC B", 0))
+	c.PC = 0x00
+	c.Regs.B = 0x10
+	c.Step()
+	assert.Equal(byte(0x11), c.Regs.B, "should B incremented")
+}
+
+func TestDecB(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := cpu.SetupCPU(0, asm.MustAssemble("DEC B", 0))
+	c.PC = 0x00
+	c.Regs.B = 0x10
+	c.Step()
+	assert.Equal(byte(0x0F), c.Regs.B, "should B decremented")
+}
+
+func TestLDnn_n(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := cpu.SetupCPU(0, asm.MustAssemble("LD B,$A5", 0))
+	c.PC = 0x00
+	c.Step()
+	assert.Equal(c.Regs.B, byte(0xA5), "should B equals 0xa5")
+}
+
+func TestStepTicksEachMCycle(t *testing.T) {
+	tests := []struct {
+		src    string
+		flags  byte
+		cycles cpu.Cycle
+	}{
+		{"NOP", 0x00, 1},
+		{"LD (HL),$12", 0x00, 3},
+		{"JR NZ,$0007", 0x00, 3},
+		{"JR NZ,$0007", 0x80, 2},
+		{"JP Z,$1000", 0x80, 4},
+		{"JP Z,$1000", 0x00, 3},
+		{"CALL $1000", 0x00, 6},
+		{"CALL C,$1000", 0x10, 6},
+		{"CALL C,$1000", 0x00, 3},
+		{"RET NC", 0x00, 5},
+		{"RET NC", 0x10, 2},
+		{"PUSH BC", 0x00, 4},
+		{"RST $38", 0x00, 4},
+		{"SET 0,(HL)", 0x00, 4},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s F=%02X", tt.src, tt.flags), func(t *testing.T) {
+			c, _ := cpu.SetupCPU(0, asm.MustAssemble(tt.src, 0))
+			ticker := &cpu.CountTicker{}
+			c.SetTicker(ticker)
+			c.PC = 0x00
+			c.SP = 0xD000
+			c.Regs.H, c.Regs.L = 0xC0, 0x00
+			c.Regs.F = tt.flags
+			assert.Equal(t, tt.cycles, c.Step())
+			assert.Equal(t, tt.cycles, ticker.Cycles())
+		})
+	}
+}
+
+func TestEIDelay(t *testing.T) {
+	c, irq := cpu.SetupIRQ(asm.MustAssemble("EI\nNOP\nNOP", 0))
+	irq.IE = interrupt.VerticalBlankFlag
+	irq.SetIRQ(interrupt.VerticalBlankFlag)
+
+	c.Step()
+	assert.Equal(t, types.Word(0x01), c.PC)
+	// EIの次の命令は割り込まれない
+	c.Step()
+	assert.Equal(t, types.Word(0x02), c.PC)
+	assert.Equal(t, cpu.Cycle(5), c.Step())
+	assert.Equal(t, types.Word(0x40), c.PC)
+	assert.Equal(t, byte(0x00), irq.IF)
+}
+
+func TestDIAfterEI(t *testing.T) {
+	c, irq := cpu.SetupIRQ(asm.MustAssemble("EI\nDI\nNOP", 0))
+	irq.IE = interrupt.VerticalBlankFlag
+	irq.SetIRQ(interrupt.VerticalBlankFlag)
+	c.Step()
+	c.Step()
+	c.Step()
+	assert.Equal(t, types.Word(0x03), c.PC)
+}
+
+func TestHALTBug(t *testing.T) {
+	c, irq := cpu.SetupIRQ(asm.MustAssemble("HALT\nINC A", 0))
+	irq.IE = interrupt.TimerOverflowFlag
+	irq.SetIRQ(interrupt.TimerOverflowFlag)
+	c.Regs.A = 0
+	c.Step()
+	c.Step()
+	c.Step()
+	assert.Equal(t, byte(2), c.Regs.A, "INC A should be executed twice")
+	assert.Equal(t, types.Word(0x02), c.PC)
+}
+
+func TestEIBeforeHALT(t *testing.T) {
+	code := make([]byte, 0x42)
+	copy(code, asm.MustAssemble("EI\nHALT\nINC A", 0))
+	copy(code[0x40:], asm.MustAssemble("INC B\nRETI", 0x40))
+	c, irq := cpu.SetupIRQ(code)
+	irq.IE = interrupt.VerticalBlankFlag
+	irq.SetIRQ(interrupt.VerticalBlankFlag)
+	c.Regs.A, c.Regs.B = 0, 0
+	c.Step() // EI
+	c.Step() // HALT
+	c.Step() // 復帰
+	c.Step() // 割り込み
+	assert.Equal(t, types.Word(0x40), c.PC)
+	c.Step() // INC B
+	assert.Equal(t, types.Word(0x41), c.PC, "the first opcode of the handler should run once")
+	c.Step() // RETI
+	assert.Equal(t, types.Word(0x02), c.PC, "HALT should not be run again")
+	c.Step()
+	assert.Equal(t, byte(1), c.Regs.A)
+	assert.Equal(t, byte(1), c.Regs.B)
+}
+
+func TestSTOPWaitsForJoypad(t *testing.T) {
+	c, bus := cpu.SetupCPU(0, asm.MustAssemble("STOP\nINC A", 0))
+	ticker := &cpu.CountTicker{}
+	c.SetTicker(ticker)
+	c.PC = 0x00
+	c.Regs.A = 0
+	bus.MockMemory[cpu.JoypadAddr] = 0xEF // P14 selected, no button pressed
+	c.Step()
+	assert.True(t, c.Stopped())
+
+	ticked := ticker.Cycles()
+	assert.Equal(t, cpu.Cycle(0), c.Step())
+	assert.Equal(t, ticked, ticker.Cycles(), "clock should stop")
+	assert.Equal(t, byte(0), c.Regs.A)
+
+	bus.MockMemory[cpu.JoypadAddr] = 0xEE // Right pressed
+	c.Step()
+	assert.False(t, c.Stopped())
+	c.Step()
+	assert.Equal(t, byte(1), c.Regs.A)
+}
+
+type mockSpeedSwitcher struct {
+	armed    bool
+	switched bool
+}
+
+func (s *mockSpeedSwitcher) Armed() bool { return s.armed }
+func (s *mockSpeedSwitcher) Switch()     { s.switched = true }
+
+func TestSTOPSwitchesSpeed(t *testing.T) {
+	c, _ := cpu.SetupCPU(0, asm.MustAssemble("STOP", 0))
+	s := &mockSpeedSwitcher{armed: true}
+	c.SetSpeedSwitcher(s)
+	c.PC = 0x00
+	c.Step()
+	assert.False(t, c.Stopped())
+	assert.True(t, s.switched)
+}
+
+func TestIllegalOpcodeLocksUp(t *testing.T) {
+	c, irq := cpu.SetupIRQ(asm.MustAssemble("NOP\nDB $D3 ; illegal\nINC A", 0))
+	c.Regs.A = 0
+	c.Step()
+	assert.Nil(t, c.Lockup())
+	c.Step()
+	e := c.Lockup()
+	assert.NotNil(t, e)
+	assert.Equal(t, lockup.IllegalOpcode, e.Kind)
+	assert.Equal(t, types.Word(0x01), e.PC)
+	assert.Equal(t, byte(0xD3), e.Opcode)
+	assert.Equal(t, -1, e.Bank)
+
+	// 割り込みも受け付けず、クロックだけが進む
+	c.SetIME(true)
+	irq.IE = interrupt.VerticalBlankFlag
+	irq.SetIRQ(interrupt.VerticalBlankFlag)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, cpu.Cycle(1), c.Step())
+	}
+	assert.Equal(t, byte(0), c.Regs.A)
+	assert.Equal(t, types.Word(0x02), c.PC)
+}
+
+type recordTracer struct {
+	states []tracer.State
+}
+
+func (r *recordTracer) Trace(s tracer.State) {
+	r.states = append(r.states, s)
+}
+
+func TestTracer(t *testing.T) {
+	c, _ := cpu.SetupCPU(0x0100, asm.MustAssemble("LD A,$42\nNOP", 0x0100))
+	tr := &recordTracer{}
+	c.SetTracer(tr)
+	c.Step()
+	c.Step()
+	assert.Len(t, tr.states, 2)
+	// 実行前の状態
+	assert.Equal(t, types.Word(0x0100), tr.states[0].PC)
+	assert.Equal(t, byte(0x01), tr.states[0].A)
+	assert.Equal(t, [4]byte{0x3E, 0x42, 0x00, 0x00}, tr.states[0].PCMem)
+	assert.Equal(t, types.Word(0x0102), tr.states[1].PC)
+	assert.Equal(t, byte(0x42), tr.states[1].A)
+}
+
+// executeBus records the addresses of the executed instructions
+type executeBus struct {
+	mocks.MockBus
+	executed []types.Word
+}
+
+func (b *executeBus) Execute(addr types.Word) {
+	b.executed = append(b.executed, addr)
+}
+
+func TestExecutor(t *testing.T) {
+	b := &executeBus{}
+	b.SetMemory(0x0100, asm.MustAssemble("LD A,$42\nNOP\nJP $0100", 0x0100))
+	c := cpu.NewCPU(logger.NewLogger(logger.LogLevel("Debug")), b, interrupt.NewInterrupt())
+	for i := 0; i < 4; i++ {
+		c.Step()
+	}
+	assert.Equal(t, []types.Word{0x0100, 0x0102, 0x0103, 0x0100}, b.executed)
+}
@@ -0,0 +1,235 @@
+package cpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// sm83Dir is the directory of the SM83 single step tests (https://github.com/SingleStepTests/sm83).
+// Put the JSON files (00.json ... cb ff.json) there, or set SM83_TESTS to the directory.
+const sm83Dir = "../../test/sm83"
+
+type sm83State struct {
+	PC  types.Word `json:"pc"`
+	SP  types.Word `json:"sp"`
+	A   byte       `json:"a"`
+	B   byte       `json:"b"`
+	C   byte       `json:"c"`
+	D   byte       `json:"d"`
+	E   byte       `json:"e"`
+	F   byte       `json:"f"`
+	H   byte       `json:"h"`
+	L   byte       `json:"l"`
+	IME byte       `json:"ime"`
+	// RAM is the list of [address, value]
+	RAM [][2]int `json:"ram"`
+}
+
+type sm83Test struct {
+	Name    string            `json:"name"`
+	Initial sm83State         `json:"initial"`
+	Final   sm83State         `json:"final"`
+	Cycles  []json.RawMessage `json:"cycles"`
+}
+
+type accessKind int
+
+const (
+	idle accessKind = iota
+	read
+	write
+)
+
+func (k accessKind) String() string {
+	return [...]string{"idle", "read", "write"}[k]
+}
+
+// busCycle is the bus access in a M-cycle.
+type busCycle struct {
+	kind accessKind
+	addr types.Word
+	data byte
+}
+
+func (c busCycle) String() string {
+	if c.kind == idle {
+		return "idle"
+	}
+	return fmt.Sprintf("%s $%04X=$%02X", c.kind, c.addr, c.data)
+}
+
+// parseCycle parses a cycle of the vector. It is null or [address, value, pins].
+// The pins are "r-m"/"-wm"/"---", or "read"/"write" in the older format.
+func parseCycle(raw json.RawMessage) (busCycle, error) {
+	var v []interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return busCycle{}, err
+	}
+	if len(v) < 3 {
+		return busCycle{kind: idle}, nil
+	}
+	pins, _ := v[2].(string)
+	addr, _ := v[0].(float64)
+	data, _ := v[1].(float64)
+	c := busCycle{addr: types.Word(addr), data: byte(data)}
+	switch {
+	case strings.Contains(pins, "w"):
+		c.kind = write
+	case strings.Contains(pins, "r"):
+		c.kind = read
+	default:
+		c.kind = idle
+		c.addr, c.data = 0, 0
+	}
+	return c, nil
+}
+
+// recordingBus is flat 64KiB memory that records the access in each M-cycle.
+// CPU ticks it before the access, so an access fills the cycle ticked just before.
+type recordingBus struct {
+	memory [0x10000]byte
+	cycles []busCycle
+}
+
+func (b *recordingBus) Tick(cycles uint) {
+	for i := uint(0); i < cycles; i++ {
+		b.cycles = append(b.cycles, busCycle{kind: idle})
+	}
+}
+
+func (b *recordingBus) access(c busCycle) {
+	if n := len(b.cycles); n > 0 && b.cycles[n-1].kind == idle {
+		b.cycles[n-1] = c
+		return
+	}
+	b.cycles = append(b.cycles, c)
+}
+
+func (b *recordingBus) ReadByte(addr types.Word) byte {
+	d := b.memory[addr]
+	b.access(busCycle{kind: read, addr: addr, data: d})
+	return d
+}
+
+func (b *recordingBus) WriteByte(addr types.Word, data byte) {
+	b.memory[addr] = data
+	b.access(busCycle{kind: write, addr: addr, data: data})
+}
+
+func (b *recordingBus) ReadWord(addr types.Word) types.Word {
+	return types.Word(b.ReadByte(addr+1))<<8 | types.Word(b.ReadByte(addr))
+}
+
+func (b *recordingBus) WriteWord(addr types.Word, data types.Word) {
+	b.WriteByte(addr, byte(data))
+	b.WriteByte(addr+1, byte(data>>8))
+}
+
+// runSM83 runs a vector and returns the differences.
+func runSM83(test sm83Test) []string {
+	b := &recordingBus{}
+	l := logger.NewLogger(logger.LogLevel("Info"))
+	cpu := NewCPU(l, b, interrupt.NewInterrupt())
+	cpu.SetTicker(b)
+	in := test.Initial
+	cpu.PC, cpu.SP = in.PC, in.SP
+	cpu.Regs = Registers{A: in.A, B: in.B, C: in.C, D: in.D, E: in.E, F: in.F, H: in.H, L: in.L}
+	cpu.ime = in.IME != 0
+	for _, m := range in.RAM {
+		b.memory[m[0]] = byte(m[1])
+	}
+
+	cpu.Step()
+
+	diffs := []string{}
+	expect := func(name string, want, got interface{}) {
+		if want != got {
+			diffs = append(diffs, fmt.Sprintf("%s: want %v, got %v", name, want, got))
+		}
+	}
+	out := test.Final
+	expect("PC", fmt.Sprintf("$%04X", out.PC), fmt.Sprintf("$%04X", cpu.PC))
+	expect("SP", fmt.Sprintf("$%04X", out.SP), fmt.Sprintf("$%04X", cpu.SP))
+	for _, r := range []struct {
+		name      string
+		want, got byte
+	}{
+		{"A", out.A, cpu.Regs.A}, {"B", out.B, cpu.Regs.B}, {"C", out.C, cpu.Regs.C}, {"D", out.D, cpu.Regs.D},
+		{"E", out.E, cpu.Regs.E}, {"F", out.F, cpu.Regs.F}, {"H", out.H, cpu.Regs.H}, {"L", out.L, cpu.Regs.L},
+	} {
+		expect(r.name, fmt.Sprintf("$%02X", r.want), fmt.Sprintf("$%02X", r.got))
+	}
+	expect("IME", out.IME != 0, cpu.ime)
+	for _, m := range out.RAM {
+		expect(fmt.Sprintf("($%04X)", m[0]), fmt.Sprintf("$%02X", m[1]), fmt.Sprintf("$%02X", b.memory[m[0]]))
+	}
+
+	want := []busCycle{}
+	for _, raw := range test.Cycles {
+		c, err := parseCycle(raw)
+		if err != nil {
+			return append(diffs, err.Error())
+		}
+		want = append(want, c)
+	}
+	expect("cycles", len(want), len(b.cycles))
+	for i := 0; i < len(want) && i < len(b.cycles); i++ {
+		expect(fmt.Sprintf("cycle %d", i), want[i], b.cycles[i])
+	}
+	return diffs
+}
+
+// TestSM83Vectors runs the vectors in testdata, so that the runner is checked without the whole tests.
+// They are written in the same format for an ALU op, a memory op and a conditional call.
+func TestSM83Vectors(t *testing.T) {
+	if n := runSM83Dir(t, "testdata/sm83"); n == 0 {
+		t.Fatal("no SM83 test vectors in testdata/sm83")
+	}
+}
+
+// TestSM83 runs the SM83 single step tests for every opcode, including the CB prefixed ones.
+// It checks the registers, the memory and the bus access in each M-cycle.
+// It is skipped when the test vectors are not found.
+func TestSM83(t *testing.T) {
+	dir := os.Getenv("SM83_TESTS")
+	if dir == "" {
+		dir = sm83Dir
+	}
+	if n := runSM83Dir(t, dir); n == 0 {
+		t.Skipf("no SM83 test vectors in %s", dir)
+	}
+}
+
+// runSM83Dir runs the vectors of each JSON file in the directory and returns the number of the files.
+func runSM83Dir(t *testing.T, dir string) int {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			buf, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tests := []sm83Test{}
+			if err := json.Unmarshal(buf, &tests); err != nil {
+				t.Fatal(err)
+			}
+			for _, test := range tests {
+				// 1つのオペコードで数千件失敗しても読めるように、最初の失敗だけ報告する
+				if diffs := runSM83(test); len(diffs) > 0 {
+					t.Errorf("%s:\n  %s", test.Name, strings.Join(diffs, "\n  "))
+					return
+				}
+			}
+		})
+	}
+	return len(files)
+}
@@ -0,0 +1,219 @@
+package dap
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/kijimaD/goboy/pkg/debugger"
+	"github.com/kijimaD/goboy/pkg/srcmap"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type sourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+type setBreakpointsArguments struct {
+	Source      source             `json:"source"`
+	Breakpoints []sourceBreakpoint `json:"breakpoints"`
+}
+
+type functionBreakpoint struct {
+	Name string `json:"name"`
+}
+
+type setFunctionBreakpointsArguments struct {
+	Breakpoints []functionBreakpoint `json:"breakpoints"`
+}
+
+type setExceptionBreakpointsArguments struct {
+	Filters []string `json:"filters"`
+}
+
+type dataBreakpointInfoArguments struct {
+	VariablesReference int    `json:"variablesReference"`
+	Name               string `json:"name"`
+}
+
+type dataBreakpointInfoResponse struct {
+	// DataID is null when the variable can't be watched
+	DataID      *string  `json:"dataId"`
+	Description string   `json:"description"`
+	AccessTypes []string `json:"accessTypes,omitempty"`
+}
+
+type dataBreakpoint struct {
+	DataID string `json:"dataId"`
+}
+
+type setDataBreakpointsArguments struct {
+	Breakpoints []dataBreakpoint `json:"breakpoints"`
+}
+
+// breakpointInfo is the Breakpoint of DAP, the result of setting a breakpoint
+type breakpointInfo struct {
+	ID                   int     `json:"id,omitempty"`
+	Verified             bool    `json:"verified"`
+	Message              string  `json:"message,omitempty"`
+	Source               *source `json:"source,omitempty"`
+	Line                 int     `json:"line,omitempty"`
+	InstructionReference string  `json:"instructionReference,omitempty"`
+}
+
+type setBreakpointsResponse struct {
+	Breakpoints []breakpointInfo `json:"breakpoints"`
+}
+
+// setBreakpoints replaces the breakpoints in the source file. A line without code moves to the next instruction.
+func (s *Server) setBreakpoints(req *request) (interface{}, error) {
+	args := setBreakpointsArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	s.after = s.suspend()
+	bps := []breakpoint{}
+	infos := []breakpointInfo{}
+	for _, b := range args.Breakpoints {
+		s.ids++
+		info := breakpointInfo{ID: s.ids, Source: &args.Source, Line: b.Line}
+		if loc, line, ok := s.lookup(args.Source.Path, b.Line); ok {
+			info.Verified = true
+			info.Line = line
+			info.InstructionReference = reference(loc.Addr)
+			bps = append(bps, breakpoint{id: s.ids, bp: debugger.Breakpoint{Bank: loc.Bank, Addr: loc.Addr}})
+		} else {
+			info.Message = "no code is found at the line"
+		}
+		infos = append(infos, info)
+	}
+	s.sources[args.Source.Path] = bps
+	s.apply()
+	return setBreakpointsResponse{Breakpoints: infos}, nil
+}
+
+// setFunctionBreakpoints replaces the breakpoints at the labels or the addresses, e.g. "Main" or "01:4000".
+func (s *Server) setFunctionBreakpoints(req *request) (interface{}, error) {
+	args := setFunctionBreakpointsArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	s.after = s.suspend()
+	s.functions = nil
+	infos := []breakpointInfo{}
+	for _, b := range args.Breakpoints {
+		s.ids++
+		info := breakpointInfo{ID: s.ids}
+		if bank, addr, err := s.d.ParseAddr(b.Name); err != nil {
+			info.Message = err.Error()
+		} else {
+			info.Verified = true
+			info.InstructionReference = reference(addr)
+			s.functions = append(s.functions, breakpoint{id: s.ids, bp: debugger.Breakpoint{Bank: bank, Addr: addr}})
+		}
+		infos = append(infos, info)
+	}
+	s.apply()
+	return setBreakpointsResponse{Breakpoints: infos}, nil
+}
+
+// setExceptionBreakpoints sets whether the run stops when an interrupt is dispatched.
+func (s *Server) setExceptionBreakpoints(req *request) (interface{}, error) {
+	args := setExceptionBreakpointsArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	s.after = s.suspend()
+	on := false
+	for _, f := range args.Filters {
+		on = on || f == interruptFilter
+	}
+	s.d.SetBreakOnInterrupt(on)
+	return nil, nil
+}
+
+// dataBreakpointInfo tells whether the variable can be watched. The IO registers and the addresses can be.
+func (s *Server) dataBreakpointInfo(req *request) (interface{}, error) {
+	args := dataBreakpointInfoArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	addr, ok := types.Word(0), false
+	switch args.VariablesReference {
+	case refIO:
+		addr, ok = ioAddress(args.Name)
+	case 0:
+		// 式やラベルはアドレスとして解釈する
+		_, a, err := s.d.ParseAddr(args.Name)
+		addr, ok = a, err == nil
+	}
+	if !ok {
+		return dataBreakpointInfoResponse{Description: "only the memory can be watched"}, nil
+	}
+	id := fmt.Sprintf("%04X", addr)
+	return dataBreakpointInfoResponse{
+		DataID:      &id,
+		Description: "write to " + s.name(-1, addr),
+		AccessTypes: []string{"write"},
+	}, nil
+}
+
+// setDataBreakpoints replaces the watched addresses.
+func (s *Server) setDataBreakpoints(req *request) (interface{}, error) {
+	args := setDataBreakpointsArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	s.after = s.suspend()
+	for _, a := range s.d.Watched() {
+		s.d.Unwatch(a)
+	}
+	infos := []breakpointInfo{}
+	for _, b := range args.Breakpoints {
+		s.ids++
+		info := breakpointInfo{ID: s.ids}
+		if addr, err := strconv.ParseUint(b.DataID, 16, 16); err != nil {
+			info.Message = fmt.Sprintf("invalid data ID %q", b.DataID)
+		} else {
+			info.Verified = true
+			s.d.Watch(types.Word(addr))
+		}
+		infos = append(infos, info)
+	}
+	return setBreakpointsResponse{Breakpoints: infos}, nil
+}
+
+func (s *Server) lookup(path string, line int) (srcmap.Location, int, bool) {
+	if s.src == nil {
+		return srcmap.Location{}, 0, false
+	}
+	return s.src.Lookup(path, line)
+}
+
+// apply sets the breakpoints of the sources and the functions to the debugger.
+func (s *Server) apply() {
+	s.d.ClearBreakpoints()
+	files := []string{}
+	for f := range s.sources {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		for _, b := range s.sources[f] {
+			s.d.AddBreakpoint(b.bp)
+		}
+	}
+	for _, b := range s.functions {
+		s.d.AddBreakpoint(b.bp)
+	}
+}
+
+// reference formats the address as a memory or an instruction reference.
+func reference(addr types.Word) string {
+	return fmt.Sprintf("0x%04X", addr)
+}
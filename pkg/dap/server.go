@@ -0,0 +1,391 @@
+package dap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kijimaD/goboy/pkg/debugger"
+	"github.com/kijimaD/goboy/pkg/srcmap"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// threadID is the only thread, the CPU
+const threadID = 1
+
+// errDisconnect ends the session
+var errDisconnect = errors.New("disconnect")
+
+// breakpoint is a breakpoint set by the client
+type breakpoint struct {
+	id int
+	bp debugger.Breakpoint
+}
+
+// run is a command running the machine
+type run struct {
+	// continuing is set for continue, which can be resumed after the breakpoints are changed
+	continuing bool
+	// suspended is set when the server stops the run to change the state
+	suspended bool
+	stop      debugger.Stop
+	done      chan struct{}
+}
+
+// Server serves the Debug Adapter Protocol for the debugger, so that the ROM can be debugged in the editors, e.g. VS Code.
+// The source breakpoints and the stack frames are mapped to the RGBDS sources by the source map.
+type Server struct {
+	d    *debugger.Debugger
+	src  *srcmap.Map
+	syms *symbols.Table
+	c    *conn
+	// sources are the line breakpoints by the file, functions are the function breakpoints
+	sources   map[string][]breakpoint
+	functions []breakpoint
+	ids       int
+
+	stopOnEntry bool
+	launched    bool
+	configured  bool
+	// after runs after the response is sent, e.g. to resume the run
+	after func()
+
+	mu  sync.Mutex
+	cur *run
+}
+
+// NewServer constructs a server. The source map can be nil.
+func NewServer(d *debugger.Debugger, src *srcmap.Map) *Server {
+	return &Server{d: d, src: src, sources: map[string][]breakpoint{}}
+}
+
+// SetSymbols sets the symbols used for the names of the frames and the function breakpoints.
+// Set the same symbols to the debugger.
+func (s *Server) SetSymbols(t *symbols.Table) {
+	s.syms = t
+}
+
+// Serve serves a session until the client disconnects.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.c = newConn(r, w)
+	for {
+		req, err := s.c.read()
+		if err == io.EOF {
+			s.suspend()
+			return nil
+		}
+		if err != nil {
+			s.suspend()
+			return err
+		}
+		body, err := s.handle(req)
+		if err == errDisconnect {
+			return s.c.respond(req, nil)
+		}
+		if err != nil {
+			err = s.c.fail(req, err)
+		} else {
+			err = s.c.respond(req, body)
+		}
+		if err != nil {
+			return err
+		}
+		if s.after != nil {
+			f := s.after
+			s.after = nil
+			f()
+		}
+	}
+}
+
+type capabilities struct {
+	SupportsConfigurationDoneRequest bool              `json:"supportsConfigurationDoneRequest"`
+	SupportsFunctionBreakpoints      bool              `json:"supportsFunctionBreakpoints"`
+	SupportsDataBreakpoints          bool              `json:"supportsDataBreakpoints"`
+	SupportsSetVariable              bool              `json:"supportsSetVariable"`
+	SupportsEvaluateForHovers        bool              `json:"supportsEvaluateForHovers"`
+	SupportsReadMemoryRequest        bool              `json:"supportsReadMemoryRequest"`
+	SupportsWriteMemoryRequest       bool              `json:"supportsWriteMemoryRequest"`
+	ExceptionBreakpointFilters       []exceptionFilter `json:"exceptionBreakpointFilters"`
+}
+
+type exceptionFilter struct {
+	Filter  string `json:"filter"`
+	Label   string `json:"label"`
+	Default bool   `json:"default"`
+}
+
+// interruptFilter stops the run when an interrupt is dispatched
+const interruptFilter = "interrupt"
+
+type launchArguments struct {
+	StopOnEntry bool `json:"stopOnEntry"`
+	// SourceRoot is the directory of the RGBDS sources
+	SourceRoot string `json:"sourceRoot"`
+}
+
+type continueResponse struct {
+	AllThreadsContinued bool `json:"allThreadsContinued"`
+}
+
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type threadsResponse struct {
+	Threads []thread `json:"threads"`
+}
+
+func (s *Server) handle(req *request) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		s.after = func() { s.c.event("initialized", nil) }
+		return capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsFunctionBreakpoints:      true,
+			SupportsDataBreakpoints:          true,
+			SupportsSetVariable:              true,
+			SupportsEvaluateForHovers:        true,
+			SupportsReadMemoryRequest:        true,
+			SupportsWriteMemoryRequest:       true,
+			ExceptionBreakpointFilters:       []exceptionFilter{{Filter: interruptFilter, Label: "Interrupts"}},
+		}, nil
+	case "launch", "attach":
+		args := launchArguments{}
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		if args.SourceRoot != "" && s.src != nil {
+			if err := s.src.AddDir(args.SourceRoot); err != nil {
+				return nil, err
+			}
+		}
+		s.stopOnEntry = args.StopOnEntry
+		s.launched = true
+		s.after = s.begin
+		return nil, nil
+	case "configurationDone":
+		s.configured = true
+		s.after = s.begin
+		return nil, nil
+	case "setBreakpoints":
+		return s.setBreakpoints(req)
+	case "setFunctionBreakpoints":
+		return s.setFunctionBreakpoints(req)
+	case "setExceptionBreakpoints":
+		return s.setExceptionBreakpoints(req)
+	case "dataBreakpointInfo":
+		return s.dataBreakpointInfo(req)
+	case "setDataBreakpoints":
+		return s.setDataBreakpoints(req)
+	case "threads":
+		return threadsResponse{Threads: []thread{{ID: threadID, Name: "CPU"}}}, nil
+	case "continue":
+		if s.running() == nil {
+			s.start(true, s.d.Continue)
+		}
+		return continueResponse{AllThreadsContinued: true}, nil
+	case "next", "stepIn", "stepOut":
+		if s.running() != nil {
+			return nil, errors.New("the machine is running")
+		}
+		f := map[string]func() debugger.Stop{
+			"next":    s.d.StepOver,
+			"stepIn":  func() debugger.Stop { return s.d.Step(1) },
+			"stepOut": s.d.StepOut,
+		}[req.Command]
+		s.start(false, f)
+		return nil, nil
+	case "pause":
+		if r := s.running(); r != nil {
+			s.interrupt(r)
+		}
+		return nil, nil
+	case "disconnect", "terminate":
+		s.suspend()
+		return nil, errDisconnect
+	}
+	// 以下は止まっている間に状態を見る
+	if s.running() != nil {
+		return nil, errors.New("the machine is running")
+	}
+	switch req.Command {
+	case "stackTrace":
+		return s.stackTrace(req)
+	case "scopes":
+		return s.scopes(req)
+	case "variables":
+		return s.variables(req)
+	case "setVariable":
+		return s.setVariable(req)
+	case "evaluate":
+		return s.evaluate(req)
+	case "readMemory":
+		return s.readMemory(req)
+	case "writeMemory":
+		return s.writeMemory(req)
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+func decode(req *request, v interface{}) error {
+	if len(req.Arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(req.Arguments, v); err != nil {
+		return fmt.Errorf("invalid arguments of %s: %v", req.Command, err)
+	}
+	return nil
+}
+
+// begin starts the machine when both launch and configurationDone are received.
+func (s *Server) begin() {
+	if !s.launched || !s.configured {
+		return
+	}
+	if s.stopOnEntry {
+		s.c.event("stopped", stoppedEvent{Reason: "entry", ThreadID: threadID, AllThreadsStopped: true})
+		return
+	}
+	s.start(true, s.d.Continue)
+}
+
+// start runs the command in a goroutine. The stopped event is sent when it stops.
+func (s *Server) start(continuing bool, f func() debugger.Stop) {
+	r := &run{continuing: continuing, done: make(chan struct{})}
+	s.mu.Lock()
+	s.cur = r
+	s.mu.Unlock()
+	go func() {
+		stop := f()
+		// 止まった状態は、次のリクエストで変わる前に読む
+		e := s.describe(stop)
+		s.mu.Lock()
+		r.stop = stop
+		s.cur = nil
+		suspended := r.suspended
+		s.mu.Unlock()
+		close(r.done)
+		if !suspended {
+			s.c.event("stopped", e)
+		}
+	}()
+}
+
+func (s *Server) running() *run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+// interrupt stops the run and waits for it.
+// The debugger drops the interrupt requested before the command starts, so it is repeated.
+func (s *Server) interrupt(r *run) {
+	for {
+		s.d.Interrupt()
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// suspend stops the run without the stopped event, so that the breakpoints can be changed.
+// The returned function resumes the run.
+func (s *Server) suspend() func() {
+	s.mu.Lock()
+	r := s.cur
+	if r != nil {
+		r.suspended = true
+	}
+	s.mu.Unlock()
+	if r == nil {
+		return func() {}
+	}
+	s.interrupt(r)
+	if r.stop.Reason == debugger.Interrupted && r.continuing {
+		return func() { s.start(true, s.d.Continue) }
+	}
+	// ステップは再開できないので、止まった場所で報告する
+	stop := r.stop
+	return func() { s.stopped(stop) }
+}
+
+type stoppedEvent struct {
+	Reason            string `json:"reason"`
+	Description       string `json:"description,omitempty"`
+	Text              string `json:"text,omitempty"`
+	ThreadID          int    `json:"threadId"`
+	AllThreadsStopped bool   `json:"allThreadsStopped"`
+	HitBreakpointIDs  []int  `json:"hitBreakpointIds,omitempty"`
+}
+
+// stopped sends the stopped event for the stop.
+func (s *Server) stopped(stop debugger.Stop) {
+	s.c.event("stopped", s.describe(stop))
+}
+
+// describe makes the stopped event for the stop.
+func (s *Server) describe(stop debugger.Stop) stoppedEvent {
+	e := stoppedEvent{ThreadID: threadID, AllThreadsStopped: true}
+	switch stop.Reason {
+	case debugger.Done:
+		e.Reason = "step"
+	case debugger.BreakpointHit:
+		e.Reason = "breakpoint"
+		for _, bps := range s.sources {
+			e.HitBreakpointIDs = append(e.HitBreakpointIDs, s.hit(bps)...)
+		}
+		if len(e.HitBreakpointIDs) == 0 {
+			e.Reason = "function breakpoint"
+			e.HitBreakpointIDs = s.hit(s.functions)
+		}
+		sort.Ints(e.HitBreakpointIDs)
+	case debugger.InterruptTaken:
+		e.Reason = "exception"
+		e.Description = "Paused on interrupt"
+		e.Text = interruptText(s.d.CPU().PC)
+	case debugger.WriteWatched:
+		e.Reason = "data breakpoint"
+		e.Description = fmt.Sprintf("Paused on write of $%02X to %s", stop.Value, s.name(-1, stop.Addr))
+	case debugger.Locked:
+		e.Reason = "exception"
+		e.Description = "Paused on lockup"
+		if s.syms == nil {
+			e.Text = stop.Lockup.String()
+		} else {
+			e.Text = stop.Lockup.Format(s.syms)
+		}
+	case debugger.Interrupted:
+		e.Reason = "pause"
+	}
+	return e
+}
+
+// interruptText describes the interrupt at the vector, e.g. "VBlank interrupt".
+func interruptText(pc types.Word) string {
+	if name := debugger.VectorName(pc); name != "" {
+		return name + " interrupt"
+	}
+	return "interrupt"
+}
+
+// hit returns the breakpoints at PC.
+func (s *Server) hit(bps []breakpoint) []int {
+	c := s.d.CPU()
+	bank := c.ROMBank(c.PC)
+	ids := []int{}
+	for _, b := range bps {
+		if b.bp.Matches(bank, c.PC) {
+			ids = append(ids, b.id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,379 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/debugger"
+	"github.com/kijimaD/goboy/pkg/gb"
+	"github.com/kijimaD/goboy/pkg/gpu"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/pad"
+	"github.com/kijimaD/goboy/pkg/ram"
+	"github.com/kijimaD/goboy/pkg/srcmap"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/timer"
+	"github.com/kijimaD/goboy/pkg/window/headless"
+	"github.com/stretchr/testify/assert"
+)
+
+// rgbdsSource is the RGBDS source of code. The markers name the lines.
+const rgbdsSource = `SECTION "Start", ROM0[$100]
+Start:
+	ld sp, $FFFE
+	ld a, 1
+	call Sub          ; @call
+	ld [wResult], a
+	ld a, $91
+	ldh [$FF40], a
+	ld a, 1
+	ldh [$FFFF], a
+	ei
+.loop
+	halt              ; @halt
+	jr .loop
+
+Sub:
+	inc a             ; @sub
+	inc a             ; @next
+	ret
+`
+
+const code = `
+	LD SP,$FFFE
+	LD A,1
+	CALL sub
+	LD ($C000),A
+	LD A,$91
+	LDH ($FF40),A
+	LD A,1
+	LDH ($FFFF),A
+	EI
+loop:
+	HALT
+	JR loop
+sub:
+	INC A
+	INC A
+	RET
+`
+
+const sym = `00:0100 Start
+00:0114 Start.loop
+00:0117 Sub
+00:C000 wResult
+`
+
+func lineOf(marker string) int {
+	for i, l := range strings.Split(rgbdsSource, "\n") {
+		if strings.HasSuffix(l, "; @"+marker) {
+			return i + 1
+		}
+	}
+	panic(marker)
+}
+
+// setup starts the server for the machine running code, and returns the client and the path of the source.
+func setup(t *testing.T) (*client, string) {
+	rom := make([]byte, 0x8000)
+	// VBlank割り込みはすぐに戻る
+	rom[0x0040] = 0xD9
+	copy(rom[0x0100:], asm.MustAssemble(code, 0x0100))
+	cart, err := cartridge.NewCartridge(rom)
+	assert.NoError(t, err)
+	l := logger.NewLogger(logger.LogLevel("Info"))
+	g := gpu.NewGPU()
+	irq := interrupt.NewInterrupt()
+	b := bus.NewBus(l, cart, g, ram.NewRAM(0x2000), ram.NewRAM(0x2000), ram.NewRAM(0x80), ram.NewRAM(0xA0), timer.NewTimer(), apu.NewAPU(), irq, pad.NewPad())
+	g.Init(b, irq)
+	c := cpu.NewCPU(l, b, irq)
+	emu := gb.NewGB(c, g, timer.NewTimer(), apu.NewAPU(), irq, headless.New())
+	d := debugger.New(emu, c, b)
+	emu.OnLockup(d.Lockup)
+
+	syms, err := symbols.Parse(strings.NewReader(sym))
+	assert.NoError(t, err)
+	d.SetSymbols(syms)
+	path := filepath.Join(t.TempDir(), "main.asm")
+	assert.NoError(t, os.WriteFile(path, []byte(rgbdsSource), 0o644))
+	s := NewServer(d, srcmap.New(rom, syms))
+	s.SetSymbols(syms)
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(inR, outW)
+		outW.Close()
+	}()
+	cl := &client{t: t, w: inW, msgs: make(chan message, 64), done: done}
+	go cl.receive(outR)
+	return cl, path
+}
+
+// message is a response or an event received by the client
+type message struct {
+	Type       string          `json:"type"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Command    string          `json:"command"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client is a scripted DAP client
+type client struct {
+	t    *testing.T
+	w    io.Writer
+	seq  int
+	msgs chan message
+	// events are received while waiting for a response
+	events []message
+	done   chan error
+}
+
+func (c *client) receive(r io.Reader) {
+	br := bufio.NewReader(r)
+	for {
+		h, err := textproto.NewReader(br).ReadMIMEHeader()
+		if err != nil {
+			close(c.msgs)
+			return
+		}
+		n, _ := strconv.Atoi(h.Get("Content-Length"))
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			close(c.msgs)
+			return
+		}
+		m := message{}
+		if err := json.Unmarshal(buf, &m); err != nil {
+			panic(err)
+		}
+		c.msgs <- m
+	}
+}
+
+func (c *client) next() message {
+	select {
+	case m, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("the server closed the connection")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timeout")
+	}
+	return message{}
+}
+
+// call sends the request and returns the response.
+func (c *client) call(command string, args interface{}) message {
+	c.seq++
+	buf, err := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	assert.NoError(c.t, err)
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	for {
+		m := c.next()
+		if m.Type == "event" {
+			c.events = append(c.events, m)
+			continue
+		}
+		assert.Equal(c.t, c.seq, m.RequestSeq)
+		return m
+	}
+}
+
+// request sends the request and decodes the body of the response into v.
+func (c *client) request(command string, args interface{}, v interface{}) {
+	m := c.call(command, args)
+	assert.True(c.t, m.Success, "%s: %s", command, m.Message)
+	if v != nil {
+		assert.NoError(c.t, json.Unmarshal(m.Body, v))
+	}
+}
+
+// event waits for the event and decodes its body into v.
+func (c *client) event(name string, v interface{}) {
+	for {
+		var m message
+		if len(c.events) > 0 {
+			m, c.events = c.events[0], c.events[1:]
+		} else {
+			m = c.next()
+		}
+		if m.Type == "event" && m.Event == name {
+			if v != nil {
+				assert.NoError(c.t, json.Unmarshal(m.Body, v))
+			}
+			return
+		}
+	}
+}
+
+func (c *client) stopped() stoppedEvent {
+	e := stoppedEvent{}
+	c.event("stopped", &e)
+	return e
+}
+
+func (c *client) stackTrace() []stackFrame {
+	res := stackTraceResponse{}
+	c.request("stackTrace", map[string]int{"threadId": threadID}, &res)
+	return res.StackFrames
+}
+
+func (c *client) variables(ref int) map[string]string {
+	res := variablesResponse{}
+	c.request("variables", map[string]int{"variablesReference": ref}, &res)
+	vars := map[string]string{}
+	for _, v := range res.Variables {
+		vars[v.Name] = v.Value
+	}
+	return vars
+}
+
+func TestSession(t *testing.T) {
+	c, path := setup(t)
+	caps := capabilities{}
+	c.request("initialize", map[string]string{"adapterID": "goboy"}, &caps)
+	assert.True(t, caps.SupportsConfigurationDoneRequest)
+	c.event("initialized", nil)
+	c.request("launch", map[string]bool{"stopOnEntry": true}, nil)
+
+	bps := setBreakpointsResponse{}
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      source{Path: path},
+		"breakpoints": []map[string]int{{"line": lineOf("sub")}, {"line": 1}},
+	}, &bps)
+	assert.Len(t, bps.Breakpoints, 2)
+	assert.True(t, bps.Breakpoints[0].Verified)
+	assert.Equal(t, lineOf("sub"), bps.Breakpoints[0].Line)
+	assert.Equal(t, "0x0117", bps.Breakpoints[0].InstructionReference)
+	// SECTIONの行は次の命令に
+	assert.True(t, bps.Breakpoints[1].Verified)
+	assert.Equal(t, 3, bps.Breakpoints[1].Line)
+
+	c.request("configurationDone", nil, nil)
+	assert.Equal(t, "entry", c.stopped().Reason)
+
+	threads := threadsResponse{}
+	c.request("threads", nil, &threads)
+	assert.Equal(t, []thread{{ID: threadID, Name: "CPU"}}, threads.Threads)
+
+	c.request("continue", map[string]int{"threadId": threadID}, nil)
+	stop := c.stopped()
+	assert.Equal(t, "breakpoint", stop.Reason)
+	assert.Equal(t, []int{bps.Breakpoints[0].ID}, stop.HitBreakpointIDs)
+
+	frames := c.stackTrace()
+	assert.Len(t, frames, 2)
+	assert.Equal(t, "Sub", frames[0].Name)
+	assert.Equal(t, lineOf("sub"), frames[0].Line)
+	assert.Equal(t, path, frames[0].Source.Path)
+	assert.Equal(t, "Start+$5", frames[1].Name)
+	assert.Equal(t, lineOf("call"), frames[1].Line)
+
+	scopes := scopesResponse{}
+	c.request("scopes", map[string]int{"frameId": frames[0].ID}, &scopes)
+	assert.Len(t, scopes.Scopes, 3)
+	regs := c.variables(refRegisters)
+	assert.Equal(t, "$01", regs["A"])
+	assert.Equal(t, "$FFFC", regs["SP"])
+	assert.Equal(t, "$0117", regs["PC"])
+
+	set := setVariableResponse{}
+	c.request("setVariable", map[string]interface{}{"variablesReference": refRegisters, "name": "A", "value": "$10"}, &set)
+	assert.Equal(t, "$10", set.Value)
+	c.request("setVariable", map[string]interface{}{"variablesReference": refFlags, "name": "C", "value": "1"}, nil)
+	assert.Equal(t, "1", c.variables(refFlags)["C"])
+
+	c.request("next", map[string]int{"threadId": threadID}, nil)
+	assert.Equal(t, "step", c.stopped().Reason)
+	assert.Equal(t, lineOf("next"), c.stackTrace()[0].Line)
+	assert.Equal(t, "$11", c.variables(refRegisters)["A"])
+
+	c.request("stepOut", map[string]int{"threadId": threadID}, nil)
+	assert.Equal(t, "step", c.stopped().Reason)
+	frames = c.stackTrace()
+	assert.Len(t, frames, 1)
+	assert.Equal(t, "Start+$8", frames[0].Name)
+
+	info := dataBreakpointInfoResponse{}
+	c.request("dataBreakpointInfo", map[string]interface{}{"variablesReference": refIO, "name": "LCDC"}, &info)
+	assert.Equal(t, "FF40", *info.DataID)
+	c.request("dataBreakpointInfo", map[string]interface{}{"variablesReference": refRegisters, "name": "A"}, &info)
+	assert.Nil(t, info.DataID)
+	c.request("setDataBreakpoints", map[string]interface{}{"breakpoints": []map[string]string{{"dataId": "FF40"}}}, nil)
+	c.request("continue", map[string]int{"threadId": threadID}, nil)
+	assert.Equal(t, "data breakpoint", c.stopped().Reason)
+	assert.Equal(t, "$91", c.variables(refIO)["LCDC"])
+
+	mem := readMemoryResponse{}
+	c.request("writeMemory", map[string]interface{}{"memoryReference": "0xC000", "offset": 1, "data": "EjQ="}, nil)
+	c.request("readMemory", map[string]interface{}{"memoryReference": "0xC000", "count": 3}, &mem)
+	// 0x12, 0x12, 0x34
+	assert.Equal(t, "EhI0", mem.Data)
+	assert.Equal(t, "12 12 34", c.variables(refRegion + 4)["C000"][:8])
+	eval := evaluateResponse{}
+	c.request("evaluate", map[string]string{"expression": "wResult"}, &eval)
+	assert.Equal(t, "$12", eval.Result)
+
+	c.request("setDataBreakpoints", map[string]interface{}{"breakpoints": []interface{}{}}, nil)
+	c.request("setExceptionBreakpoints", map[string]interface{}{"filters": []string{interruptFilter}}, nil)
+	c.request("continue", map[string]int{"threadId": threadID}, nil)
+	stop = c.stopped()
+	assert.Equal(t, "exception", stop.Reason)
+	assert.Equal(t, "VBlank interrupt", stop.Text)
+
+	c.request("disconnect", nil, nil)
+	assert.NoError(t, <-c.done)
+}
+
+func TestPause(t *testing.T) {
+	c, path := setup(t)
+	c.request("initialize", nil, nil)
+	c.request("launch", nil, nil)
+	c.request("configurationDone", nil, nil)
+
+	// 実行中はレジスタを見られない
+	assert.False(t, c.call("variables", map[string]int{"variablesReference": refRegisters}).Success)
+
+	c.request("pause", map[string]int{"threadId": threadID}, nil)
+	assert.Equal(t, "pause", c.stopped().Reason)
+
+	// 実行中に設定したブレークポイントで止まる
+	c.request("continue", map[string]int{"threadId": threadID}, nil)
+	bps := setBreakpointsResponse{}
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      source{Path: path},
+		"breakpoints": []map[string]int{{"line": lineOf("halt")}},
+	}, &bps)
+	stop := c.stopped()
+	assert.Equal(t, "breakpoint", stop.Reason)
+	assert.Equal(t, []int{bps.Breakpoints[0].ID}, stop.HitBreakpointIDs)
+	assert.Equal(t, lineOf("halt"), c.stackTrace()[0].Line)
+
+	c.request("setFunctionBreakpoints", map[string]interface{}{"breakpoints": []map[string]string{{"name": "Sub"}, {"name": "Nowhere"}}}, &bps)
+	assert.True(t, bps.Breakpoints[0].Verified)
+	assert.False(t, bps.Breakpoints[1].Verified)
+
+	c.request("disconnect", nil, nil)
+	assert.NoError(t, <-c.done)
+}
@@ -0,0 +1,445 @@
+package dap
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// variablesReference of the scopes. The memory regions follow refRegion.
+const (
+	refRegisters = iota + 1
+	refIO
+	refMemory
+	refFlags
+	refRegion = 100
+)
+
+// ioRegister is an IO register shown in the IO scope
+type ioRegister struct {
+	name string
+	addr types.Word
+}
+
+var ioRegisters = []ioRegister{
+	{"P1", 0xFF00}, {"SB", 0xFF01}, {"SC", 0xFF02},
+	{"DIV", 0xFF04}, {"TIMA", 0xFF05}, {"TMA", 0xFF06}, {"TAC", 0xFF07},
+	{"IF", 0xFF0F},
+	{"NR10", 0xFF10}, {"NR11", 0xFF11}, {"NR12", 0xFF12}, {"NR13", 0xFF13}, {"NR14", 0xFF14},
+	{"NR21", 0xFF16}, {"NR22", 0xFF17}, {"NR23", 0xFF18}, {"NR24", 0xFF19},
+	{"NR30", 0xFF1A}, {"NR31", 0xFF1B}, {"NR32", 0xFF1C}, {"NR33", 0xFF1D}, {"NR34", 0xFF1E},
+	{"NR41", 0xFF20}, {"NR42", 0xFF21}, {"NR43", 0xFF22}, {"NR44", 0xFF23},
+	{"NR50", 0xFF24}, {"NR51", 0xFF25}, {"NR52", 0xFF26},
+	{"LCDC", 0xFF40}, {"STAT", 0xFF41}, {"SCY", 0xFF42}, {"SCX", 0xFF43}, {"LY", 0xFF44}, {"LYC", 0xFF45},
+	{"DMA", 0xFF46}, {"BGP", 0xFF47}, {"OBP0", 0xFF48}, {"OBP1", 0xFF49}, {"WY", 0xFF4A}, {"WX", 0xFF4B},
+	{"IE", 0xFFFF},
+}
+
+func ioAddress(name string) (types.Word, bool) {
+	for _, r := range ioRegisters {
+		if r.name == name {
+			return r.addr, true
+		}
+	}
+	return 0, false
+}
+
+// region is a memory range shown in the Memory scope
+type region struct {
+	name       string
+	start, end types.Word
+}
+
+var regions = []region{
+	{"ROM0", 0x0000, 0x3FFF},
+	{"ROMX", 0x4000, 0x7FFF},
+	{"VRAM", 0x8000, 0x9FFF},
+	{"SRAM", 0xA000, 0xBFFF},
+	{"WRAM", 0xC000, 0xDFFF},
+	{"OAM", 0xFE00, 0xFE9F},
+	{"HRAM", 0xFF80, 0xFFFE},
+}
+
+// rowSize is the bytes in a row of a memory region
+const rowSize = 16
+
+type stackTraceArguments struct {
+	StartFrame int `json:"startFrame"`
+	Levels     int `json:"levels"`
+}
+
+type stackFrame struct {
+	ID                          int     `json:"id"`
+	Name                        string  `json:"name"`
+	Source                      *source `json:"source,omitempty"`
+	Line                        int     `json:"line"`
+	Column                      int     `json:"column"`
+	InstructionPointerReference string  `json:"instructionPointerReference"`
+}
+
+type stackTraceResponse struct {
+	StackFrames []stackFrame `json:"stackFrames"`
+	TotalFrames int          `json:"totalFrames"`
+}
+
+// stackTrace returns the current instruction and the calls tracked by the debugger.
+func (s *Server) stackTrace(req *request) (interface{}, error) {
+	args := stackTraceArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	c := s.d.CPU()
+	frames := []stackFrame{s.frame(0, c.ROMBank(c.PC), c.PC)}
+	calls := s.d.Frames()
+	for i := len(calls) - 1; i >= 0; i-- {
+		frames = append(frames, s.frame(len(frames), calls[i].CallBank, calls[i].CallPC))
+	}
+	total := len(frames)
+	if args.StartFrame < len(frames) {
+		frames = frames[args.StartFrame:]
+	} else {
+		frames = nil
+	}
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+	return stackTraceResponse{StackFrames: frames, TotalFrames: total}, nil
+}
+
+func (s *Server) frame(id, bank int, pc types.Word) stackFrame {
+	// IDは1から
+	f := stackFrame{ID: id + 1, Name: s.name(bank, pc), InstructionPointerReference: reference(pc)}
+	if s.src == nil {
+		return f
+	}
+	if l, ok := s.src.Line(bank, pc); ok {
+		f.Source = &source{Name: filepath.Base(l.File), Path: l.File}
+		f.Line, f.Column = l.Line, 1
+	}
+	return f
+}
+
+// name returns the label of the address, or the address, e.g. "Main+$5" or "01:4000".
+func (s *Server) name(bank int, addr types.Word) string {
+	if label, ok := s.syms.Label(bank, addr); ok {
+		return label
+	}
+	if bank < 0 {
+		return fmt.Sprintf("$%04X", addr)
+	}
+	return fmt.Sprintf("%02X:%04X", bank, addr)
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	PresentationHint   string `json:"presentationHint,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type scopesResponse struct {
+	Scopes []scope `json:"scopes"`
+}
+
+// scopes returns the same scopes for all the frames. The machine has no local variables.
+func (s *Server) scopes(req *request) (interface{}, error) {
+	return scopesResponse{Scopes: []scope{
+		{Name: "Registers", PresentationHint: "registers", VariablesReference: refRegisters},
+		{Name: "IO", VariablesReference: refIO},
+		{Name: "Memory", VariablesReference: refMemory, Expensive: true},
+	}}, nil
+}
+
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+type variablesResponse struct {
+	Variables []variable `json:"variables"`
+}
+
+func (s *Server) variables(req *request) (interface{}, error) {
+	args := variablesArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	c, r := s.d.CPU(), s.d.CPU().Regs
+	vars := []variable{}
+	switch ref := args.VariablesReference; {
+	case ref == refRegisters:
+		for _, v := range []struct {
+			name  string
+			value byte
+		}{{"A", r.A}, {"F", r.F}, {"B", r.B}, {"C", r.C}, {"D", r.D}, {"E", r.E}, {"H", r.H}, {"L", r.L}} {
+			vars = append(vars, variable{Name: v.name, Value: fmt.Sprintf("$%02X", v.value)})
+		}
+		vars[1].VariablesReference = refFlags
+		for _, v := range []struct {
+			name  string
+			value types.Word
+		}{{"AF", word(r.A, r.F)}, {"BC", word(r.B, r.C)}, {"DE", word(r.D, r.E)}, {"HL", word(r.H, r.L)}, {"SP", c.SP}, {"PC", c.PC}} {
+			vars = append(vars, variable{Name: v.name, Value: fmt.Sprintf("$%04X", v.value), MemoryReference: reference(v.value)})
+		}
+		vars = append(vars, variable{Name: "IME", Value: strconv.Itoa(btoi(c.IME()))})
+	case ref == refFlags:
+		for i, name := range []string{"Z", "N", "H", "C"} {
+			vars = append(vars, variable{Name: name, Value: strconv.Itoa(int(r.F>>(7-i)) & 1)})
+		}
+	case ref == refIO:
+		for _, io := range ioRegisters {
+			vars = append(vars, variable{Name: io.name, Value: fmt.Sprintf("$%02X", s.d.ReadMemory(io.addr, 1)[0]), MemoryReference: reference(io.addr)})
+		}
+	case ref == refMemory:
+		for i, m := range regions {
+			vars = append(vars, variable{
+				Name:               m.name,
+				Value:              fmt.Sprintf("$%04X-$%04X", m.start, m.end),
+				VariablesReference: refRegion + i,
+				MemoryReference:    reference(m.start),
+			})
+		}
+	case ref >= refRegion && ref < refRegion+len(regions):
+		m := regions[ref-refRegion]
+		for addr := int(m.start); addr <= int(m.end); addr += rowSize {
+			n := rowSize
+			if addr+n > int(m.end)+1 {
+				n = int(m.end) + 1 - addr
+			}
+			vars = append(vars, variable{
+				Name:            fmt.Sprintf("%04X", addr),
+				Value:           hexBytes(s.d.ReadMemory(types.Word(addr), n)),
+				MemoryReference: reference(types.Word(addr)),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown variables reference %d", ref)
+	}
+	return variablesResponse{Variables: vars}, nil
+}
+
+type setVariableArguments struct {
+	VariablesReference int    `json:"variablesReference"`
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+}
+
+type setVariableResponse struct {
+	Value string `json:"value"`
+}
+
+// setVariable sets a register, a flag, an IO register or a row of memory.
+// The numbers are decimal unless they have $ or 0x. The row takes hex bytes, e.g. "12 34".
+func (s *Server) setVariable(req *request) (interface{}, error) {
+	args := setVariableArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	switch ref := args.VariablesReference; {
+	case ref == refRegisters:
+		v, err := parseNumber(args.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.d.SetRegister(args.Name, v); err != nil {
+			return nil, err
+		}
+		if len(args.Name) == 1 {
+			return setVariableResponse{Value: fmt.Sprintf("$%02X", v&0xFF)}, nil
+		}
+		return setVariableResponse{Value: fmt.Sprintf("$%04X", v)}, nil
+	case ref == refFlags:
+		bit := strings.Index("ZNHC", args.Name)
+		if len(args.Name) != 1 || bit < 0 || args.Value != "0" && args.Value != "1" {
+			return nil, fmt.Errorf("flag %s takes 0 or 1", args.Name)
+		}
+		f := s.d.CPU().Regs.F &^ (0x80 >> bit)
+		if args.Value == "1" {
+			f |= 0x80 >> bit
+		}
+		s.d.SetRegister("f", int(f))
+		return setVariableResponse{Value: args.Value}, nil
+	case ref == refIO:
+		addr, ok := ioAddress(args.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown IO register %q", args.Name)
+		}
+		v, err := parseNumber(args.Value)
+		if err != nil || v > 0xFF {
+			return nil, fmt.Errorf("%s is not a byte", args.Value)
+		}
+		s.d.WriteMemory(addr, []byte{byte(v)})
+		return setVariableResponse{Value: fmt.Sprintf("$%02X", s.d.ReadMemory(addr, 1)[0])}, nil
+	case ref >= refRegion && ref < refRegion+len(regions):
+		addr, err := strconv.ParseUint(args.Name, 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid row %q", args.Name)
+		}
+		data := []byte{}
+		for _, f := range strings.Fields(args.Value) {
+			b, err := strconv.ParseUint(f, 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a hex byte", f)
+			}
+			data = append(data, byte(b))
+		}
+		s.d.WriteMemory(types.Word(addr), data)
+		return setVariableResponse{Value: hexBytes(s.d.ReadMemory(types.Word(addr), len(data)))}, nil
+	}
+	return nil, errors.New("the variable can't be set")
+}
+
+type evaluateArguments struct {
+	Expression string `json:"expression"`
+}
+
+type evaluateResponse struct {
+	Result             string `json:"result"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+// evaluate returns a register, or the byte at an address or a label, e.g. "hl", "wScore" or "C000".
+func (s *Server) evaluate(req *request) (interface{}, error) {
+	args := evaluateArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	expr := strings.TrimSpace(args.Expression)
+	c, r := s.d.CPU(), s.d.CPU().Regs
+	regs := map[string]int{
+		"a": int(r.A), "f": int(r.F), "b": int(r.B), "c": int(r.C), "d": int(r.D), "e": int(r.E), "h": int(r.H), "l": int(r.L),
+		"af": int(word(r.A, r.F)), "bc": int(word(r.B, r.C)), "de": int(word(r.D, r.E)), "hl": int(word(r.H, r.L)),
+		"sp": int(c.SP), "pc": int(c.PC),
+	}
+	if v, ok := regs[strings.ToLower(expr)]; ok {
+		if len(expr) == 1 {
+			return evaluateResponse{Result: fmt.Sprintf("$%02X", v)}, nil
+		}
+		return evaluateResponse{Result: fmt.Sprintf("$%04X", v), MemoryReference: reference(types.Word(v))}, nil
+	}
+	bank, addr, err := s.d.ParseAddr(expr)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateResponse{
+		Result:          fmt.Sprintf("$%02X", s.d.ReadMemory(addr, 1)[0]),
+		Type:            s.name(bank, addr),
+		MemoryReference: reference(addr),
+	}, nil
+}
+
+type readMemoryArguments struct {
+	MemoryReference string `json:"memoryReference"`
+	Offset          int    `json:"offset"`
+	Count           int    `json:"count"`
+}
+
+type readMemoryResponse struct {
+	Address         string `json:"address"`
+	Data            string `json:"data"`
+	UnreadableBytes int    `json:"unreadableBytes,omitempty"`
+}
+
+func (s *Server) readMemory(req *request) (interface{}, error) {
+	args := readMemoryArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	start, n, err := memoryRange(args.MemoryReference, args.Offset, args.Count)
+	if err != nil {
+		return nil, err
+	}
+	return readMemoryResponse{
+		Address:         reference(types.Word(start)),
+		Data:            base64.StdEncoding.EncodeToString(s.d.ReadMemory(types.Word(start), n)),
+		UnreadableBytes: args.Count - n,
+	}, nil
+}
+
+type writeMemoryArguments struct {
+	MemoryReference string `json:"memoryReference"`
+	Offset          int    `json:"offset"`
+	Data            string `json:"data"`
+}
+
+type writeMemoryResponse struct {
+	BytesWritten int `json:"bytesWritten"`
+}
+
+func (s *Server) writeMemory(req *request) (interface{}, error) {
+	args := writeMemoryArguments{}
+	if err := decode(req, &args); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(args.Data)
+	if err != nil {
+		return nil, err
+	}
+	start, n, err := memoryRange(args.MemoryReference, args.Offset, len(data))
+	if err != nil {
+		return nil, err
+	}
+	s.d.WriteMemory(types.Word(start), data[:n])
+	return writeMemoryResponse{BytesWritten: n}, nil
+}
+
+// memoryRange returns the start and the length of the range in the address space.
+func memoryRange(ref string, offset, count int) (int, int, error) {
+	base, err := strconv.ParseUint(ref, 0, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid memory reference %q", ref)
+	}
+	start := int(base) + offset
+	if start < 0 || start > 0xFFFF || count < 0 {
+		return 0, 0, fmt.Errorf("$%X is out of the address space", start)
+	}
+	if start+count > 0x10000 {
+		count = 0x10000 - start
+	}
+	return start, count, nil
+}
+
+// parseNumber parses "$FF", "0xFF" or "255".
+func parseNumber(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "$") {
+		s = "0x" + s[1:]
+	}
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return int(v), nil
+}
+
+func hexBytes(data []byte) string {
+	hex := make([]string, len(data))
+	for i, b := range data {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, " ")
+}
+
+func word(hi, lo byte) types.Word {
+	return types.Word(hi)<<8 | types.Word(lo)
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,415 @@
+package debugger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/profiler"
+	"github.com/kijimaD/goboy/pkg/journal"
+	"github.com/kijimaD/goboy/pkg/lockup"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// Machine is the emulator driven by the debugger. gb.GB implements it.
+type Machine interface {
+	// Step runs one CPU step with the peripherals. It returns true when a frame is completed.
+	Step() bool
+	// OAMDMA reports whether the next step runs OAM DMA instead of CPU
+	OAMDMA() bool
+}
+
+// Breakpoint stops the run before the instruction at the address.
+// Bank is -1 to stop in any bank. It is only checked in 0x4000-0x7FFF.
+type Breakpoint struct {
+	Bank int
+	Addr types.Word
+}
+
+func (b Breakpoint) String() string {
+	if b.Bank < 0 {
+		return fmt.Sprintf("$%04X", b.Addr)
+	}
+	return fmt.Sprintf("%02X:%04X", b.Bank, b.Addr)
+}
+
+// Matches reports whether the breakpoint is at the PC in the bank.
+func (b Breakpoint) Matches(bank int, pc types.Word) bool {
+	if b.Addr != pc {
+		return false
+	}
+	return b.Bank < 0 || pc < 0x4000 || pc >= 0x8000 || b.Bank == bank
+}
+
+// Reason is why the run stopped.
+type Reason int
+
+const (
+	// Done means the command finished, e.g. an instruction was stepped
+	Done Reason = iota
+	// BreakpointHit means PC reached a breakpoint
+	BreakpointHit
+	// InterruptTaken means CPU jumped to an interrupt vector
+	InterruptTaken
+	// WriteWatched means CPU wrote a watched address
+	WriteWatched
+	// Locked means the machine got stuck
+	Locked
+	// Interrupted means the user stopped the run, e.g. by Ctrl-C
+	Interrupted
+)
+
+// Stop describes why the run stopped.
+type Stop struct {
+	Reason Reason
+	// Addr and Value are the watched write
+	Addr  types.Word
+	Value byte
+	// Lockup is the event when Reason is Locked
+	Lockup *lockup.Event
+}
+
+// step is what happened in a step of the machine
+type step struct {
+	// executed is set when CPU executed an instruction
+	executed bool
+	// irq is set when CPU dispatched an interrupt
+	irq bool
+	// frame is set when a frame is completed
+	frame bool
+	// opcode is the executed opcode
+	opcode byte
+	// pc, bank and sp are the state before the step
+	pc   types.Word
+	bank int
+	sp   types.Word
+}
+
+// maxFrames bounds the call stack. Code that never returns, e.g. a main loop entered by CALL, stops growing it.
+const maxFrames = 256
+
+// Frame is a subroutine or an interrupt handler on the call stack.
+type Frame struct {
+	// Bank and Addr are the called address
+	Bank int
+	Addr types.Word
+	// CallBank and CallPC are the call instruction, or the interrupted instruction
+	CallBank int
+	CallPC   types.Word
+	// Interrupt is set for an interrupt handler
+	Interrupt bool
+	// sp is SP just after the return address was pushed
+	sp types.Word
+}
+
+// write is a CPU write to a watched address
+type write struct {
+	addr  types.Word
+	value byte
+}
+
+// Debugger runs the machine until a breakpoint, a watched write, an interrupt or the end of a command.
+type Debugger struct {
+	m       Machine
+	cpu     *cpu.CPU
+	bus     *bus.Bus
+	watches map[types.Word]*bus.Hook
+	hit     *write
+	// editing is set while the user writes the memory, so that the writes are not caught
+	editing     bool
+	syms        *symbols.Table
+	journal     *journal.Journal
+	breakpoints []Breakpoint
+	breakOnIRQ  bool
+	lockup      *lockup.Event
+	frames      []Frame
+	// reported is set when the lockup has been reported
+	reported    bool
+	interrupted atomic.Bool
+}
+
+// New constructs a debugger of the machine whose CPU uses the bus.
+func New(m Machine, c *cpu.CPU, b *bus.Bus) *Debugger {
+	return &Debugger{m: m, cpu: c, bus: b, watches: map[types.Word]*bus.Hook{}}
+}
+
+// SetSymbols sets the symbols used for the addresses and the labels in the commands.
+func (d *Debugger) SetSymbols(t *symbols.Table) {
+	d.syms = t
+}
+
+// SetJournal sets the journal of the bus writes asked by who and writes.
+func (d *Debugger) SetJournal(j *journal.Journal) {
+	d.journal = j
+}
+
+// Lockup stops the run when the machine gets stuck. Set it to gb.GB with OnLockup.
+func (d *Debugger) Lockup(e lockup.Event) {
+	d.lockup = &e
+}
+
+// Interrupt stops the running command. It can be called from another goroutine, e.g. on Ctrl-C.
+func (d *Debugger) Interrupt() {
+	d.interrupted.Store(true)
+}
+
+// AddBreakpoint adds the breakpoint. It returns false if it already exists.
+func (d *Debugger) AddBreakpoint(bp Breakpoint) bool {
+	for _, b := range d.breakpoints {
+		if b == bp {
+			return false
+		}
+	}
+	d.breakpoints = append(d.breakpoints, bp)
+	return true
+}
+
+// DeleteBreakpoint deletes the i-th breakpoint (0 origin).
+func (d *Debugger) DeleteBreakpoint(i int) bool {
+	if i < 0 || i >= len(d.breakpoints) {
+		return false
+	}
+	d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+	return true
+}
+
+// ClearBreakpoints deletes all the breakpoints.
+func (d *Debugger) ClearBreakpoints() {
+	d.breakpoints = nil
+}
+
+// Breakpoints returns the breakpoints.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	return d.breakpoints
+}
+
+// SetBreakOnInterrupt sets whether the run stops when an interrupt is dispatched.
+func (d *Debugger) SetBreakOnInterrupt(on bool) {
+	d.breakOnIRQ = on
+}
+
+// Watch stops the run when CPU writes the address, e.g. an IO register.
+func (d *Debugger) Watch(addr types.Word) {
+	if _, ok := d.watches[addr]; ok {
+		return
+	}
+	h := bus.NewHook(bus.Write, addr, addr, d.catch)
+	d.bus.AddHook(h)
+	d.watches[addr] = h
+}
+
+// Unwatch stops watching the address.
+func (d *Debugger) Unwatch(addr types.Word) {
+	if h, ok := d.watches[addr]; ok {
+		d.bus.RemoveHook(h)
+		delete(d.watches, addr)
+	}
+}
+
+// catch keeps the first watched write by CPU in the step.
+func (d *Debugger) catch(e bus.Event) {
+	// OAM DMAの転送とユーザーの書き換えはCPUの書き込みではない
+	if d.editing || d.m.OAMDMA() || d.hit != nil {
+		return
+	}
+	d.hit = &write{addr: e.Addr, value: e.Value}
+}
+
+// Watched returns the watched addresses in order.
+func (d *Debugger) Watched() []types.Word {
+	addrs := []types.Word{}
+	for a := range d.watches {
+		addrs = append(addrs, a)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
+
+// Step executes n instructions. An interrupt dispatch counts as an instruction.
+func (d *Debugger) Step(n int) Stop {
+	return d.run(func(s step) bool {
+		if s.executed || s.irq {
+			n--
+		}
+		return n <= 0
+	})
+}
+
+// StepOver is like Step but runs the called subroutine to the end.
+func (d *Debugger) StepOver() Stop {
+	pc, sp := d.cpu.PC, d.cpu.SP
+	text, size := cpu.Disassemble(d.bus, pc)
+	if d.cpu.Halted() || !strings.HasPrefix(text, "CALL") && !strings.HasPrefix(text, "RST") {
+		return d.Step(1)
+	}
+	next := pc + types.Word(size)
+	return d.run(func(s step) bool {
+		return d.cpu.PC == next && d.cpu.SP >= sp
+	})
+}
+
+// StepOut runs until the current subroutine returns.
+func (d *Debugger) StepOut() Stop {
+	sp := d.cpu.SP
+	return d.run(func(s step) bool {
+		return s.executed && isReturn(s.opcode) && d.cpu.SP > sp
+	})
+}
+
+// Continue runs until something stops it.
+func (d *Debugger) Continue() Stop {
+	return d.run(func(step) bool { return false })
+}
+
+// RunFrames runs until the end of the n-th frame.
+func (d *Debugger) RunFrames(n int) Stop {
+	return d.run(func(s step) bool {
+		if s.frame {
+			n--
+		}
+		return n <= 0
+	})
+}
+
+func isReturn(opcode byte) bool {
+	switch opcode {
+	case 0xC9, 0xD9, 0xC0, 0xC8, 0xD0, 0xD8:
+		return true
+	}
+	return false
+}
+
+// run steps the machine until done returns true or something stops it.
+// The breakpoint at the first instruction is skipped, so that the run can leave it.
+func (d *Debugger) run(done func(step) bool) Stop {
+	d.interrupted.Store(false)
+	if stop, ok := d.locked(); ok {
+		return stop
+	}
+	if e := d.cpu.Lockup(); e != nil {
+		// 未定義命令でハングしたCPUは二度と命令を実行しない
+		return Stop{Reason: Locked, Lockup: e}
+	}
+	started := false
+	for {
+		if d.interrupted.Swap(false) {
+			return Stop{Reason: Interrupted}
+		}
+		s := d.next()
+		if s.executed {
+			if started && d.atBreakpoint() {
+				return Stop{Reason: BreakpointHit}
+			}
+			started = true
+			s.opcode = d.bus.Peek(d.cpu.PC)
+		}
+		s.pc, s.bank, s.sp = d.cpu.PC, d.cpu.ROMBank(d.cpu.PC), d.cpu.SP
+		s.frame = d.m.Step()
+		d.track(s)
+		if stop, ok := d.locked(); ok {
+			return stop
+		}
+		if w := d.hit; w != nil {
+			d.hit = nil
+			return Stop{Reason: WriteWatched, Addr: w.addr, Value: w.value}
+		}
+		if s.irq && d.breakOnIRQ {
+			return Stop{Reason: InterruptTaken}
+		}
+		if done(s) {
+			return Stop{Reason: Done}
+		}
+	}
+}
+
+// track follows the calls and the returns by the stack pointer.
+func (d *Debugger) track(s step) {
+	c := d.cpu
+	if s.irq || s.executed && isCall(s.opcode) && c.SP == s.sp-2 {
+		if len(d.frames) < maxFrames {
+			d.frames = append(d.frames, Frame{
+				Bank: c.ROMBank(c.PC), Addr: c.PC, CallBank: s.bank, CallPC: s.pc, Interrupt: s.irq, sp: c.SP,
+			})
+		}
+		return
+	}
+	// RETやPOPで戻りアドレスが取り除かれたら、関数を抜けたとみなす
+	for len(d.frames) > 0 && d.frames[len(d.frames)-1].sp < c.SP {
+		d.frames = d.frames[:len(d.frames)-1]
+	}
+}
+
+// Frames returns the call stack from the outermost call.
+// It covers the calls made while the debugger runs the machine.
+func (d *Debugger) Frames() []Frame {
+	return d.frames
+}
+
+func isCall(opcode byte) bool {
+	switch opcode {
+	case 0xCD, 0xC4, 0xCC, 0xD4, 0xDC, 0xC7, 0xCF, 0xD7, 0xDF, 0xE7, 0xEF, 0xF7, 0xFF:
+		return true
+	}
+	return false
+}
+
+// CPU returns the debugged CPU.
+func (d *Debugger) CPU() *cpu.CPU {
+	return d.cpu
+}
+
+// ReadMemory reads the memory without ticking and without catching it as a watched access.
+func (d *Debugger) ReadMemory(addr types.Word, n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = d.bus.Peek(addr + types.Word(i))
+	}
+	return data
+}
+
+// WriteMemory writes the memory. The writes to ROM go to the MBC registers.
+func (d *Debugger) WriteMemory(addr types.Word, data []byte) {
+	d.editing = true
+	defer func() { d.editing = false }()
+	for i, b := range data {
+		d.bus.WriteByte(addr+types.Word(i), b)
+	}
+}
+
+// next predicts what the next step of the machine does. GB runs OAM DMA before CPU.
+func (d *Debugger) next() step {
+	if d.m.OAMDMA() {
+		return step{}
+	}
+	switch d.cpu.NextStep() {
+	case profiler.Instruction:
+		return step{executed: true}
+	case profiler.Interrupt:
+		return step{irq: true}
+	}
+	return step{}
+}
+
+// locked returns the stop for the lockup once.
+func (d *Debugger) locked() (Stop, bool) {
+	if d.lockup == nil || d.reported {
+		return Stop{}, false
+	}
+	d.reported = true
+	return Stop{Reason: Locked, Lockup: d.lockup}, true
+}
+
+// atBreakpoint reports whether PC is at a breakpoint.
+func (d *Debugger) atBreakpoint() bool {
+	bank := d.cpu.ROMBank(d.cpu.PC)
+	for _, b := range d.breakpoints {
+		if b.Matches(bank, d.cpu.PC) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/gb"
+	"github.com/kijimaD/goboy/pkg/gpu"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/journal"
+	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/pad"
+	"github.com/kijimaD/goboy/pkg/ram"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/timer"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/kijimaD/goboy/pkg/window/headless"
+	"github.com/stretchr/testify/assert"
+)
+
+const program = `
+	LD SP,$FFFE    ; $0100
+	LD A,1         ; $0103
+	CALL sub       ; $0105
+	LD ($C000),A   ; $0108
+	LD A,$C0       ; $010B
+	LDH ($FF46),A  ; $010D
+	NOP            ; $010F
+	LD A,$91       ; $0110
+	LDH ($FF40),A  ; $0112
+	LD A,1         ; $0114
+	LDH ($FFFF),A  ; $0116
+	EI             ; $0118
+loop:
+	HALT           ; $0119
+	JR loop        ; $011A
+sub:
+	INC A          ; $011C
+	INC A          ; $011D
+	RET            ; $011E
+`
+
+const sub types.Word = 0x011C
+
+// setup makes the debugger of the machine running the assembly at 0x0100.
+func setup(src string) (*Debugger, *gb.GB, *cpu.CPU) {
+	rom := make([]byte, 0x8000)
+	// VBlank割り込みはすぐに戻る
+	rom[0x0040] = 0xD9
+	copy(rom[0x0100:], asm.MustAssemble(src, 0x0100))
+	cart, err := cartridge.NewCartridge(rom)
+	if err != nil {
+		panic(err)
+	}
+	l := logger.NewLogger(logger.LogLevel("Info"))
+	g := gpu.NewGPU()
+	t := timer.NewTimer()
+	irq := interrupt.NewInterrupt()
+	b := bus.NewBus(l, cart, g, ram.NewRAM(0x2000), ram.NewRAM(0x2000), ram.NewRAM(0x80), ram.NewRAM(0xA0), t, apu.NewAPU(), irq, pad.NewPad())
+	g.Init(b, irq)
+	c := cpu.NewCPU(l, b, irq)
+	emu := gb.NewGB(c, g, t, apu.NewAPU(), irq, headless.New())
+	d := New(emu, c, b)
+	emu.OnLockup(d.Lockup)
+	return d, emu, c
+}
+
+func TestStep(t *testing.T) {
+	d, _, c := setup(program)
+	assert.Equal(t, Stop{Reason: Done}, d.Step(1))
+	assert.Equal(t, types.Word(0x0103), c.PC)
+	d.Step(2)
+	assert.Equal(t, sub, c.PC)
+	assert.Equal(t, types.Word(0xFFFC), c.SP)
+}
+
+func TestStepSkipsDMA(t *testing.T) {
+	d, _, c := setup(program)
+	c.PC = 0x010B
+	// LD A,$C0、LDH ($FF46),A、OAM DMA、NOP
+	d.Step(3)
+	assert.Equal(t, types.Word(0x0110), c.PC)
+}
+
+func TestStepOver(t *testing.T) {
+	d, _, c := setup(program)
+	d.Step(2)
+	assert.Equal(t, Stop{Reason: Done}, d.StepOver())
+	assert.Equal(t, types.Word(0x0108), c.PC)
+	assert.Equal(t, byte(3), c.Regs.A)
+
+	// CALL以外は1命令進む
+	d.StepOver()
+	assert.Equal(t, types.Word(0x010B), c.PC)
+}
+
+func TestStepOut(t *testing.T) {
+	d, _, c := setup(program)
+	d.Step(4)
+	assert.Equal(t, sub+1, c.PC)
+	assert.Equal(t, Stop{Reason: Done}, d.StepOut())
+	assert.Equal(t, types.Word(0x0108), c.PC)
+	assert.Equal(t, types.Word(0xFFFE), c.SP)
+}
+
+func TestBreakpoint(t *testing.T) {
+	d, _, c := setup(program)
+	assert.True(t, d.AddBreakpoint(Breakpoint{Bank: -1, Addr: sub}))
+	assert.False(t, d.AddBreakpoint(Breakpoint{Bank: -1, Addr: sub}))
+	assert.Equal(t, Stop{Reason: BreakpointHit}, d.Continue())
+	assert.Equal(t, sub, c.PC)
+	assert.Equal(t, byte(1), c.Regs.A)
+
+	// 止まった場所からは進める
+	assert.Equal(t, Stop{Reason: Done}, d.Step(1))
+	assert.Equal(t, sub+1, c.PC)
+
+	assert.True(t, d.DeleteBreakpoint(0))
+	assert.False(t, d.DeleteBreakpoint(0))
+}
+
+func TestFrames(t *testing.T) {
+	d, _, _ := setup(program)
+	d.Step(3)
+	assert.Equal(t, []Frame{{Bank: 0, Addr: sub, CallBank: 0, CallPC: 0x0105, sp: 0xFFFC}}, d.Frames())
+	d.StepOut()
+	assert.Empty(t, d.Frames())
+
+	d.SetBreakOnInterrupt(true)
+	d.Continue()
+	assert.Equal(t, []Frame{{Bank: 0, Addr: 0x0040, CallBank: 0, CallPC: 0x011A, Interrupt: true, sp: 0xFFFC}}, d.Frames())
+	d.Step(1)
+	assert.Empty(t, d.Frames())
+}
+
+func TestBreakpointBank(t *testing.T) {
+	assert.True(t, Breakpoint{Bank: -1, Addr: 0x4000}.Matches(2, 0x4000))
+	assert.True(t, Breakpoint{Bank: 2, Addr: 0x4000}.Matches(2, 0x4000))
+	assert.False(t, Breakpoint{Bank: 2, Addr: 0x4000}.Matches(3, 0x4000))
+	assert.False(t, Breakpoint{Bank: 2, Addr: 0x4000}.Matches(2, 0x4001))
+	// ROM0とRAMのアドレスはバンクによらない
+	assert.True(t, Breakpoint{Bank: 1, Addr: 0x0150}.Matches(0, 0x0150))
+	assert.True(t, Breakpoint{Bank: 1, Addr: 0xC000}.Matches(-1, 0xC000))
+}
+
+func TestWatch(t *testing.T) {
+	d, _, c := setup(program)
+	d.Watch(0xFF40)
+	assert.Equal(t, []types.Word{0xFF40}, d.Watched())
+	assert.Equal(t, Stop{Reason: WriteWatched, Addr: 0xFF40, Value: 0x91}, d.Continue())
+	assert.Equal(t, types.Word(0x0114), c.PC)
+
+	d.Unwatch(0xFF40)
+	assert.Empty(t, d.Watched())
+
+	// ユーザーの書き換えでは止まらない
+	d, _, c = setup(program)
+	d.Watch(0xC000)
+	d.WriteMemory(0xC000, []byte{0xFF})
+	assert.Equal(t, Stop{Reason: WriteWatched, Addr: 0xC000, Value: 0x03}, d.Continue())
+	assert.Equal(t, types.Word(0x010B), c.PC)
+}
+
+func TestBreakOnInterrupt(t *testing.T) {
+	d, _, c := setup(program)
+	d.SetBreakOnInterrupt(true)
+	assert.Equal(t, Stop{Reason: InterruptTaken}, d.Continue())
+	assert.Equal(t, types.Word(0x0040), c.PC)
+	// 戻り先はHALTの次
+	assert.Equal(t, types.Word(0x011A), types.Word(d.bus.ReadWord(c.SP)))
+}
+
+func TestRunFrames(t *testing.T) {
+	d, emu, _ := setup(program)
+	assert.Equal(t, Stop{Reason: Done}, d.RunFrames(3))
+	assert.Equal(t, 3, emu.Frame())
+}
+
+func TestLockup(t *testing.T) {
+	d, _, c := setup("NOP\nDB $FD")
+	stop := d.Continue()
+	assert.Equal(t, Locked, stop.Reason)
+	assert.Equal(t, types.Word(0x0101), stop.Lockup.PC)
+
+	// ハングしたCPUは動かない
+	pc := c.PC
+	assert.Equal(t, Locked, d.Step(1).Reason)
+	assert.Equal(t, pc, c.PC)
+}
+
+func TestInterrupt(t *testing.T) {
+	d, _, _ := setup(program)
+	d.Interrupt()
+	// 実行前の割り込みは捨てる
+	assert.Equal(t, Stop{Reason: Done}, d.Step(1))
+
+	done := make(chan Stop)
+	go func() { done <- d.Continue() }()
+	for {
+		select {
+		case stop := <-done:
+			assert.Equal(t, Stop{Reason: Interrupted}, stop)
+			return
+		case <-time.After(time.Millisecond):
+			d.Interrupt()
+		}
+	}
+}
+
+func TestREPL(t *testing.T) {
+	d, _, c := setup(program)
+	syms, err := symbols.Parse(strings.NewReader("00:0100 Start\n00:011C Sub\n00:C000 wResult\n"))
+	assert.NoError(t, err)
+	d.SetSymbols(syms)
+
+	in := strings.Join([]string{
+		"b Sub",
+		"c",
+		"s",
+		"",
+		"bt",
+		"r",
+		"set a 42",
+		"set hl wResult",
+		"x wResult 4",
+		"w C001 12 34",
+		"l 0100 2",
+		"b",
+		"d 0",
+		"watch FF40",
+		"c",
+		"nop",
+		"q",
+	}, "\n")
+	out := &bytes.Buffer{}
+	assert.NoError(t, d.Run(strings.NewReader(in), out))
+	text := out.String()
+
+	for _, want := range []string{
+		"=> 00:0100 Start                LD SP,$FFFE",
+		"breakpoint 0 at 00:011C Sub",
+		"breakpoint\n=> 00:011C Sub",
+		// 空行は直前のコマンドを繰り返す
+		"=> 00:011E Sub+$2",
+		"#0 00:011E Sub+$2\n#1 00:0105 Start+$5  (called 00:011C Sub)\n",
+		"A=03 F=10",
+		"A=42",
+		"H=C0 L=00",
+		"C001  12 34 ",
+		"   00:0103 Start+$3",
+		"0: 00:011C Sub",
+		"write $91 to FF40",
+		`error: unknown command "nop"`,
+	} {
+		assert.Contains(t, text, want)
+	}
+	assert.Equal(t, types.Word(0x0114), c.PC)
+}
+
+func TestJournal(t *testing.T) {
+	d, emu, _ := setup(program)
+	syms, err := symbols.Parse(strings.NewReader("00:0100 Start\n00:C000 wResult\n"))
+	assert.NoError(t, err)
+	d.SetSymbols(syms)
+	j := journal.New(emu, 1024)
+	j.Attach(d.bus)
+
+	out := &bytes.Buffer{}
+	in := "who wResult\nwrites oam\nq\n"
+	assert.NoError(t, d.Run(strings.NewReader(in), out))
+	assert.Contains(t, out.String(), "error: no journal")
+
+	d.SetJournal(j)
+	d.Step(10)
+	out.Reset()
+	assert.NoError(t, d.Run(strings.NewReader(in), out))
+	text := out.String()
+	assert.Contains(t, text, "wResult $00 -> $03 by Start+$8 (00:0x0108)\n")
+	assert.Contains(t, text, "$FE00 $00 -> $03 by OAM DMA\n")
+}
+
+func TestInspectFiresNoReadHook(t *testing.T) {
+	d, _, _ := setup(program)
+	reads := 0
+	d.bus.AddHook(bus.NewHook(bus.Read, 0x0000, 0xFFFF, func(e bus.Event) {
+		reads++
+	}))
+
+	out := &bytes.Buffer{}
+	in := "x 0100 16\nx FF40 8\nl 0100 4\nr\nq\n"
+	assert.NoError(t, d.Run(strings.NewReader(in), out))
+	assert.Contains(t, out.String(), "0100  31 FE FF ")
+	assert.Equal(t, []byte{0x31, 0xFE, 0xFF}, d.ReadMemory(0x0100, 3))
+	// 覗くだけでCPUのアクセスにはならない
+	assert.Equal(t, 0, reads)
+
+	d.Step(1)
+	assert.Equal(t, 3, reads)
+}
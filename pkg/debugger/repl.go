@@ -0,0 +1,460 @@
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/symbolizer"
+	"github.com/kijimaD/goboy/pkg/journal"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+const prompt = "(gb) "
+
+const help = `Addresses and values are hex ($ and 0x are optional). Addresses can be bank:addr or labels.
+Counts are decimal. An empty line repeats the last command.
+
+  b, break [addr]        set a breakpoint, or list them
+  d, delete <n>|all      delete the breakpoint
+  s, step [n]            execute n instructions
+  n, next                step over CALL and RST
+  o, out                 run until the subroutine returns
+  c, continue            run until something stops it (Ctrl-C to stop)
+  f, frame [n]           run to the end of the n-th frame
+  r, regs                show the registers
+  bt, backtrace          show the calls made while debugging
+  set <reg> <value>      set a, f, b, c, d, e, h, l, af, bc, de, hl, sp or pc
+  x <addr> [len]         dump the memory
+  w <addr> <byte>...     write the memory
+  l, list [addr] [n]     disassemble
+  int on|off             stop when an interrupt is dispatched
+  watch [addr]           stop when CPU writes the address, or list them
+  unwatch <addr>         stop watching the address
+  who <addr> [n]         show the last n writers of the address (-journal)
+  writes <range>         show the writes in this frame, e.g. oam or C000-C0FF (-journal)
+  h, help                show this help
+  q, quit                quit
+`
+
+// errQuit ends the REPL
+var errQuit = errors.New("quit")
+
+// errNoJournal is returned by the journal commands without -journal
+var errNoJournal = errors.New("no journal. Run with -journal")
+
+// Run reads the commands from in and writes the results to out until quit or EOF.
+func (d *Debugger) Run(in io.Reader, out io.Writer) error {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	d.where(w)
+	sc := bufio.NewScanner(in)
+	last := ""
+	for {
+		fmt.Fprint(w, prompt)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if !sc.Scan() {
+			fmt.Fprintln(w)
+			return sc.Err()
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			line = last
+		}
+		if line == "" {
+			continue
+		}
+		last = line
+		err := d.exec(w, strings.Fields(line))
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+		}
+	}
+}
+
+func (d *Debugger) exec(w io.Writer, args []string) error {
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "b", "break":
+		if len(args) == 0 {
+			for i, b := range d.breakpoints {
+				fmt.Fprintf(w, "%d: %s\n", i, d.name(b.Bank, b.Addr))
+			}
+			return nil
+		}
+		bank, addr, err := d.ParseAddr(args[0])
+		if err != nil {
+			return err
+		}
+		if d.AddBreakpoint(Breakpoint{Bank: bank, Addr: addr}) {
+			fmt.Fprintf(w, "breakpoint %d at %s\n", len(d.breakpoints)-1, d.name(bank, addr))
+		}
+	case "d", "delete":
+		if len(args) != 1 {
+			return errors.New("usage: delete <n>|all")
+		}
+		if args[0] == "all" {
+			d.ClearBreakpoints()
+			return nil
+		}
+		i, err := strconv.Atoi(args[0])
+		if err != nil || !d.DeleteBreakpoint(i) {
+			return fmt.Errorf("no breakpoint %s", args[0])
+		}
+	case "s", "step":
+		n, err := count(args, 1)
+		if err != nil {
+			return err
+		}
+		d.stopped(w, d.Step(n))
+	case "n", "next":
+		d.stopped(w, d.StepOver())
+	case "o", "out":
+		d.stopped(w, d.StepOut())
+	case "c", "continue":
+		d.stopped(w, d.Continue())
+	case "f", "frame":
+		n, err := count(args, 1)
+		if err != nil {
+			return err
+		}
+		d.stopped(w, d.RunFrames(n))
+	case "r", "regs":
+		d.regs(w)
+	case "bt", "backtrace":
+		d.backtrace(w)
+	case "set":
+		if len(args) != 2 {
+			return errors.New("usage: set <reg> <value>")
+		}
+		v, err := d.parseValue(args[1])
+		if err != nil {
+			return err
+		}
+		if err := d.SetRegister(args[0], v); err != nil {
+			return err
+		}
+		d.regs(w)
+	case "x":
+		if len(args) == 0 {
+			return errors.New("usage: x <addr> [len]")
+		}
+		_, addr, err := d.ParseAddr(args[0])
+		if err != nil {
+			return err
+		}
+		n, err := count(args[1:], 64)
+		if err != nil {
+			return err
+		}
+		d.dump(w, addr, n)
+	case "w":
+		if len(args) < 2 {
+			return errors.New("usage: w <addr> <byte>...")
+		}
+		_, addr, err := d.ParseAddr(args[0])
+		if err != nil {
+			return err
+		}
+		data := []byte{}
+		for _, a := range args[1:] {
+			v, err := d.parseValue(a)
+			if err != nil {
+				return err
+			}
+			if v > 0xFF {
+				return fmt.Errorf("%s is not a byte", a)
+			}
+			data = append(data, byte(v))
+		}
+		d.WriteMemory(addr, data)
+		d.dump(w, addr, len(data))
+	case "l", "list":
+		addr := d.cpu.PC
+		if len(args) > 0 {
+			_, a, err := d.ParseAddr(args[0])
+			if err != nil {
+				return err
+			}
+			addr = a
+			args = args[1:]
+		}
+		n, err := count(args, 8)
+		if err != nil {
+			return err
+		}
+		d.list(w, addr, n)
+	case "int":
+		if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+			return errors.New("usage: int on|off")
+		}
+		d.SetBreakOnInterrupt(args[0] == "on")
+	case "watch":
+		if len(args) == 0 {
+			for _, a := range d.Watched() {
+				fmt.Fprintf(w, "%s\n", d.name(-1, a))
+			}
+			return nil
+		}
+		_, addr, err := d.ParseAddr(args[0])
+		if err != nil {
+			return err
+		}
+		d.Watch(addr)
+	case "unwatch":
+		if len(args) != 1 {
+			return errors.New("usage: unwatch <addr>")
+		}
+		_, addr, err := d.ParseAddr(args[0])
+		if err != nil {
+			return err
+		}
+		d.Unwatch(addr)
+	case "who":
+		if d.journal == nil {
+			return errNoJournal
+		}
+		if len(args) == 0 || len(args) > 2 {
+			return errors.New("usage: who <addr> [n]")
+		}
+		_, addr, err := d.ParseAddr(args[0])
+		if err != nil {
+			return err
+		}
+		n, err := count(args[1:], 10)
+		if err != nil {
+			return err
+		}
+		return journal.Dump(w, d.journal.LastWriters(addr, n), d.symbolizer())
+	case "writes":
+		if d.journal == nil {
+			return errNoJournal
+		}
+		if len(args) != 1 {
+			return errors.New("usage: writes <range>")
+		}
+		start, end, err := journal.ParseRange(args[0], d.syms)
+		if err != nil {
+			return err
+		}
+		return journal.Dump(w, d.journal.Writes(start, end, d.journal.Frame()), d.symbolizer())
+	case "h", "help":
+		fmt.Fprint(w, help)
+	case "q", "quit":
+		return errQuit
+	default:
+		return fmt.Errorf("unknown command %q. help shows the commands", cmd)
+	}
+	return nil
+}
+
+// stopped prints why the run stopped and where.
+func (d *Debugger) stopped(w io.Writer, s Stop) {
+	switch s.Reason {
+	case BreakpointHit:
+		fmt.Fprintln(w, "breakpoint")
+	case InterruptTaken:
+		fmt.Fprintf(w, "interrupt %s\n", VectorName(d.cpu.PC))
+	case WriteWatched:
+		fmt.Fprintf(w, "write $%02X to %s\n", s.Value, d.name(-1, s.Addr))
+	case Locked:
+		if d.syms == nil {
+			fmt.Fprintf(w, "LOCKUP: %s\n", s.Lockup)
+		} else {
+			fmt.Fprintf(w, "LOCKUP: %s\n", s.Lockup.Format(d.syms))
+		}
+	case Interrupted:
+		fmt.Fprintln(w, "interrupted")
+	}
+	d.where(w)
+}
+
+// vectors are the names of the interrupt vectors
+var vectors = map[types.Word]string{
+	0x0040: "VBlank",
+	0x0048: "STAT",
+	0x0050: "Timer",
+	0x0058: "Serial",
+	0x0060: "Joypad",
+}
+
+// VectorName returns the name of the interrupt at the vector, e.g. "VBlank".
+func VectorName(addr types.Word) string {
+	return vectors[addr]
+}
+
+// where prints the next instruction.
+func (d *Debugger) where(w io.Writer) {
+	d.list(w, d.cpu.PC, 1)
+}
+
+func (d *Debugger) list(w io.Writer, addr types.Word, n int) {
+	for i := 0; i < n; i++ {
+		text, size := cpu.Disassemble(d.bus, addr)
+		mark := "  "
+		if addr == d.cpu.PC {
+			mark = "=>"
+		}
+		fmt.Fprintf(w, "%s %-28s %s\n", mark, d.name(d.cpu.ROMBank(addr), addr), text)
+		addr += types.Word(size)
+	}
+}
+
+// name formats the address with the bank and the label, e.g. "01:4A51 UpdateSprites+$12".
+func (d *Debugger) name(bank int, addr types.Word) string {
+	s := fmt.Sprintf("%04X", addr)
+	if bank >= 0 {
+		s = fmt.Sprintf("%02X:%04X", bank, addr)
+	}
+	if label, ok := d.syms.Label(bank, addr); ok {
+		s += " " + label
+	}
+	return s
+}
+
+// symbolizer returns nil without the symbols, so that the addresses are printed as they are.
+func (d *Debugger) symbolizer() symbolizer.Symbolizer {
+	if d.syms == nil {
+		return nil
+	}
+	return d.syms
+}
+
+func (d *Debugger) backtrace(w io.Writer) {
+	fmt.Fprintf(w, "#0 %s\n", d.name(d.cpu.ROMBank(d.cpu.PC), d.cpu.PC))
+	for i := len(d.frames) - 1; i >= 0; i-- {
+		f := d.frames[i]
+		kind := "called"
+		if f.Interrupt {
+			kind = "interrupted"
+		}
+		fmt.Fprintf(w, "#%d %s  (%s %s)\n", len(d.frames)-i, d.name(f.CallBank, f.CallPC), kind, d.name(f.Bank, f.Addr))
+	}
+}
+
+func (d *Debugger) regs(w io.Writer) {
+	c, r := d.cpu, d.cpu.Regs
+	fmt.Fprintf(w, "A=%02X F=%02X B=%02X C=%02X D=%02X E=%02X H=%02X L=%02X SP=%04X PC=%04X\n",
+		r.A, r.F, r.B, r.C, r.D, r.E, r.H, r.L, c.SP, c.PC)
+	bit := func(b byte) int { return int(r.F>>b) & 1 }
+	fmt.Fprintf(w, "Z=%d N=%d H=%d C=%d IME=%d IE=%02X IF=%02X", bit(7), bit(6), bit(5), bit(4), btoi(c.IME()),
+		d.bus.Peek(0xFFFF), d.bus.Peek(0xFF0F))
+	switch {
+	case c.Halted():
+		fmt.Fprint(w, " HALT")
+	case c.Stopped():
+		fmt.Fprint(w, " STOP")
+	}
+	fmt.Fprintln(w)
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// SetRegister sets a, f, b, c, d, e, h, l, af, bc, de, hl, sp or pc.
+func (d *Debugger) SetRegister(name string, v int) error {
+	c, r := d.cpu, &d.cpu.Regs
+	regs8 := map[string]*types.Register{"a": &r.A, "f": &r.F, "b": &r.B, "c": &r.C, "d": &r.D, "e": &r.E, "h": &r.H, "l": &r.L}
+	regs16 := map[string][2]*types.Register{"af": {&r.A, &r.F}, "bc": {&r.B, &r.C}, "de": {&r.D, &r.E}, "hl": {&r.H, &r.L}}
+	name = strings.ToLower(name)
+	if p, ok := regs8[name]; ok {
+		if v > 0xFF {
+			return fmt.Errorf("$%X is out of the 8-bit range", v)
+		}
+		*p = byte(v)
+	} else if p, ok := regs16[name]; ok {
+		*p[0], *p[1] = byte(v>>8), byte(v)
+	} else if name == "sp" {
+		c.SP = types.Word(v)
+	} else if name == "pc" {
+		c.PC = types.Word(v)
+	} else {
+		return fmt.Errorf("unknown register %q", name)
+	}
+	// Fの下位4ビットは常に0
+	r.F &= 0xF0
+	return nil
+}
+
+func (d *Debugger) dump(w io.Writer, addr types.Word, n int) {
+	for i := 0; i < n; i += 16 {
+		row := addr + types.Word(i)
+		hex := []string{}
+		text := []byte{}
+		for j := 0; j < 16 && i+j < n; j++ {
+			b := d.bus.Peek(row + types.Word(j))
+			hex = append(hex, fmt.Sprintf("%02X", b))
+			if b < 0x20 || b > 0x7E {
+				b = '.'
+			}
+			text = append(text, b)
+		}
+		fmt.Fprintf(w, "%04X  %-47s  %s\n", row, strings.Join(hex, " "), text)
+	}
+}
+
+// ParseAddr parses "$C000", "C000", "01:4000" or a label.
+// The bank is -1 unless it is given or the label is in ROM.
+func (d *Debugger) ParseAddr(s string) (int, types.Word, error) {
+	if bank, addr, ok := strings.Cut(s, ":"); ok {
+		b, err := strconv.ParseUint(bank, 16, 8)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid bank %q", bank)
+		}
+		a, err := parseHex(addr)
+		if err != nil {
+			return 0, 0, err
+		}
+		return int(b), types.Word(a), nil
+	}
+	if sym, ok := d.syms.Address(s); ok {
+		if sym.Addr >= 0x8000 {
+			return -1, sym.Addr, nil
+		}
+		return sym.Bank, sym.Addr, nil
+	}
+	a, err := parseHex(s)
+	return -1, types.Word(a), err
+}
+
+// parseValue parses a hex number or a label.
+func (d *Debugger) parseValue(s string) (int, error) {
+	if sym, ok := d.syms.Address(s); ok {
+		return int(sym.Addr), nil
+	}
+	return parseHex(s)
+}
+
+func parseHex(s string) (int, error) {
+	h := strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(s, "$"), "0x"), "0X")
+	v, err := strconv.ParseUint(h, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address or value %q", s)
+	}
+	return int(v), nil
+}
+
+// count parses the optional decimal count.
+func count(args []string, def int) (int, error) {
+	if len(args) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid count %q", args[0])
+	}
+	return n, nil
+}
@@ -0,0 +1,273 @@
+package disasm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/utils"
+)
+
+const (
+	// BankSize is the size of a ROM bank
+	BankSize = 0x4000
+	// entryPoint is where the boot ROM jumps to
+	entryPoint = 0x0100
+)
+
+// vectors are the entry points of the ROM. The traversal starts from them.
+var vectors = []struct {
+	addr int
+	name string
+}{
+	{entryPoint, "Boot"},
+	{0x0000, "RST_00"},
+	{0x0008, "RST_08"},
+	{0x0010, "RST_10"},
+	{0x0018, "RST_18"},
+	{0x0020, "RST_20"},
+	{0x0028, "RST_28"},
+	{0x0030, "RST_30"},
+	{0x0038, "RST_38"},
+	{0x0040, "VBlankInterrupt"},
+	{0x0048, "LCDCInterrupt"},
+	{0x0050, "TimerOverflowInterrupt"},
+	{0x0058, "SerialTransferCompleteInterrupt"},
+	{0x0060, "JoypadTransitionInterrupt"},
+}
+
+type byteKind int
+
+const (
+	data byteKind = iota
+	// opcode is the first byte of an instruction
+	opcode
+	// operand is the rest of an instruction
+	operand
+)
+
+// unknownBank is the switchable bank that can't be inferred
+const unknownBank = -1
+
+// Disassembler separates the code from the data by walking the control flow of the ROM.
+type Disassembler struct {
+	rom   []byte
+	kinds []byteKind
+	// labels are the names of the jump targets by the ROM offset
+	labels map[int]string
+	// targets are the ROM offsets that the jumps at the offset go to
+	targets map[int]int
+	queue   []path
+}
+
+// path is a place to trace, with the switchable bank mapped there.
+type path struct {
+	offset int
+	bank   int
+}
+
+// New walks the ROM from the entry point, the RST vectors and the interrupt vectors.
+// The vectors filled with padding are left as data.
+// Jumps and calls are followed recursively. The bank mapped at 0x4000-0x7FFF is inferred
+// from "LD A,n" followed by a write to 0x2000-0x3FFF, which switches the bank of MBC1.
+func New(rom []byte) *Disassembler {
+	d := &Disassembler{
+		rom:     rom,
+		kinds:   make([]byteKind, len(rom)),
+		labels:  map[int]string{},
+		targets: map[int]int{},
+	}
+	for _, v := range vectors {
+		if v.addr >= len(rom) {
+			continue
+		}
+		d.labels[v.addr] = v.name
+		// 使われないベクタは0x00か0xFFで埋められている。RSTで呼ばれるものはjumpで辿る
+		if v.addr == entryPoint || (rom[v.addr] != 0x00 && rom[v.addr] != 0xFF) {
+			// 電源投入直後はバンク1がマップされている
+			d.queue = append(d.queue, path{offset: v.addr, bank: 1})
+		}
+	}
+	d.walk()
+	return d
+}
+
+// walk traces the queued paths.
+func (d *Disassembler) walk() {
+	for len(d.queue) > 0 {
+		p := d.queue[0]
+		d.queue = d.queue[1:]
+		d.trace(p)
+	}
+}
+
+// Trace walks the code from the ROM offset too, e.g. from an opcode executed in the code/data log.
+// It finds the code reached only by the jumps that can't be followed statically, such as jump tables.
+func (d *Disassembler) Trace(offset int) {
+	if offset < 0 || offset >= len(d.rom) || d.kinds[offset] != data {
+		return
+	}
+	if _, ok := d.labels[offset]; !ok {
+		b, a := Address(offset)
+		d.labels[offset] = fmt.Sprintf("Code_%02X_%04X", b, a)
+	}
+	bank := 1
+	if offset >= BankSize {
+		bank = offset / BankSize
+	}
+	d.queue = append(d.queue, path{offset: offset, bank: bank})
+	d.walk()
+}
+
+// IsCode reports whether the byte at the ROM offset belongs to an instruction.
+func (d *Disassembler) IsCode(offset int) bool {
+	return d.kinds[offset] != data
+}
+
+// Labels returns the labels by the ROM offset.
+func (d *Disassembler) Labels() map[int]string {
+	return d.labels
+}
+
+// SetLabel names the ROM offset, e.g. by the symbols. The jumps to it use the name.
+func (d *Disassembler) SetLabel(offset int, name string) {
+	d.labels[offset] = name
+}
+
+// Address returns the bank and the CPU address of the ROM offset.
+func Address(offset int) (int, int) {
+	bank := offset / BankSize
+	if bank == 0 {
+		return 0, offset
+	}
+	return bank, BankSize + offset%BankSize
+}
+
+// Offset returns the ROM offset of the bank and the CPU address, or -1 if it is not in ROM.
+func Offset(bank, addr int) int {
+	switch {
+	case addr < BankSize:
+		return addr
+	case addr < 2*BankSize && bank > 0:
+		return bank*BankSize + addr - BankSize
+	}
+	return -1
+}
+
+// offset returns the ROM offset of the CPU address with the switchable bank, or -1 if it is not in ROM.
+func (d *Disassembler) offset(addr, bank int) int {
+	if bank == unknownBank {
+		bank = 0
+	}
+	if off := Offset(bank, addr); off < len(d.rom) {
+		return off
+	}
+	return -1
+}
+
+// trace marks the instructions from the path until the flow ends.
+func (d *Disassembler) trace(p path) {
+	off, bank := p.offset, p.bank
+	// a is the value of A set by the previous instruction, to infer the bank switch
+	a := -1
+	for off >= 0 && off < len(d.rom) && d.kinds[off] == data {
+		in := cpu.Decode(d.rom[off:])
+		if in.Description == "" || off+in.Length > len(d.rom) || off/BankSize != (off+in.Length-1)/BankSize {
+			return
+		}
+		for i := 1; i < in.Length; i++ {
+			// 他の命令の途中に入るときは、データとして残す
+			if d.kinds[off+i] != data {
+				return
+			}
+		}
+		d.kinds[off] = opcode
+		for i := 1; i < in.Length; i++ {
+			d.kinds[off+i] = operand
+		}
+
+		_, addr := Address(off)
+		if dst, ok := target(in, addr); ok {
+			d.jump(off, dst, bank, in.Description)
+		}
+		prev := a
+		a = -1
+		switch in.Description {
+		case "LD A,n":
+			a = int(in.Operands[0])
+		case "LD (nn),A":
+			if dst := utils.Bytes2Word(in.Operands[1], in.Operands[0]); 0x2000 <= dst && dst < 0x4000 {
+				bank = d.switchBank(prev)
+			}
+		}
+		if endsFlow(in.Description) {
+			return
+		}
+		off += in.Length
+	}
+}
+
+// target returns the address that the jump, call or RST at addr goes to.
+func target(in cpu.Instruction, addr int) (int, bool) {
+	mnemonic, args, _ := strings.Cut(in.Description, " ")
+	switch {
+	case (mnemonic == "JP" || mnemonic == "CALL") && strings.HasSuffix(args, "nn"):
+		return int(utils.Bytes2Word(in.Operands[1], in.Operands[0])), true
+	case mnemonic == "JR":
+		return (addr + in.Length + int(int8(in.Operands[0]))) & 0xFFFF, true
+	case mnemonic == "RST":
+		v, err := strconv.ParseUint(strings.TrimPrefix(args, "$"), 16, 16)
+		return int(v), err == nil
+	}
+	return 0, false
+}
+
+// endsFlow reports whether the next instruction is never executed after the instruction.
+func endsFlow(desc string) bool {
+	switch desc {
+	case "JP nn", "JR e", "JP (HL)", "RET", "RETI":
+		return true
+	}
+	return false
+}
+
+// switchBank returns the bank selected by writing v to the MBC1 bank register.
+func (d *Disassembler) switchBank(v int) int {
+	banks := (len(d.rom) + BankSize - 1) / BankSize
+	if banks <= 2 {
+		// バンク切り替えのないROM
+		return 1
+	}
+	if v < 0 {
+		return unknownBank
+	}
+	v &= 0x1F
+	if v == 0 {
+		v = 1
+	}
+	return v % banks
+}
+
+// jump records the jump target and queues it.
+func (d *Disassembler) jump(from, addr, bank int, desc string) {
+	off := d.offset(addr, bank)
+	if off < 0 {
+		// RAMやHRAMに転送されたコードは追えない
+		return
+	}
+	d.targets[from] = off
+	if _, ok := d.labels[off]; !ok {
+		kind := "Jump"
+		if strings.HasPrefix(desc, "CALL") {
+			kind = "Call"
+		}
+		b, a := Address(off)
+		d.labels[off] = fmt.Sprintf("%s_%02X_%04X", kind, b, a)
+	}
+	next := bank
+	if off >= BankSize {
+		next = off / BankSize
+	}
+	d.queue = append(d.queue, path{offset: off, bank: next})
+}
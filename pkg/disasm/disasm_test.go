@@ -0,0 +1,216 @@
+package disasm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/kijimaD/goboy/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// rebuild assembles the RGBDS source with asm.Assemble.
+// The syntax is translated and the labels are replaced with the addresses, so that each section is assembled alone.
+func rebuild(t *testing.T, d *Disassembler, src string) []byte {
+	addrs := map[string]string{}
+	for off, name := range d.labels {
+		_, addr := Address(off)
+		addrs[name] = fmt.Sprintf("$%04X", addr)
+	}
+	word := regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+	section := regexp.MustCompile(`^SECTION .*\[\$([0-9A-F]{4})\]`)
+	syntax := strings.NewReplacer("ldh a, [c]", "LD A,(C)", "ldh [c], a", "LD (C),A", "jp hl", "JP (HL)", "[", "(", "]", ")")
+
+	rom := []byte{}
+	org, chunk := 0, []string{}
+	flush := func() {
+		code, err := asm.Assemble(strings.Join(chunk, "\n"), types.Word(org))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rom = append(rom, code...)
+		chunk = []string{}
+	}
+	for _, line := range strings.Split(src, "\n") {
+		if m := section.FindStringSubmatch(line); m != nil {
+			flush()
+			v, _ := strconv.ParseUint(m[1], 16, 16)
+			org = int(v)
+			continue
+		}
+		line, _, _ = strings.Cut(line, ";")
+		if strings.HasSuffix(line, ":") {
+			continue
+		}
+		line = word.ReplaceAllStringFunc(line, func(w string) string {
+			if addr, ok := addrs[w]; ok {
+				return addr
+			}
+			return w
+		})
+		chunk = append(chunk, syntax.Replace(line))
+	}
+	flush()
+	return rom
+}
+
+// roms are rebuilt from the disassembly
+var roms = []string{
+	"../../roms/helloworld/hello.gb",
+	"../../roms/cpu_instrs/cpu_instrs.gb",
+	"../../roms/genesis/Genesis1.gb",
+}
+
+func TestRebuildROMs(t *testing.T) {
+	for _, file := range roms {
+		t.Run(file, func(t *testing.T) {
+			rom, err := utils.LoadROM(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := New(rom)
+			var buf bytes.Buffer
+			assert.NoError(t, d.WriteASM(&buf))
+			assert.Equal(t, rom, rebuild(t, d, buf.String()))
+			assert.True(t, d.IsCode(0x0100))
+			assert.False(t, d.IsCode(0x0134), "title should be data")
+		})
+	}
+}
+
+// TestRebuildWithRGBDS builds the disassembly with RGBDS, so that the syntax is checked by the real assembler.
+// It is skipped when rgbasm and rgblink are not on PATH.
+func TestRebuildWithRGBDS(t *testing.T) {
+	for _, tool := range []string{"rgbasm", "rgblink"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not on PATH", tool)
+		}
+	}
+	run := func(t *testing.T, name string, args ...string) {
+		if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", name, err, out)
+		}
+	}
+	for _, file := range roms {
+		t.Run(file, func(t *testing.T) {
+			rom, err := utils.LoadROM(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			assert.NoError(t, New(rom).WriteASM(&buf))
+			dir := t.TempDir()
+			src := filepath.Join(dir, "rom.asm")
+			obj := filepath.Join(dir, "rom.o")
+			out := filepath.Join(dir, "rom.gb")
+			assert.NoError(t, os.WriteFile(src, buf.Bytes(), 0644))
+			run(t, "rgbasm", "-o", obj, src)
+			run(t, "rgblink", "-o", out, obj)
+			built, err := os.ReadFile(out)
+			assert.NoError(t, err)
+			assert.Equal(t, rom, built)
+		})
+	}
+}
+
+func TestBankSwitch(t *testing.T) {
+	rom := make([]byte, 4*BankSize)
+	copy(rom[0x0100:], asm.MustAssemble(`
+	NOP
+	JP $0150
+`, 0x0100))
+	copy(rom[0x0150:], asm.MustAssemble(`
+start:
+	LD A,2
+	LD ($2000),A
+	CALL $4000
+	LD ($2000),A ; unknown bank
+	CALL $4000
+loop:
+	JR loop
+`, 0x0150))
+	copy(rom[2*BankSize:], asm.MustAssemble(`
+	LD A,$42
+	RET
+`, 0x4000))
+
+	d := New(rom)
+	assert.True(t, d.IsCode(2*BankSize))
+	assert.False(t, d.IsCode(1*BankSize), "bank 1 is not called")
+	assert.False(t, d.IsCode(3*BankSize))
+	assert.Equal(t, "Call_02_4000", d.Labels()[2*BankSize])
+
+	var buf bytes.Buffer
+	assert.NoError(t, d.WriteASM(&buf))
+	src := buf.String()
+	assert.Contains(t, src, "SECTION \"ROM Bank $02\", ROMX[$4000], BANK[$02]")
+	assert.Contains(t, src, "\tcall Call_02_4000")
+	assert.Contains(t, src, "\tcall $4000")
+	assert.Equal(t, rom, rebuild(t, d, src))
+}
+
+func TestInstructionSyntax(t *testing.T) {
+	tests := []struct {
+		code []byte
+		text string
+	}{
+		{[]byte{0xF2}, "ldh a, [c]"},
+		{[]byte{0xE2}, "ldh [c], a"},
+		{[]byte{0xE9}, "jp hl"},
+		{[]byte{0x2A}, "ld a, [hl+]"},
+		{[]byte{0xE0, 0x44}, "ldh [$FF44], a"},
+		{[]byte{0xF8, 0xFD}, "ld hl, sp-3"},
+		{[]byte{0xE8, 0x05}, "add sp, 5"},
+		{[]byte{0xCB, 0x7C}, "bit 7, h"},
+		{[]byte{0xFF}, "rst $38"},
+		{[]byte{0x10, 0x00}, "stop"},
+		// 長さが変わりうる命令と、2バイト目が0でないSTOPはdbで残す
+		{[]byte{0xFA, 0x44, 0xFF}, ""},
+		{[]byte{0x10, 0x01}, ""},
+	}
+	for _, tt := range tests {
+		d := &Disassembler{rom: tt.code}
+		text, n := d.instruction(0)
+		assert.Equal(t, tt.text, text, "% X", tt.code)
+		if tt.text != "" {
+			assert.Equal(t, len(tt.code), n)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	rom := make([]byte, 2*BankSize)
+	copy(rom[0x0100:], asm.MustAssemble(`
+	LD HL,$0200
+	JP (HL)
+`, 0x0100))
+	copy(rom[0x0200:], asm.MustAssemble(`
+	LD A,1
+	RET
+`, 0x0200))
+
+	d := New(rom)
+	assert.False(t, d.IsCode(0x0200), "JP (HL) can't be followed")
+	d.Trace(0x0200)
+	assert.True(t, d.IsCode(0x0200))
+	assert.True(t, d.IsCode(0x0202))
+	assert.Equal(t, "Code_00_0200", d.Labels()[0x0200])
+	// 命令の途中や、既にコードのところからは辿らない
+	d.Trace(0x0201)
+	d.Trace(0x0100)
+	assert.Equal(t, "Boot", d.Labels()[0x0100])
+	_, ok := d.Labels()[0x0201]
+	assert.False(t, ok)
+
+	var buf bytes.Buffer
+	assert.NoError(t, d.WriteASM(&buf))
+	assert.Equal(t, rom, rebuild(t, d, buf.String()))
+}
@@ -0,0 +1,139 @@
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/utils"
+)
+
+// bytesPerLine is the number of bytes in a db line
+const bytesPerLine = 8
+
+const header = `; Disassembled by goboy.
+; Rebuild it with RGBDS 0.6 or later:
+;
+;   rgbasm -o rom.o rom.asm
+;   rgblink -o rom.gb rom.o
+;
+; The header and the checksums are kept as data, so rgbfix is not needed.
+`
+
+// WriteASM writes the RGBDS source that rebuilds the byte-identical ROM.
+// Each bank is a section. The code is written as instructions with labels and the rest as db.
+func (d *Disassembler) WriteASM(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, header)
+	for off := 0; off < len(d.rom); {
+		if off%BankSize == 0 {
+			bank := off / BankSize
+			if bank == 0 {
+				fmt.Fprintf(bw, "\nSECTION \"ROM Bank $%02X\", ROM0[$0000]\n", bank)
+			} else {
+				fmt.Fprintf(bw, "\nSECTION \"ROM Bank $%02X\", ROMX[$4000], BANK[$%02X]\n", bank, bank)
+			}
+		}
+		if name, ok := d.labels[off]; ok {
+			fmt.Fprintf(bw, "\n%s:\n", name)
+		}
+		var text string
+		var n int
+		if d.kinds[off] == opcode {
+			text, n = d.instruction(off)
+		}
+		if n == 0 {
+			text, n = d.data(off)
+		}
+		_, addr := Address(off)
+		fmt.Fprintf(bw, "\t%-27s ; $%04X\n", text, addr)
+		off += n
+	}
+	return bw.Flush()
+}
+
+// data formats the db line from the offset.
+// The line ends before the next instruction, label or bank.
+func (d *Disassembler) data(off int) (string, int) {
+	list := []string{}
+	for i := off; i < len(d.rom) && len(list) < bytesPerLine; i++ {
+		if i != off && (d.kinds[i] == opcode || i%BankSize == 0 || d.labels[i] != "") {
+			break
+		}
+		list = append(list, fmt.Sprintf("$%02X", d.rom[i]))
+	}
+	return "db " + strings.Join(list, ", "), len(list)
+}
+
+// instruction formats the instruction at the offset in RGBDS syntax.
+// It returns 0 as the length when the instruction has to be written as db to keep the bytes.
+func (d *Disassembler) instruction(off int) (string, int) {
+	in := cpu.Decode(d.rom[off:])
+	switch in.Description {
+	case "LD A,(C)":
+		return "ldh a, [c]", in.Length
+	case "LD (C),A":
+		return "ldh [c], a", in.Length
+	case "JP (HL)":
+		return "jp hl", in.Length
+	case "STOP":
+		if in.Operands[0] != 0x00 {
+			return "", 0
+		}
+		return "stop", in.Length
+	case "LD A,(nn)", "LD (nn),A":
+		// アセンブラによってはLDHに最適化されて長さが変わる
+		if in.Operands[1] == 0xFF {
+			return "", 0
+		}
+	}
+	mnemonic, args, ok := strings.Cut(in.Description, " ")
+	mnemonic = strings.ToLower(mnemonic)
+	if !ok {
+		return mnemonic, in.Length
+	}
+	_, addr := Address(off)
+	list := strings.Split(args, ",")
+	for i, arg := range list {
+		list[i] = d.operand(off, mnemonic, arg, in, addr+in.Length)
+	}
+	return mnemonic + " " + strings.Join(list, ", "), in.Length
+}
+
+func (d *Disassembler) operand(off int, mnemonic, arg string, in cpu.Instruction, next int) string {
+	switch arg {
+	case "nn":
+		nn := int(utils.Bytes2Word(in.Operands[1], in.Operands[0]))
+		if mnemonic == "jp" || mnemonic == "call" {
+			return d.reference(off, nn)
+		}
+		return fmt.Sprintf("$%04X", nn)
+	case "(nn)":
+		return fmt.Sprintf("[$%04X]", utils.Bytes2Word(in.Operands[1], in.Operands[0]))
+	case "n":
+		return fmt.Sprintf("$%02X", in.Operands[0])
+	case "(n)":
+		return fmt.Sprintf("[$FF%02X]", in.Operands[0])
+	case "e":
+		if mnemonic == "jr" {
+			return d.reference(off, (next+int(int8(in.Operands[0])))&0xFFFF)
+		}
+		return fmt.Sprintf("%d", int8(in.Operands[0]))
+	case "SP+e":
+		return fmt.Sprintf("sp%+d", int8(in.Operands[0]))
+	}
+	arg = strings.NewReplacer("(", "[", ")", "]").Replace(arg)
+	return strings.ToLower(arg)
+}
+
+// reference returns the label of the jump target at the offset, or the address if it has no label.
+func (d *Disassembler) reference(off, addr int) string {
+	if t, ok := d.targets[off]; ok && d.kinds[t] != operand {
+		if name, ok := d.labels[t]; ok {
+			return name
+		}
+	}
+	return fmt.Sprintf("$%04X", addr)
+}
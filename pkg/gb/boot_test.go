@@ -0,0 +1,118 @@
+package gb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/model"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootROMHandoff(t *testing.T) {
+	boot := make([]byte, bus.DMGBootROMSize)
+	copy(boot, asm.MustAssemble(`
+	LD SP,$FFFE
+	LD A,$42
+	LD ($C000),A
+`, 0x0000))
+	// 最後の命令でブートROMを外し、そのまま0x0100に進む
+	copy(boot[0xFC:], asm.MustAssemble(`
+	LD A,1
+	LDH ($FF50),A
+`, 0x00FC))
+	rom := make([]byte, 0x8000)
+	rom[0x0000] = 0xAA
+	copy(rom[0x0100:], asm.MustAssemble(`
+	INC A
+loop:
+	JR loop
+`, 0x0100))
+	emu, b := setupROM(rom)
+	assert.NoError(t, emu.SetBootROM(b, boot))
+	assert.Equal(t, types.Word(0x0000), emu.cpu.PC)
+	assert.Equal(t, byte(0x31), b.ReadByte(0x0000))
+
+	emu.next()
+	assert.Equal(t, byte(0x42), b.ReadByte(0xC000))
+	assert.Equal(t, byte(0xAA), b.ReadByte(0x0000))
+	assert.Equal(t, byte(0x02), emu.cpu.Regs.A)
+	assert.Equal(t, types.Word(0x0101), emu.cpu.PC)
+}
+
+func TestBootROMOfModel(t *testing.T) {
+	emu, b := setupROM(make([]byte, 0x8000))
+	emu.SetModel(model.CGB)
+	// バスもCGBとしてブートROMを受け付ける
+	assert.Error(t, emu.SetBootROM(b, make([]byte, bus.DMGBootROMSize)))
+	assert.NoError(t, emu.SetBootROM(b, make([]byte, bus.CGBBootROMSize)))
+	assert.Equal(t, types.Word(0x0000), emu.cpu.PC)
+
+	emu.SetModel(model.DMG)
+	assert.NoError(t, emu.SetBootROM(b, make([]byte, bus.DMGBootROMSize)))
+}
+
+// TestPostBootIO checks the IO registers without the boot ROM against the values the DMG boot ROM leaves.
+// https://gbdev.io/pandocs/Power_Up_Sequence.html#hardware-registers
+func TestPostBootIO(t *testing.T) {
+	_, b := setupROM(make([]byte, 0x8000))
+	for _, tt := range []struct {
+		name  string
+		addr  types.Word
+		value byte
+	}{
+		{"P1", 0xFF00, 0xCF},
+		{"SB", 0xFF01, 0x00},
+		{"SC", 0xFF02, 0x7E},
+		{"DIV", 0xFF04, 0xAB},
+		{"TIMA", 0xFF05, 0x00},
+		{"TMA", 0xFF06, 0x00},
+		{"TAC", 0xFF07, 0xF8},
+		{"IF", 0xFF0F, 0xE1},
+		{"NR10", 0xFF10, 0x80},
+		{"NR11", 0xFF11, 0xBF},
+		{"NR12", 0xFF12, 0xF3},
+		{"NR13", 0xFF13, 0xFF},
+		{"NR14", 0xFF14, 0xBF},
+		{"NR21", 0xFF16, 0x3F},
+		{"NR22", 0xFF17, 0x00},
+		{"NR23", 0xFF18, 0xFF},
+		{"NR24", 0xFF19, 0xBF},
+		{"NR30", 0xFF1A, 0x7F},
+		{"NR31", 0xFF1B, 0xFF},
+		{"NR32", 0xFF1C, 0x9F},
+		{"NR33", 0xFF1D, 0xFF},
+		{"NR34", 0xFF1E, 0xBF},
+		{"NR41", 0xFF20, 0xFF},
+		{"NR42", 0xFF21, 0x00},
+		{"NR43", 0xFF22, 0x00},
+		{"NR44", 0xFF23, 0xBF},
+		{"NR50", 0xFF24, 0x77},
+		{"NR51", 0xFF25, 0xF3},
+		{"NR52", 0xFF26, 0xF1},
+		{"LCDC", 0xFF40, 0x91},
+		{"STAT", 0xFF41, 0x85},
+		{"SCY", 0xFF42, 0x00},
+		{"SCX", 0xFF43, 0x00},
+		{"LY", 0xFF44, 0x00},
+		{"LYC", 0xFF45, 0x00},
+		{"DMA", 0xFF46, 0xFF},
+		{"BGP", 0xFF47, 0xFC},
+		{"WY", 0xFF4A, 0x00},
+		{"WX", 0xFF4B, 0x00},
+		// CGBのレジスタはDMGには無い
+		{"KEY1", 0xFF4D, 0xFF},
+		{"VBK", 0xFF4F, 0xFF},
+		{"HDMA1", 0xFF51, 0xFF},
+		{"HDMA5", 0xFF55, 0xFF},
+		{"RP", 0xFF56, 0xFF},
+		{"BCPS", 0xFF68, 0xFF},
+		{"OCPD", 0xFF6B, 0xFF},
+		{"SVBK", 0xFF70, 0xFF},
+		{"IE", 0xFFFF, 0x00},
+	} {
+		assert.Equal(t, fmt.Sprintf("$%02X", tt.value), fmt.Sprintf("$%02X", b.ReadByte(tt.addr)), tt.name)
+	}
+}
@@ -1,12 +1,16 @@
 package gb
 
 import (
-	"time"
+	"sync/atomic"
 
+	"github.com/kijimaD/goboy/pkg/apu"
 	"github.com/kijimaD/goboy/pkg/cpu"
 	"github.com/kijimaD/goboy/pkg/gpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/profiler"
 	"github.com/kijimaD/goboy/pkg/interfaces/window"
 	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/model"
+	"github.com/kijimaD/goboy/pkg/pacer"
 	"github.com/kijimaD/goboy/pkg/timer"
 	"github.com/kijimaD/goboy/pkg/types"
 )
@@ -17,55 +21,224 @@ const CyclesPerFrame = 70224
 // GB is gameboy emulator struct
 type GB struct {
 	currentCycle uint
+	frame        int
+	totalCycles  uint64
+	steps        uint64
+	instructions uint64
 	cpu          *cpu.CPU
 	gpu          *gpu.GPU
 	timer        *timer.Timer
+	apu          *apu.APU
 	irq          *interrupt.Interrupt
 	win          window.Window
+	pacer        *pacer.Pacer
+	audioSink    apu.Sink
+	samples      []apu.Sample
+	audioErr     error
+	watchdog     watchdog
+	model        model.Model
+	rewind       *rewind
+	quit         atomic.Bool
 }
 
 // NewGB is gb initializer
-func NewGB(cpu *cpu.CPU, gpu *gpu.GPU, timer *timer.Timer, irq *interrupt.Interrupt, win window.Window) *GB {
-	return &GB{
+func NewGB(cpu *cpu.CPU, gpu *gpu.GPU, timer *timer.Timer, apu *apu.APU, irq *interrupt.Interrupt, win window.Window) *GB {
+	g := &GB{
 		currentCycle: 0,
 		cpu:          cpu,
 		gpu:          gpu,
 		timer:        timer,
+		apu:          apu,
 		irq:          irq,
 		win:          win,
+		pacer:        pacer.NewPacer(pacer.Timer),
+		watchdog:     watchdog{lo: 0xFFFF},
 	}
+	cpu.SetTicker(g)
+	return g
 }
 
-// Start is
+// SetModel selects the hardware model. The machine is put into the state the boot ROM of the model leaves it.
+// Call it before PowerOn to run the boot ROM as the model.
+func (g *GB) SetModel(m model.Model) {
+	g.model = m
+	g.cpu.SetModel(m)
+	g.gpu.SetModel(m)
+	g.timer.SetModel(m)
+}
+
+// Model returns the hardware model.
+func (g *GB) Model() model.Model {
+	return g.model
+}
+
+// BootMemory is the memory the boot ROM is mapped to. bus.Bus implements it.
+type BootMemory interface {
+	// SetModel selects the model the boot ROM is mapped as
+	SetModel(m model.Model)
+	SetBootROM(rom []byte) error
+}
+
+// SetBootROM maps the boot ROM of the model to the memory and powers on the machine to run it.
+// The memory gets the model from the machine, so that both are the same model.
+func (g *GB) SetBootROM(mem BootMemory, rom []byte) error {
+	mem.SetModel(g.model)
+	if err := mem.SetBootROM(rom); err != nil {
+		return err
+	}
+	g.PowerOn()
+	return nil
+}
+
+// PowerOn puts the machine into the state at power on, to run the boot ROM from 0x0000.
+// Without it, the machine starts in the state the boot ROM leaves it.
+func (g *GB) PowerOn() {
+	g.cpu.PowerOn()
+	g.gpu.PowerOn()
+	g.timer.PowerOn()
+	g.apu.PowerOn()
+	g.irq.PowerOn()
+}
+
+// SetPacer replaces the frame pacer used by Start.
+func (g *GB) SetPacer(p *pacer.Pacer) {
+	g.pacer = p
+}
+
+// SetAudioSink sets where the samples of each frame are written.
+// The samples stay in the APU buffer if no sink is set.
+func (g *GB) SetAudioSink(s apu.Sink) {
+	g.audioSink = s
+}
+
+// AudioErr returns the error of the audio sink. The sink is detached at the first error.
+func (g *GB) AudioErr() error {
+	return g.audioErr
+}
+
+// Cycles returns the clocks elapsed since power on.
+func (g *GB) Cycles() uint64 {
+	return g.totalCycles
+}
+
+// Frame returns the number of the frames since power on.
+func (g *GB) Frame() int {
+	return g.frame
+}
+
+// OAMDMA reports whether OAM DMA is started. The writes to OAM are made by the transfer, not by CPU, then.
+func (g *GB) OAMDMA() bool {
+	return g.gpu.DMAStarted() && !g.cpu.Stopped()
+}
+
+// OAMDMASource returns the address OAM DMA copies from.
+func (g *GB) OAMDMASource() types.Word {
+	return g.gpu.DMASource()
+}
+
+// Start runs the emulator at the speed of the real hardware.
+// It returns when the window is closed or Quit is called.
 func (g *GB) Start() {
-	t := time.NewTicker(16 * time.Millisecond)
-	for {
-		select {
-		case <-t.C:
-			g.win.Render(g.next())
-		}
+	for !g.win.Closed() && !g.quit.Load() {
+		g.win.Render(g.next())
+		g.pacer.Wait()
+	}
+}
+
+// Quit makes Start return after the current frame. It can be called from another goroutine, e.g. on Ctrl-C.
+func (g *GB) Quit() {
+	g.quit.Store(true)
+}
+
+// RunFrames runs n frames as fast as possible. It is used for headless runs.
+func (g *GB) RunFrames(n int) {
+	for i := 0; i < n; i++ {
+		g.win.Render(g.next())
 	}
-	t.Stop()
 }
+
 func (g *GB) next() types.ImageData {
 	for {
-		var cycles uint
-		if g.gpu.DMAStarted() {
-			g.gpu.Transfer()
-			// https://github.com/Gekkio/mooneye-gb/blob/master/docs/accuracy.markdown#how-many-cycles-does-oam-dma-take
-			cycles = 162
+		if g.Step() {
+			return g.gpu.GetImageData()
+		}
+	}
+}
+
+// Step runs one CPU step, or one OAM DMA transfer, with the peripherals.
+// It returns true when a frame is completed.
+func (g *GB) Step() bool {
+	if g.replayed() {
+		g.setReplay(true)
+		defer g.setReplay(false)
+	}
+	switch {
+	case g.cpu.Stopped():
+		// STOP中はクロックが止まり、LCDは消える
+		// ボタンが押されるまで、フレームを進めずに入力を待つ
+		g.cpu.Step()
+		if g.cpu.Stopped() {
+			g.currentCycle = CyclesPerFrame
 		} else {
-			cycles = g.cpu.Step()
+			g.gpu.SetBlank(false)
 		}
-		g.gpu.Step(cycles * 4)
-		if overflowed := g.timer.Update(cycles); overflowed {
-			g.irq.SetIRQ(interrupt.TimerOverflowFlag)
+	case g.gpu.DMAStarted():
+		g.gpu.Transfer()
+		// https://github.com/Gekkio/mooneye-gb/blob/master/docs/accuracy.markdown#how-many-cycles-does-oam-dma-take
+		g.Tick(162)
+	default:
+		if g.cpu.NextStep() == profiler.Instruction {
+			g.instructions++
 		}
-		g.currentCycle += cycles * 4
-		if g.currentCycle >= CyclesPerFrame {
-			g.win.PollKey()
-			g.currentCycle -= CyclesPerFrame
-			return g.gpu.GetImageData()
+		// 周辺機器はCPUのメモリアクセスごとにTickで進む
+		g.cpu.Step()
+		if g.cpu.Stopped() {
+			g.timer.ResetDIV()
+			g.gpu.SetBlank(true)
 		}
 	}
+	g.steps++
+	g.watch()
+	if g.currentCycle < CyclesPerFrame {
+		return false
+	}
+	g.frame++
+	g.watchFrame()
+	g.pollKey()
+	g.currentCycle -= CyclesPerFrame
+	g.flushAudio()
+	g.record()
+	return true
+}
+
+// Tick advances the peripherals by the given M-cycles.
+// CPU calls it on each memory access, so that the peripherals see the access at the right timing.
+func (g *GB) Tick(cycles uint) {
+	g.gpu.Step(cycles * 4)
+	g.apu.Step(cycles * 4)
+	if overflowed := g.timer.Update(cycles); overflowed {
+		g.irq.SetIRQ(interrupt.TimerOverflowFlag)
+	}
+	g.currentCycle += cycles * 4
+	g.totalCycles += uint64(cycles * 4)
+}
+
+// flushAudio pulls the samples of the frame out of the APU into the audio sink.
+func (g *GB) flushAudio() {
+	if g.audioSink == nil {
+		return
+	}
+	if cap(g.samples) < g.apu.Buffered() {
+		g.samples = make([]apu.Sample, g.apu.Buffered())
+	}
+	n := g.apu.ReadSamples(g.samples[:cap(g.samples)])
+	if g.replaying() {
+		// 再実行したフレームの音は出力済み
+		return
+	}
+	if err := g.audioSink.WriteSamples(g.samples[:n]); err != nil {
+		// 書けなくなったシンクは外して、エミュレーションは続ける
+		g.audioErr = err
+		g.audioSink = nil
+	}
 }
@@ -1,11 +1,14 @@
 package gb
 
 import (
+	"errors"
 	"image"
 	"image/png"
 	"os"
 	"testing"
 
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/asm"
 	"github.com/kijimaD/goboy/pkg/bus"
 	"github.com/kijimaD/goboy/pkg/cartridge"
 	"github.com/kijimaD/goboy/pkg/constants"
@@ -19,6 +22,7 @@ import (
 	"github.com/kijimaD/goboy/pkg/timer"
 	"github.com/kijimaD/goboy/pkg/types"
 	"github.com/kijimaD/goboy/pkg/utils"
+	"github.com/stretchr/testify/assert"
 )
 
 const (
@@ -35,11 +39,16 @@ func (m mockWindow) PollKey() {
 }
 
 func setup(file string) *GB {
-	l := logger.NewLogger(logger.LogLevel("DEBUG"))
 	buf, err := utils.LoadROM(file)
 	if err != nil {
 		panic(err)
 	}
+	emu, _ := setupROM(buf)
+	return emu
+}
+
+func setupROM(buf []byte) (*GB, *bus.Bus) {
+	l := logger.NewLogger(logger.LogLevel("DEBUG"))
 	cart, err := cartridge.NewCartridge(buf)
 	if err != nil {
 		panic(err)
@@ -51,13 +60,14 @@ func setup(file string) *GB {
 	oamRAM := ram.NewRAM(0xA0)
 	gpu := gpu.NewGPU()
 	t := timer.NewTimer()
+	a := apu.NewAPU()
 	pad := pad.NewPad()
 	irq := interrupt.NewInterrupt()
-	b := bus.NewBus(l, cart, gpu, vRAM, wRAM, hRAM, oamRAM, t, irq, pad)
+	b := bus.NewBus(l, cart, gpu, vRAM, wRAM, hRAM, oamRAM, t, a, irq, pad)
 	gpu.Init(b, irq)
 	win := mockWindow{}
-	emu := NewGB(cpu.NewCPU(l, b, irq), gpu, t, irq, win)
-	return emu
+	emu := NewGB(cpu.NewCPU(l, b, irq), gpu, t, a, irq, win)
+	return emu, b
 }
 
 func set(img *image.RGBA, imageData types.ImageData) {
@@ -136,7 +146,7 @@ func TestROMs(t *testing.T) {
 		{
 			"11-op a,(hl).gb",
 			RomPathPrefix + "cpu_instrs/11-op a,(hl).gb",
-			1000,
+			1300,
 		},
 		{
 			"cpu_instr",
@@ -171,3 +181,100 @@ func TestROMs(t *testing.T) {
 		})
 	}
 }
+
+// quitWindow calls Quit on a frame, like Ctrl-C while the window is open
+type quitWindow struct {
+	mockWindow
+	emu    *GB
+	frames int
+}
+
+func (w *quitWindow) Render(imageData types.ImageData) {
+	w.frames++
+	if w.frames == 3 {
+		w.emu.Quit()
+	}
+}
+
+func (w *quitWindow) Closed() bool {
+	return false
+}
+
+func TestStartQuit(t *testing.T) {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], asm.MustAssemble("loop:\n\tJR loop", 0x0100))
+	emu, _ := setupROM(rom)
+	win := &quitWindow{emu: emu}
+	emu.win = win
+	emu.Start()
+	assert.Equal(t, 3, emu.Frame())
+}
+
+// failingSink fails to write like a full disk
+type failingSink struct {
+	calls int
+}
+
+func (s *failingSink) WriteSamples(samples []apu.Sample) error {
+	s.calls++
+	return errors.New("no space left on device")
+}
+
+func TestAudioSinkError(t *testing.T) {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], asm.MustAssemble("loop:\n\tJR loop", 0x0100))
+	emu, _ := setupROM(rom)
+	sink := &failingSink{}
+	emu.SetAudioSink(sink)
+	for emu.Frame() < 3 {
+		emu.Step()
+	}
+	// エラーの後もエミュレーションは続き、シンクは外される
+	assert.Equal(t, 3, emu.Frame())
+	assert.Equal(t, 1, sink.calls)
+	assert.EqualError(t, emu.AudioErr(), "no space left on device")
+}
+
+func TestSTOP(t *testing.T) {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], asm.MustAssemble(`
+	LD A,$FF
+	LDH ($FF47),A ; 消えたLCDと区別できるように背景を黒にする
+	LD A,$10
+	LDH ($FF00),A ; ボタンを選ぶ
+wait:
+	LDH A,($FF44)
+	CP $91
+	JR NZ,wait
+	STOP
+	INC B
+loop:
+	JR loop
+`, 0x0100))
+	emu, b := setupROM(rom)
+	div := byte(0)
+	for i := 0; i < 100000 && !emu.cpu.Stopped(); i++ {
+		div = b.ReadByte(0xFF04)
+		emu.Step()
+	}
+	assert.True(t, emu.cpu.Stopped())
+	assert.NotEqual(t, byte(0), div)
+	assert.Equal(t, byte(0), b.ReadByte(0xFF04))
+
+	// ボタンが押されるまで、DIVは止まり画面は消えたまま
+	for i := 0; i < 3; i++ {
+		img := emu.next()
+		assert.Equal(t, gpu.THIN_GREEN, img[0])
+		assert.Equal(t, gpu.THIN_GREEN, img[len(img)-1])
+	}
+	assert.True(t, emu.cpu.Stopped())
+	assert.Equal(t, byte(0), b.ReadByte(0xFF04))
+	assert.Equal(t, byte(0x00), emu.cpu.Regs.B)
+
+	b.SetButtons(pad.A)
+	img := emu.next()
+	assert.False(t, emu.cpu.Stopped())
+	assert.Equal(t, byte(0x01), emu.cpu.Regs.B)
+	assert.Equal(t, gpu.BLACK_GREEN, img[0])
+	assert.NotEqual(t, byte(0), b.ReadByte(0xFF04))
+}
@@ -0,0 +1,71 @@
+package gb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/lockstep"
+	"github.com/kijimaD/goboy/pkg/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockstep(t *testing.T) {
+	path := RomPathPrefix + "cpu_instrs/06-ld r,r.gb"
+
+	var ref bytes.Buffer
+	emu := setup(path)
+	emu.cpu.SetTracer(trace.NewTracer(&ref, emu))
+	for i := 0; i < 5; i++ {
+		emu.next()
+	}
+	emu.cpu.SetTracer(nil)
+	lines := strings.Split(strings.TrimSpace(ref.String()), "\n")
+	assert.True(t, len(lines) > 1000)
+
+	emu = setup(path)
+	d, err := lockstep.Run(strings.NewReader(ref.String()), emu, emu.cpu, 8)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+
+	// Aレジスタが違う参照に対して、その行で止まる
+	broken := []rune(lines[999])
+	broken[2], broken[3] = 'E', 'E'
+	lines[999] = string(broken)
+	emu = setup(path)
+	d, err = lockstep.Run(strings.NewReader(strings.Join(lines, "\n")), emu, emu.cpu, 8)
+	assert.NoError(t, err)
+	if assert.NotNil(t, d) {
+		assert.Equal(t, 1000, d.Line)
+		assert.Len(t, d.History, 8)
+		assert.Contains(t, d.Fields(), "A")
+	}
+}
+
+// TestROMsLockstep compares the ROMs with the reference traces in test/trace/<name>.log, e.g. gameboy-doctor logs.
+// It is skipped when no reference exists.
+func TestROMsLockstep(t *testing.T) {
+	logs, _ := filepath.Glob("../../test/trace/*.log")
+	if len(logs) == 0 {
+		t.Skip("no reference trace in test/trace")
+	}
+	for _, log := range logs {
+		name := strings.TrimSuffix(filepath.Base(log), ".log")
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			emu := setup(RomPathPrefix + "cpu_instrs/" + name + ".gb")
+			emu.gpu.FixLY(0x90)
+			d, err := lockstep.Run(f, emu, emu.cpu, 16)
+			assert.NoError(t, err)
+			if d != nil {
+				t.Error(d)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package gb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/gpu"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/pad"
+	"github.com/kijimaD/goboy/pkg/timer"
+)
+
+// Memory is the state behind the bus: the RAMs, the cartridge and the joypad. bus.Bus implements it.
+type Memory interface {
+	Snapshot() bus.State
+	Restore(s bus.State)
+	// Buttons returns the pressed buttons, which are recorded as the input of the frame
+	Buttons() pad.Button
+	SetButtons(buttons pad.Button)
+	// SetReplay mutes the hooks and the recorders behind the bus during the replay
+	SetReplay(replay bool)
+}
+
+// snapshot is the whole machine at a step
+type snapshot struct {
+	steps        uint64
+	instructions uint64
+	frame        int
+	currentCycle uint
+	totalCycles  uint64
+	watchdog     watchdog
+	cpu          cpu.State
+	gpu          gpu.State
+	timer        timer.State
+	apu          apu.State
+	irq          interrupt.State
+	mem          bus.State
+}
+
+// input is the buttons polled at the end of a frame
+type input struct {
+	frame   int
+	buttons pad.Button
+}
+
+// rewind keeps the snapshots and the inputs to go back in time.
+// The machine is deterministic except the inputs, so a step is reached again by a replay from the snapshot before it.
+type rewind struct {
+	mem       Memory
+	interval  int
+	depth     int
+	snapshots []snapshot
+	// inputs are the changes of the buttons
+	inputs []input
+	// live is the steps run live. The steps up to it are replayed with the recorded inputs.
+	live uint64
+	// replay is set during a replayed step
+	replay bool
+}
+
+var errNoRewind = errors.New("rewind is not enabled")
+
+// SetRewind enables StepBack and RunBackTo. The machine is saved every interval frames and the last depth snapshots are kept.
+// The buttons are recorded on each frame, so that the replay goes the same way.
+// The replayed steps are not seen by the tracer, the profiler, the bus hooks, the sound recorder, the audio sink and the lockup handler again.
+func (g *GB) SetRewind(mem Memory, interval, depth int) {
+	if interval < 1 {
+		interval = 1
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	g.rewind = &rewind{
+		mem:      mem,
+		interval: interval,
+		depth:    depth,
+		inputs:   []input{{frame: g.frame, buttons: mem.Buttons()}},
+		live:     g.steps,
+	}
+	g.save()
+}
+
+// Steps returns the number of the calls of Step since power on. OAM DMA and the idle steps in HALT and STOP are included.
+func (g *GB) Steps() uint64 {
+	return g.steps
+}
+
+// Instructions returns the number of the instructions executed since power on. StepBack counts them.
+func (g *GB) Instructions() uint64 {
+	return g.instructions
+}
+
+// StepBack goes back n instructions, to just after the instruction executed n instructions ago.
+// The machine is restored from the last snapshot before it and run again up to it.
+func (g *GB) StepBack(n int) error {
+	rw := g.rewind
+	if rw == nil {
+		return errNoRewind
+	}
+	if n < 0 || uint64(n) > g.instructions {
+		return fmt.Errorf("cannot step back %d instructions", n)
+	}
+	if n == 0 {
+		return nil
+	}
+	target := g.instructions - uint64(n)
+	i := sort.Search(len(rw.snapshots), func(i int) bool { return rw.snapshots[i].instructions > target })
+	if i == 0 {
+		return fmt.Errorf("instruction %d is before the oldest snapshot", target)
+	}
+	g.leave()
+	g.restore(rw.snapshots[i-1])
+	for g.instructions < target {
+		g.Step()
+	}
+	return nil
+}
+
+// RunBackTo goes back to the last step before the current one where cond holds.
+// cond is checked before each step, like a breakpoint. The machine stays if it is not found.
+func (g *GB) RunBackTo(cond func() bool) error {
+	rw := g.rewind
+	if rw == nil {
+		return errNoRewind
+	}
+	end := g.steps
+	g.leave()
+	// 新しいスナップショットから順に、次のスナップショットまでを再実行して探す
+	for i := len(rw.snapshots) - 1; i >= 0; i-- {
+		if rw.snapshots[i].steps >= end {
+			continue
+		}
+		limit := end
+		if i+1 < len(rw.snapshots) && rw.snapshots[i+1].steps < end {
+			limit = rw.snapshots[i+1].steps
+		}
+		g.restore(rw.snapshots[i])
+		found, ok := uint64(0), false
+		for g.steps < limit {
+			if cond() {
+				found, ok = g.steps, true
+			}
+			g.Step()
+		}
+		if ok {
+			return g.seek(found)
+		}
+	}
+	if err := g.seek(end); err != nil {
+		return err
+	}
+	return errors.New("the condition does not hold since the oldest snapshot")
+}
+
+// seek restores the last snapshot before the step and replays up to it.
+func (g *GB) seek(target uint64) error {
+	rw := g.rewind
+	i := sort.Search(len(rw.snapshots), func(i int) bool { return rw.snapshots[i].steps > target })
+	if i == 0 {
+		return fmt.Errorf("step %d is before the oldest snapshot", target)
+	}
+	g.leave()
+	g.restore(rw.snapshots[i-1])
+	for g.steps < target {
+		g.Step()
+	}
+	return nil
+}
+
+// leave remembers how far the machine has run live, before it goes back.
+func (g *GB) leave() {
+	if g.steps > g.rewind.live {
+		g.rewind.live = g.steps
+	}
+}
+
+// replayed reports whether the next step has been run live before.
+func (g *GB) replayed() bool {
+	return g.rewind != nil && g.steps < g.rewind.live
+}
+
+// setReplay mutes the recorders during a replayed step, so that they see each step once.
+func (g *GB) setReplay(replay bool) {
+	g.rewind.replay = replay
+	g.cpu.SetReplay(replay)
+	g.rewind.mem.SetReplay(replay)
+}
+
+// replaying reports whether the current step is a replay.
+func (g *GB) replaying() bool {
+	return g.rewind != nil && g.rewind.replay
+}
+
+// pollKey reads the buttons at the end of a frame. The replayed frames get the recorded buttons instead.
+func (g *GB) pollKey() {
+	if !g.replaying() {
+		g.win.PollKey()
+		return
+	}
+	rw := g.rewind
+	i := sort.Search(len(rw.inputs), func(i int) bool { return rw.inputs[i].frame > g.frame })
+	if i > 0 {
+		rw.mem.SetButtons(rw.inputs[i-1].buttons)
+	}
+}
+
+// record records the buttons at the end of a live frame, and saves the machine every interval frames.
+func (g *GB) record() {
+	rw := g.rewind
+	if rw == nil || g.replaying() {
+		return
+	}
+	if b := rw.mem.Buttons(); b != rw.inputs[len(rw.inputs)-1].buttons {
+		rw.inputs = append(rw.inputs, input{frame: g.frame, buttons: b})
+	}
+	if g.frame%rw.interval == 0 {
+		g.save()
+	}
+}
+
+// save takes a snapshot. The oldest one and the inputs before it are dropped over the depth.
+func (g *GB) save() {
+	rw := g.rewind
+	rw.snapshots = append(rw.snapshots, snapshot{
+		steps:        g.steps,
+		instructions: g.instructions,
+		frame:        g.frame,
+		currentCycle: g.currentCycle,
+		totalCycles:  g.totalCycles,
+		watchdog:     g.watchdog,
+		cpu:          g.cpu.Snapshot(),
+		gpu:          g.gpu.Snapshot(),
+		timer:        g.timer.Snapshot(),
+		apu:          g.apu.Snapshot(),
+		irq:          g.irq.Snapshot(),
+		mem:          rw.mem.Snapshot(),
+	})
+	if len(rw.snapshots) <= rw.depth {
+		return
+	}
+	rw.snapshots = append(rw.snapshots[:0], rw.snapshots[1:]...)
+	// 最古のスナップショットの時点のボタンは残す
+	oldest := rw.snapshots[0].frame
+	i := sort.Search(len(rw.inputs), func(i int) bool { return rw.inputs[i].frame > oldest })
+	if i > 1 {
+		rw.inputs = append(rw.inputs[:0], rw.inputs[i-1:]...)
+	}
+}
+
+// restore puts the whole machine back into the snapshot. The lockup handler is kept.
+func (g *GB) restore(s snapshot) {
+	handler := g.watchdog.handler
+	g.steps = s.steps
+	g.instructions = s.instructions
+	g.frame = s.frame
+	g.currentCycle = s.currentCycle
+	g.totalCycles = s.totalCycles
+	g.watchdog = s.watchdog
+	g.watchdog.handler = handler
+	g.cpu.Restore(s.cpu)
+	g.gpu.Restore(s.gpu)
+	g.timer.Restore(s.timer)
+	g.apu.Restore(s.apu)
+	g.irq.Restore(s.irq)
+	g.rewind.mem.Restore(s.mem)
+}
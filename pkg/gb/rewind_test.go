@@ -0,0 +1,255 @@
+package gb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/window"
+	"github.com/kijimaD/goboy/pkg/journal"
+	"github.com/kijimaD/goboy/pkg/pad"
+	"github.com/kijimaD/goboy/pkg/soundlog"
+	"github.com/kijimaD/goboy/pkg/trace"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const rewindProgram = `
+	LD SP,$FFFE
+	LD A,1
+	LDH ($FFFF),A
+	LD A,$20
+	LDH ($FF00),A
+	EI
+	LD HL,$C000
+loop:
+	INC (HL)
+	LDH A,($FF00)
+	LD ($C001),A
+	JR loop
+`
+
+// VBlankで数えて、音量にも書く
+const vblankHandler = `
+	PUSH AF
+	LD A,($C002)
+	INC A
+	LD ($C002),A
+	LDH ($FF24),A
+	POP AF
+	RETI
+`
+
+// pressWindow presses a different direction every 3 frames, so that a replay without the recorded inputs goes another way.
+type pressWindow struct {
+	window.Window
+	b    *bus.Bus
+	poll int
+}
+
+func (w *pressWindow) PollKey() {
+	w.poll++
+	w.b.SetButtons(pad.Button(w.poll/3%4) << 4)
+}
+
+// machineState is what a replay has to reproduce
+type machineState struct {
+	steps  uint64
+	insts  uint64
+	frame  int
+	cycles uint64
+	pc, sp types.Word
+	regs   cpu.Registers
+	ime    bool
+	mem    [3]byte
+	div    byte
+	ly     byte
+	ifReg  byte
+}
+
+func stateOf(g *GB, b *bus.Bus) machineState {
+	return machineState{
+		steps:  g.Steps(),
+		insts:  g.Instructions(),
+		frame:  g.Frame(),
+		cycles: g.Cycles(),
+		pc:     g.cpu.PC,
+		sp:     g.cpu.SP,
+		regs:   g.cpu.Regs,
+		ime:    g.cpu.IME(),
+		mem:    [3]byte{b.ReadByte(0xC000), b.ReadByte(0xC001), b.ReadByte(0xC002)},
+		div:    b.ReadByte(0xFF04),
+		ly:     b.ReadByte(0xFF44),
+		ifReg:  b.ReadByte(0xFF0F),
+	}
+}
+
+func setupRewind(interval, depth int) (*GB, *bus.Bus) {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0040:], asm.MustAssemble(vblankHandler, 0x0040))
+	copy(rom[0x0100:], asm.MustAssemble(rewindProgram, 0x0100))
+	emu, b := setupROM(rom)
+	emu.win = &pressWindow{b: b}
+	emu.SetRewind(b, interval, depth)
+	return emu, b
+}
+
+// stepInstruction steps until CPU executes an instruction, so that the machine is just after it.
+func stepInstruction(g *GB) {
+	for n := g.Instructions(); g.Instructions() == n; {
+		g.Step()
+	}
+}
+
+func TestStepBack(t *testing.T) {
+	emu, b := setupRewind(4, 100)
+	for emu.Frame() < 10 {
+		emu.Step()
+	}
+	for i := 0; i < 1234; i++ {
+		stepInstruction(emu)
+	}
+	past := stateOf(emu, b)
+	for emu.Frame() < 20 {
+		emu.Step()
+	}
+	for i := 0; i < 567; i++ {
+		emu.Step()
+	}
+	now := stateOf(emu, b)
+	assert.NotEqual(t, past.mem[1], now.mem[1])
+
+	assert.NoError(t, emu.StepBack(int(now.insts-past.insts)))
+	assert.Equal(t, past, stateOf(emu, b))
+	// 記録した入力で同じ未来に戻る
+	for emu.Steps() < now.steps {
+		emu.Step()
+	}
+	assert.Equal(t, now, stateOf(emu, b))
+
+	assert.NoError(t, emu.StepBack(1))
+	assert.Equal(t, now.insts-1, emu.Instructions())
+	assert.Error(t, emu.StepBack(int(emu.Instructions())+1))
+	assert.Equal(t, now.insts-1, emu.Instructions())
+}
+
+func TestStepBackDepth(t *testing.T) {
+	emu, _ := setupRewind(2, 3)
+	for emu.Frame() < 10 {
+		emu.Step()
+	}
+	// 6フレームより前のスナップショットは捨てられている
+	assert.Error(t, emu.StepBack(int(emu.Instructions())))
+	assert.Equal(t, 3, len(emu.rewind.snapshots))
+	assert.Equal(t, 6, emu.rewind.snapshots[0].frame)
+	assert.NoError(t, emu.StepBack(100))
+
+	noRewind, _ := setupROM(make([]byte, 0x8000))
+	assert.Error(t, noRewind.StepBack(1))
+}
+
+// dmaProgram starts OAM DMA in every loop
+const dmaProgram = `
+loop:
+	LD A,$C0
+	LDH ($FF46),A
+	INC B
+	JR loop
+`
+
+func TestStepBackOverDMA(t *testing.T) {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], asm.MustAssemble(dmaProgram, 0x0100))
+	emu, b := setupROM(rom)
+	emu.SetRewind(b, 1, 100)
+	for emu.Frame() < 3 {
+		emu.Step()
+	}
+	stepInstruction(emu)
+	pcs := []types.Word{}
+	for i := 0; i < 8; i++ {
+		stepInstruction(emu)
+		pcs = append(pcs, emu.cpu.PC)
+	}
+	insts := emu.Instructions()
+
+	// DMAのステップは命令に数えない
+	for n := 1; n < len(pcs); n++ {
+		assert.NoError(t, emu.StepBack(n))
+		assert.Equal(t, insts-uint64(n), emu.Instructions())
+		assert.Equal(t, pcs[len(pcs)-1-n], emu.cpu.PC)
+		for emu.Instructions() < insts {
+			stepInstruction(emu)
+		}
+	}
+	assert.Equal(t, pcs[len(pcs)-1], emu.cpu.PC)
+}
+
+func TestRunBackTo(t *testing.T) {
+	emu, b := setupRewind(3, 100)
+	for emu.Frame() < 12 {
+		emu.Step()
+	}
+	end := emu.Steps()
+
+	// フレーム5の最後のVBlank割り込みの直前
+	cond := func() bool { return emu.Frame() == 5 && emu.cpu.PC == 0x0040 }
+	assert.NoError(t, emu.RunBackTo(cond))
+	assert.Equal(t, types.Word(0x0040), emu.cpu.PC)
+	assert.Equal(t, 5, emu.Frame())
+	found := stateOf(emu, b)
+	for emu.Steps() < end {
+		emu.Step()
+		assert.False(t, cond())
+	}
+
+	assert.NoError(t, emu.RunBackTo(cond))
+	assert.Equal(t, found, stateOf(emu, b))
+
+	assert.Error(t, emu.RunBackTo(func() bool { return false }))
+	assert.Equal(t, found.steps, emu.Steps())
+}
+
+func TestReplayRecordsOnce(t *testing.T) {
+	emu, b := setupRewind(3, 100)
+	rec := soundlog.NewRecorder(emu)
+	b.SetSoundRecorder(rec)
+	j := journal.New(emu, 1000)
+	j.SetRange(0xC002, 0xC002)
+	j.Attach(b)
+	var out bytes.Buffer
+	emu.cpu.SetTracer(trace.NewTracer(&out, emu))
+	for emu.Frame() < 12 {
+		emu.Step()
+	}
+	end := emu.Steps()
+	events := append([]soundlog.Event{}, rec.Events()...)
+	entries := j.Entries()
+	lines := out.String()
+	n := len(events)
+	assert.Equal(t, n, len(entries))
+
+	// 巻き戻して同じところまで進めても、記録は変わらない
+	assert.NoError(t, emu.StepBack(20000))
+	for emu.Steps() < end {
+		emu.Step()
+	}
+	assert.NoError(t, emu.RunBackTo(func() bool { return emu.Frame() == 5 && emu.cpu.PC == 0x0040 }))
+	for emu.Steps() < end {
+		emu.Step()
+	}
+	assert.Equal(t, events, rec.Events())
+	assert.Equal(t, entries, j.Entries())
+	assert.Equal(t, lines, out.String())
+
+	// その先は記録が続く
+	for emu.Frame() < 13 {
+		emu.Step()
+	}
+	assert.Equal(t, n+1, len(rec.Events()))
+	assert.True(t, rec.Events()[n].Cycle > events[n-1].Cycle)
+	assert.Equal(t, n+1, len(j.Entries()))
+	assert.True(t, len(out.String()) > len(lines))
+}
@@ -0,0 +1,99 @@
+package gb
+
+import (
+	"github.com/kijimaD/goboy/pkg/lockup"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+const (
+	// tightLoopSize is the PC range regarded as a tight loop
+	tightLoopSize = 16
+	// deadLoopFrames is how long a tight loop with interrupts disabled and no IO reads runs until it is regarded as dead
+	deadLoopFrames = 60
+)
+
+// watchdog detects the states that the machine can never leave.
+// A crashed ROM is told apart from a slow one by them.
+//
+//   - illegal opcode
+//   - HALT with IE=0
+//   - tight loop with interrupts disabled for deadLoopFrames frames. A loop polling IO, e.g. waiting for LY, can end.
+type watchdog struct {
+	// PC range in the current frame
+	lo, hi types.Word
+	// interrupted is set when interrupts are enabled or CPU halts during the frame
+	interrupted bool
+	// polled is set when CPU reads an IO register during the frame
+	polled bool
+	// looped counts the frames spent in a tight loop
+	looped  int
+	event   *lockup.Event
+	handler func(lockup.Event)
+}
+
+// OnLockup sets the function called once when the machine gets stuck.
+func (g *GB) OnLockup(f func(lockup.Event)) {
+	g.watchdog.handler = f
+}
+
+// Lockup returns the event that the machine got stuck. It returns nil while the machine is alive.
+func (g *GB) Lockup() *lockup.Event {
+	return g.watchdog.event
+}
+
+// watch checks the CPU state after each step.
+func (g *GB) watch() {
+	w := &g.watchdog
+	if w.event != nil {
+		return
+	}
+	if e := g.cpu.Lockup(); e != nil {
+		g.raise(e)
+		return
+	}
+	if g.cpu.Halted() {
+		if g.irq.IE == 0 {
+			// PCはHALTの次を指している
+			g.raise(g.cpu.NewLockup(lockup.HaltWithoutIRQ, g.cpu.PC-1))
+			return
+		}
+		w.interrupted = true
+	}
+	if g.cpu.IME() || g.cpu.Stopped() {
+		w.interrupted = true
+	}
+	if g.cpu.PolledIO() {
+		w.polled = true
+	}
+	pc := g.cpu.PC
+	if pc < w.lo {
+		w.lo = pc
+	}
+	if pc > w.hi {
+		w.hi = pc
+	}
+}
+
+// watchFrame checks the loop at the end of each frame.
+func (g *GB) watchFrame() {
+	w := &g.watchdog
+	if w.event == nil && !w.interrupted && !w.polled && w.hi-w.lo < tightLoopSize {
+		w.looped++
+		if w.looped >= deadLoopFrames {
+			g.raise(g.cpu.NewLockup(lockup.DeadLoop, g.cpu.PC))
+		}
+	} else {
+		w.looped = 0
+	}
+	w.lo, w.hi = 0xFFFF, 0x0000
+	w.interrupted = false
+	w.polled = false
+}
+
+func (g *GB) raise(e *lockup.Event) {
+	g.watchdog.event = e
+	// 再実行で同じロックアップを二度報告しない
+	if g.watchdog.handler != nil && !g.replaying() {
+		g.watchdog.handler(*e)
+	}
+}
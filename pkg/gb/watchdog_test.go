@@ -0,0 +1,96 @@
+package gb
+
+import (
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/lockup"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// runCode runs the assembly placed at the entry point 0x0100.
+func runCode(src string, frames int) (*GB, []lockup.Event) {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], asm.MustAssemble(src, 0x0100))
+	emu, _ := setupROM(rom)
+	events := []lockup.Event{}
+	emu.OnLockup(func(e lockup.Event) { events = append(events, e) })
+	for i := 0; i < frames; i++ {
+		emu.next()
+	}
+	return emu, events
+}
+
+func TestWatchdogIllegalOpcode(t *testing.T) {
+	emu, events := runCode("NOP\nDB $FD", 2)
+	assert.Len(t, events, 1)
+	assert.Equal(t, lockup.Event{Kind: lockup.IllegalOpcode, PC: 0x0101, Opcode: 0xFD, Bank: 0}, events[0])
+	assert.Equal(t, &events[0], emu.Lockup())
+}
+
+func TestWatchdogHaltWithoutIRQ(t *testing.T) {
+	code := `
+	XOR A
+	LDH ($FFFF),A ; IE
+	HALT
+`
+	_, events := runCode(code, 2)
+	assert.Len(t, events, 1)
+	assert.Equal(t, lockup.HaltWithoutIRQ, events[0].Kind)
+	assert.Equal(t, types.Word(0x0103), events[0].PC)
+	assert.Equal(t, byte(0x76), events[0].Opcode)
+}
+
+func TestWatchdogDeadLoop(t *testing.T) {
+	code := `
+	DI
+loop:
+	JR loop
+`
+	_, events := runCode(code, deadLoopFrames-1)
+	assert.Len(t, events, 0)
+	_, events = runCode(code, deadLoopFrames+1)
+	assert.Len(t, events, 1)
+	assert.Equal(t, lockup.DeadLoop, events[0].Kind)
+	assert.Equal(t, types.Word(0x0101), events[0].PC)
+}
+
+func TestWatchdogIgnoresHaltWithIRQ(t *testing.T) {
+	code := `
+	LD A,1
+	LDH ($FFFF),A ; IE
+	EI
+loop:
+	HALT
+	JR loop
+`
+	_, events := runCode(code, deadLoopFrames*2)
+	assert.Len(t, events, 0)
+}
+
+func TestWatchdogIgnoresIOPolling(t *testing.T) {
+	// LYは割り込みなしでも変わるので、待ち続けるループは抜けられる
+	code := `
+	DI
+wait:
+	LDH A,($FF44) ; LY
+	CP $FF
+	JR NZ,wait
+`
+	_, events := runCode(code, deadLoopFrames*2)
+	assert.Len(t, events, 0)
+
+	// HRAMは割り込みを止めるとCPUしか書き換えないので、抜けられない
+	code = `
+	DI
+	LD HL,$FF80
+wait:
+	LD A,(HL)
+	AND A
+	JR Z,wait
+`
+	_, events = runCode(code, deadLoopFrames*2)
+	assert.Len(t, events, 1)
+	assert.Equal(t, lockup.DeadLoop, events[0].Kind)
+}
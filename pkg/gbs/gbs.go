@@ -0,0 +1,191 @@
+package gbs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// GBS (Game Boy Sound) is a music rip. It has only the sound driver and the music data of a game.
+// https://ocremix.org/info/GBS_Format_Specification
+//
+//	0x00 "GBS"
+//	0x03 version (1)
+//	0x04 number of songs
+//	0x05 first song (1 origin)
+//	0x06 load address
+//	0x08 init address
+//	0x0A play address
+//	0x0C stack pointer
+//	0x0E timer modulo
+//	0x0F timer control
+//	0x10 title (32 bytes)
+//	0x30 author (32 bytes)
+//	0x50 copyright (32 bytes)
+//	0x70 code and data. It is loaded to the load address.
+const headerSize = 0x70
+
+const (
+	// TimerInterruptEnabled is the bit of timer control to drive the play routine by the timer.
+	// Otherwise the play routine is called on each VBlank.
+	TimerInterruptEnabled = 0x04
+
+	// driverAddr is where the driver code is placed.
+	// It is between the interrupt vectors and the cartridge header.
+	driverAddr = 0x0068
+	entryAddr  = 0x0100
+	romBank    = 0x4000
+	minROMSize = 0x8000
+)
+
+// GBS is a parsed GBS file
+type GBS struct {
+	Version      byte
+	Songs        int
+	FirstSong    int
+	LoadAddr     types.Word
+	InitAddr     types.Word
+	PlayAddr     types.Word
+	StackPointer types.Word
+	TMA          byte
+	TAC          byte
+	Title        string
+	Author       string
+	Copyright    string
+	Data         []byte
+}
+
+// IsGBS reports whether buf starts with GBS magic.
+func IsGBS(buf []byte) bool {
+	return len(buf) >= 3 && string(buf[0:3]) == "GBS"
+}
+
+// Parse parses GBS file
+func Parse(buf []byte) (*GBS, error) {
+	if len(buf) < headerSize || !IsGBS(buf) {
+		return nil, errors.New("not a GBS file")
+	}
+	g := &GBS{
+		Version:      buf[0x03],
+		Songs:        int(buf[0x04]),
+		FirstSong:    int(buf[0x05]),
+		LoadAddr:     word(buf[0x06:]),
+		InitAddr:     word(buf[0x08:]),
+		PlayAddr:     word(buf[0x0A:]),
+		StackPointer: word(buf[0x0C:]),
+		TMA:          buf[0x0E],
+		TAC:          buf[0x0F],
+		Title:        text(buf[0x10:0x30]),
+		Author:       text(buf[0x30:0x50]),
+		Copyright:    text(buf[0x50:0x70]),
+		Data:         buf[headerSize:],
+	}
+	if g.Version != 1 {
+		return nil, fmt.Errorf("unsupported GBS version %d", g.Version)
+	}
+	if g.LoadAddr < entryAddr+0x50 || g.LoadAddr >= 0x8000 {
+		return nil, fmt.Errorf("unsupported load address 0x%04X", g.LoadAddr)
+	}
+	return g, nil
+}
+
+// ROM builds a cartridge image that plays the song. song is 1 origin.
+//
+// The driver sets the stack pointer, calls the init routine with the song number in A,
+// sets up the timer and then halts forever. The play routine is called from
+// the VBlank or the timer interrupt handler.
+// RST vectors are redirected to the load address, as GBS requires.
+func (g *GBS) ROM(song int) ([]byte, error) {
+	if song < 1 || song > g.Songs {
+		return nil, fmt.Errorf("song %d is out of range (1-%d)", song, g.Songs)
+	}
+	size := int(g.LoadAddr) + len(g.Data)
+	if size < minROMSize {
+		size = minROMSize
+	}
+	size = (size + romBank - 1) / romBank * romBank
+	rom := make([]byte, size)
+	copy(rom[g.LoadAddr:], g.Data)
+
+	// RST
+	for v := 0x00; v <= 0x38; v += 0x08 {
+		putJP(rom[v:], g.LoadAddr+types.Word(v))
+	}
+
+	// interrupt handlers
+	ie := interrupt.VerticalBlankFlag
+	if g.TAC&TimerInterruptEnabled != 0 {
+		ie = interrupt.TimerOverflowFlag
+	}
+	for v := 0x40; v <= 0x60; v += 0x08 {
+		rom[v] = 0xD9 // RETI
+	}
+	// VBlank, Timer: CALL play; RETI
+	for _, v := range []int{0x40, 0x50} {
+		rom[v] = 0xCD
+		putWord(rom[v+1:], g.PlayAddr)
+		rom[v+3] = 0xD9
+	}
+
+	spL, spH := byte(g.StackPointer), byte(g.StackPointer>>8)
+	initL, initH := byte(g.InitAddr), byte(g.InitAddr>>8)
+	tac := g.TAC & 0x07
+	driver := []byte{
+		0xF3,           // DI
+		0x31, spL, spH, // LD SP,nn
+		0x3E, byte(song - 1), // LD A,n
+		0xCD, initL, initH, // CALL init
+		0x3E, g.TMA, // LD A,n
+		0xE0, 0x06, // LDH (TMA),A
+		0x3E, tac, // LD A,n
+		0xE0, 0x07, // LDH (TAC),A
+		0xAF,       // XOR A
+		0xE0, 0x0F, // LDH (IF),A
+		0x3E, ie, // LD A,n
+		0xE0, 0xFF, // LDH (IE),A
+		0xFB,       // EI
+		0x76,       // HALT
+		0x00,       // NOP
+		0x18, 0xFC, // JR -4
+	}
+	copy(rom[driverAddr:], driver)
+
+	// cartridge header
+	putJP(rom[entryAddr:], driverAddr)
+	copy(rom[cartridge.TITLE_START:cartridge.TITLE_END], g.Title)
+	// 多くのドライバはA000-BFFFに状態を置くので、8KBのRAMを付ける
+	rom[cartridge.CARTRIDGE_TYPE] = cartridge.MBC_1_RAM
+	rom[cartridge.RAM_SIZE] = 0x02
+	return rom, nil
+}
+
+// Cartridge builds the synthetic cartridge that plays the song. song is 1 origin.
+func (g *GBS) Cartridge(song int) (*cartridge.Cartridge, error) {
+	rom, err := g.ROM(song)
+	if err != nil {
+		return nil, err
+	}
+	return cartridge.NewCartridge(rom)
+}
+
+func putJP(b []byte, addr types.Word) {
+	b[0] = 0xC3
+	putWord(b[1:], addr)
+}
+
+func putWord(b []byte, w types.Word) {
+	b[0] = byte(w)
+	b[1] = byte(w >> 8)
+}
+
+func word(b []byte) types.Word {
+	return types.Word(b[1])<<8 | types.Word(b[0])
+}
+
+func text(b []byte) string {
+	return strings.TrimRight(string(b), "\x00 ")
+}
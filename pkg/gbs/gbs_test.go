@@ -0,0 +1,109 @@
+package gbs
+
+import (
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/gb"
+	"github.com/kijimaD/goboy/pkg/gpu"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/pad"
+	"github.com/kijimaD/goboy/pkg/ram"
+	"github.com/kijimaD/goboy/pkg/timer"
+	"github.com/kijimaD/goboy/pkg/window/headless"
+	"github.com/stretchr/testify/assert"
+)
+
+// testGBS makes a GBS whose init stores the song number to 0xC000
+// and whose play counts up 0xC001.
+func testGBS(tac byte) []byte {
+	return newGBS(tac, asm.MustAssemble(`
+	LD ($C000),A
+	RET
+	LD HL,$C001
+	INC (HL)
+	RET
+`, 0x0400))
+}
+
+// newGBS makes a GBS of the code loaded at 0x0400. init is at 0x0400 and play is at 0x0404.
+func newGBS(tac byte, code []byte) []byte {
+	buf := make([]byte, headerSize)
+	copy(buf, "GBS")
+	buf[0x03] = 1
+	buf[0x04] = 3
+	buf[0x05] = 2
+	putWord(buf[0x06:], 0x0400)
+	putWord(buf[0x08:], 0x0400)
+	putWord(buf[0x0A:], 0x0404)
+	putWord(buf[0x0C:], 0xDFFF)
+	buf[0x0E] = 0x00
+	buf[0x0F] = tac
+	copy(buf[0x10:], "Test Song")
+	return append(buf, code...)
+}
+
+func TestParse(t *testing.T) {
+	g, err := Parse(testGBS(0))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, g.Songs)
+	assert.Equal(t, 2, g.FirstSong)
+	assert.Equal(t, "Test Song", g.Title)
+	assert.Equal(t, uint16(0x0404), uint16(g.PlayAddr))
+
+	_, err = Parse([]byte("NES"))
+	assert.Error(t, err)
+	_, err = g.ROM(4)
+	assert.Error(t, err)
+}
+
+func run(t *testing.T, buf []byte, song int, frames int) *bus.Bus {
+	g, err := Parse(buf)
+	assert.NoError(t, err)
+	cart, err := g.Cartridge(song)
+	assert.NoError(t, err)
+
+	l := logger.NewLogger(logger.LogLevel("ERROR"))
+	gpu := gpu.NewGPU()
+	tm := timer.NewTimer()
+	a := apu.NewAPU()
+	irq := interrupt.NewInterrupt()
+	b := bus.NewBus(l, cart, gpu, ram.NewRAM(0x2000), ram.NewRAM(0x2000), ram.NewRAM(0x80), ram.NewRAM(0xA0), tm, a, irq, pad.NewPad())
+	gpu.Init(b, irq)
+	emu := gb.NewGB(cpu.NewCPU(l, b, irq), gpu, tm, a, irq, headless.New())
+	emu.RunFrames(frames)
+	return b
+}
+
+func TestPlayOnVBlank(t *testing.T) {
+	b := run(t, testGBS(0x00), 3, 10)
+	assert.Equal(t, byte(2), b.ReadByte(0xC000))
+	// 1フレームに1回play
+	assert.InDelta(t, 10, int(b.ReadByte(0xC001)), 1)
+}
+
+func TestPlayOnTimer(t *testing.T) {
+	// 4096Hz / 256 = 16Hz
+	b := run(t, testGBS(TimerInterruptEnabled), 1, 60)
+	assert.Equal(t, byte(0), b.ReadByte(0xC000))
+	assert.InDelta(t, 16, int(b.ReadByte(0xC001)), 1)
+}
+
+func TestCartridgeRAM(t *testing.T) {
+	// 状態をA000に置くドライバ
+	b := run(t, newGBS(0x00, asm.MustAssemble(`
+	LD ($A000),A
+	RET
+	LD HL,$A000
+	INC (HL)
+	LD A,(HL)
+	LD ($C001),A
+	RET
+`, 0x0400)), 3, 10)
+	assert.Equal(t, b.ReadByte(0xA000), b.ReadByte(0xC001))
+	assert.InDelta(t, 2+10, int(b.ReadByte(0xC001)), 1)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/kijimaD/goboy/pkg/interfaces/bus"
 	"github.com/kijimaD/goboy/pkg/interfaces/interrupt"
 	irq "github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/model"
 	"github.com/kijimaD/goboy/pkg/types"
 )
 
@@ -40,6 +41,14 @@ type GPU struct {
 	disableDisplay  bool
 	oamDMAStarted   bool
 	oamDMAStartAddr types.Word
+	// blank is set while the LCD is off in STOP mode
+	blank      bool
+	blankImage types.ImageData
+	// palette is the colors of the LCD. It depends on the model.
+	palette Palette
+	model   model.Model
+	// fixedLY is read from LY instead of the real value if set.
+	fixedLY *byte
 }
 
 // GPUMode
@@ -104,18 +113,50 @@ const (
 
 // NewGPU is GPU constructor
 func NewGPU() *GPU {
-	return &GPU{
+	g := &GPU{
 		imageData:       make([]color.RGBA, constants.ScreenWidth*constants.ScreenHeight),
-		mode:            HBlankMode,
+		mode:            VBlankMode, // ブートROMの終了時はVBlank
+		stat:            0x04,       // LY=LYC=0
 		clock:           0,
 		lcdc:            0x91, // LCD Control
+		bgPalette:       0xFC,
+		objPalette0:     0xFF,
+		objPalette1:     0xFF,
 		ly:              0,
 		scrollX:         0,
 		scrollY:         0,
 		disableDisplay:  false,
 		oamDMAStarted:   false,
-		oamDMAStartAddr: 0,
+		oamDMAStartAddr: 0xFF00,
 	}
+	g.SetModel(model.DMG)
+	return g
+}
+
+// SetModel sets the model. The LCD colors depend on it.
+func (g *GPU) SetModel(m model.Model) {
+	g.model = m
+	g.palette = palettes[m]
+	g.blankImage = nil
+}
+
+// PowerOn puts GPU into the state at power on, before the boot ROM runs.
+// LCD is off until the boot ROM turns it on.
+func (g *GPU) PowerOn() {
+	g.lcdc = 0x00
+	g.stat = 0x00
+	g.mode = HBlankMode
+	g.scrollX, g.scrollY = 0x00, 0x00
+	g.windowX, g.windowY = 0x00, 0x00
+	g.lyc = 0x00
+	g.bgPalette = 0x00
+	g.objPalette0 = 0x00
+	g.objPalette1 = 0x00
+}
+
+// FixLY makes LY always read v. gameboy-doctor logs are taken with LY fixed at 0x90.
+func (g *GPU) FixLY(v byte) {
+	g.fixedLY = &v
 }
 
 // Init initialize GPU
@@ -124,6 +165,14 @@ func (g *GPU) Init(bus bus.Accessor, irq interrupt.Interrupt) {
 	g.irq = irq
 }
 
+// peek reads the memory without the read hooks of the bus. PPU and OAM DMA are not the accesses by CPU.
+func (g *GPU) peek(addr types.Word) byte {
+	if p, ok := g.bus.(bus.Peeker); ok {
+		return p.Peek(addr)
+	}
+	return g.bus.ReadByte(addr)
+}
+
 // Step is run GPU
 // 一列ずつ描画していく
 // レイヤーには3種類ある。背景、ウィンドウ、スプライト。
@@ -192,13 +241,20 @@ func (g *GPU) Read(addr types.Word) byte {
 	case LCDC:
 		return g.lcdc
 	case STAT:
-		return g.stat&0xF8 | (byte(g.mode)) | 0x80
+		return g.stat&0xFC | (byte(g.mode)) | 0x80
 	case SCROLLX:
 		return g.scrollX
 	case SCROLLY:
 		return g.scrollY
 	case LY:
+		if g.fixedLY != nil {
+			return *g.fixedLY
+		}
 		return byte(g.ly)
+	case LYC:
+		return g.lyc
+	case DMA:
+		return byte(g.oamDMAStartAddr >> 8)
 	case BGP:
 		return g.bgPalette
 	case OBP0:
@@ -287,18 +343,37 @@ func (g *GPU) Write(addr types.Word, data byte) {
 
 // GetImageData is image data getter
 func (g *GPU) GetImageData() types.ImageData {
+	if g.blank {
+		return g.blankImage
+	}
 	return g.imageData
 }
 
+// SetBlank turns the screen blank (white), as the LCD does in STOP mode.
+func (g *GPU) SetBlank(blank bool) {
+	g.blank = blank
+	if blank && g.blankImage == nil {
+		g.blankImage = make([]color.RGBA, constants.ScreenWidth*constants.ScreenHeight)
+		for i := range g.blankImage {
+			g.blankImage[i] = g.palette[0]
+		}
+	}
+}
+
 func (g *GPU) DMAStarted() bool {
 	return g.oamDMAStarted
 }
 
+// DMASource returns the address OAM DMA copies from.
+func (g *GPU) DMASource() types.Word {
+	return g.oamDMAStartAddr
+}
+
 // DMA(Direct Memory Access)を使用してOAM(Object Attribute Memory)のデータを転送する
 func (g *GPU) Transfer() {
 	for i := 0; i < 0xA0; i++ {
 		// データを特定
-		data := g.bus.ReadByte(g.oamDMAStartAddr + types.Word(i))
+		data := g.peek(g.oamDMAStartAddr + types.Word(i))
 		// データをバスを経由してOAMに書き込み
 		g.bus.WriteByte(OAMSTART+types.Word(i), data)
 	}
@@ -311,10 +386,10 @@ func (g *GPU) Transfer() {
 // 画面1行ごとに最大10個のスプライトしか置けない
 func (g *GPU) buildSprites() {
 	for i := 0; i < spriteNum; i++ {
-		offsetY := int(g.bus.ReadByte(types.Word(OAMSTART+i*4))) - 16
-		offsetX := int(g.bus.ReadByte(types.Word(OAMSTART+i*4+1))) - 8
-		tileID := g.bus.ReadByte(types.Word(OAMSTART + i*4 + 2)) // 4バイトで1セットなので*4、タイルIDは3番目なので+2。
-		config := types.Word(g.bus.ReadByte(types.Word(OAMSTART + i*4 + 3)))
+		offsetY := int(g.peek(types.Word(OAMSTART+i*4))) - 16
+		offsetX := int(g.peek(types.Word(OAMSTART+i*4+1))) - 8
+		tileID := g.peek(types.Word(OAMSTART + i*4 + 2)) // 4バイトで1セットなので*4、タイルIDは3番目なので+2。
+		config := types.Word(g.peek(types.Word(OAMSTART + i*4 + 3)))
 		// aboveBG := config&0x80 == 0
 		yFlip := config&0x40 != 0
 		xFlip := config&0x20 != 0
@@ -399,8 +474,8 @@ func (g *GPU) getSpritePaletteID(tileID int, x int, y uint) byte {
 	x = x % 8
 	addr := types.Word(tileID * 0x10)
 	base := types.Word(TILEDATA1 + addr + types.Word(y*2))
-	l1 := g.bus.ReadByte(base)
-	l2 := g.bus.ReadByte(base + 1)
+	l1 := g.peek(base)
+	l2 := g.peek(base + 1)
 	paletteID := byte(0)
 	if l1&(0x01<<(7-uint(x))) != 0 {
 		paletteID = 1
@@ -429,8 +504,8 @@ func (g *GPU) getBGPaletteID(tileID int, x int, y uint) byte {
 		addr = types.Word(tileID * 0x10)
 	}
 	base := types.Word(g.getTileDataAddr() + addr + types.Word(y*2)) // 2バイトで1列だからy*2
-	l1 := g.bus.ReadByte(base)
-	l2 := g.bus.ReadByte(base + 1)
+	l1 := g.peek(base)
+	l2 := g.peek(base + 1)
 	paletteID := byte(0)
 	if l1&(0x01<<(7-uint(x))) != 0 {
 		paletteID = 1
@@ -444,7 +519,7 @@ func (g *GPU) getBGPaletteID(tileID int, x int, y uint) byte {
 // タイル位置のタイルIDを取得。タイルIDがわかると、8x8をどのタイルで描画するかが決まる
 func (g *GPU) getTileID(tileY, lineOffset uint, offsetAddr types.Word) int {
 	addr := types.Word(tileY) + types.Word(lineOffset) + offsetAddr
-	id := byte(g.bus.ReadByte(addr))
+	id := byte(g.peek(addr))
 	return int(id)
 }
 
@@ -461,17 +536,44 @@ var MEDIUM_GREEN = color.RGBA{93, 147, 66, 255}
 var DEEP_GREEN = color.RGBA{22, 63, 48, 255}
 var BLACK_GREEN = color.RGBA{0, 40, 0, 255}
 
+// Palette is the 4 shades of the LCD, from the lightest to the darkest.
+type Palette [4]color.RGBA
+
+// palettes are the default colors of each model
+var palettes = map[model.Model]Palette{
+	model.DMG0: {THIN_GREEN, MEDIUM_GREEN, DEEP_GREEN, BLACK_GREEN},
+	model.DMG:  {THIN_GREEN, MEDIUM_GREEN, DEEP_GREEN, BLACK_GREEN},
+	// Pocketの液晶は白黒
+	model.MGB: {{255, 255, 255, 255}, {170, 170, 170, 255}, {85, 85, 85, 255}, {0, 0, 0, 255}},
+	// SGBのデフォルトパレット(1-A)
+	model.SGB: {{248, 232, 200, 255}, {216, 144, 72, 255}, {168, 40, 32, 255}, {48, 24, 80, 255}},
+	// CGBでタイトルに対応する色がないときのパレット
+	model.CGB: {{255, 255, 255, 255}, {123, 255, 49, 255}, {0, 99, 197, 255}, {0, 0, 0, 255}},
+}
+
 // パレットIDから色を取得
 func (g *GPU) getPalette(c byte) color.RGBA {
-	switch c {
-	case 0:
-		return THIN_GREEN
-	case 1:
-		return MEDIUM_GREEN
-	case 2:
-		return DEEP_GREEN
-	case 3:
-		return BLACK_GREEN
+	if c > 3 {
+		panic("unhandled color number detected.")
 	}
-	panic("unhandled color number detected.")
+	return g.palette[c]
+}
+
+// State is the state of GPU saved by Snapshot. The image is not saved, it is drawn again line by line.
+type State struct {
+	gpu GPU
+}
+
+// Snapshot saves the state of GPU.
+func (g *GPU) Snapshot() State {
+	s := State{gpu: *g}
+	s.gpu.imageData = nil
+	return s
+}
+
+// Restore puts GPU back into the saved state. The bus, irq and FixLY are kept.
+func (g *GPU) Restore(s State) {
+	bus, irq, imageData, fixedLY := g.bus, g.irq, g.imageData, g.fixedLY
+	*g = s.gpu
+	g.bus, g.irq, g.imageData, g.fixedLY = bus, irq, imageData, fixedLY
 }
@@ -2,13 +2,18 @@ package gpu
 
 import (
 	"image"
+	"image/color"
 	"image/png"
 	"os"
 	"testing"
 
+	"github.com/kijimaD/goboy/pkg/asm"
 	"github.com/kijimaD/goboy/pkg/constants"
+	"github.com/kijimaD/goboy/pkg/cpu"
 	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/logger"
 	"github.com/kijimaD/goboy/pkg/mocks"
+	"github.com/kijimaD/goboy/pkg/model"
 	"github.com/kijimaD/goboy/pkg/types"
 
 	"github.com/stretchr/testify/assert"
@@ -279,7 +284,8 @@ func TestGetBGPalette(t *testing.T) {
 	assert := assert.New(t)
 	g := setup()
 
-	// g.bgPaletteが指定されてないのですべて薄緑になる
+	// g.bgPaletteが0なのですべて薄緑になる
+	g.bgPalette = 0x00
 	color := g.getBGPalette(3)
 	assert.Equal(THIN_GREEN, color)
 	color = g.getBGPalette(2)
@@ -300,3 +306,66 @@ func TestGetBGPalette(t *testing.T) {
 	color = g.getBGPalette(0)
 	assert.Equal(THIN_GREEN, color)
 }
+
+func TestPaletteByModel(t *testing.T) {
+	assert := assert.New(t)
+	g := setup()
+	g.bgPalette = 0xE4
+	assert.Equal(THIN_GREEN, g.getBGPalette(0))
+	assert.Equal(BLACK_GREEN, g.getBGPalette(3))
+
+	g.SetModel(model.MGB)
+	assert.Equal(color.RGBA{255, 255, 255, 255}, g.getBGPalette(0))
+	assert.Equal(color.RGBA{0, 0, 0, 255}, g.getBGPalette(3))
+
+	// STOP中の画面も一番明るい色になる
+	g.SetBlank(true)
+	assert.Equal(color.RGBA{255, 255, 255, 255}, g.GetImageData()[0])
+}
+
+// ioBus gives the LCD registers to CPU
+type ioBus struct {
+	mocks.MockBus
+	gpu *GPU
+}
+
+func (b *ioBus) WriteByte(addr types.Word, data byte) {
+	if addr >= 0xFF40 && addr <= 0xFF4B {
+		b.gpu.Write(addr-0xFF40, data)
+		return
+	}
+	b.MockBus.WriteByte(addr, data)
+}
+
+func (b *ioBus) ReadByte(addr types.Word) byte {
+	if addr >= 0xFF40 && addr <= 0xFF4B {
+		return b.gpu.Read(addr - 0xFF40)
+	}
+	return b.MockBus.ReadByte(addr)
+}
+
+func TestRegistersWrittenByCPU(t *testing.T) {
+	assert := assert.New(t)
+	g := setup()
+	b := &ioBus{gpu: g}
+	b.SetMemory(0x0100, asm.MustAssemble(`
+	LD A,$E4
+	LDH ($FF47),A
+	LD A,$10
+	LDH ($FF42),A
+	LD A,$C1
+	LDH ($FF46),A
+	LDH A,($FF42)
+`, 0x0100))
+	c := cpu.NewCPU(logger.NewLogger(logger.LogLevel("Info")), b, interrupt.NewInterrupt())
+	for i := 0; i < 7; i++ {
+		c.Step()
+	}
+	assert.Equal(byte(0xE4), g.Read(BGP))
+	assert.Equal(THIN_GREEN, g.getBGPalette(0))
+	assert.Equal(BLACK_GREEN, g.getBGPalette(3))
+	assert.Equal(byte(0x10), c.Regs.A)
+	// OAM DMAはCPUの書き込みで始まる
+	assert.True(g.DMAStarted())
+	assert.Equal(types.Word(0xC100), g.DMASource())
+}
@@ -10,3 +10,19 @@ type Accessor interface {
 	ReadByte(addr types.Word) byte
 	ReadWord(addr types.Word) types.Word
 }
+
+// Banker knows which ROM bank is mapped at the address.
+type Banker interface {
+	ROMBank(addr types.Word) int
+}
+
+// Peeker reads the memory without the read hooks.
+// The reads which are not memory accesses of the machine, e.g. by the debugger or the tracer, go through it.
+type Peeker interface {
+	Peek(addr types.Word) byte
+}
+
+// Executor is notified of the address of each instruction before CPU fetches it.
+type Executor interface {
+	Execute(addr types.Word)
+}
@@ -0,0 +1,23 @@
+package cdl
+
+import "github.com/kijimaD/goboy/pkg/types"
+
+// Usage is how a ROM byte was used. They are combined in the log, e.g. Opcode|Data.
+type Usage byte
+
+const (
+	// Opcode is the first byte of an executed instruction, including the byte after the CB prefix
+	Opcode Usage = 1 << iota
+	// Operand is an immediate value or an address fetched as a part of an instruction
+	Operand
+	// Data is a byte read by an instruction, e.g. LD A,(HL)
+	Data
+	// DMA is a byte copied to OAM by OAM DMA
+	DMA
+)
+
+// Logger receives the reads of the ROM.
+type Logger interface {
+	// Log is called on a read of addr in 0x0000-0x7FFF. Bank is the ROM bank mapped at addr, or -1 for the boot ROM.
+	Log(addr types.Word, bank int, u Usage)
+}
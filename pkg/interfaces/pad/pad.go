@@ -8,4 +8,8 @@ type Pad interface {
 	Release(b pad.Button)
 	Read() byte
 	Write(v byte)
+	Buttons() pad.Button
+	SetButtons(b pad.Button)
+	Snapshot() pad.State
+	Restore(s pad.State)
 }
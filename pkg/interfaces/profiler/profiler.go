@@ -0,0 +1,35 @@
+package profiler
+
+import "github.com/kijimaD/goboy/pkg/types"
+
+// Kind is what CPU did in a step.
+type Kind int
+
+const (
+	// Instruction is an executed instruction
+	Instruction Kind = iota
+	// Interrupt is an interrupt dispatch. NextPC is the vector
+	Interrupt
+	// Idle is a step while CPU is halted, stopped or locked up
+	Idle
+)
+
+// Sample is a CPU step.
+type Sample struct {
+	Kind Kind
+	// PC and Bank are where the step started
+	PC   types.Word
+	Bank int
+	// Opcode is the executed opcode. CB prefixed ones are 0xCB00|opcode
+	Opcode uint16
+	Cycles uint
+	// NextPC, NextBank and SP are the state after the step, to track calls and returns
+	NextPC   types.Word
+	NextBank int
+	SP       types.Word
+}
+
+// Profiler receives every CPU step.
+type Profiler interface {
+	Profile(s Sample)
+}
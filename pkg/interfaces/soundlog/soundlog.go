@@ -0,0 +1,8 @@
+package soundlog
+
+import "github.com/kijimaD/goboy/pkg/types"
+
+// Recorder receives writes to the sound registers and wave RAM.
+type Recorder interface {
+	Record(addr types.Word, data byte)
+}
@@ -0,0 +1,8 @@
+package speed
+
+// Switcher is the CGB speed switch (KEY1).
+// When the switch is armed, STOP switches the CPU speed instead of stopping.
+type Switcher interface {
+	Armed() bool
+	Switch()
+}
@@ -0,0 +1,9 @@
+package symbolizer
+
+import "github.com/kijimaD/goboy/pkg/types"
+
+// Symbolizer names an address, e.g. "UpdateSprites+$12".
+// Bank is the ROM bank mapped at the address, or -1 if it is unknown.
+type Symbolizer interface {
+	Symbolize(bank int, addr types.Word) string
+}
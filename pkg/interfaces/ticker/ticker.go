@@ -0,0 +1,7 @@
+package ticker
+
+// Ticker advances the peripherals (GPU, timer, APU...) by the given M-cycles.
+// CPU calls it on every memory access and internal cycle.
+type Ticker interface {
+	Tick(cycles uint)
+}
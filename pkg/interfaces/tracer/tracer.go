@@ -0,0 +1,16 @@
+package tracer
+
+import "github.com/kijimaD/goboy/pkg/types"
+
+// State is the CPU state just before an instruction is executed.
+type State struct {
+	A, F, B, C, D, E, H, L byte
+	SP, PC                 types.Word
+	// PCMem is the 4 bytes from PC
+	PCMem [4]byte
+}
+
+// Tracer receives the CPU state on every instruction.
+type Tracer interface {
+	Trace(s State)
+}
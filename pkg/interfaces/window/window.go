@@ -7,4 +7,6 @@ type Window interface {
 	Render(imageData types.ImageData)
 	Run(run func())
 	PollKey()
+	// Closed reports whether the user closed the window
+	Closed() bool
 }
@@ -75,20 +75,25 @@ const (
 
 // Interrupt has 2 registers to manage
 type Interrupt struct {
-	IF      byte
-	IE      byte
-	enabled bool
+	IF byte
+	IE byte
 }
 
-// NewInterrupt constructs irq peripheral.
+// NewInterrupt constructs irq peripheral in the state the boot ROM leaves it.
+// VBlank is already requested, because the boot ROM waits for it.
 func NewInterrupt() *Interrupt {
 	return &Interrupt{
-		IF:      0x00,
-		IE:      0x00,
-		enabled: false,
+		IF: VerticalBlankFlag,
+		IE: 0x00,
 	}
 }
 
+// PowerOn puts irq into the state at power on, before the boot ROM runs.
+func (irq *Interrupt) PowerOn() {
+	irq.IF = 0x00
+	irq.IE = 0x00
+}
+
 // SetIRQ set flag
 func (irq *Interrupt) SetIRQ(f IRQFlag) {
 	irq.IF |= f
@@ -121,18 +126,9 @@ func (irq *Interrupt) HasIRQ() bool {
 	return i != 0x00
 }
 
-func (irq *Interrupt) Enable() {
-	irq.enabled = true
-}
-
-func (irq *Interrupt) Enabled() bool {
-	return irq.enabled
-}
-
-func (irq *Interrupt) Disable() {
-	irq.enabled = false
-}
-
+// ResolveISRAddr acknowledges the pending interrupt with the highest priority
+// and returns its ISR address. nil if no interrupt is pending.
+// IME (interrupt master enable) is in the CPU.
 func (irq *Interrupt) ResolveISRAddr() *types.Word {
 	i := irq.IF & irq.IE
 	switch {
@@ -154,3 +150,18 @@ func (irq *Interrupt) ResolveISRAddr() *types.Word {
 	}
 	return nil
 }
+
+// State is the state of irq saved by Snapshot.
+type State struct {
+	irq Interrupt
+}
+
+// Snapshot saves the state of irq.
+func (irq *Interrupt) Snapshot() State {
+	return State{irq: *irq}
+}
+
+// Restore puts irq back into the saved state.
+func (irq *Interrupt) Restore(s State) {
+	*irq = s.irq
+}
@@ -0,0 +1,207 @@
+package journal
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/interfaces/symbolizer"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// OAM is the address range of OAM, e.g. for the writes to OAM in a frame
+const (
+	OAMStart types.Word = 0xFE00
+	OAMEnd   types.Word = 0xFE9F
+)
+
+// Machine gives the time of the writes. gb.GB implements it.
+type Machine interface {
+	// Cycles returns the clocks elapsed since power on
+	Cycles() uint64
+	// Frame returns the number of the frames since power on
+	Frame() int
+	// OAMDMA reports whether the writes to OAM are made by OAM DMA
+	OAMDMA() bool
+}
+
+// Entry is a write to the bus.
+type Entry struct {
+	Addr types.Word
+	Old  byte
+	New  byte
+	// PC and Bank are the instruction that wrote. The pushes of an interrupt dispatch have the last instruction before it.
+	PC   types.Word
+	Bank int
+	// DMA is set for the writes to OAM made by OAM DMA
+	DMA   bool
+	Frame int
+	Cycle uint64
+}
+
+// Format formats the entry, e.g. "frame 12 cycle 842310: $C0A0 $00 -> $05 by 01:0x4A51".
+// The addresses are shown as labels with the symbolizer.
+func (e Entry) Format(s symbolizer.Symbolizer) string {
+	addr := fmt.Sprintf("$%04X", e.Addr)
+	by := fmt.Sprintf("0x%04X", e.PC)
+	if e.Bank >= 0 {
+		by = fmt.Sprintf("%02X:0x%04X", e.Bank, e.PC)
+	}
+	if s != nil {
+		addr = s.Symbolize(-1, e.Addr)
+		by = fmt.Sprintf("%s (%s)", s.Symbolize(e.Bank, e.PC), by)
+	}
+	if e.DMA {
+		by = "OAM DMA"
+	}
+	return fmt.Sprintf("frame %d cycle %d: %s $%02X -> $%02X by %s", e.Frame, e.Cycle, addr, e.Old, e.New, by)
+}
+
+func (e Entry) String() string {
+	return e.Format(nil)
+}
+
+// Journal records the bus writes in a ring buffer, so that the last writers of an address can be found.
+type Journal struct {
+	m       Machine
+	entries []Entry
+	// next is the index of the next entry, n is the number of the entries
+	next int
+	n    int
+	// start and end are the recorded range
+	start, end types.Word
+	// pc and bank are the instruction being executed
+	pc   types.Word
+	bank int
+}
+
+// New constructs a journal which keeps the last size writes.
+func New(m Machine, size int) *Journal {
+	if size < 1 {
+		size = 1
+	}
+	return &Journal{m: m, entries: make([]Entry, size), end: 0xFFFF, bank: -1}
+}
+
+// SetRange limits the recorded writes to start-end (inclusive). Call it before Attach.
+func (j *Journal) SetRange(start, end types.Word) {
+	j.start, j.end = start, end
+}
+
+// Attach starts recording the writes to the bus. CPU has to call the execute hooks of the bus.
+func (j *Journal) Attach(b *bus.Bus) {
+	// 書き込みの時点ではPCが進んでいるので、命令の開始アドレスを覚えておく
+	b.AddHook(bus.NewHook(bus.Execute, 0x0000, 0xFFFF, func(e bus.Event) {
+		j.pc, j.bank = e.Addr, e.Bank
+	}))
+	b.AddHook(bus.NewHook(bus.Write, j.start, j.end, j.record))
+}
+
+func (j *Journal) record(e bus.Event) {
+	dma := e.Addr >= OAMStart && e.Addr <= OAMEnd && j.m.OAMDMA()
+	j.entries[j.next] = Entry{
+		Addr: e.Addr, Old: e.Old, New: e.Value,
+		PC: j.pc, Bank: j.bank, DMA: dma,
+		Frame: j.m.Frame(), Cycle: j.m.Cycles(),
+	}
+	j.next = (j.next + 1) % len(j.entries)
+	if j.n < len(j.entries) {
+		j.n++
+	}
+}
+
+// Frame returns the current frame of the machine, e.g. for the writes in this frame.
+func (j *Journal) Frame() int {
+	return j.m.Frame()
+}
+
+// Len returns the number of the kept entries.
+func (j *Journal) Len() int {
+	return j.n
+}
+
+// at returns the i-th entry from the oldest.
+func (j *Journal) at(i int) Entry {
+	return j.entries[(j.next-j.n+i+len(j.entries))%len(j.entries)]
+}
+
+// Entries returns the kept entries from the oldest.
+func (j *Journal) Entries() []Entry {
+	entries := make([]Entry, j.n)
+	for i := range entries {
+		entries[i] = j.at(i)
+	}
+	return entries
+}
+
+// LastWriters returns the last n writes to the address from the newest.
+func (j *Journal) LastWriters(addr types.Word, n int) []Entry {
+	entries := []Entry{}
+	for i := j.n - 1; i >= 0 && len(entries) < n; i-- {
+		if e := j.at(i); e.Addr == addr {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Writes returns the writes to start-end (inclusive) in the frame from the oldest.
+// A negative frame matches all frames.
+func (j *Journal) Writes(start, end types.Word, frame int) []Entry {
+	entries := []Entry{}
+	for i := 0; i < j.n; i++ {
+		e := j.at(i)
+		if e.Addr >= start && e.Addr <= end && (frame < 0 || e.Frame == frame) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Dump writes the entries line by line.
+func Dump(w io.Writer, entries []Entry, s symbolizer.Symbolizer) error {
+	for _, e := range entries {
+		if _, err := fmt.Fprintln(w, e.Format(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseRange parses "C000-C0FF", "$C0A0", "OAM" or a label. The addresses are hex.
+func ParseRange(spec string, syms *symbols.Table) (types.Word, types.Word, error) {
+	if strings.EqualFold(spec, "oam") {
+		return OAMStart, OAMEnd, nil
+	}
+	if from, to, ok := strings.Cut(spec, "-"); ok {
+		start, err := parseAddr(from, syms)
+		if err != nil {
+			return 0, 0, err
+		}
+		end, err := parseAddr(to, syms)
+		if err != nil {
+			return 0, 0, err
+		}
+		if start > end {
+			return 0, 0, fmt.Errorf("invalid range %q", spec)
+		}
+		return start, end, nil
+	}
+	addr, err := parseAddr(spec, syms)
+	return addr, addr, err
+}
+
+func parseAddr(s string, syms *symbols.Table) (types.Word, error) {
+	if sym, ok := syms.Address(s); ok {
+		return sym.Addr, nil
+	}
+	h := strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(s, "$"), "0x"), "0X")
+	v, err := strconv.ParseUint(h, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q", s)
+	}
+	return types.Word(v), nil
+}
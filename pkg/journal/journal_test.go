@@ -0,0 +1,128 @@
+package journal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/gb"
+	"github.com/kijimaD/goboy/pkg/gpu"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/pad"
+	"github.com/kijimaD/goboy/pkg/ram"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/timer"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/kijimaD/goboy/pkg/window/headless"
+	"github.com/stretchr/testify/assert"
+)
+
+const program = `
+	LD SP,$FFFE    ; $0100
+	LD A,5         ; $0103
+	LD ($C0A0),A   ; $0105
+	INC A          ; $0108
+	LD ($C0A0),A   ; $0109
+	LD A,$C0       ; $010C
+	LDH ($FF46),A  ; $010E
+loop:
+	JR loop        ; $0110
+`
+
+// run runs the assembly at 0x0100 with the journal for the steps.
+func run(t *testing.T, j func(*gb.GB) *Journal, steps int) *Journal {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], asm.MustAssemble(program, 0x0100))
+	cart, err := cartridge.NewCartridge(rom)
+	assert.NoError(t, err)
+	l := logger.NewLogger(logger.LogLevel("Info"))
+	g := gpu.NewGPU()
+	tm := timer.NewTimer()
+	irq := interrupt.NewInterrupt()
+	b := bus.NewBus(l, cart, g, ram.NewRAM(0x2000), ram.NewRAM(0x2000), ram.NewRAM(0x80), ram.NewRAM(0xA0), tm, apu.NewAPU(), irq, pad.NewPad())
+	g.Init(b, irq)
+	c := cpu.NewCPU(l, b, irq)
+	emu := gb.NewGB(c, g, tm, apu.NewAPU(), irq, headless.New())
+	journal := j(emu)
+	journal.Attach(b)
+	for i := 0; i < steps; i++ {
+		emu.Step()
+	}
+	return journal
+}
+
+func TestLastWriters(t *testing.T) {
+	j := run(t, func(emu *gb.GB) *Journal { return New(emu, 1024) }, 1000)
+	writers := j.LastWriters(0xC0A0, 10)
+	assert.Equal(t, 2, len(writers))
+	assert.Equal(t, types.Word(0x0109), writers[0].PC)
+	assert.Equal(t, byte(5), writers[0].Old)
+	assert.Equal(t, byte(6), writers[0].New)
+	assert.Equal(t, types.Word(0x0105), writers[1].PC)
+	assert.Equal(t, byte(5), writers[1].New)
+	assert.Equal(t, 0, writers[0].Bank)
+	assert.True(t, writers[0].Cycle > writers[1].Cycle)
+	assert.Equal(t, 1, len(j.LastWriters(0xC0A0, 1)))
+
+	// OAM DMAの書き込みはCPUでなくDMAによるもの
+	oam := j.Writes(OAMStart, OAMEnd, j.Frame())
+	assert.Equal(t, 0xA0, len(oam))
+	for _, e := range oam {
+		assert.True(t, e.DMA)
+	}
+	assert.Equal(t, OAMStart, oam[0].Addr)
+	assert.Equal(t, 0, len(j.Writes(OAMStart, OAMEnd, j.Frame()+1)))
+}
+
+func TestRing(t *testing.T) {
+	j := run(t, func(emu *gb.GB) *Journal {
+		j := New(emu, 4)
+		j.SetRange(OAMStart, OAMEnd)
+		return j
+	}, 1000)
+	entries := j.Entries()
+	assert.Equal(t, 4, j.Len())
+	assert.Equal(t, []types.Word{0xFE9C, 0xFE9D, 0xFE9E, 0xFE9F}, []types.Word{
+		entries[0].Addr, entries[1].Addr, entries[2].Addr, entries[3].Addr,
+	})
+	assert.Equal(t, 0, len(j.LastWriters(0xC0A0, 10)))
+}
+
+func TestFormat(t *testing.T) {
+	syms, err := symbols.Parse(strings.NewReader("00:0100 Start\n00:C0A0 wScore\n"))
+	assert.NoError(t, err)
+	e := Entry{Addr: 0xC0A0, Old: 0x00, New: 0x05, PC: 0x0105, Bank: 0, Frame: 12, Cycle: 842310}
+	assert.Equal(t, "frame 12 cycle 842310: $C0A0 $00 -> $05 by 00:0x0105", e.String())
+	assert.Equal(t, "frame 12 cycle 842310: wScore $00 -> $05 by Start+$5 (00:0x0105)", e.Format(syms))
+	e.DMA = true
+	assert.Equal(t, "frame 12 cycle 842310: $C0A0 $00 -> $05 by OAM DMA", e.String())
+}
+
+func TestParseRange(t *testing.T) {
+	syms, err := symbols.Parse(strings.NewReader("00:C0A0 wScore\n"))
+	assert.NoError(t, err)
+	for _, tt := range []struct {
+		spec       string
+		start, end types.Word
+	}{
+		{"C000-DFFF", 0xC000, 0xDFFF},
+		{"$C0A0", 0xC0A0, 0xC0A0},
+		{"0xff80-0xfffe", 0xFF80, 0xFFFE},
+		{"oam", OAMStart, OAMEnd},
+		{"wScore", 0xC0A0, 0xC0A0},
+	} {
+		start, end, err := ParseRange(tt.spec, syms)
+		assert.NoError(t, err, tt.spec)
+		assert.Equal(t, tt.start, start, tt.spec)
+		assert.Equal(t, tt.end, end, tt.spec)
+	}
+	for _, spec := range []string{"", "D000-C000", "nolabel"} {
+		_, _, err := ParseRange(spec, syms)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,208 @@
+package lockstep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/symbolizer"
+	"github.com/kijimaD/goboy/pkg/interfaces/tracer"
+	"github.com/kijimaD/goboy/pkg/trace"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// Machine is the emulator driven by the harness. gb.GB implements it.
+type Machine interface {
+	// Step runs one CPU step with the peripherals.
+	Step() bool
+}
+
+// Target is the CPU compared with the reference. cpu.CPU implements it.
+type Target interface {
+	SetTracer(t tracer.Tracer)
+}
+
+// maxIdleSteps bounds the steps without any instruction, e.g. HALT forever.
+const maxIdleSteps = 1 << 20
+
+// Divergence is the first point where the run differs from the reference.
+type Divergence struct {
+	// Line is the line number in the reference (1 origin)
+	Line     int
+	Expected tracer.State
+	Actual   tracer.State
+	// History is the states before the divergence, the oldest first.
+	// The last one is the instruction that caused the divergence.
+	History []tracer.State
+}
+
+// Run steps the machine and compares the CPU state before every instruction with the reference trace
+// in gameboy-doctor format. The reference is read one line at a time.
+// It stops at the first divergence and returns it. It returns nil if the whole reference matches.
+// history is the number of the previous instructions kept for the report.
+func Run(ref io.Reader, m Machine, target Target, history int) (*Divergence, error) {
+	c := &checker{
+		sc:   bufio.NewScanner(ref),
+		size: history,
+	}
+	c.next()
+	target.SetTracer(c)
+	defer target.SetTracer(nil)
+
+	idle := 0
+	for !c.finished() {
+		line := c.line
+		m.Step()
+		if c.line != line {
+			idle = 0
+			continue
+		}
+		idle++
+		if idle > maxIdleSteps {
+			return nil, fmt.Errorf("no instruction is executed after line %d", c.line)
+		}
+	}
+	return c.divergence, c.err
+}
+
+// checker compares the states with the reference. It is set to CPU as the tracer.
+type checker struct {
+	sc   *bufio.Scanner
+	line int
+	// expected is the state on the line
+	expected   tracer.State
+	size       int
+	history    []tracer.State
+	divergence *Divergence
+	eof        bool
+	err        error
+}
+
+func (c *checker) finished() bool {
+	return c.divergence != nil || c.eof || c.err != nil
+}
+
+// next reads the next line of the reference.
+func (c *checker) next() {
+	if !c.sc.Scan() {
+		c.err = c.sc.Err()
+		c.eof = true
+		return
+	}
+	c.line++
+	s, err := trace.Parse(c.sc.Text())
+	if err != nil {
+		c.err = fmt.Errorf("line %d: %w", c.line, err)
+		return
+	}
+	c.expected = s
+}
+
+func (c *checker) Trace(s tracer.State) {
+	if c.finished() {
+		return
+	}
+	if c.expected != s {
+		c.divergence = &Divergence{
+			Line:     c.line,
+			Expected: c.expected,
+			Actual:   s,
+			History:  append([]tracer.State{}, c.history...),
+		}
+		return
+	}
+	if c.size > 0 {
+		if len(c.history) == c.size {
+			c.history = c.history[1:]
+		}
+		c.history = append(c.history, s)
+	}
+	c.next()
+}
+
+// Instruction returns the instruction that caused the divergence.
+// It is empty if the states differ from the first line.
+func (d *Divergence) Instruction() string {
+	if len(d.History) == 0 {
+		return ""
+	}
+	return disassemble(d.History[len(d.History)-1])
+}
+
+// Fields returns the names of the fields that differ.
+func (d *Divergence) Fields() []string {
+	e, a := d.Expected, d.Actual
+	fields := []string{}
+	for _, f := range []struct {
+		name string
+		same bool
+	}{
+		{"A", e.A == a.A}, {"F", e.F == a.F}, {"B", e.B == a.B}, {"C", e.C == a.C},
+		{"D", e.D == a.D}, {"E", e.E == a.E}, {"H", e.H == a.H}, {"L", e.L == a.L},
+		{"SP", e.SP == a.SP}, {"PC", e.PC == a.PC}, {"PCMEM", e.PCMem == a.PCMem},
+	} {
+		if !f.same {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+func (d *Divergence) String() string {
+	return d.Format(nil)
+}
+
+// Format is like String but names the addresses with the symbols.
+// The bank is unknown in the trace, so the addresses in 0x4000-0x7FFF match the labels in any bank.
+func (d *Divergence) Format(s symbolizer.Symbolizer) string {
+	at := func(pc types.Word) string {
+		if s == nil {
+			return fmt.Sprintf("$%04X", pc)
+		}
+		return fmt.Sprintf("$%04X %s", pc, s.Symbolize(-1, pc))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "diverged at line %d", d.Line)
+	if inst := d.Instruction(); inst != "" {
+		fmt.Fprintf(&b, " after %s at %s", inst, at(d.History[len(d.History)-1].PC))
+	}
+	fmt.Fprintf(&b, " (%s)\n", strings.Join(d.Fields(), " "))
+	fmt.Fprintf(&b, "expected: %s\n", trace.Format(d.Expected))
+	fmt.Fprintf(&b, "actual:   %s\n", trace.Format(d.Actual))
+	if len(d.History) > 0 {
+		b.WriteString("previous instructions:\n")
+	}
+	for _, h := range d.History {
+		fmt.Fprintf(&b, "  %s %-16s %s\n", at(h.PC), disassemble(h), trace.Format(h))
+	}
+	return b.String()
+}
+
+// disassemble decodes the instruction from PCMEM of the state.
+func disassemble(s tracer.State) string {
+	text, _ := cpu.Disassemble(&pcmem{pc: s.PC, mem: s.PCMem}, s.PC)
+	return text
+}
+
+// pcmem is the memory that only has the 4 bytes from PC.
+type pcmem struct {
+	pc  types.Word
+	mem [4]byte
+}
+
+func (m *pcmem) ReadByte(addr types.Word) byte {
+	if i := addr - m.pc; i < types.Word(len(m.mem)) {
+		return m.mem[i]
+	}
+	return 0x00
+}
+
+func (m *pcmem) ReadWord(addr types.Word) types.Word {
+	return types.Word(m.ReadByte(addr+1))<<8 | types.Word(m.ReadByte(addr))
+}
+
+func (m *pcmem) WriteByte(addr types.Word, data byte) {}
+
+func (m *pcmem) WriteWord(addr types.Word, data types.Word) {}
@@ -0,0 +1,110 @@
+package lockstep
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/interfaces/tracer"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/trace"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMachine executes the scripted states one per step.
+type fakeMachine struct {
+	states []tracer.State
+	t      tracer.Tracer
+}
+
+func (m *fakeMachine) SetTracer(t tracer.Tracer) { m.t = t }
+
+func (m *fakeMachine) Step() bool {
+	if len(m.states) == 0 || m.t == nil {
+		return false
+	}
+	m.t.Trace(m.states[0])
+	m.states = m.states[1:]
+	return false
+}
+
+// program is INC A repeated from 0x0100.
+func program(n int) []tracer.State {
+	states := []tracer.State{}
+	for i := 0; i < n; i++ {
+		states = append(states, tracer.State{
+			A: byte(i), F: 0x00, SP: 0xFFFE, PC: types.Word(0x0100 + i),
+			PCMem: [4]byte{0x3C, 0x3C, 0x3C, 0x3C},
+		})
+	}
+	return states
+}
+
+func reference(states []tracer.State) string {
+	lines := []string{}
+	for _, s := range states {
+		lines = append(lines, trace.Format(s))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestRunMatches(t *testing.T) {
+	m := &fakeMachine{states: program(8)}
+	d, err := Run(strings.NewReader(reference(program(8))), m, m, 4)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+	assert.Nil(t, m.t)
+}
+
+func TestRunDiverges(t *testing.T) {
+	ref := program(8)
+	ref[5].A = 0x10
+	ref[5].F = 0x80
+	m := &fakeMachine{states: program(8)}
+	d, err := Run(strings.NewReader(reference(ref)), m, m, 3)
+	assert.NoError(t, err)
+	if assert.NotNil(t, d) {
+		assert.Equal(t, 6, d.Line)
+		assert.Equal(t, ref[5], d.Expected)
+		assert.Equal(t, program(8)[5], d.Actual)
+		assert.Equal(t, program(8)[2:5], d.History)
+		assert.Equal(t, "INC A", d.Instruction())
+		assert.Equal(t, []string{"A", "F"}, d.Fields())
+		report := d.String()
+		assert.Contains(t, report, "diverged at line 6 after INC A at $0104 (A F)")
+		assert.Contains(t, report, "expected: "+trace.Format(ref[5]))
+		assert.Contains(t, report, "  $0102 INC A")
+
+		syms, err := symbols.Parse(strings.NewReader("00:0100 Start\n"))
+		assert.NoError(t, err)
+		report = d.Format(syms)
+		assert.Contains(t, report, "after INC A at $0104 Start+$4 (A F)")
+		assert.Contains(t, report, "  $0102 Start+$2 INC A")
+	}
+}
+
+func TestRunDivergesAtFirstLine(t *testing.T) {
+	ref := program(2)
+	ref[0].SP = 0xDFFF
+	m := &fakeMachine{states: program(2)}
+	d, err := Run(strings.NewReader(reference(ref)), m, m, 3)
+	assert.NoError(t, err)
+	if assert.NotNil(t, d) {
+		assert.Equal(t, 1, d.Line)
+		assert.Empty(t, d.History)
+		assert.Equal(t, "", d.Instruction())
+		assert.Equal(t, []string{"SP"}, d.Fields())
+	}
+}
+
+func TestRunBrokenReference(t *testing.T) {
+	m := &fakeMachine{states: program(2)}
+	_, err := Run(strings.NewReader("broken\n"), m, m, 3)
+	assert.Error(t, err)
+}
+
+func TestRunIdle(t *testing.T) {
+	m := &fakeMachine{}
+	_, err := Run(strings.NewReader(reference(program(1))), m, m, 3)
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package lockup
+
+import (
+	"fmt"
+
+	"github.com/kijimaD/goboy/pkg/interfaces/symbolizer"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// Kind is the kind of the dead state
+type Kind int
+
+const (
+	// IllegalOpcode means CPU fetched one of the undefined opcodes. The hardware hangs until reset.
+	IllegalOpcode Kind = iota
+	// HaltWithoutIRQ means HALT with IE=0. No interrupt can wake CPU up.
+	HaltWithoutIRQ
+	// DeadLoop means CPU is spinning in a tight loop with interrupts disabled, reading no IO register.
+	DeadLoop
+)
+
+func (k Kind) String() string {
+	switch k {
+	case IllegalOpcode:
+		return "illegal opcode"
+	case HaltWithoutIRQ:
+		return "halt without interrupt"
+	case DeadLoop:
+		return "dead loop"
+	}
+	return "unknown"
+}
+
+// Event describes where the machine got stuck.
+// Bank is the ROM bank mapped at PC, or -1 if PC is not in ROM.
+type Event struct {
+	Kind   Kind
+	PC     types.Word
+	Opcode byte
+	Bank   int
+}
+
+func (e Event) String() string {
+	return e.Format(nil)
+}
+
+// Format is like String but names PC with the symbols, e.g. "at UpdateSprites+$12 (01:0x4A51)".
+func (e Event) Format(s symbolizer.Symbolizer) string {
+	at := fmt.Sprintf("0x%04X", e.PC)
+	if e.Bank >= 0 {
+		at = fmt.Sprintf("%02X:0x%04X", e.Bank, e.PC)
+	}
+	if s != nil {
+		at = fmt.Sprintf("%s (%s)", s.Symbolize(e.Bank, e.PC), at)
+	}
+	return fmt.Sprintf("%s: opcode 0x%02X at %s", e.Kind, e.Opcode, at)
+}
@@ -0,0 +1,124 @@
+package midi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/soundlog"
+)
+
+const (
+	ticksPerQuarter = 480
+	// tempo is microseconds per quarter note. (120BPM)
+	tempo          = 500000
+	ticksPerSecond = ticksPerQuarter * 1000000 / tempo
+)
+
+// track settings for each DMG channel
+var tracks = [channelNum]struct {
+	name    string
+	channel byte
+	program byte
+}{
+	{name: "Pulse 1", channel: 0, program: 80}, // Lead 1 (square)
+	{name: "Pulse 2", channel: 1, program: 80},
+	{name: "Wave", channel: 2, program: 38}, // Synth Bass 1
+	{name: "Noise", channel: 9, program: 0}, // GM percussion
+}
+
+// Write converts the sound register writes to a Standard MIDI File (format 1).
+// Track 0 has the tempo, and tracks 1-4 have each DMG channel.
+func Write(w io.Writer, events []soundlog.Event, end uint64) error {
+	notes := Notes(events, end)
+	chunks := [][]byte{conductorTrack()}
+	for ch := range notes {
+		chunks = append(chunks, channelTrack(ch, notes[ch]))
+	}
+
+	header := make([]byte, 14)
+	copy(header[0:4], "MThd")
+	binary.BigEndian.PutUint32(header[4:8], 6)
+	binary.BigEndian.PutUint16(header[8:10], 1) // format 1
+	binary.BigEndian.PutUint16(header[10:12], uint16(len(chunks)))
+	binary.BigEndian.PutUint16(header[12:14], ticksPerQuarter)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := w.Write(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func conductorTrack() []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x00, 0xFF, 0x51, 0x03, tempo >> 16, tempo >> 8 & 0xFF, tempo & 0xFF})
+	buf.Write([]byte{0x00, 0xFF, 0x2F, 0x00})
+	return trackChunk(buf.Bytes())
+}
+
+type midiEvent struct {
+	tick uint64
+	off  bool
+	data []byte
+}
+
+func channelTrack(ch int, notes []Note) []byte {
+	t := tracks[ch]
+	var buf bytes.Buffer
+	buf.WriteByte(0x00)
+	buf.Write([]byte{0xFF, 0x03, byte(len(t.name))})
+	buf.WriteString(t.name)
+	if t.channel != 9 {
+		buf.Write([]byte{0x00, 0xC0 | t.channel, t.program})
+	}
+
+	events := make([]midiEvent, 0, len(notes)*2)
+	for _, n := range notes {
+		events = append(events,
+			midiEvent{tick: toTick(n.Start), data: []byte{0x90 | t.channel, n.Key, n.Velocity}},
+			midiEvent{tick: toTick(n.End), off: true, data: []byte{0x80 | t.channel, n.Key, 0}},
+		)
+	}
+	// 同じtickではnote offを先に出す
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].tick != events[j].tick {
+			return events[i].tick < events[j].tick
+		}
+		return events[i].off && !events[j].off
+	})
+
+	last := uint64(0)
+	for _, e := range events {
+		writeVarLen(&buf, e.tick-last)
+		buf.Write(e.data)
+		last = e.tick
+	}
+	buf.Write([]byte{0x00, 0xFF, 0x2F, 0x00})
+	return trackChunk(buf.Bytes())
+}
+
+func trackChunk(data []byte) []byte {
+	chunk := make([]byte, 8, 8+len(data))
+	copy(chunk[0:4], "MTrk")
+	binary.BigEndian.PutUint32(chunk[4:8], uint32(len(data)))
+	return append(chunk, data...)
+}
+
+func toTick(cycle uint64) uint64 {
+	return cycle * ticksPerSecond / apu.ClockSpeed
+}
+
+// writeVarLen writes v as a MIDI variable length quantity.
+func writeVarLen(buf *bytes.Buffer, v uint64) {
+	b := []byte{byte(v & 0x7F)}
+	for v >>= 7; v > 0; v >>= 7 {
+		b = append([]byte{byte(v&0x7F) | 0x80}, b...)
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,76 @@
+package midi
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/soundlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// A4 (440Hz) on the square channels
+const a4 = 2048 - 131072/440
+
+func TestNotesTriggerAndLength(t *testing.T) {
+	events := []soundlog.Event{
+		{Cycle: 0, Addr: 0xFF11, Data: 0x3F}, // length 1
+		{Cycle: 0, Addr: 0xFF12, Data: 0xF0}, // volume 15, no envelope
+		{Cycle: 0, Addr: 0xFF13, Data: a4 & 0xFF},
+		{Cycle: 100, Addr: 0xFF14, Data: 0xC0 | byte(a4>>8)}, // trigger, length enabled
+	}
+	notes := Notes(events, apu.ClockSpeed)
+	assert.Equal(t, []Note{{Start: 100, End: 100 + lengthUnit, Key: 69, Velocity: 127}}, notes[Pulse1])
+	assert.Empty(t, notes[Pulse2])
+}
+
+func TestNotesEnvelopeDecay(t *testing.T) {
+	events := []soundlog.Event{
+		{Cycle: 0, Addr: 0xFF17, Data: 0x21}, // volume 2, decrease, period 1
+		{Cycle: 0, Addr: 0xFF19, Data: 0x80 | byte(a4>>8)},
+	}
+	notes := Notes(events, apu.ClockSpeed)
+	assert.Len(t, notes[Pulse2], 1)
+	assert.Equal(t, uint64(2*envelopeUnit), notes[Pulse2][0].End)
+}
+
+func TestNotesRetuneAndPowerOff(t *testing.T) {
+	events := []soundlog.Event{
+		{Cycle: 0, Addr: 0xFF1A, Data: 0x80},
+		{Cycle: 0, Addr: 0xFF1C, Data: 0x20},
+		{Cycle: 0, Addr: 0xFF1D, Data: 0x00},
+		{Cycle: 10, Addr: 0xFF1E, Data: 0x84}, // trigger
+		{Cycle: 20, Addr: 0xFF1D, Data: 0x80}, // pitch change
+		{Cycle: 30, Addr: 0xFF26, Data: 0x00}, // power off
+	}
+	notes := Notes(events, 100)
+	assert.Len(t, notes[Wave], 2)
+	assert.Equal(t, uint64(20), notes[Wave][0].End)
+	assert.Equal(t, uint64(30), notes[Wave][1].End)
+	assert.NotEqual(t, notes[Wave][0].Key, notes[Wave][1].Key)
+}
+
+func TestWrite(t *testing.T) {
+	events := []soundlog.Event{
+		{Cycle: 0, Addr: 0xFF21, Data: 0xF0},
+		{Cycle: 0, Addr: 0xFF22, Data: 0x00},
+		{Cycle: 0, Addr: 0xFF23, Data: 0x80},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, Write(&buf, events, apu.ClockSpeed))
+	b := buf.Bytes()
+	assert.Equal(t, []byte("MThd"), b[0:4])
+	assert.Equal(t, []byte{0x00, 0x01, 0x00, 0x05, 0x01, 0xE0}, b[8:14])
+	// noise track has a hi-hat on the percussion channel
+	assert.True(t, bytes.Contains(b, []byte{0x99, keyClosedHiHat, 127}))
+	assert.Equal(t, 5, bytes.Count(b, []byte("MTrk")))
+}
+
+func TestWriteVarLen(t *testing.T) {
+	var buf bytes.Buffer
+	writeVarLen(&buf, 0)
+	writeVarLen(&buf, 0x7F)
+	writeVarLen(&buf, 0x80)
+	writeVarLen(&buf, 0x3FFF)
+	assert.Equal(t, []byte{0x00, 0x7F, 0x81, 0x00, 0xFF, 0x7F}, buf.Bytes())
+}
@@ -0,0 +1,268 @@
+package midi
+
+import (
+	"math"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/soundlog"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// DMG sound channels
+const (
+	Pulse1 = iota
+	Pulse2
+	Wave
+	Noise
+	channelNum
+)
+
+const (
+	// lengthUnit is the clocks of one length counter step (256Hz).
+	lengthUnit = apu.ClockSpeed / 256
+	// envelopeUnit is the clocks of one envelope step (64Hz).
+	envelopeUnit = apu.ClockSpeed / 64
+)
+
+// General MIDI drum keys used for the noise channel.
+const (
+	keyBassDrum    = 36
+	keySnare       = 38
+	keyClosedHiHat = 42
+)
+
+// Note is a note played on a channel. Start and End are clocks.
+type Note struct {
+	Start    uint64
+	End      uint64
+	Key      byte
+	Velocity byte
+}
+
+// voice follows the registers of a channel and cuts them into notes.
+type voice struct {
+	ch            int
+	playing       bool
+	current       Note
+	stopAt        uint64 // 0 if the note does not stop by itself
+	dacEnabled    bool
+	freq          uint16
+	volume        byte
+	envIncrease   bool
+	envPeriod     byte
+	lengthEnabled bool
+	length        int
+	poly          byte
+	notes         []Note
+}
+
+// Notes converts the sound register writes into notes for each channel.
+// end is the clock where the recording stopped. It closes the notes still playing.
+func Notes(events []soundlog.Event, end uint64) [channelNum][]Note {
+	voices := [channelNum]*voice{}
+	for i := range voices {
+		voices[i] = &voice{ch: i}
+	}
+	for _, ev := range events {
+		for _, v := range voices {
+			v.expire(ev.Cycle)
+		}
+		write(&voices, ev)
+	}
+	notes := [channelNum][]Note{}
+	for i, v := range voices {
+		v.expire(end)
+		v.stop(end)
+		notes[i] = v.notes
+	}
+	return notes
+}
+
+func write(voices *[channelNum]*voice, ev soundlog.Event) {
+	data := ev.Data
+	switch ev.Addr {
+	// NR11, NR21, NR41
+	case 0xFF11, 0xFF16, 0xFF20:
+		voices[channelOf(ev.Addr)].length = 64 - int(data&0x3F)
+	// NR12, NR22, NR42
+	case 0xFF12, 0xFF17, 0xFF21:
+		v := voices[channelOf(ev.Addr)]
+		v.volume = data >> 4
+		v.envIncrease = data&0x08 != 0
+		v.envPeriod = data & 0x07
+		v.dacEnabled = data&0xF8 != 0
+		if !v.dacEnabled {
+			v.stop(ev.Cycle)
+		}
+	// NR13, NR23, NR33
+	case 0xFF13, 0xFF18, 0xFF1D:
+		v := voices[channelOf(ev.Addr)]
+		v.freq = v.freq&0x0700 | uint16(data)
+		v.retune(ev.Cycle)
+	// NR14, NR24, NR34, NR44
+	case 0xFF14, 0xFF19, 0xFF1E, 0xFF23:
+		v := voices[channelOf(ev.Addr)]
+		if v.ch != Noise {
+			v.freq = v.freq&0x00FF | uint16(data&0x07)<<8
+		}
+		v.lengthEnabled = data&0x40 != 0
+		if data&0x80 != 0 {
+			v.trigger(ev.Cycle)
+			return
+		}
+		v.retune(ev.Cycle)
+	// NR30
+	case 0xFF1A:
+		v := voices[Wave]
+		v.dacEnabled = data&0x80 != 0
+		if !v.dacEnabled {
+			v.stop(ev.Cycle)
+		}
+	// NR31
+	case 0xFF1B:
+		voices[Wave].length = 256 - int(data)
+	// NR32
+	case 0xFF1C:
+		v := voices[Wave]
+		v.volume = waveVolume[(data>>5)&0x03]
+		if v.volume == 0 {
+			v.stop(ev.Cycle)
+		}
+	// NR43
+	case 0xFF22:
+		v := voices[Noise]
+		v.poly = data
+		v.retune(ev.Cycle)
+	// NR52
+	case 0xFF26:
+		if data&0x80 == 0 {
+			for _, v := range voices {
+				v.stop(ev.Cycle)
+				v.dacEnabled = false
+			}
+		}
+	}
+}
+
+// waveVolume is the NR32 volume code in the 0-15 scale of the envelope.
+var waveVolume = [4]byte{0, 15, 8, 4}
+
+func channelOf(addr types.Word) int {
+	switch {
+	case addr <= 0xFF14:
+		return Pulse1
+	case addr <= 0xFF19:
+		return Pulse2
+	case addr <= 0xFF1E:
+		return Wave
+	}
+	return Noise
+}
+
+func (v *voice) trigger(cycle uint64) {
+	v.stop(cycle)
+	if !v.dacEnabled {
+		return
+	}
+	// 減衰していくエンベロープで音量0は無音
+	if v.volume == 0 && !v.envIncrease {
+		return
+	}
+	v.stopAt = 0
+	if !v.envIncrease && v.envPeriod != 0 && v.ch != Wave {
+		v.stopAt = cycle + uint64(v.volume)*uint64(v.envPeriod)*envelopeUnit
+	}
+	if v.lengthEnabled {
+		length := v.length
+		if length == 0 {
+			length = 64
+			if v.ch == Wave {
+				length = 256
+			}
+		}
+		lengthEnd := cycle + uint64(length)*lengthUnit
+		if v.stopAt == 0 || lengthEnd < v.stopAt {
+			v.stopAt = lengthEnd
+		}
+	}
+	velocity := v.volume
+	if velocity == 0 {
+		velocity = 1
+	}
+	v.start(cycle, v.key(), byte(int(velocity)*127/15))
+}
+
+// retune starts a new note when the pitch changes while playing. (vibrato, slide)
+func (v *voice) retune(cycle uint64) {
+	if !v.playing {
+		return
+	}
+	key := v.key()
+	if key == v.current.Key {
+		return
+	}
+	velocity := v.current.Velocity
+	v.stop(cycle)
+	v.start(cycle, key, velocity)
+}
+
+func (v *voice) start(cycle uint64, key, velocity byte) {
+	v.playing = true
+	v.current = Note{Start: cycle, Key: key, Velocity: velocity}
+}
+
+func (v *voice) stop(cycle uint64) {
+	if !v.playing {
+		return
+	}
+	v.playing = false
+	if cycle <= v.current.Start {
+		return
+	}
+	v.current.End = cycle
+	v.notes = append(v.notes, v.current)
+}
+
+// expire stops the note whose length or envelope ran out before cycle.
+func (v *voice) expire(cycle uint64) {
+	if v.playing && v.stopAt != 0 && v.stopAt <= cycle {
+		v.stop(v.stopAt)
+	}
+}
+
+func (v *voice) key() byte {
+	switch v.ch {
+	case Wave:
+		return hzToKey(65536 / float64(2048-int(v.freq)))
+	case Noise:
+		return noiseKey(v.poly)
+	}
+	return hzToKey(131072 / float64(2048-int(v.freq)))
+}
+
+func hzToKey(hz float64) byte {
+	key := math.Round(69 + 12*math.Log2(hz/440))
+	if key < 0 {
+		return 0
+	}
+	if key > 127 {
+		return 127
+	}
+	return byte(key)
+}
+
+// noiseKey picks a drum from the clock of the noise LFSR.
+func noiseKey(poly byte) byte {
+	divisor := float64(poly & 0x07)
+	if divisor == 0 {
+		divisor = 0.5
+	}
+	hz := 524288 / divisor / math.Pow(2, float64(poly>>4)+1)
+	switch {
+	case hz >= 32768:
+		return keyClosedHiHat
+	case hz >= 8192:
+		return keySnare
+	}
+	return keyBassDrum
+}
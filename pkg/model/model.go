@@ -0,0 +1,53 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Model is the hardware revision.
+// The initial register values, the boot behavior and small quirks depend on it.
+type Model int
+
+const (
+	// DMG is the original Game Boy (DMG-CPU A/B/C)
+	DMG Model = iota
+	// DMG0 is the early revision of the original Game Boy (DMG-CPU 0)
+	DMG0
+	// MGB is Game Boy Pocket and Game Boy Light
+	MGB
+	// SGB is Super Game Boy
+	SGB
+	// CGB is Game Boy Color running a DMG cartridge in DMG compatibility mode
+	CGB
+)
+
+var names = map[Model]string{
+	DMG:  "dmg",
+	DMG0: "dmg0",
+	MGB:  "mgb",
+	SGB:  "sgb",
+	CGB:  "cgb",
+}
+
+func (m Model) String() string {
+	if n, ok := names[m]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// Parse parses the model name. It is case insensitive.
+func Parse(name string) (Model, error) {
+	for m, n := range names {
+		if strings.EqualFold(n, name) {
+			return m, nil
+		}
+	}
+	return DMG, fmt.Errorf("unknown model %q. dmg, dmg0, mgb, sgb or cgb is expected", name)
+}
+
+// IsCGB reports whether the model is Game Boy Color.
+func (m Model) IsCGB() bool {
+	return m == CGB
+}
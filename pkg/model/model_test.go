@@ -0,0 +1,21 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for _, m := range []Model{DMG, DMG0, MGB, SGB, CGB} {
+		parsed, err := Parse(m.String())
+		assert.NoError(t, err)
+		assert.Equal(t, m, parsed)
+	}
+	m, err := Parse("MGB")
+	assert.NoError(t, err)
+	assert.Equal(t, MGB, m)
+
+	_, err = Parse("gba")
+	assert.Error(t, err)
+}
@@ -0,0 +1,132 @@
+package pacer
+
+import (
+	"time"
+)
+
+// FrameRate is the refresh rate of DMG LCD in Hz. 4194304 / 70224
+const FrameRate = 4194304.0 / 70224
+
+const (
+	// maxLag is how far behind the deadline the pacer may fall.
+	// Beyond this the pacer gives up catching up and restarts from now,
+	// so that a pause (e.g. window drag, debugger) does not cause a burst of frames.
+	maxLag = 5
+	// statsInterval is the period of FPS measurement.
+	statsInterval = time.Second
+)
+
+// Mode is how the pacer waits for the next frame.
+type Mode int
+
+const (
+	// Timer sleeps until the deadline of the next frame.
+	Timer Mode = iota
+	// VSync does not sleep. The display refresh (window update) blocks instead.
+	VSync
+)
+
+// Clock is a monotonic clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Stats is the measured speed of the emulation.
+type Stats struct {
+	// FPS is the frames per second
+	FPS float64
+	// Speed is the ratio to the real hardware. 1.0 is full speed.
+	Speed float64
+}
+
+// Pacer keeps the emulated time in line with the real time.
+type Pacer struct {
+	mode   Mode
+	clock  Clock
+	period time.Duration
+
+	// The deadline of n-th frame is base + n * period.
+	// It is computed from base every time so that the rounding error does not add up.
+	base    time.Time
+	frames  int64
+	started bool
+
+	statsStart  time.Time
+	statsFrames int
+	stats       Stats
+	onStats     func(Stats)
+}
+
+// NewPacer is Pacer constructor
+func NewPacer(mode Mode) *Pacer {
+	return newPacer(mode, systemClock{})
+}
+
+func newPacer(mode Mode, clock Clock) *Pacer {
+	return &Pacer{
+		mode:   mode,
+		clock:  clock,
+		period: time.Second * 70224 / 4194304,
+	}
+}
+
+// OnStats sets the callback called each time the stats are measured.
+func (p *Pacer) OnStats(f func(Stats)) {
+	p.onStats = f
+}
+
+// Stats returns the last measured stats.
+func (p *Pacer) Stats() Stats {
+	return p.stats
+}
+
+// Wait blocks until the next frame should start. Call it once a frame.
+func (p *Pacer) Wait() {
+	now := p.clock.Now()
+	if !p.started {
+		p.started = true
+		p.base = now
+		p.statsStart = now
+	} else {
+		p.measure(now)
+	}
+	p.frames++
+
+	if p.mode == VSync {
+		return
+	}
+	deadline := p.deadline()
+	if lag := now.Sub(deadline); lag > maxLag*p.period {
+		p.base = now
+		p.frames = 0
+		return
+	}
+	if d := deadline.Sub(now); d > 0 {
+		p.clock.Sleep(d)
+	}
+}
+
+func (p *Pacer) deadline() time.Time {
+	return p.base.Add(time.Duration(float64(p.frames) * float64(time.Second) / FrameRate))
+}
+
+func (p *Pacer) measure(now time.Time) {
+	p.statsFrames++
+	elapsed := now.Sub(p.statsStart)
+	if elapsed < statsInterval {
+		return
+	}
+	fps := float64(p.statsFrames) / elapsed.Seconds()
+	p.stats = Stats{FPS: fps, Speed: fps / FrameRate}
+	p.statsStart = now
+	p.statsFrames = 0
+	if p.onStats != nil {
+		p.onStats(p.stats)
+	}
+}
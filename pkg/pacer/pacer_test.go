@@ -0,0 +1,61 @@
+package pacer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func TestWaitKeepsFrameRateWithoutDrift(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	p := newPacer(Timer, c)
+	for i := 0; i < 597275; i++ {
+		// 毎フレームの処理時間がばらついてもずれない
+		c.now = c.now.Add(time.Duration(i%7) * time.Millisecond)
+		p.Wait()
+	}
+	// 597275 frames = 10000 seconds
+	assert.InDelta(t, 10000, c.now.Sub(time.Unix(0, 0)).Seconds(), 0.001)
+	assert.InDelta(t, 1.0, p.Stats().Speed, 0.01)
+	assert.InDelta(t, FrameRate, p.Stats().FPS, 0.5)
+}
+
+func TestWaitResyncsAfterLongPause(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	p := newPacer(Timer, c)
+	p.Wait()
+	c.now = c.now.Add(time.Second)
+	p.Wait()
+	// 追いつこうとせずに次のフレームから通常の間隔に戻る
+	c.slept = 0
+	p.Wait()
+	assert.InDelta(t, p.period, c.slept, float64(time.Microsecond))
+}
+
+func TestVSyncDoesNotSleep(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	p := newPacer(VSync, c)
+	measured := []Stats{}
+	p.OnStats(func(s Stats) { measured = append(measured, s) })
+	for i := 0; i < 125; i++ {
+		p.Wait()
+		c.now = c.now.Add(time.Second / 120)
+	}
+	assert.Equal(t, time.Duration(0), c.slept)
+	assert.Len(t, measured, 1)
+	assert.InDelta(t, 120, measured[0].FPS, 0.5)
+	assert.InDelta(t, 120/FrameRate, measured[0].Speed, 0.01)
+}
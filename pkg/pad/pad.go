@@ -49,7 +49,8 @@ const (
 // NewPad constructs pad peripheral.
 func NewPad() *Pad {
 	return &Pad{
-		reg: 0x3F,
+		// bit6-7は使われておらず1が読める
+		reg: 0xCF,
 	}
 }
 
@@ -82,3 +83,29 @@ func (pad *Pad) Press(button Button) {
 func (pad *Pad) Release(button Button) {
 	pad.state &= ^button
 }
+
+// Buttons returns the pressed buttons.
+func (pad *Pad) Buttons() Button {
+	return pad.state
+}
+
+// SetButtons presses the buttons and releases the others.
+func (pad *Pad) SetButtons(buttons Button) {
+	pad.state = buttons
+}
+
+// State is the state of the pad saved by Snapshot.
+type State struct {
+	reg   byte
+	state Button
+}
+
+// Snapshot saves the state of the pad.
+func (pad *Pad) Snapshot() State {
+	return State{reg: pad.reg, state: pad.state}
+}
+
+// Restore puts the pad back into the saved state.
+func (pad *Pad) Restore(s State) {
+	pad.reg, pad.state = s.reg, s.state
+}
@@ -0,0 +1,129 @@
+package profile
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// WritePprof writes the profile in the pprof format (gzipped profile.proto), so that `go tool pprof` reads it.
+// A sample is a call stack. The values are the instructions and the M-cycles.
+// A location is bank:PC in a function, and the address is bank<<16|PC. Outside ROM it is PC.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	e := &pprofEncoder{strings: map[string]int{"": 0}, table: []string{""}}
+	var out []byte
+	// sample_type
+	out = e.message(out, 1, e.valueType("instructions", "count"))
+	out = e.message(out, 1, e.valueType("cycles", "count"))
+
+	type key struct{ loc, fn Location }
+	locIDs := map[key]uint64{}
+	fnIDs := map[Location]uint64{}
+	var locs, fns []byte
+
+	keys := make([]string, 0, len(p.stacks))
+	for k := range p.stacks {
+		keys = append(keys, k)
+	}
+	// 出力を決定的にする
+	sort.Strings(keys)
+	for _, k := range keys {
+		st := p.stacks[k]
+		ids := []uint64{}
+		for i, l := range st.locs {
+			fn := st.funcs[i]
+			fid, ok := fnIDs[fn]
+			if !ok {
+				fid = uint64(len(fnIDs) + 1)
+				fnIDs[fn] = fid
+				var f []byte
+				f = e.varint(f, 1, fid)
+				f = e.varint(f, 2, e.str(p.name(fn)))
+				f = e.varint(f, 3, e.str(p.name(fn)))
+				fns = e.message(fns, 5, f)
+			}
+			lid, ok := locIDs[key{l, fn}]
+			if !ok {
+				lid = uint64(len(locIDs) + 1)
+				locIDs[key{l, fn}] = lid
+				var line []byte
+				line = e.varint(line, 1, fid)
+				var loc []byte
+				loc = e.varint(loc, 1, lid)
+				addr := uint64(l.PC)
+				if l.Bank >= 0 {
+					addr |= uint64(l.Bank) << 16
+				}
+				loc = e.varint(loc, 3, addr)
+				loc = e.message(loc, 4, line)
+				locs = e.message(locs, 4, loc)
+			}
+			ids = append(ids, lid)
+		}
+		var sample []byte
+		sample = e.packed(sample, 1, ids)
+		sample = e.packed(sample, 2, []uint64{st.count, st.cycles})
+		out = e.message(out, 2, sample)
+	}
+	out = append(out, locs...)
+	out = append(out, fns...)
+	for _, s := range e.table {
+		out = e.bytes(out, 6, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// pprofEncoder writes the protocol buffers fields that profile.proto uses.
+type pprofEncoder struct {
+	strings map[string]int
+	table   []string
+}
+
+// str returns the index in the string table.
+func (e *pprofEncoder) str(s string) uint64 {
+	if i, ok := e.strings[s]; ok {
+		return uint64(i)
+	}
+	e.strings[s] = len(e.table)
+	e.table = append(e.table, s)
+	return uint64(len(e.table) - 1)
+}
+
+func (e *pprofEncoder) valueType(typ, unit string) []byte {
+	var b []byte
+	b = e.varint(b, 1, e.str(typ))
+	return e.varint(b, 2, e.str(unit))
+}
+
+func (e *pprofEncoder) tag(b []byte, field, wire uint64) []byte {
+	return binary.AppendUvarint(b, field<<3|wire)
+}
+
+func (e *pprofEncoder) varint(b []byte, field, v uint64) []byte {
+	b = e.tag(b, field, 0)
+	return binary.AppendUvarint(b, v)
+}
+
+func (e *pprofEncoder) bytes(b []byte, field uint64, v []byte) []byte {
+	b = e.tag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func (e *pprofEncoder) message(b []byte, field uint64, m []byte) []byte {
+	return e.bytes(b, field, m)
+}
+
+func (e *pprofEncoder) packed(b []byte, field uint64, vs []uint64) []byte {
+	var p []byte
+	for _, v := range vs {
+		p = binary.AppendUvarint(p, v)
+	}
+	return e.bytes(b, field, p)
+}
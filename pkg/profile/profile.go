@@ -0,0 +1,269 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/interfaces/profiler"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// maxDepth bounds the call stack. Code that never returns, e.g. a main loop entered by CALL, stops growing it.
+const maxDepth = 256
+
+// Location is an address in a ROM bank. Bank is -1 outside ROM.
+type Location struct {
+	Bank int
+	PC   types.Word
+}
+
+func (l Location) String() string {
+	if l.Bank < 0 {
+		return fmt.Sprintf("%04X", l.PC)
+	}
+	return fmt.Sprintf("%02X:%04X", l.Bank, l.PC)
+}
+
+// root is the function of the code outside any call
+var root = Location{Bank: -1, PC: 0xFFFF}
+
+type counter struct {
+	cycles uint64
+	count  uint64
+}
+
+func (c *counter) add(cycles uint64) {
+	c.cycles += cycles
+	c.count++
+}
+
+type frame struct {
+	// fn is the called address
+	fn Location
+	// site is the call instruction in the caller
+	site Location
+	// sp is SP just after the call pushed the return address
+	sp types.Word
+}
+
+// stack is a call stack with the executed location at the beginning.
+// The call sites follow it. funcs are the functions that the locations belong to.
+type stack struct {
+	locs  []Location
+	funcs []Location
+	counter
+}
+
+// Profiler counts the cycles per bank:PC, per opcode and per function.
+// The functions are tracked by CALL, RST and interrupts, and RET, RETI and the stack pointer.
+type Profiler struct {
+	total   counter
+	addrs   map[Location]*counter
+	opcodes map[uint16]*counter
+	frames  []frame
+	stacks  map[string]*stack
+	namer   func(Location) (string, bool)
+}
+
+// NewProfiler constructs a profiler. Set it to CPU with SetProfiler.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		addrs:   map[Location]*counter{},
+		opcodes: map[uint16]*counter{},
+		stacks:  map[string]*stack{},
+	}
+}
+
+// name returns the name of the function, or the default one like Func_01_4000.
+func (p *Profiler) name(l Location) string {
+	if l == root {
+		return "(root)"
+	}
+	if p.namer != nil {
+		if name, ok := p.namer(l); ok {
+			return name
+		}
+	}
+	return "Func_" + strings.Replace(l.String(), ":", "_", 1)
+}
+
+var _ profiler.Profiler = (*Profiler)(nil)
+
+// Profile counts a CPU step.
+func (p *Profiler) Profile(s profiler.Sample) {
+	here := Location{Bank: s.Bank, PC: s.PC}
+	cycles := uint64(s.Cycles)
+	p.total.cycles += cycles
+	if s.Kind == profiler.Instruction {
+		p.total.count++
+		if p.opcodes[s.Opcode] == nil {
+			p.opcodes[s.Opcode] = &counter{}
+		}
+		p.opcodes[s.Opcode].add(cycles)
+	}
+	if p.addrs[here] == nil {
+		p.addrs[here] = &counter{}
+	}
+	p.addrs[here].add(cycles)
+	p.stackAt(here).add(cycles)
+
+	if s.Kind == profiler.Interrupt || s.Kind == profiler.Instruction && isCall(s) {
+		if len(p.frames) < maxDepth {
+			p.frames = append(p.frames, frame{fn: Location{Bank: s.NextBank, PC: s.NextPC}, site: here, sp: s.SP})
+		}
+		return
+	}
+	// RETやPOPで戻りアドレスが取り除かれたら、関数を抜けたとみなす
+	for len(p.frames) > 0 && p.frames[len(p.frames)-1].sp < s.SP {
+		p.frames = p.frames[:len(p.frames)-1]
+	}
+}
+
+// isCall reports whether the instruction called a subroutine.
+func isCall(s profiler.Sample) bool {
+	switch s.Opcode {
+	case 0xCD, 0xC7, 0xCF, 0xD7, 0xDF, 0xE7, 0xEF, 0xF7, 0xFF:
+		return true
+	case 0xC4, 0xCC, 0xD4, 0xDC:
+		// 条件を満たさなかったCALLは次の命令に進む
+		return s.NextPC != s.PC+3
+	}
+	return false
+}
+
+// stackAt returns the current call stack executing the location.
+func (p *Profiler) stackAt(here Location) *stack {
+	var b strings.Builder
+	b.WriteString(here.String())
+	for i := len(p.frames) - 1; i >= 0; i-- {
+		b.WriteByte(' ')
+		b.WriteString(p.frames[i].site.String())
+	}
+	key := b.String()
+	if st, ok := p.stacks[key]; ok {
+		return st
+	}
+	st := &stack{locs: []Location{here}}
+	for i := len(p.frames) - 1; i >= 0; i-- {
+		st.funcs = append(st.funcs, p.frames[i].fn)
+		st.locs = append(st.locs, p.frames[i].site)
+	}
+	st.funcs = append(st.funcs, root)
+	p.stacks[key] = st
+	return st
+}
+
+// SetNamer sets the function that names the functions, e.g. by the symbols.
+// The functions that it can't name get the default names like Func_01_4000.
+func (p *Profiler) SetNamer(f func(Location) (string, bool)) {
+	p.namer = f
+}
+
+// Cycles returns the total M-cycles.
+func (p *Profiler) Cycles() uint64 {
+	return p.total.cycles
+}
+
+type row struct {
+	name        string
+	cycles, cum uint64
+	count       uint64
+}
+
+func top(rows []row, n int) []row {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].cycles != rows[j].cycles {
+			return rows[i].cycles > rows[j].cycles
+		}
+		return rows[i].name < rows[j].name
+	})
+	if n > 0 && len(rows) > n {
+		rows = rows[:n]
+	}
+	return rows
+}
+
+// mnemonic returns the mnemonic of the opcode with the operand placeholders.
+func mnemonic(op uint16) string {
+	code := []byte{byte(op)}
+	if op>>8 == 0xCB {
+		code = []byte{0xCB, byte(op)}
+	}
+	if d := cpu.Decode(code).Description; d != "" {
+		return d
+	}
+	return fmt.Sprintf("DB $%02X", op)
+}
+
+// addresses returns the hottest addresses with the function.
+func (p *Profiler) addresses(n int) []row {
+	rows := []row{}
+	funcs := map[Location]Location{}
+	for _, st := range p.stacks {
+		funcs[st.locs[0]] = st.funcs[0]
+	}
+	for l, c := range p.addrs {
+		rows = append(rows, row{name: l.String() + " " + p.name(funcs[l]), cycles: c.cycles, count: c.count})
+	}
+	return top(rows, n)
+}
+
+func (p *Profiler) opcodeRows(n int) []row {
+	rows := []row{}
+	for op, c := range p.opcodes {
+		rows = append(rows, row{name: mnemonic(op), cycles: c.cycles, count: c.count})
+	}
+	return top(rows, n)
+}
+
+// functions returns the functions by the self cycles, with the cycles including the callees.
+func (p *Profiler) functions(n int) []row {
+	flat := map[Location]uint64{}
+	cum := map[Location]uint64{}
+	for _, st := range p.stacks {
+		flat[st.funcs[0]] += st.cycles
+		// 再帰呼び出しで二重に数えない
+		seen := map[Location]bool{}
+		for _, fn := range st.funcs {
+			if !seen[fn] {
+				seen[fn] = true
+				cum[fn] += st.cycles
+			}
+		}
+	}
+	rows := []row{}
+	for fn, c := range cum {
+		rows = append(rows, row{name: p.name(fn), cycles: flat[fn], cum: c})
+	}
+	return top(rows, n)
+}
+
+// WriteReport writes the top n addresses, opcodes and functions by the cycles.
+func (p *Profiler) WriteReport(w io.Writer, n int) error {
+	percent := func(v uint64) float64 {
+		if p.total.cycles == 0 {
+			return 0
+		}
+		return float64(v) * 100 / float64(p.total.cycles)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "total: %d M-cycles, %d instructions\n", p.total.cycles, p.total.count)
+
+	fmt.Fprintf(&b, "\n%12s %7s %10s  %s\n", "cycles", "%", "count", "address")
+	for _, r := range p.addresses(n) {
+		fmt.Fprintf(&b, "%12d %6.2f%% %10d  %s\n", r.cycles, percent(r.cycles), r.count, r.name)
+	}
+	fmt.Fprintf(&b, "\n%12s %7s %10s  %s\n", "cycles", "%", "count", "opcode")
+	for _, r := range p.opcodeRows(n) {
+		fmt.Fprintf(&b, "%12d %6.2f%% %10d  %s\n", r.cycles, percent(r.cycles), r.count, r.name)
+	}
+	fmt.Fprintf(&b, "\n%12s %7s %12s %7s  %s\n", "flat", "flat%", "cum", "cum%", "function")
+	for _, r := range p.functions(n) {
+		fmt.Fprintf(&b, "%12d %6.2f%% %12d %6.2f%%  %s\n", r.cycles, percent(r.cycles), r.cum, percent(r.cum), r.name)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
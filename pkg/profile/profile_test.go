@@ -0,0 +1,108 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/interfaces/profiler"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func inst(pc types.Word, op uint16, cycles uint, next, sp types.Word) profiler.Sample {
+	return profiler.Sample{Kind: profiler.Instruction, PC: pc, Bank: 0, Opcode: op, Cycles: cycles, NextPC: next, NextBank: 0, SP: sp}
+}
+
+// samples are CALL $0200, the callee, a CALL NZ not taken and RET.
+func samples() []profiler.Sample {
+	return []profiler.Sample{
+		inst(0x0150, 0x00, 1, 0x0151, 0xFFFE),
+		inst(0x0151, 0xCD, 6, 0x0200, 0xFFFC),
+		inst(0x0200, 0x3C, 1, 0x0201, 0xFFFC),
+		inst(0x0201, 0xC4, 3, 0x0204, 0xFFFC),
+		inst(0x0204, 0xCB37, 2, 0x0206, 0xFFFC),
+		inst(0x0206, 0xC9, 4, 0x0154, 0xFFFE),
+		inst(0x0154, 0x00, 1, 0x0155, 0xFFFE),
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	p := NewProfiler()
+	for _, s := range samples() {
+		p.Profile(s)
+	}
+	assert.Equal(t, uint64(18), p.Cycles())
+
+	rows := p.functions(0)
+	assert.Equal(t, []row{
+		{name: "Func_00_0200", cycles: 10, cum: 10},
+		{name: "(root)", cycles: 8, cum: 18},
+	}, rows)
+}
+
+func TestInterrupt(t *testing.T) {
+	p := NewProfiler()
+	p.Profile(inst(0x0150, 0x00, 1, 0x0151, 0xFFFE))
+	p.Profile(profiler.Sample{Kind: profiler.Interrupt, PC: 0x0151, Bank: 0, Cycles: 5, NextPC: 0x0040, NextBank: 0, SP: 0xFFFC})
+	p.Profile(inst(0x0040, 0xD9, 4, 0x0151, 0xFFFE))
+	p.Profile(profiler.Sample{Kind: profiler.Idle, PC: 0x0151, Bank: 0, Cycles: 1, NextPC: 0x0151, SP: 0xFFFE})
+
+	assert.Equal(t, []row{
+		{name: "(root)", cycles: 7, cum: 11},
+		{name: "Func_00_0040", cycles: 4, cum: 4},
+	}, p.functions(0))
+	// 割り込みと待機は命令として数えない
+	assert.Equal(t, uint64(2), p.total.count)
+}
+
+func TestMaxDepth(t *testing.T) {
+	p := NewProfiler()
+	sp := types.Word(0xFFFE)
+	for i := 0; i < maxDepth+10; i++ {
+		sp -= 2
+		p.Profile(inst(0x0200, 0xCD, 6, 0x0200, sp))
+	}
+	assert.Equal(t, maxDepth, len(p.frames))
+}
+
+func TestWriteReport(t *testing.T) {
+	p := NewProfiler()
+	for _, s := range samples() {
+		p.Profile(s)
+	}
+	p.SetNamer(func(l Location) (string, bool) {
+		return "Update", l == Location{Bank: 0, PC: 0x0200}
+	})
+	b := &bytes.Buffer{}
+	assert.NoError(t, p.WriteReport(b, 2))
+	out := b.String()
+
+	assert.Contains(t, out, "total: 18 M-cycles, 7 instructions")
+	assert.Contains(t, out, "00:0151 (root)")
+	assert.Contains(t, out, "CALL nn")
+	assert.Contains(t, out, "RET")
+	assert.Contains(t, out, "Update")
+	// 上位2件だけ出す
+	assert.NotContains(t, out, "SWAP A")
+}
+
+func TestWritePprof(t *testing.T) {
+	p := NewProfiler()
+	for _, s := range samples() {
+		p.Profile(s)
+	}
+	b := &bytes.Buffer{}
+	assert.NoError(t, p.WritePprof(b))
+
+	r, err := gzip.NewReader(b)
+	assert.NoError(t, err)
+	raw, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, len(raw) > 0)
+	for _, s := range []string{"instructions", "cycles", "count", "(root)", "Func_00_0200"} {
+		assert.True(t, strings.Contains(string(raw), s), s)
+	}
+}
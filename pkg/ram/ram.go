@@ -24,3 +24,13 @@ func (r *RAM) Read(addr types.Word) byte {
 func (r *RAM) Write(addr types.Word, data byte) {
 	r.data[addr] = data
 }
+
+// Snapshot returns a copy of the contents.
+func (r *RAM) Snapshot() []byte {
+	return append([]byte{}, r.data...)
+}
+
+// Restore puts back the contents saved by Snapshot.
+func (r *RAM) Restore(data []byte) {
+	copy(r.data, data)
+}
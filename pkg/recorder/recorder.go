@@ -0,0 +1,287 @@
+package recorder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cdl"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/gb"
+	"github.com/kijimaD/goboy/pkg/interfaces/symbolizer"
+	"github.com/kijimaD/goboy/pkg/journal"
+	"github.com/kijimaD/goboy/pkg/midi"
+	"github.com/kijimaD/goboy/pkg/profile"
+	"github.com/kijimaD/goboy/pkg/soundlog"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/trace"
+	"github.com/kijimaD/goboy/pkg/vgm"
+)
+
+// Config is the files written by the recorders. The recorders of the empty paths are not started.
+type Config struct {
+	// WAV is the audio
+	WAV string
+	// MIDI and VGM are the music exported from the sound register writes
+	MIDI string
+	VGM  string
+	// Trace is the instruction trace in gameboy-doctor format
+	Trace string
+	// TraceStart and TraceStop are the conditions of the trace, e.g. pc:0x0100, pc:<label> or frame:60
+	TraceStart string
+	TraceStop  string
+	// Profile is the profile of the ROM code in pprof format
+	Profile string
+	// ProfileTop is the number of the rows in the profile report
+	ProfileTop int
+	// JournalSize is the number of the kept bus writes. The journal is not kept if it is 0.
+	JournalSize int
+	// JournalRange limits the recorded writes, e.g. C000-DFFF, oam or a label
+	JournalRange string
+	// JournalDump is the recorded writes
+	JournalDump string
+	// CDL is the code/data log. The log in the file is merged.
+	CDL string
+	// ROMSize is the size of the ROM the code/data log covers
+	ROMSize int
+	// Symbols resolves the labels. It can be nil.
+	Symbols *symbols.Table
+	// Report is where the profile report and the CDL summary are written at Close
+	Report io.Writer
+}
+
+// Recorders are the recorders started on the machine.
+type Recorders struct {
+	journal *journal.Journal
+	closers []func() error
+}
+
+// Start starts the recorders of the config. The started recorders are closed on an error.
+func Start(emu *gb.GB, c *cpu.CPU, b *bus.Bus, cfg Config) (*Recorders, error) {
+	r := &Recorders{}
+	for _, start := range []func(*gb.GB, *cpu.CPU, *bus.Bus, Config) error{
+		r.recordAudio, r.recordSoundLog, r.traceCPU, r.profileCPU, r.journalWrites, r.logCoverage,
+	} {
+		if err := start(emu, c, b, cfg); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Journal returns the journal of the bus writes. It is nil if the journal is not kept.
+func (r *Recorders) Journal() *journal.Journal {
+	return r.journal
+}
+
+// Close writes the recorded files. It has to be called after the run.
+// The other files are still written on an error.
+func (r *Recorders) Close() error {
+	errs := []error{}
+	for _, closer := range r.closers {
+		errs = append(errs, closer())
+	}
+	r.closers = nil
+	return errors.Join(errs...)
+}
+
+func (r *Recorders) recordAudio(emu *gb.GB, _ *cpu.CPU, _ *bus.Bus, cfg Config) error {
+	if cfg.WAV == "" {
+		return nil
+	}
+	f, err := os.Create(cfg.WAV)
+	if err != nil {
+		return err
+	}
+	w, err := apu.NewWAVWriter(f, apu.SampleRate)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	emu.SetAudioSink(w)
+	r.closers = append(r.closers, func() error {
+		// 閉じるとヘッダにサイズが書かれる
+		return errors.Join(emu.AudioErr(), w.Close(), f.Close())
+	})
+	return nil
+}
+
+func (r *Recorders) recordSoundLog(emu *gb.GB, _ *cpu.CPU, b *bus.Bus, cfg Config) error {
+	if cfg.MIDI == "" && cfg.VGM == "" {
+		return nil
+	}
+	rec := soundlog.NewRecorder(emu)
+	b.SetSoundRecorder(rec)
+	r.closers = append(r.closers, func() error {
+		errs := []error{}
+		if cfg.MIDI != "" {
+			errs = append(errs, writeSoundLog(cfg.MIDI, rec, emu.Cycles(), midi.Write))
+		}
+		if cfg.VGM != "" {
+			errs = append(errs, writeSoundLog(cfg.VGM, rec, emu.Cycles(), vgm.Write))
+		}
+		return errors.Join(errs...)
+	})
+	return nil
+}
+
+func writeSoundLog(path string, rec *soundlog.Recorder, end uint64, write func(io.Writer, []soundlog.Event, uint64) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return write(f, rec.Events(), end)
+}
+
+func (r *Recorders) traceCPU(emu *gb.GB, c *cpu.CPU, _ *bus.Bus, cfg Config) error {
+	if cfg.Trace == "" {
+		return nil
+	}
+	f, err := os.Create(cfg.Trace)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	tr := trace.NewTracer(w, emu)
+	for _, cond := range []struct {
+		spec string
+		set  func(trace.Condition)
+	}{
+		{cfg.TraceStart, tr.StartWhen},
+		{cfg.TraceStop, tr.StopWhen},
+	} {
+		if cond.spec == "" {
+			continue
+		}
+		parsed, err := trace.ParseCondition(resolveLabel(cond.spec, cfg.Symbols))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		cond.set(parsed)
+	}
+	c.SetTracer(tr)
+	r.closers = append(r.closers, func() error {
+		// バッファに残った行も書き出す
+		return errors.Join(tr.Err(), w.Flush(), f.Close())
+	})
+	return nil
+}
+
+// resolveLabel replaces the label in "pc:<label>" with the address.
+func resolveLabel(spec string, syms *symbols.Table) string {
+	name, ok := strings.CutPrefix(spec, "pc:")
+	if !ok {
+		return spec
+	}
+	if s, ok := syms.Address(name); ok {
+		return fmt.Sprintf("pc:0x%04X", s.Addr)
+	}
+	return spec
+}
+
+func (r *Recorders) profileCPU(_ *gb.GB, c *cpu.CPU, _ *bus.Bus, cfg Config) error {
+	if cfg.Profile == "" {
+		return nil
+	}
+	p := profile.NewProfiler()
+	if cfg.Symbols != nil {
+		p.SetNamer(func(l profile.Location) (string, bool) {
+			return cfg.Symbols.Label(l.Bank, l.PC)
+		})
+	}
+	c.SetProfiler(p)
+	r.closers = append(r.closers, func() error {
+		c.SetProfiler(nil)
+		f, err := os.Create(cfg.Profile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := p.WritePprof(f); err != nil {
+			return err
+		}
+		return p.WriteReport(report(cfg), cfg.ProfileTop)
+	})
+	return nil
+}
+
+func (r *Recorders) journalWrites(emu *gb.GB, _ *cpu.CPU, b *bus.Bus, cfg Config) error {
+	if cfg.JournalSize <= 0 {
+		return nil
+	}
+	j := journal.New(emu, cfg.JournalSize)
+	if cfg.JournalRange != "" {
+		start, end, err := journal.ParseRange(cfg.JournalRange, cfg.Symbols)
+		if err != nil {
+			return err
+		}
+		j.SetRange(start, end)
+	}
+	j.Attach(b)
+	r.journal = j
+	if cfg.JournalDump == "" {
+		return nil
+	}
+	r.closers = append(r.closers, func() error {
+		f, err := os.Create(cfg.JournalDump)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		if err := journal.Dump(w, j.Entries(), symbolizerOf(cfg.Symbols)); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+	return nil
+}
+
+func (r *Recorders) logCoverage(emu *gb.GB, c *cpu.CPU, b *bus.Bus, cfg Config) error {
+	if cfg.CDL == "" {
+		return nil
+	}
+	cov, err := cdl.LoadFile(cfg.CDL, cfg.ROMSize)
+	if err != nil {
+		return err
+	}
+	c.SetCDL(cov)
+	cov.Attach(b, emu)
+	r.closers = append(r.closers, func() error {
+		c.SetCDL(nil)
+		f, err := os.Create(cfg.CDL)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := cov.Write(f); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(report(cfg), "CDL: %s\n", cov.Summary())
+		return err
+	})
+	return nil
+}
+
+// report returns where the reports are written. They are discarded without Report.
+func report(cfg Config) io.Writer {
+	if cfg.Report == nil {
+		return io.Discard
+	}
+	return cfg.Report
+}
+
+func symbolizerOf(syms *symbols.Table) symbolizer.Symbolizer {
+	if syms == nil {
+		return nil
+	}
+	return syms
+}
@@ -0,0 +1,136 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/bus"
+	"github.com/kijimaD/goboy/pkg/cartridge"
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/gb"
+	"github.com/kijimaD/goboy/pkg/gpu"
+	cdlUsage "github.com/kijimaD/goboy/pkg/interfaces/cdl"
+	"github.com/kijimaD/goboy/pkg/interrupt"
+	"github.com/kijimaD/goboy/pkg/logger"
+	"github.com/kijimaD/goboy/pkg/pad"
+	"github.com/kijimaD/goboy/pkg/ram"
+	"github.com/kijimaD/goboy/pkg/timer"
+	"github.com/kijimaD/goboy/pkg/utils"
+	"github.com/kijimaD/goboy/pkg/window/headless"
+	"github.com/stretchr/testify/assert"
+)
+
+const romPath = "../../roms/helloworld/hello.gb"
+
+// setup makes the machine running the ROM.
+func setup(t *testing.T, buf []byte) (*gb.GB, *cpu.CPU, *bus.Bus) {
+	cart, err := cartridge.NewCartridge(buf)
+	assert.NoError(t, err)
+	l := logger.NewLogger(logger.LogLevel("Info"))
+	g := gpu.NewGPU()
+	tm := timer.NewTimer()
+	a := apu.NewAPU()
+	irq := interrupt.NewInterrupt()
+	b := bus.NewBus(l, cart, g, ram.NewRAM(0x2000), ram.NewRAM(0x2000), ram.NewRAM(0x80), ram.NewRAM(0xA0), tm, a, irq, pad.NewPad())
+	g.Init(b, irq)
+	c := cpu.NewCPU(l, b, irq)
+	return gb.NewGB(c, g, tm, a, irq, headless.New()), c, b
+}
+
+// TestRecorders runs the machine with all the recorders, and checks the recorded files are written at Close.
+func TestRecorders(t *testing.T) {
+	dir := t.TempDir()
+	buf, err := utils.LoadROM(romPath)
+	assert.NoError(t, err)
+	report := &bytes.Buffer{}
+	cfg := Config{
+		WAV:         filepath.Join(dir, "out.wav"),
+		MIDI:        filepath.Join(dir, "out.mid"),
+		VGM:         filepath.Join(dir, "out.vgm"),
+		Trace:       filepath.Join(dir, "trace.log"),
+		Profile:     filepath.Join(dir, "cpu.pprof"),
+		ProfileTop:  5,
+		JournalSize: 16,
+		JournalDump: filepath.Join(dir, "journal.txt"),
+		CDL:         filepath.Join(dir, "hello.cdl"),
+		ROMSize:     len(buf),
+		Report:      report,
+	}
+	emu, c, b := setup(t, buf)
+	r, err := Start(emu, c, b, cfg)
+	assert.NoError(t, err)
+	emu.RunFrames(10)
+	assert.NoError(t, r.Close())
+
+	// 閉じたWAVはヘッダにサイズが書かれている
+	data, err := os.ReadFile(cfg.WAV)
+	assert.NoError(t, err)
+	assert.True(t, len(data) > 44+apu.SampleRate/10*4)
+	assert.Equal(t, uint32(len(data)-8), binary.LittleEndian.Uint32(data[4:8]))
+
+	data, err = os.ReadFile(cfg.MIDI)
+	assert.NoError(t, err)
+	assert.Equal(t, "MThd", string(data[:4]))
+
+	data, err = os.ReadFile(cfg.VGM)
+	assert.NoError(t, err)
+	assert.Equal(t, "Vgm ", string(data[:4]))
+
+	// バッファに残った行も書き出されている
+	data, err = os.ReadFile(cfg.Trace)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	assert.True(t, strings.HasPrefix(lines[0], "A:"))
+	assert.True(t, strings.Contains(lines[0], "PC:0100 "))
+	assert.True(t, strings.HasPrefix(lines[len(lines)-1], "A:"))
+
+	// pprofはgzipで圧縮されている
+	data, err = os.ReadFile(cfg.Profile)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x1F, 0x8B}, data[:2])
+
+	assert.Equal(t, 16, r.Journal().Len())
+	data, err = os.ReadFile(cfg.JournalDump)
+	assert.NoError(t, err)
+	assert.Equal(t, 16, strings.Count(string(data), "\n"))
+
+	data, err = os.ReadFile(cfg.CDL)
+	assert.NoError(t, err)
+	assert.Equal(t, len(buf), len(data))
+	assert.Equal(t, byte(cdlUsage.Opcode), data[0x0100])
+	assert.Contains(t, report.String(), "CDL: ")
+}
+
+func TestNoRecorders(t *testing.T) {
+	buf, err := utils.LoadROM(romPath)
+	assert.NoError(t, err)
+	emu, c, b := setup(t, buf)
+	r, err := Start(emu, c, b, Config{})
+	assert.NoError(t, err)
+	emu.RunFrames(1)
+	assert.Nil(t, r.Journal())
+	assert.NoError(t, r.Close())
+}
+
+func TestStartError(t *testing.T) {
+	dir := t.TempDir()
+	buf, err := utils.LoadROM(romPath)
+	assert.NoError(t, err)
+	emu, c, b := setup(t, buf)
+	_, err = Start(emu, c, b, Config{
+		WAV:        filepath.Join(dir, "out.wav"),
+		Trace:      filepath.Join(dir, "trace.log"),
+		TraceStart: "pc:NoSuchLabel",
+	})
+	assert.Error(t, err)
+
+	// 開始済みのWAVは閉じられている
+	data, err := os.ReadFile(filepath.Join(dir, "out.wav"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(len(data)-8), binary.LittleEndian.Uint32(data[4:8]))
+}
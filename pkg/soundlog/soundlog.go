@@ -0,0 +1,57 @@
+package soundlog
+
+import (
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+const (
+	// SoundBegin is the first sound register (NR10).
+	SoundBegin types.Word = 0xFF10
+	// SoundEnd is the last byte of wave RAM.
+	SoundEnd types.Word = 0xFF3F
+)
+
+// Clock tells the current time in clocks since power on.
+type Clock interface {
+	Cycles() uint64
+}
+
+// Event is a write to a sound register.
+type Event struct {
+	// Cycle is the clock count when the write happened.
+	Cycle uint64
+	Addr  types.Word
+	Data  byte
+}
+
+// Recorder keeps the writes to 0xFF10-0xFF3F with their timestamp.
+// It does not synthesize any audio.
+type Recorder struct {
+	clock  Clock
+	events []Event
+}
+
+// NewRecorder is Recorder constructor
+func NewRecorder(clock Clock) *Recorder {
+	return &Recorder{
+		clock:  clock,
+		events: []Event{},
+	}
+}
+
+// Record appends a write. Writes outside the sound registers are ignored.
+func (r *Recorder) Record(addr types.Word, data byte) {
+	if addr < SoundBegin || addr > SoundEnd {
+		return
+	}
+	r.events = append(r.events, Event{
+		Cycle: r.clock.Cycles(),
+		Addr:  addr,
+		Data:  data,
+	})
+}
+
+// Events returns the recorded writes in order.
+func (r *Recorder) Events() []Event {
+	return r.events
+}
@@ -0,0 +1,367 @@
+package srcmap
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/cpu"
+	"github.com/kijimaD/goboy/pkg/disasm"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// maxSkip is how far a breakpoint on a line without code moves down to the next instruction
+const maxSkip = 16
+
+// Location is an address in a ROM bank
+type Location struct {
+	Bank int
+	Addr types.Word
+}
+
+// Line is a line in a source file. Line is 1 origin.
+type Line struct {
+	File string
+	Line int
+}
+
+// Map maps the lines of RGBDS sources to the ROM addresses.
+//
+// RGBDS doesn't write line info, so the map is made from the symbols and the ROM.
+// Each label found in the symbols gives the address of the line. The following lines
+// get the addresses by the lengths of the instructions decoded from the ROM. The mnemonic
+// of each line is checked against the ROM, and the lines are not mapped until the next label
+// once they are out of sync, e.g. after a macro call or a conditional block.
+type Map struct {
+	rom   []byte
+	syms  *symbols.Table
+	lines map[Line]Location
+	addrs map[Location]Line
+	files map[string]bool
+}
+
+// New constructs an empty map for the ROM and its symbols.
+func New(rom []byte, syms *symbols.Table) *Map {
+	return &Map{
+		rom:   rom,
+		syms:  syms,
+		lines: map[Line]Location{},
+		addrs: map[Location]Line{},
+		files: map[string]bool{},
+	}
+}
+
+// AddDir maps the sources (.asm, .inc, .s and .z80) under the directory.
+func (m *Map) AddDir(root string) error {
+	return filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".asm", ".inc", ".s", ".z80":
+			return m.AddFile(path)
+		}
+		return nil
+	})
+}
+
+// AddFile maps the source file. A file is read once.
+func (m *Map) AddFile(path string) error {
+	path = normalize(path)
+	if m.files[path] {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.AddSource(path, f)
+}
+
+// AddSource maps the source read from r as the file.
+func (m *Map) AddSource(file string, r io.Reader) error {
+	file = normalize(file)
+	m.files[file] = true
+	p := &parser{m: m, file: file}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		p.line(n, sc.Text())
+	}
+	return sc.Err()
+}
+
+// Lookup returns the address of the line. A line without code moves to the next instruction,
+// and the moved line is returned. The file is read if it is not mapped yet.
+func (m *Map) Lookup(file string, line int) (Location, int, bool) {
+	file = normalize(file)
+	if !m.files[file] {
+		if err := m.AddFile(file); err != nil {
+			return Location{}, 0, false
+		}
+	}
+	for l := line; l <= line+maxSkip; l++ {
+		if loc, ok := m.lines[Line{File: file, Line: l}]; ok {
+			return loc, l, true
+		}
+	}
+	return Location{}, 0, false
+}
+
+// Line returns the source line of the instruction at the address.
+func (m *Map) Line(bank int, addr types.Word) (Line, bool) {
+	if addr < 0x4000 {
+		bank = 0
+	}
+	l, ok := m.addrs[Location{Bank: bank, Addr: addr}]
+	return l, ok
+}
+
+func normalize(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return filepath.Clean(path)
+}
+
+// parser follows the addresses through a source file.
+type parser struct {
+	m    *Map
+	file string
+	// global is the last global label, the scope of the local labels
+	global string
+	cur    Location
+	synced bool
+	// nested counts the MACRO, REPT and FOR bodies, which are not assembled where they are written
+	nested int
+}
+
+// directives are the ones that emit no bytes
+var directives = map[string]bool{
+	"def": true, "redef": true, "export": true, "global": true, "purge": true,
+	"charmap": true, "newcharmap": true, "setcharmap": true, "pushc": true, "popc": true,
+	"opt": true, "pusho": true, "popo": true, "assert": true, "static_assert": true,
+	"print": true, "println": true, "warn": true, "rsreset": true, "rsset": true,
+}
+
+// constants are the second words that define a constant, e.g. "X EQU 1"
+var constants = map[string]bool{"equ": true, "equs": true, "=": true, "set": true, "rb": true, "rw": true, "rl": true}
+
+func (p *parser) line(n int, text string) {
+	text = stripComment(text)
+	label, rest := cutLabel(text)
+	word, args := cutWord(rest)
+	if label == "" {
+		word, args = cutWord(text)
+	}
+	switch word {
+	case "macro", "rept", "for":
+		p.nested++
+		p.synced = false
+		return
+	case "endm", "endr":
+		p.nested--
+		p.synced = false
+		return
+	}
+	if p.nested > 0 {
+		return
+	}
+	if label != "" {
+		p.label(label)
+	}
+	if word == "" || directives[word] {
+		return
+	}
+	if second, _ := cutWord(args); constants[second] {
+		return
+	}
+	switch word {
+	case "db":
+		p.skip(dataLen(args, 1))
+	case "dw":
+		p.skip(dataLen(args, 2))
+	case "dl":
+		p.skip(dataLen(args, 4))
+	case "ds":
+		size, _, _ := strings.Cut(args, ",")
+		v, err := parseNumber(strings.TrimSpace(size))
+		if err != nil {
+			p.synced = false
+			return
+		}
+		p.skip(v)
+	default:
+		p.instruction(n, word)
+	}
+}
+
+// label syncs the address with the symbol of the label.
+func (p *parser) label(label string) {
+	name := label
+	switch {
+	case strings.HasPrefix(label, "."):
+		name = p.global + label
+	case strings.Contains(label, "."):
+		p.global, _, _ = strings.Cut(label, ".")
+	default:
+		p.global = label
+	}
+	s, ok := p.m.syms.Address(name)
+	// RAMのラベルにはコードがない
+	p.synced = ok && s.Addr < 0x8000
+	p.cur = Location{Bank: s.Bank, Addr: s.Addr}
+}
+
+func (p *parser) skip(n int) {
+	if n < 0 {
+		p.synced = false
+		return
+	}
+	p.cur.Addr += types.Word(n)
+}
+
+// instruction maps the line if the instruction in the ROM has the same mnemonic.
+func (p *parser) instruction(n int, mnemonic string) {
+	if !p.synced {
+		return
+	}
+	off := disasm.Offset(p.cur.Bank, int(p.cur.Addr))
+	if off < 0 || off >= len(p.m.rom) {
+		p.synced = false
+		return
+	}
+	in := cpu.Decode(p.m.rom[off:])
+	decoded, _, _ := strings.Cut(in.Description, " ")
+	if in.Description == "" || !sameMnemonic(mnemonic, strings.ToLower(decoded)) {
+		// マクロの呼び出しや条件付きアセンブルで、ROMとずれた
+		p.synced = false
+		return
+	}
+	line := Line{File: p.file, Line: n}
+	if _, ok := p.m.lines[line]; !ok {
+		p.m.lines[line] = p.cur
+	}
+	if _, ok := p.m.addrs[p.cur]; !ok {
+		p.m.addrs[p.cur] = line
+	}
+	p.cur.Addr += types.Word(in.Length)
+}
+
+// sameMnemonic compares the mnemonics. LDH, LDI and LDD are variants of LD.
+func sameMnemonic(a, b string) bool {
+	ld := func(s string) string {
+		switch s {
+		case "ldh", "ldi", "ldd":
+			return "ld"
+		}
+		return s
+	}
+	return ld(a) == ld(b)
+}
+
+// stripComment removes the comment outside the strings.
+func stripComment(s string) string {
+	quoted := false
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+// cutLabel splits "Label:", "Label::" and ".local:" at the beginning of the line.
+func cutLabel(s string) (string, string) {
+	t := strings.TrimSpace(s)
+	i := strings.IndexFunc(t, func(r rune) bool {
+		return !(r == '_' || r == '.' || r == '#' || r == '@' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')
+	})
+	if i <= 0 || t[i] != ':' {
+		// RGBDSではローカルラベルのコロンは省略できる
+		if strings.HasPrefix(s, ".") {
+			label, rest, _ := strings.Cut(t, " ")
+			return label, rest
+		}
+		return "", s
+	}
+	return t[:i], strings.TrimLeft(t[i:], ":")
+}
+
+// cutWord returns the first word in lower case and the rest.
+func cutWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return strings.ToLower(s), ""
+	}
+	return strings.ToLower(s[:i]), strings.TrimSpace(s[i:])
+}
+
+// dataLen returns the bytes of db, dw and dl. It returns -1 when it can't be known.
+func dataLen(args string, size int) int {
+	if strings.TrimSpace(args) == "" {
+		// 引数のないdbは1つ分を確保する
+		return size
+	}
+	total := 0
+	for _, item := range splitArgs(args) {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "\"") {
+			if size != 1 || !strings.HasSuffix(item, "\"") || len(item) < 2 || strings.Contains(item, "\\") {
+				return -1
+			}
+			total += len(item) - 2
+			continue
+		}
+		total += size
+	}
+	return total
+}
+
+// splitArgs splits the arguments by the commas outside the strings.
+func splitArgs(s string) []string {
+	args := []string{}
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			args = append(args, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(args, s[start:])
+}
+
+// parseNumber parses $FF, %1010, &17, 0xFF and 255.
+func parseNumber(s string) (int, error) {
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "$"):
+		s, base = s[1:], 16
+	case strings.HasPrefix(s, "%"):
+		s, base = s[1:], 2
+	case strings.HasPrefix(s, "&"):
+		s, base = s[1:], 8
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		s, base = s[2:], 16
+	}
+	v, err := strconv.ParseUint(strings.ReplaceAll(s, "_", ""), base, 16)
+	return int(v), err
+}
@@ -0,0 +1,178 @@
+package srcmap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/asm"
+	"github.com/kijimaD/goboy/pkg/symbols"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// source is the RGBDS source of the ROM made by setup. The markers name the lines.
+const source = `INCLUDE "hardware.inc"
+
+MACRO TwoNops
+	nop
+	nop
+ENDM
+
+DEF SCREEN_WIDTH EQU 160
+COUNT = 3
+
+SECTION "Header", ROM0[$100]
+EntryPoint:                  ; @entry
+	nop                      ; @nop
+	jp Main
+
+SECTION "Main", ROM0[$150]
+Main::
+	ld sp, $FFFE             ; @main
+	call Clear               ; @call
+.loop
+	halt                     ; @halt
+	jr .loop
+
+Clear:
+	ld hl, Data              ; @clear
+	ldh a, [$FF44]           ; @ldh
+	ld [hl+], a
+	TwoNops                  ; @macro
+	ret                      ; @lost
+Data:
+	db "A;B", 1
+	dw $1234, Data
+.after
+	ret                      ; @after
+
+SECTION "Bank 1", ROMX, BANK[1]
+Far:
+	; comment
+	ld a, 1                  ; @far
+	ret
+`
+
+const code = `
+Main:
+	LD SP,$FFFE
+	CALL Clear
+loop:
+	HALT
+	JR loop
+Clear:
+	LD HL,Data
+	LDH A,($FF44)
+	LD (HL+),A
+	NOP
+	NOP
+	RET
+Data:
+	DB $41,$3B,$42,1
+	DW $1234,Data
+	RET
+`
+
+const sym = `00:0100 EntryPoint
+00:0150 Main
+00:0156 Main.loop
+00:0159 Clear
+00:0162 Data
+00:016A Data.after
+01:4000 Far
+00:C000 wBuffer
+`
+
+func setup(t *testing.T) *Map {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], asm.MustAssemble("NOP\nJP $0150", 0x0100))
+	copy(rom[0x0150:], asm.MustAssemble(code, 0x0150))
+	copy(rom[0x4000:], asm.MustAssemble("LD A,1\nRET", 0x4000))
+	syms, err := symbols.Parse(strings.NewReader(sym))
+	assert.NoError(t, err)
+	m := New(rom, syms)
+	assert.NoError(t, m.AddSource("main.asm", strings.NewReader(source)))
+	return m
+}
+
+// lineOf returns the line number with the marker.
+func lineOf(marker string) int {
+	for i, l := range strings.Split(source, "\n") {
+		if strings.HasSuffix(l, "; @"+marker) {
+			return i + 1
+		}
+	}
+	panic(marker)
+}
+
+func TestLookup(t *testing.T) {
+	m := setup(t)
+	tests := []struct {
+		marker string
+		want   Location
+	}{
+		{"nop", Location{0, 0x0100}},
+		{"main", Location{0, 0x0150}},
+		{"call", Location{0, 0x0153}},
+		{"halt", Location{0, 0x0156}},
+		{"clear", Location{0, 0x0159}},
+		{"ldh", Location{0, 0x015C}},
+		{"after", Location{0, 0x016A}},
+		{"far", Location{1, 0x4000}},
+	}
+	for _, tt := range tests {
+		loc, line, ok := m.Lookup("main.asm", lineOf(tt.marker))
+		assert.True(t, ok, tt.marker)
+		assert.Equal(t, tt.want, loc, tt.marker)
+		assert.Equal(t, lineOf(tt.marker), line, tt.marker)
+	}
+}
+
+func TestLookupMovesToCode(t *testing.T) {
+	m := setup(t)
+	// ラベルの行は次の命令に
+	_, line, ok := m.Lookup("main.asm", lineOf("entry"))
+	assert.True(t, ok)
+	assert.Equal(t, lineOf("nop"), line)
+
+	// マクロの後はラベルまで同期しない
+	_, line, ok = m.Lookup("main.asm", lineOf("macro"))
+	assert.True(t, ok)
+	assert.Equal(t, lineOf("after"), line)
+
+	_, _, ok = m.Lookup("main.asm", len(strings.Split(source, "\n")))
+	assert.False(t, ok)
+	_, _, ok = m.Lookup("other.asm", 1)
+	assert.False(t, ok)
+}
+
+func TestLine(t *testing.T) {
+	m := setup(t)
+	l, ok := m.Line(0, 0x0156)
+	assert.True(t, ok)
+	assert.Equal(t, lineOf("halt"), l.Line)
+	assert.True(t, strings.HasSuffix(l.File, "main.asm"))
+
+	l, ok = m.Line(1, 0x4000)
+	assert.True(t, ok)
+	assert.Equal(t, lineOf("far"), l.Line)
+	_, ok = m.Line(2, 0x4000)
+	assert.False(t, ok)
+
+	// ROM0はバンクによらない
+	_, ok = m.Line(3, 0x0100)
+	assert.True(t, ok)
+
+	for _, addr := range []types.Word{0x015F, 0x0161, 0x0162} {
+		_, ok = m.Line(0, addr)
+		assert.False(t, ok, "%04X", addr)
+	}
+}
+
+func TestDataLen(t *testing.T) {
+	assert.Equal(t, 1, dataLen("", 1))
+	assert.Equal(t, 4, dataLen(`"A,B", 1`, 1))
+	assert.Equal(t, 4, dataLen("1, 2", 2))
+	assert.Equal(t, -1, dataLen(`"A\n"`, 1))
+	assert.Equal(t, -1, dataLen(`"AB"`, 2))
+}
@@ -0,0 +1,190 @@
+package symbols
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/interfaces/symbolizer"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// UnknownBank is the bank of an address whose bank is not known.
+// It matches the labels in any bank.
+const UnknownBank = -1
+
+// Symbol is a label at bank:address
+type Symbol struct {
+	Name string
+	Bank int
+	Addr types.Word
+}
+
+// Table is the symbols loaded from a .sym file of RGBDS.
+// The same address in the different banks has different labels, so the lookup takes the bank.
+type Table struct {
+	// symbols are sorted by the address and the bank
+	symbols []Symbol
+	names   map[string]Symbol
+}
+
+var _ symbolizer.Symbolizer = (*Table)(nil)
+
+// Parse reads the .sym file. Each line is "BB:AAAA Label". Comments start with ";".
+func Parse(r io.Reader) (*Table, error) {
+	t := &Table{names: map[string]Symbol{}}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		s, err := parseSymbol(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		t.symbols = append(t.symbols, s)
+		if _, ok := t.names[s.Name]; !ok {
+			t.names[s.Name] = s
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(t.symbols, func(i, j int) bool {
+		if t.symbols[i].Addr != t.symbols[j].Addr {
+			return t.symbols[i].Addr < t.symbols[j].Addr
+		}
+		return t.symbols[i].Bank < t.symbols[j].Bank
+	})
+	return t, nil
+}
+
+func parseSymbol(fields []string) (Symbol, error) {
+	if len(fields) != 2 {
+		return Symbol{}, fmt.Errorf("invalid symbol %q. \"BB:AAAA Label\" is expected", strings.Join(fields, " "))
+	}
+	bank, addr, ok := strings.Cut(fields[0], ":")
+	if !ok {
+		return Symbol{}, fmt.Errorf("invalid address %q", fields[0])
+	}
+	b, err := strconv.ParseUint(bank, 16, 16)
+	if err != nil {
+		return Symbol{}, fmt.Errorf("invalid bank %q", bank)
+	}
+	a, err := strconv.ParseUint(addr, 16, 16)
+	if err != nil {
+		return Symbol{}, fmt.Errorf("invalid address %q", addr)
+	}
+	return Symbol{Name: fields[1], Bank: int(b), Addr: types.Word(a)}, nil
+}
+
+// Load reads the .sym file at the path.
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// LoadForROM reads the .sym file next to the ROM, e.g. game.sym for game.gb.
+// It returns nil without error when there is none.
+func LoadForROM(romPath string) (*Table, error) {
+	path := strings.TrimSuffix(romPath, filepath.Ext(romPath)) + ".sym"
+	t, err := Load(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return t, err
+}
+
+// region returns the start of the memory area that the address belongs to.
+// A label covers the addresses after it only in the same area.
+func region(addr types.Word) types.Word {
+	switch {
+	case addr < 0x4000:
+		return 0x0000
+	case addr < 0x8000:
+		return 0x4000
+	case addr < 0xA000:
+		return 0x8000
+	case addr < 0xC000:
+		return 0xA000
+	case addr < 0xD000:
+		return 0xC000
+	case addr < 0xE000:
+		return 0xD000
+	case addr < 0xFF80:
+		return 0xE000
+	}
+	return 0xFF80
+}
+
+// Lookup returns the label at or before the address in the same bank and memory area.
+func (t *Table) Lookup(bank int, addr types.Word) (Symbol, bool) {
+	if t == nil {
+		return Symbol{}, false
+	}
+	if addr < 0x4000 {
+		// ROM0はバンク0
+		bank = 0
+	}
+	start := region(addr)
+	i := sort.Search(len(t.symbols), func(i int) bool { return t.symbols[i].Addr > addr })
+	for i--; i >= 0 && t.symbols[i].Addr >= start; i-- {
+		if bank == UnknownBank || t.symbols[i].Bank == bank {
+			return t.symbols[i], true
+		}
+	}
+	return Symbol{}, false
+}
+
+// Symbols returns all the symbols sorted by the address.
+func (t *Table) Symbols() []Symbol {
+	if t == nil {
+		return nil
+	}
+	return t.symbols
+}
+
+// Address returns the symbol of the label.
+func (t *Table) Address(name string) (Symbol, bool) {
+	if t == nil {
+		return Symbol{}, false
+	}
+	s, ok := t.names[name]
+	return s, ok
+}
+
+// Label returns the name of the address like "UpdateSprites+$12", or false if no label covers it.
+func (t *Table) Label(bank int, addr types.Word) (string, bool) {
+	s, ok := t.Lookup(bank, addr)
+	if !ok {
+		return "", false
+	}
+	if s.Addr == addr {
+		return s.Name, true
+	}
+	return fmt.Sprintf("%s+$%X", s.Name, addr-s.Addr), true
+}
+
+// Symbolize returns the label of the address, or the address like "$1A51" if it has none.
+func (t *Table) Symbolize(bank int, addr types.Word) string {
+	if name, ok := t.Label(bank, addr); ok {
+		return name
+	}
+	return fmt.Sprintf("$%04X", addr)
+}
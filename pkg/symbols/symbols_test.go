@@ -0,0 +1,92 @@
+package symbols
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const sym = `; File generated by rgblink
+00:0150 Main
+00:0158 Main.loop
+01:4000 UpdateSprites
+02:4000 PlayMusic
+02:4010 PlayMusic.next
+00:C000 wBuffer
+00:FF80 hCounter
+`
+
+func TestParse(t *testing.T) {
+	tbl, err := Parse(strings.NewReader(sym))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, len(tbl.Symbols()))
+
+	s, ok := tbl.Address("PlayMusic.next")
+	assert.True(t, ok)
+	assert.Equal(t, Symbol{Name: "PlayMusic.next", Bank: 2, Addr: 0x4010}, s)
+	_, ok = tbl.Address("Nothing")
+	assert.False(t, ok)
+}
+
+func TestParseError(t *testing.T) {
+	for _, src := range []string{"0150 Main", "00:0150", "zz:0150 Main", "00:xyz Main", "00:10000 Main"} {
+		_, err := Parse(strings.NewReader(src))
+		assert.Error(t, err, src)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	tbl, err := Parse(strings.NewReader(sym))
+	assert.NoError(t, err)
+	tests := []struct {
+		bank int
+		addr types.Word
+		want string
+	}{
+		{0, 0x0150, "Main"},
+		{0, 0x0153, "Main+$3"},
+		{0, 0x0160, "Main.loop+$8"},
+		// ROM0のアドレスは、マップされているバンクによらない
+		{1, 0x0150, "Main"},
+		// 同じアドレスでもバンクによってラベルが違う
+		{1, 0x4012, "UpdateSprites+$12"},
+		{2, 0x4012, "PlayMusic.next+$2"},
+		{UnknownBank, 0xC005, "wBuffer+$5"},
+		{UnknownBank, 0xFF81, "hCounter+$1"},
+		// ラベルは別の領域にまたがらない
+		{0, 0x0100, "$0100"},
+		{3, 0x4012, "$4012"},
+		{UnknownBank, 0x8000, "$8000"},
+		{UnknownBank, 0xFF40, "$FF40"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tbl.Symbolize(tt.bank, tt.addr), "%02X:%04X", tt.bank, tt.addr)
+	}
+}
+
+func TestNilTable(t *testing.T) {
+	var tbl *Table
+	assert.Equal(t, "$1A51", tbl.Symbolize(0, 0x1A51))
+	_, ok := tbl.Address("Main")
+	assert.False(t, ok)
+	assert.Nil(t, tbl.Symbols())
+}
+
+func TestLoadForROM(t *testing.T) {
+	dir := t.TempDir()
+	rom := filepath.Join(dir, "game.gb")
+	tbl, err := LoadForROM(rom)
+	assert.NoError(t, err)
+	assert.Nil(t, tbl)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "game.sym"), []byte(sym), 0o644))
+	tbl, err = LoadForROM(rom)
+	assert.NoError(t, err)
+	if assert.NotNil(t, tbl) {
+		assert.Equal(t, "UpdateSprites", tbl.Symbolize(1, 0x4000))
+	}
+}
@@ -1,6 +1,7 @@
 package timer
 
 import (
+	"github.com/kijimaD/goboy/pkg/model"
 	"github.com/kijimaD/goboy/pkg/types"
 )
 
@@ -38,15 +39,36 @@ type Timer struct {
 	TMA             byte
 }
 
-// NewTimer constructs timer peripheral.
+// postBootCounters are the internal counters when the boot ROM jumps to 0x0100. DIV is the upper byte.
+// SGB and CGB boot ROMs take variable time, so the values are typical ones.
+var postBootCounters = map[model.Model]uint16{
+	model.DMG0: 0x182C,
+	model.DMG:  0xABCC,
+	model.MGB:  0xABCC,
+	model.SGB:  0xD85C,
+	model.CGB:  0x267C,
+}
+
+// NewTimer constructs timer peripheral in the state the DMG boot ROM leaves it.
 func NewTimer() *Timer {
-	return &Timer{
+	t := &Timer{
 		// 4.194304MHz / 256 = 16.384KHz
-		internalCounter: 0,
-		TIMA:            0x00,
-		TAC:             0x00,
-		TMA:             0x00,
+		TIMA: 0x00,
+		TAC:  0x00,
+		TMA:  0x00,
 	}
+	t.SetModel(model.DMG)
+	return t
+}
+
+// SetModel sets the DIV phase the boot ROM of the model leaves.
+func (timer *Timer) SetModel(m model.Model) {
+	timer.internalCounter = postBootCounters[m]
+}
+
+// PowerOn puts timer into the state at power on, before the boot ROM runs.
+func (timer *Timer) PowerOn() {
+	*timer = Timer{}
 }
 
 // Update timer counter registers
@@ -82,7 +104,8 @@ func (timer *Timer) Read(addr types.Word) byte {
 	case TMA:
 		return timer.TMA
 	case TAC:
-		return timer.TAC
+		// 未使用のbit7-3は1が読める
+		return timer.TAC | 0xF8
 	}
 	panic("Illegal access detected.")
 }
@@ -94,10 +117,7 @@ func (timer *Timer) Write(addr types.Word, data byte) {
 		// When writing to DIV, the whole counter is reseted, so the timer is also affected.
 		// When writing to DIV, if the current output is '1' and timer is enabled
 		// as the new value after reseting DIV will be '0', the falling edge detector will detect a falling edge and TIMA will increase.
-		if timer.hasFallingEdgeDetected(timer.internalCounter, 0) {
-			timer.TIMA++
-		}
-		timer.internalCounter = 0
+		timer.ResetDIV()
 	case TIMA:
 		timer.TIMA = data
 	case TMA:
@@ -107,6 +127,14 @@ func (timer *Timer) Write(addr types.Word, data byte) {
 	}
 }
 
+// ResetDIV resets the internal counter. It is done by writing DIV and by STOP.
+func (timer *Timer) ResetDIV() {
+	if timer.hasFallingEdgeDetected(timer.internalCounter, 0) {
+		timer.TIMA++
+	}
+	timer.internalCounter = 0
+}
+
 func (timer *Timer) isStarted() bool {
 	return timer.TAC&0x04 == 0x04
 }
@@ -129,3 +157,18 @@ func (timer *Timer) getMaskBit() uint {
 	}
 	return 0
 }
+
+// State is the state of the timer saved by Snapshot.
+type State struct {
+	timer Timer
+}
+
+// Snapshot saves the state of the timer.
+func (timer *Timer) Snapshot() State {
+	return State{timer: *timer}
+}
+
+// Restore puts the timer back into the saved state.
+func (timer *Timer) Restore(s State) {
+	*timer = s.timer
+}
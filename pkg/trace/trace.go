@@ -0,0 +1,131 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/goboy/pkg/interfaces/tracer"
+	"github.com/kijimaD/goboy/pkg/types"
+)
+
+// Frames tells the number of the frames since power on.
+type Frames interface {
+	Frame() int
+}
+
+// Condition decides when the trace starts or stops.
+type Condition func(s tracer.State, frame int) bool
+
+// AtPC matches when the instruction at pc is about to be executed.
+func AtPC(pc types.Word) Condition {
+	return func(s tracer.State, frame int) bool {
+		return s.PC == pc
+	}
+}
+
+// AtFrame matches from the given frame.
+func AtFrame(n int) Condition {
+	return func(s tracer.State, frame int) bool {
+		return frame >= n
+	}
+}
+
+// ParseCondition parses "pc:0x0150" or "frame:60".
+func ParseCondition(spec string) (Condition, error) {
+	kind, value, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "pc":
+		pc, err := strconv.ParseUint(value, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PC %q: %w", value, err)
+		}
+		return AtPC(types.Word(pc)), nil
+	case "frame":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame %q: %w", value, err)
+		}
+		return AtFrame(n), nil
+	}
+	return nil, fmt.Errorf("invalid condition %q. pc:<addr> or frame:<n> is expected", spec)
+}
+
+// Tracer writes one line per instruction in the gameboy-doctor format.
+// https://github.com/robert/gameboy-doctor
+//
+//	A:00 F:11 B:22 C:33 D:44 E:55 H:66 L:77 SP:8888 PC:9999 PCMEM:AA,BB,CC,DD
+//
+// It starts at once and never stops unless the conditions are set.
+// Once stopped, it does not start again.
+type Tracer struct {
+	w       io.Writer
+	frames  Frames
+	start   Condition
+	stop    Condition
+	started bool
+	stopped bool
+	err     error
+}
+
+// NewTracer is Tracer constructor
+func NewTracer(w io.Writer, frames Frames) *Tracer {
+	return &Tracer{
+		w:      w,
+		frames: frames,
+	}
+}
+
+// StartWhen sets the condition to start the trace.
+func (t *Tracer) StartWhen(c Condition) {
+	t.start = c
+}
+
+// StopWhen sets the condition to stop the trace. The instruction that matches is not written.
+func (t *Tracer) StopWhen(c Condition) {
+	t.stop = c
+}
+
+// Err returns the first error of the writer.
+func (t *Tracer) Err() error {
+	return t.err
+}
+
+// Trace writes the state if the trace is active.
+func (t *Tracer) Trace(s tracer.State) {
+	if t.stopped || t.err != nil {
+		return
+	}
+	frame := t.frames.Frame()
+	if !t.started {
+		if t.start != nil && !t.start(s, frame) {
+			return
+		}
+		t.started = true
+	}
+	if t.stop != nil && t.stop(s, frame) {
+		t.stopped = true
+		return
+	}
+	_, t.err = fmt.Fprintln(t.w, Format(s))
+}
+
+// Format formats the state as a line of gameboy-doctor log.
+func Format(s tracer.State) string {
+	return fmt.Sprintf("A:%02X F:%02X B:%02X C:%02X D:%02X E:%02X H:%02X L:%02X SP:%04X PC:%04X PCMEM:%02X,%02X,%02X,%02X",
+		s.A, s.F, s.B, s.C, s.D, s.E, s.H, s.L, s.SP, s.PC, s.PCMem[0], s.PCMem[1], s.PCMem[2], s.PCMem[3])
+}
+
+// Parse parses a line of gameboy-doctor log.
+func Parse(line string) (tracer.State, error) {
+	var s tracer.State
+	var sp, pc uint16
+	_, err := fmt.Sscanf(strings.TrimSpace(line), "A:%X F:%X B:%X C:%X D:%X E:%X H:%X L:%X SP:%X PC:%X PCMEM:%X,%X,%X,%X",
+		&s.A, &s.F, &s.B, &s.C, &s.D, &s.E, &s.H, &s.L, &sp, &pc, &s.PCMem[0], &s.PCMem[1], &s.PCMem[2], &s.PCMem[3])
+	if err != nil {
+		return s, fmt.Errorf("invalid trace line %q: %w", line, err)
+	}
+	s.SP, s.PC = types.Word(sp), types.Word(pc)
+	return s, nil
+}
@@ -0,0 +1,78 @@
+package trace
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/interfaces/tracer"
+	"github.com/kijimaD/goboy/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeFrames struct {
+	frame int
+}
+
+func (f *fakeFrames) Frame() int { return f.frame }
+
+func state(pc types.Word) tracer.State {
+	return tracer.State{
+		A: 0x01, F: 0xB0, B: 0x00, C: 0x13, D: 0x00, E: 0xD8, H: 0x01, L: 0x4D,
+		SP: 0xFFFE, PC: pc, PCMem: [4]byte{0x00, 0xC3, 0x13, 0x02},
+	}
+}
+
+func TestTraceFormat(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTracer(&buf, &fakeFrames{})
+	tr.Trace(state(0x0100))
+	assert.Equal(t, "A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,13,02\n", buf.String())
+}
+
+func TestTraceConditions(t *testing.T) {
+	var buf bytes.Buffer
+	frames := &fakeFrames{}
+	tr := NewTracer(&buf, frames)
+	tr.StartWhen(AtPC(0x0150))
+	tr.StopWhen(AtFrame(2))
+
+	tr.Trace(state(0x0100))
+	assert.Equal(t, 0, buf.Len())
+	tr.Trace(state(0x0150))
+	tr.Trace(state(0x0100))
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+
+	frames.frame = 2
+	tr.Trace(state(0x0150))
+	frames.frame = 0
+	// 一度止まったら再開しない
+	tr.Trace(state(0x0150))
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+}
+
+func TestParseCondition(t *testing.T) {
+	c, err := ParseCondition("pc:0x0150")
+	assert.NoError(t, err)
+	assert.True(t, c(state(0x0150), 0))
+	assert.False(t, c(state(0x0151), 0))
+
+	c, err = ParseCondition("frame:60")
+	assert.NoError(t, err)
+	assert.False(t, c(state(0), 59))
+	assert.True(t, c(state(0), 60))
+
+	for _, spec := range []string{"0x0150", "pc:zz", "pc:0x10000", "frame:x", "line:3"} {
+		_, err := ParseCondition(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestParse(t *testing.T) {
+	s, err := Parse("A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,13,02\n")
+	assert.NoError(t, err)
+	assert.Equal(t, state(0x0100), s)
+	assert.Equal(t, "A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,13,02", Format(s))
+
+	_, err = Parse("A:01 F:B0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package vgm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/soundlog"
+)
+
+// https://vgmrips.net/wiki/VGM_Specification
+const (
+	// Version is the VGM version which supports GameBoy DMG.
+	Version = 0x161
+	// SampleRate is the fixed rate of the wait commands.
+	SampleRate = 44100
+
+	headerSize = 0x100
+
+	offsetEOF          = 0x04
+	offsetVersion      = 0x08
+	offsetTotalSamples = 0x18
+	offsetDataOffset   = 0x34
+	offsetDMGClock     = 0x80
+)
+
+// commands
+const (
+	cmdDMGWrite   = 0xB3
+	cmdWait       = 0x61
+	cmdWait60th   = 0x62
+	cmdWait50th   = 0x63
+	cmdWaitShort  = 0x70 // 0x7n waits n+1 samples
+	cmdEndOfSound = 0x66
+)
+
+// Write writes the sound register writes as a VGM file.
+// end is the clock where the recording stopped.
+func Write(w io.Writer, events []soundlog.Event, end uint64) error {
+	var data bytes.Buffer
+	last := uint64(0)
+	for _, ev := range events {
+		at := toSample(ev.Cycle)
+		writeWait(&data, at-last)
+		last = at
+		// レジスタ番号は0xFF10からのオフセット
+		data.Write([]byte{cmdDMGWrite, byte(ev.Addr - soundlog.SoundBegin), ev.Data})
+	}
+	total := toSample(end)
+	if total < last {
+		total = last
+	}
+	writeWait(&data, total-last)
+	data.WriteByte(cmdEndOfSound)
+
+	header := make([]byte, headerSize)
+	copy(header[0:4], "Vgm ")
+	binary.LittleEndian.PutUint32(header[offsetEOF:], uint32(headerSize+data.Len()-offsetEOF))
+	binary.LittleEndian.PutUint32(header[offsetVersion:], Version)
+	binary.LittleEndian.PutUint32(header[offsetTotalSamples:], uint32(total))
+	binary.LittleEndian.PutUint32(header[offsetDataOffset:], headerSize-offsetDataOffset)
+	binary.LittleEndian.PutUint32(header[offsetDMGClock:], apu.ClockSpeed)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data.Bytes())
+	return err
+}
+
+func toSample(cycle uint64) uint64 {
+	return cycle * SampleRate / apu.ClockSpeed
+}
+
+// writeWait writes the shortest wait commands for n samples.
+func writeWait(buf *bytes.Buffer, n uint64) {
+	for n > 0 {
+		switch {
+		case n <= 16:
+			buf.WriteByte(cmdWaitShort | byte(n-1))
+			return
+		case n == 735:
+			buf.WriteByte(cmdWait60th)
+			return
+		case n == 882:
+			buf.WriteByte(cmdWait50th)
+			return
+		}
+		wait := n
+		if wait > 0xFFFF {
+			wait = 0xFFFF
+		}
+		buf.Write([]byte{cmdWait, byte(wait), byte(wait >> 8)})
+		n -= wait
+	}
+}
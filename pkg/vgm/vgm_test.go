@@ -0,0 +1,54 @@
+package vgm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/kijimaD/goboy/pkg/apu"
+	"github.com/kijimaD/goboy/pkg/soundlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	events := []soundlog.Event{
+		{Cycle: 0, Addr: 0xFF26, Data: 0x80},
+		{Cycle: 0, Addr: 0xFF12, Data: 0xF0},
+		{Cycle: apu.ClockSpeed / 60, Addr: 0xFF14, Data: 0x87},
+		{Cycle: apu.ClockSpeed / 60 * 2, Addr: 0xFF30, Data: 0x12},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, Write(&buf, events, apu.ClockSpeed))
+	b := buf.Bytes()
+
+	assert.Equal(t, []byte("Vgm "), b[0:4])
+	assert.Equal(t, uint32(len(b)-4), binary.LittleEndian.Uint32(b[0x04:]))
+	assert.Equal(t, uint32(0x161), binary.LittleEndian.Uint32(b[0x08:]))
+	assert.Equal(t, uint32(SampleRate), binary.LittleEndian.Uint32(b[0x18:]))
+	assert.Equal(t, uint32(0xCC), binary.LittleEndian.Uint32(b[0x34:]))
+	assert.Equal(t, uint32(apu.ClockSpeed), binary.LittleEndian.Uint32(b[0x80:]))
+
+	// 44100 - 734 - 735 = 42631 = 0xA687
+	expected := []byte{
+		0xB3, 0x16, 0x80,
+		0xB3, 0x02, 0xF0,
+		0x61, 0xDE, 0x02, // 734 samples
+		0xB3, 0x04, 0x87,
+		0x62, // 735 samples
+		0xB3, 0x20, 0x12,
+		0x61, 0x87, 0xA6,
+		0x66,
+	}
+	assert.Equal(t, expected, b[headerSize:])
+}
+
+func TestWriteWait(t *testing.T) {
+	var buf bytes.Buffer
+	writeWait(&buf, 0)
+	writeWait(&buf, 1)
+	writeWait(&buf, 16)
+	writeWait(&buf, 735)
+	writeWait(&buf, 882)
+	writeWait(&buf, 0x10000)
+	assert.Equal(t, []byte{0x70, 0x7F, 0x62, 0x63, 0x61, 0xFF, 0xFF, 0x70}, buf.Bytes())
+}
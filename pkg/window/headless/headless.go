@@ -0,0 +1,29 @@
+package headless
+
+import "github.com/kijimaD/goboy/pkg/types"
+
+// Headless is a window that shows nothing.
+// It is used to run ROMs on CI, where there is no display.
+// It is apart from the window package, so that it builds without glfw.
+type Headless struct{}
+
+// New is Headless constructor
+func New() *Headless {
+	return &Headless{}
+}
+
+// Render discards the frame.
+func (h *Headless) Render(imageData types.ImageData) {}
+
+// Run calls f directly, because there is no window event loop.
+func (h *Headless) Run(f func()) {
+	f()
+}
+
+// PollKey does nothing. There are no keys without a window.
+func (h *Headless) PollKey() {}
+
+// Closed is always false, since there is nothing to close.
+func (h *Headless) Closed() bool {
+	return false
+}
@@ -1,28 +1,47 @@
 package window
 
 import (
+	"fmt"
 	"image/color"
 	"math"
 
 	"github.com/faiface/pixel"
 	"github.com/faiface/pixel/pixelgl"
 	"github.com/kijimaD/goboy/pkg/constants"
+	"github.com/kijimaD/goboy/pkg/pacer"
 	"github.com/kijimaD/goboy/pkg/pad"
 	"github.com/kijimaD/goboy/pkg/types"
 	"golang.org/x/image/colornames"
 )
 
+const title = "gopher-boy"
+
 // Window is
 type Window struct {
 	win   *pixelgl.Window
 	image *pixel.PictureData
 	pad   *pad.Pad
+	vsync bool
 }
 
 func NewWindow(pad *pad.Pad) *Window {
 	return &Window{pad: pad}
 }
 
+// SetVSync makes the window update wait for the display refresh.
+// It must be called before Init.
+func (w *Window) SetVSync(vsync bool) {
+	w.vsync = vsync
+}
+
+// ShowStats shows the measured speed in the title bar. It does nothing before Init.
+func (w *Window) ShowStats(s pacer.Stats) {
+	if w.win == nil {
+		return
+	}
+	w.win.SetTitle(fmt.Sprintf("%s - %.1f fps (%.0f%%)", title, s.FPS, s.Speed*100))
+}
+
 // func (w *Window) AddObserver(onKeyPress func(button Button)) {
 // 	w.onKeyPress = onKeyPress
 // }
@@ -56,9 +75,9 @@ func (w *Window) updateCamera() {
 
 func (w *Window) Init() {
 	cfg := pixelgl.WindowConfig{
-		Title:  "gopher-boy",
+		Title:  title,
 		Bounds: pixel.R(0, 0, constants.ScreenWidth, constants.ScreenHeight),
-		// VSync:  true,
+		VSync:  w.vsync,
 	}
 	win, err := pixelgl.NewWindow(cfg)
 	if err != nil {
@@ -91,6 +110,11 @@ func (w *Window) PollKey() {
 	}
 }
 
+// Closed reports whether the close button of the window was clicked.
+func (w *Window) Closed() bool {
+	return w.win != nil && w.win.Closed()
+}
+
 var keyMap = map[pixelgl.Button]pad.Button{
 	pixelgl.KeyZ:         pad.A,
 	pixelgl.KeyX:         pad.B,